@@ -0,0 +1,95 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/git"
+
+	"github.com/urfave/cli"
+)
+
+var subcmdAnnexPrune = cli.Command{
+	Name:  "annex-prune",
+	Usage: "Remove the git-annex content of a repository that no branch or tag refers to anymore",
+	Description: `Only content of which enough other copies exist by the numcopies and trust settings of the repository is removed,
+like with "git annex dropunused". Everything else is kept and reported.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "repo",
+			Usage: "The repository to prune, as owner/repo",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only list the unused content, without removing it",
+		},
+	},
+	Action: runAnnexPrune,
+}
+
+func runAnnexPrune(c *cli.Context) error {
+	ownerName, repoName, ok := strings.Cut(c.String("repo"), "/")
+	if !ok || ownerName == "" || repoName == "" {
+		return fmt.Errorf("You must provide the repository to prune as owner/repo")
+	}
+
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	if err := initDB(ctx); err != nil {
+		return err
+	}
+	if err := git.InitSimple(ctx); err != nil {
+		return err
+	}
+
+	repo, err := repo_model.GetRepositoryByOwnerAndName(ctx, ownerName, repoName)
+	if err != nil {
+		return err
+	}
+	if !annex.IsInitialized(ctx, repo.RepoPath()) {
+		return fmt.Errorf("git-annex is not initialized in %s", repo.FullName())
+	}
+	return pruneAnnexObjects(ctx, os.Stdout, repo.RepoPath(), c.Bool("dry-run"))
+}
+
+// pruneAnnexObjects drops the unused git-annex content of the repository and reports what happened to each key to out
+func pruneAnnexObjects(ctx context.Context, out io.Writer, repoPath string, dryRun bool) error {
+	keys, err := annex.Unused(ctx, repoPath)
+	if err != nil {
+		return fmt.Errorf("unable to find the unused git-annex content: %w", err)
+	}
+
+	var dropped int
+	var freed int64
+	for _, key := range keys {
+		size, _ := annex.KeySize(key.Key)
+		if dryRun {
+			fmt.Fprintf(out, "Would drop %s (%s)\n", key.Key, base.FileSize(size))
+			continue
+		}
+		if err := annex.DropUnused(ctx, repoPath, key); err != nil {
+			fmt.Fprintf(out, "Kept %s: %v\n", key.Key, err)
+			continue
+		}
+		fmt.Fprintf(out, "Dropped %s (%s)\n", key.Key, base.FileSize(size))
+		dropped++
+		freed += size
+	}
+
+	if dryRun {
+		fmt.Fprintf(out, "%d unused objects\n", len(keys))
+		return nil
+	}
+	fmt.Fprintf(out, "Dropped %d of %d unused objects, freeing %s\n", dropped, len(keys), base.FileSize(freed))
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneAnnexObjects(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake git-annex is a shell script")
+	}
+
+	// git-annex reports two unused keys, the second can't be dropped as no other copy of it exists
+	binDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "git-annex"), []byte(`#!/bin/sh
+case "$1" in
+unused)
+	echo "unused . (checking for unused data...) (checking main...)"
+	echo "  Some annexed data is no longer used by any files:"
+	echo "    NUMBER  KEY"
+	echo "    1       SHA256E-s1024--orphaned.bin"
+	echo "    2       SHA256E-s2048--lastcopy.bin"
+	echo "ok"
+	;;
+dropunused)
+	if [ "$3" = 2 ]; then
+		echo "dropunused 2 (unsafe) Could only verify the existence of 0 out of 1 necessary copy" >&2
+		exit 1
+	fi
+	echo "$3" >> dropped
+	;;
+esac
+`), 0o755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	ctx := context.Background()
+	repoPath := t.TempDir()
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, pruneAnnexObjects(ctx, out, repoPath, true))
+	assert.Equal(t, "Would drop SHA256E-s1024--orphaned.bin (1.0 KiB)\nWould drop SHA256E-s2048--lastcopy.bin (2.0 KiB)\n2 unused objects\n", out.String())
+	assert.NoFileExists(t, filepath.Join(repoPath, "dropped"))
+
+	out.Reset()
+	assert.NoError(t, pruneAnnexObjects(ctx, out, repoPath, false))
+	assert.Contains(t, out.String(), "Dropped SHA256E-s1024--orphaned.bin (1.0 KiB)\n")
+	assert.Contains(t, out.String(), "Kept SHA256E-s2048--lastcopy.bin: ")
+	assert.Contains(t, out.String(), "Dropped 1 of 2 unused objects, freeing 1.0 KiB\n")
+	dropped, err := os.ReadFile(filepath.Join(repoPath, "dropped"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", string(dropped))
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/urfave/cli"
+)
+
+var microcmdUserAcceptCLA = cli.Command{
+	Name:   "accept-cla",
+	Usage:  "Record that a user has accepted the contributor license agreement of a [repository.cla] entry",
+	Action: runAcceptCLA,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "username,u",
+			Usage: "Username of the user who accepted the CLA",
+		},
+		cli.StringFlag{
+			Name:  "cla",
+			Usage: "Name of the [repository.cla] entry, either owner/repo or owner",
+		},
+		cli.BoolFlag{
+			Name:  "revoke",
+			Usage: "Instead of recording the acceptance, remove it",
+		},
+	},
+}
+
+func runAcceptCLA(c *cli.Context) error {
+	if err := argsSet(c, "username", "cla"); err != nil {
+		return err
+	}
+
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	if err := initDB(ctx); err != nil {
+		return err
+	}
+
+	name := strings.ToLower(c.String("cla"))
+	claURL, has := setting.Repository.CLAs[name]
+	if !has {
+		return errors.New("the CLA must be the name of a [repository.cla] entry")
+	}
+
+	user, err := user_model.GetUserByName(ctx, c.String("username"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("revoke") {
+		if err := user_model.DeleteUserSetting(user.ID, user_model.SettingsKeyAcceptedCLAPrefix+name); err != nil {
+			return err
+		}
+		fmt.Printf("Removed the acceptance of the CLA of %s by %s\n", name, user.Name)
+		return nil
+	}
+
+	if err := user_model.SetUserSetting(user.ID, user_model.SettingsKeyAcceptedCLAPrefix+name, claURL); err != nil {
+		return err
+	}
+	fmt.Printf("%s has accepted the CLA of %s at %s\n", user.Name, name, claURL)
+	return nil
+}
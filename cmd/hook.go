@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/git"
 	"code.gitea.io/gitea/modules/private"
 	repo_module "code.gitea.io/gitea/modules/repository"
@@ -177,6 +178,15 @@ Gitea or set your environment appropriately.`, "")
 		return nil
 	}
 
+	if msg := pushOptionsMessage(); msg != "" {
+		return fail(ctx, msg, "")
+	}
+	dryRun := isDryRunPush()
+	if dryRun && !setting.Repository.AllowDryRunPush {
+		return fail(ctx, "Dry-run pushes are not allowed on this server, nothing has been pushed", "")
+	}
+	var dryRunUpdates []string
+
 	// the environment is set by serv command
 	isWiki, _ := strconv.ParseBool(os.Getenv(repo_module.EnvRepoIsWiki))
 	username := os.Getenv(repo_module.EnvRepoUsername)
@@ -185,6 +195,8 @@ Gitea or set your environment appropriately.`, "")
 	prID, _ := strconv.ParseInt(os.Getenv(repo_module.EnvPRID), 10, 64)
 	deployKeyID, _ := strconv.ParseInt(os.Getenv(repo_module.EnvDeployKeyID), 10, 64)
 	actionPerm, _ := strconv.ParseInt(os.Getenv(repo_module.EnvActionPerm), 10, 64)
+	verifyAuthorEmails, _ := strconv.ParseBool(os.Getenv(repo_module.EnvVerifyAuthorEmails))
+	enforceLFSLocks, _ := strconv.ParseBool(os.Getenv(repo_module.EnvEnforceLFSLocks))
 
 	hookOptions := private.HookOptions{
 		UserID:                          userID,
@@ -195,6 +207,8 @@ Gitea or set your environment appropriately.`, "")
 		PullRequestID:                   prID,
 		DeployKeyID:                     deployKeyID,
 		ActionPerm:                      int(actionPerm),
+		VerifyAuthorEmails:              verifyAuthorEmails,
+		EnforceLFSLocks:                 enforceLFSLocks,
 	}
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -239,6 +253,9 @@ Gitea or set your environment appropriately.`, "")
 		refFullName := string(fields[2])
 		total++
 		lastline++
+		if dryRun {
+			dryRunUpdates = append(dryRunUpdates, dryRunUpdate(oldCommitID, newCommitID, refFullName))
+		}
 
 		// If the ref is a branch or tag, check if it's protected
 		// if supportProcReceive all ref should be checked because
@@ -288,9 +305,43 @@ Gitea or set your environment appropriately.`, "")
 	}
 
 	fmt.Fprintf(out, "Checked %d references in total\n", total)
+
+	if dryRun {
+		// rejecting the push discards it, after all the checks a real push would get
+		return fail(ctx, "Dry run: the push would have been accepted, no references have been changed:\n"+strings.Join(dryRunUpdates, "\n"), "")
+	}
 	return nil
 }
 
+// isDryRunPush returns true if the pusher asked for a dry run with "git push -o dry-run"
+func isDryRunPush() bool {
+	count, _ := strconv.Atoi(os.Getenv(private.GitPushOptionCount))
+	for idx := 0; idx < count; idx++ {
+		key, value, hasValue := strings.Cut(os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", idx)), "=")
+		if key != private.GitPushOptionDryRun {
+			continue
+		}
+		if !hasValue {
+			return true
+		}
+		dryRun, _ := strconv.ParseBool(value)
+		return dryRun
+	}
+	return false
+}
+
+// dryRunUpdate describes what a push would do to the reference
+func dryRunUpdate(oldCommitID, newCommitID, refFullName string) string {
+	switch {
+	case oldCommitID == git.EmptySHA:
+		return fmt.Sprintf("  %s would be created at %s", refFullName, base.ShortSha(newCommitID))
+	case newCommitID == git.EmptySHA:
+		return fmt.Sprintf("  %s would be deleted", refFullName)
+	default:
+		return fmt.Sprintf("  %s would be updated from %s to %s", refFullName, base.ShortSha(oldCommitID), base.ShortSha(newCommitID))
+	}
+}
+
 func runHookUpdate(c *cli.Context) error {
 	// Update is empty and is kept only for backwards compatibility
 	return nil
@@ -461,6 +512,23 @@ func hookPrintResults(results []private.HookPostReceiveBranchResult) {
 	}
 }
 
+// pushOptionsMessage returns the reason to reject a push whose options exceed [git] MAX_PUSH_OPTIONS or MAX_PUSH_OPTION_SIZE
+func pushOptionsMessage() string {
+	count, _ := strconv.Atoi(os.Getenv(private.GitPushOptionCount))
+	if setting.Git.MaxPushOptions > 0 && count > setting.Git.MaxPushOptions {
+		return fmt.Sprintf("Too many push options: %d, at most %d are allowed", count, setting.Git.MaxPushOptions)
+	}
+	if setting.Git.MaxPushOptionSize <= 0 {
+		return ""
+	}
+	for idx := 0; idx < count; idx++ {
+		if len(os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", idx))) > setting.Git.MaxPushOptionSize {
+			return fmt.Sprintf("Push option %d is too large, push options may have at most %d bytes", idx+1, setting.Git.MaxPushOptionSize)
+		}
+	}
+	return ""
+}
+
 func pushOptions() map[string]string {
 	opts := make(map[string]string)
 	if pushCount, err := strconv.Atoi(os.Getenv(private.GitPushOptionCount)); err == nil {
@@ -7,9 +7,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/setting"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -40,3 +46,89 @@ func TestPktLine(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("0007a\nb"), w.Bytes())
 }
+
+func TestPushOptionsReachHooks(t *testing.T) {
+	// a repository whose pre-receive hook records the push options it gets
+	repoPath := t.TempDir()
+	optionsFile := filepath.Join(t.TempDir(), "options")
+	gitEnv := append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	gitCmd := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = gitEnv
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return string(out)
+	}
+	gitCmd(repoPath, "init", "--bare", ".")
+	hook := "#!/bin/sh\nenv | grep ^GIT_PUSH_OPTION | sort > " + optionsFile + "\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(repoPath, "hooks", "pre-receive"), []byte(hook), 0o755))
+
+	clonePath := t.TempDir()
+	gitCmd(clonePath, "init", ".")
+	gitCmd(clonePath, "commit", "--allow-empty", "-m", "init")
+
+	// the receive-pack of serv advertises push options, so they end up in the environment of the hooks
+	receivePack := "env " + strings.Join(gitConfigEnvs(servGitConfigs("git-receive-pack")), " ") + " git-receive-pack"
+	gitCmd(clonePath, "push", "--receive-pack", receivePack, "-o", "ci.skip", "-o", "repo.private=true", repoPath, "HEAD:refs/heads/main")
+	options, err := os.ReadFile(optionsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "GIT_PUSH_OPTION_0=ci.skip\nGIT_PUSH_OPTION_1=repo.private=true\nGIT_PUSH_OPTION_COUNT=2\n", string(options))
+
+	t.Setenv("GIT_PUSH_OPTION_COUNT", "2")
+	t.Setenv("GIT_PUSH_OPTION_0", "ci.skip")
+	t.Setenv("GIT_PUSH_OPTION_1", "repo.private=true")
+	assert.Equal(t, map[string]string{"repo.private": "true"}, pushOptions())
+}
+
+func TestPushOptionsMessage(t *testing.T) {
+	oldMax, oldMaxSize := setting.Git.MaxPushOptions, setting.Git.MaxPushOptionSize
+	defer func() {
+		setting.Git.MaxPushOptions, setting.Git.MaxPushOptionSize = oldMax, oldMaxSize
+	}()
+	setting.Git.MaxPushOptions = 2
+	setting.Git.MaxPushOptionSize = 16
+
+	assert.Empty(t, pushOptionsMessage())
+
+	t.Setenv("GIT_PUSH_OPTION_COUNT", "2")
+	t.Setenv("GIT_PUSH_OPTION_0", "ci.skip")
+	t.Setenv("GIT_PUSH_OPTION_1", "repo.private=true")
+	assert.Equal(t, "Push option 2 is too large, push options may have at most 16 bytes", pushOptionsMessage())
+
+	t.Setenv("GIT_PUSH_OPTION_1", "repo.private=1")
+	assert.Empty(t, pushOptionsMessage())
+
+	t.Setenv("GIT_PUSH_OPTION_COUNT", "3")
+	t.Setenv("GIT_PUSH_OPTION_2", "a")
+	assert.Equal(t, "Too many push options: 3, at most 2 are allowed", pushOptionsMessage())
+
+	// 0 disables the limits
+	setting.Git.MaxPushOptions = 0
+	setting.Git.MaxPushOptionSize = 0
+	t.Setenv("GIT_PUSH_OPTION_1", strings.Repeat("x", 4096))
+	assert.Empty(t, pushOptionsMessage())
+}
+
+func TestIsDryRunPush(t *testing.T) {
+	assert.False(t, isDryRunPush())
+
+	t.Setenv("GIT_PUSH_OPTION_COUNT", "2")
+	t.Setenv("GIT_PUSH_OPTION_0", "ci.skip")
+	t.Setenv("GIT_PUSH_OPTION_1", "dry-run")
+	assert.True(t, isDryRunPush())
+	t.Setenv("GIT_PUSH_OPTION_1", "dry-run=true")
+	assert.True(t, isDryRunPush())
+	t.Setenv("GIT_PUSH_OPTION_1", "dry-run=false")
+	assert.False(t, isDryRunPush())
+	t.Setenv("GIT_PUSH_OPTION_1", "dry-running")
+	assert.False(t, isDryRunPush())
+}
+
+func TestDryRunUpdate(t *testing.T) {
+	oldCommitID := "65f1bf27bc3bf70f64657658635e66094edbcb4d"
+	newCommitID := "985f0301dba5e7b34be866819cd15ad3d8f508ee"
+	assert.Equal(t, "  refs/heads/main would be updated from 65f1bf27bc to 985f0301db", dryRunUpdate(oldCommitID, newCommitID, "refs/heads/main"))
+	assert.Equal(t, "  refs/heads/feature would be created at 985f0301db", dryRunUpdate(git.EmptySHA, newCommitID, "refs/heads/feature"))
+	assert.Equal(t, "  refs/tags/v1 would be deleted", dryRunUpdate(oldCommitID, git.EmptySHA, "refs/tags/v1"))
+}
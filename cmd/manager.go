@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -24,6 +25,13 @@ var (
 			subcmdFlushQueues,
 			subcmdLogging,
 			subCmdProcesses,
+			subcmdApproveClone,
+			subcmdServUsage,
+			subcmdServProtocols,
+			subcmdBackupStart,
+			subcmdBackupEnd,
+			subcmdLockRepo,
+			subcmdUnlockRepo,
 		},
 	}
 	subcmdShutdown = cli.Command{
@@ -95,6 +103,108 @@ var (
 			},
 		},
 	}
+	subcmdApproveClone = cli.Command{
+		Name:      "approve-clone",
+		Usage:     "Approve a pending request to read a repository which needs approval",
+		ArgsUsage: "<request-id>",
+		Action:    runApproveClone,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+		},
+	}
+	subcmdBackupStart = cli.Command{
+		Name:   "backup-start",
+		Usage:  "Pause writes over SSH while a backup snapshot is taken, reads go on",
+		Action: runBackupStart,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+			cli.DurationFlag{
+				Name:  "max-duration",
+				Value: time.Hour,
+				Usage: "Resume writes after this long if the backup window isn't ended before",
+			},
+		},
+	}
+	subcmdBackupEnd = cli.Command{
+		Name:   "backup-end",
+		Usage:  "Resume writes over SSH after a backup snapshot",
+		Action: runBackupEnd,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+		},
+	}
+	subcmdLockRepo = cli.Command{
+		Name:   "lock-repo",
+		Usage:  "Reject operations over SSH on a repository, e.g. while it is repaired",
+		Action: runLockRepo,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+			cli.StringFlag{
+				Name:  "repo",
+				Usage: "The repository to lock, as owner/repo",
+			},
+			cli.StringFlag{
+				Name:  "scope",
+				Value: private.RepoLockWrite,
+				Usage: "The operations to reject, \"write\" for writes or \"all\" for reads too",
+			},
+			cli.DurationFlag{
+				Name:  "max-duration",
+				Value: time.Hour,
+				Usage: "Unlock the repository after this long if unlock-repo isn't run before",
+			},
+		},
+	}
+	subcmdUnlockRepo = cli.Command{
+		Name:   "unlock-repo",
+		Usage:  "Accept operations over SSH on a repository locked with lock-repo again",
+		Action: runUnlockRepo,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+			cli.StringFlag{
+				Name:  "repo",
+				Usage: "The repository to unlock, as owner/repo",
+			},
+		},
+	}
+	subcmdServUsage = cli.Command{
+		Name:   "serv-usage",
+		Usage:  "Display the CPU time and memory used by SSH operations per repository since the start",
+		Action: runServUsage,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Output as json",
+			},
+		},
+	}
+	subcmdServProtocols = cli.Command{
+		Name:   "serv-protocols",
+		Usage:  "Display the number of SSH operations per git transport protocol version since the start",
+		Action: runServProtocols,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "debug",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Output as json",
+			},
+		},
+	}
 )
 
 func runShutdown(c *cli.Context) error {
@@ -132,3 +242,70 @@ func runProcesses(c *cli.Context) error {
 	extra := private.Processes(ctx, os.Stdout, c.Bool("flat"), c.Bool("no-system"), c.Bool("stacktraces"), c.Bool("json"), c.String("cancel"))
 	return handleCliResponseExtra(extra)
 }
+
+func runApproveClone(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected the ID of the clone approval request")
+	}
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.ApproveClone(ctx, c.Args().First())
+	return handleCliResponseExtra(extra)
+}
+
+func runServUsage(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.ServUsageStats(ctx, os.Stdout, c.Bool("json"))
+	return handleCliResponseExtra(extra)
+}
+
+func runServProtocols(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.ServProtocolStats(ctx, os.Stdout, c.Bool("json"))
+	return handleCliResponseExtra(extra)
+}
+
+func runBackupStart(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.BackupStart(ctx, c.Duration("max-duration"))
+	return handleCliResponseExtra(extra)
+}
+
+func runBackupEnd(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.BackupEnd(ctx)
+	return handleCliResponseExtra(extra)
+}
+
+func runLockRepo(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.LockRepo(ctx, c.String("repo"), c.String("scope"), c.Duration("max-duration"))
+	return handleCliResponseExtra(extra)
+}
+
+func runUnlockRepo(c *cli.Context) error {
+	ctx, cancel := installSignals()
+	defer cancel()
+
+	setup(ctx, c.Bool("debug"))
+	extra := private.UnlockRepo(ctx, c.String("repo"))
+	return handleCliResponseExtra(extra)
+}
@@ -7,6 +7,8 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -14,20 +16,30 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
 	git_model "code.gitea.io/gitea/models/git"
 	"code.gitea.io/gitea/models/perm"
+	repo_model "code.gitea.io/gitea/models/repo"
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/hostmatcher"
 	"code.gitea.io/gitea/modules/json"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/pprof"
 	"code.gitea.io/gitea/modules/private"
-	"code.gitea.io/gitea/modules/process"
 	repo_module "code.gitea.io/gitea/modules/repository"
 	"code.gitea.io/gitea/modules/setting"
+	ssh_module "code.gitea.io/gitea/modules/ssh"
+	"code.gitea.io/gitea/modules/storage"
+	"code.gitea.io/gitea/modules/translation"
+	"code.gitea.io/gitea/modules/translation/i18n"
+	"code.gitea.io/gitea/modules/util"
 	"code.gitea.io/gitea/services/lfs"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -37,6 +49,12 @@ import (
 
 const (
 	lfsAuthenticateVerb = "git-lfs-authenticate"
+	gitAnnexShellVerb   = "git-annex-shell"
+	// annexCapabilitiesVerb probes the git-annex features of the server, like ssh_info for AGit.
+	// It is sent like a git-annex-shell command but answered by Gitea itself.
+	annexCapabilitiesVerb = "gitea-capabilities"
+	// annexConfiglistVerb is the first command git-annex sends to a remote, which also tells it whether the remote is usable
+	annexConfiglistVerb = "configlist"
 )
 
 // CmdServ represents the available serv sub-command.
@@ -52,6 +70,10 @@ var CmdServ = cli.Command{
 		cli.BoolFlag{
 			Name: "debug",
 		},
+		cli.IntFlag{
+			Name:  "result-fd",
+			Usage: "Write the result of the operation as a JSON object to this file descriptor",
+		},
 	},
 }
 
@@ -89,6 +111,43 @@ var (
 		"git-upload-archive": perm.AccessModeRead,
 		"git-receive-pack":   perm.AccessModeWrite,
 		lfsAuthenticateVerb:  perm.AccessModeNone,
+		gitAnnexShellVerb:    perm.AccessModeNone,
+	}
+	// annexCommands maps the git-annex-shell commands to the access mode they need.
+	// There are no commands for "git annex init" or "uninit", they only work on the local repository.
+	// A remote is initialized by "configlist" if the client may write to it, and by "gcryptsetup" for gcrypt.
+	annexCommands = map[string]perm.AccessMode{
+		annexConfiglistVerb:   perm.AccessModeRead,
+		"inannex":             perm.AccessModeRead,
+		"lockcontent":         perm.AccessModeRead,
+		"sendkey":             perm.AccessModeRead,
+		"transferinfo":        perm.AccessModeRead,
+		"notifychanges":       perm.AccessModeRead,
+		"recvkey":             perm.AccessModeWrite,
+		"dropkey":             perm.AccessModeWrite,
+		"commit":              perm.AccessModeWrite,
+		"gcryptsetup":         perm.AccessModeWrite,
+		"p2pstdio":            perm.AccessModeWrite,
+		annexCapabilitiesVerb: perm.AccessModeRead,
+	}
+	// annexKeyVerbs are the git-annex-shell commands taking keys as arguments
+	annexKeyVerbs = map[string]bool{
+		"inannex":      true,
+		"lockcontent":  true,
+		"sendkey":      true,
+		"transferinfo": true,
+		"recvkey":      true,
+		"dropkey":      true,
+	}
+	// lfsVerbs maps the operations git-lfs may authenticate for over SSH to the access mode they need
+	lfsVerbs = map[string]perm.AccessMode{
+		"upload":   perm.AccessModeWrite,
+		"download": perm.AccessModeRead,
+		// file locking
+		"lock":   perm.AccessModeWrite,
+		"unlock": perm.AccessModeWrite,
+		"list":   perm.AccessModeRead,
+		"verify": perm.AccessModeRead,
 	}
 	alphaDashDotPattern = regexp.MustCompile(`[^\w-\.]`)
 )
@@ -122,6 +181,74 @@ func fail(ctx context.Context, userMessage, logMsgFmt string, args ...interface{
 	return cli.NewExitError("", 1)
 }
 
+// servMessageData is what the templates of [ssh.messages] can use
+type servMessageData struct {
+	Owner   string // owner of the repository
+	Repo    string // name of the repository
+	User    string // name of the user, empty if it isn't known yet
+	Message string // the message shown if none has been configured
+}
+
+// denialMessage returns the message shown for a denial with the reason code, the one configured in [ssh.messages] if there is one
+func denialMessage(reason string, data servMessageData) string {
+	tmpl, has := setting.SSH.Messages[reason]
+	if reason == "" || !has {
+		return data.Message
+	}
+	sb := &strings.Builder{}
+	if err := tmpl.Execute(sb, data); err != nil {
+		log.Error("Unable to render the message %s of [ssh.messages]: %v", reason, err)
+		return data.Message
+	}
+	return sb.String()
+}
+
+// servLocalesOnce loads the locales the first time a denial message is translated,
+// most invocations of serv never show one.
+var servLocalesOnce sync.Once
+
+// servLocale returns the locale of the language, the default language if lang is empty or not one of [i18n] LANGS
+func servLocale(ctx context.Context, lang string) translation.Locale {
+	servLocalesOnce.Do(func() {
+		translation.InitLocales(ctx)
+	})
+	return translation.NewLocale(lang)
+}
+
+// localizeDenial returns the translation "ssh.denial.<reason>" of the message of a denial in the language,
+// filled with args. The fallback is returned if the denial has no reason code or there is no translation for it at all.
+func localizeDenial(ctx context.Context, reason, lang string, args []string, fallback string) string {
+	if reason == "" {
+		return fallback
+	}
+	locale := servLocale(ctx, lang)
+	key := "ssh.denial." + reason
+	// like Tr, a message not translated to the language is shown in the default language
+	if !i18n.DefaultLocales.Has(locale.Language(), key) && !i18n.DefaultLocales.Has(setting.Langs[0], key) {
+		return fallback
+	}
+	trArgs := make([]any, len(args))
+	for i, arg := range args {
+		trArgs[i] = arg
+	}
+	return locale.Tr(key, trArgs...)
+}
+
+// authFailureLogLine returns the line logged when serv refuses the request of a key.
+// Its format is stable, so that intrusion prevention tools like fail2ban can match it.
+func authFailureLogLine(keyID int64, ip string) string {
+	if ip == "" {
+		ip = "unknown"
+	}
+	return fmt.Sprintf("Failed authentication attempt for key-%d from %s", keyID, ip)
+}
+
+// failAuth is like fail, but for authentication and authorization failures, which are also logged with authFailureLogLine
+func failAuth(ctx context.Context, keyID int64, userMessage, logMsgFmt string, args ...interface{}) error {
+	_ = private.SSHLog(ctx, true, authFailureLogLine(keyID, private.SSHClientIP()))
+	return fail(ctx, userMessage, logMsgFmt, args...)
+}
+
 // handleCliResponseExtra handles the extra response from the cli sub-commands
 // If there is a user message it will be printed to stdout
 // If the command failed it will return an error (the error will be printed by cli framework)
@@ -135,18 +262,215 @@ func handleCliResponseExtra(extra private.ResponseExtra) error {
 	return nil
 }
 
-func runServ(c *cli.Context) error {
+// lfsTokenOp returns the operation to put into the claims of an LFS token for lfsVerb granting mode.
+// Tokens for locking and unlocking may only write locks, the LFS server refuses them for uploads.
+func lfsTokenOp(lfsVerb string, mode perm.AccessMode) string {
+	switch {
+	case mode < perm.AccessModeWrite:
+		return lfs.TokenOpDownload
+	case lfsVerb == "upload":
+		return lfs.TokenOpUpload
+	}
+	return lfs.TokenOpLock
+}
+
+// gogsRepoRootDir is the name of the default Gogs repository root, "~/gogs-repositories"
+const gogsRepoRootDir = "gogs-repositories/"
+
+// normalizeGogsRepoPath turns the repository paths of remotes set up against Gogs into the "owner/repo.git" form:
+// "~/owner/repo.git", "gogs-repositories/owner/repo.git", "/home/git/gogs-repositories/owner/repo.git" and "owner/repo.git/".
+// Any other path is returned as is.
+func normalizeGogsRepoPath(repoPath string) string {
+	repoPath = strings.TrimPrefix(strings.TrimSpace(repoPath), "/")
+	repoPath = strings.TrimPrefix(repoPath, "~/")
+	if strings.HasPrefix(repoPath, gogsRepoRootDir) {
+		repoPath = strings.TrimPrefix(repoPath, gogsRepoRootDir)
+	} else if i := strings.LastIndex(repoPath, "/"+gogsRepoRootDir); i >= 0 {
+		repoPath = repoPath[i+len(gogsRepoRootDir)+1:]
+	}
+	return strings.TrimSuffix(repoPath, "/")
+}
+
+// parseRepoPath splits the repository path requested by the client into the lower-cased owner and repository names.
+// Whitespace around each segment is trimmed, but whitespace within a segment is rejected.
+// If the path is invalid the returned userMsg explains why.
+func parseRepoPath(repoPath string) (ownerName, repoName, userMsg string) {
+	rr := strings.SplitN(strings.TrimSpace(repoPath), "/", 2)
+	if len(rr) != 2 {
+		if rr[0] != "" {
+			// A common mistake is to forget the owner, e.g. "git clone git@host:repo.git"
+			return "", "", fmt.Sprintf("Invalid repository path, the owner is missing. Please use the form <owner>/%s", rr[0])
+		}
+		return "", "", "Invalid repository path"
+	}
+
+	ownerName = strings.ToLower(strings.TrimSpace(rr[0]))
+	repoName = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rr[1]), ".git")))
+	if ownerName == "" || repoName == "" {
+		return "", "", "Invalid repository path"
+	}
+	if strings.IndexFunc(ownerName, unicode.IsSpace) >= 0 {
+		return "", "", "Invalid repository path, the owner name must not contain whitespace"
+	}
+	if strings.IndexFunc(repoName, unicode.IsSpace) >= 0 {
+		return "", "", "Invalid repository path, the repository name must not contain whitespace"
+	}
+	if alphaDashDotPattern.MatchString(repoName) {
+		return "", "", "Invalid repo name"
+	}
+	return ownerName, repoName, ""
+}
+
+// clientIPMessage returns the reason to reject a client connecting from ip,
+// if SSH_ALLOWED_CLIENT_IPS or SSH_DENIED_CLIENT_IPS forbid it
+func clientIPMessage(ip string) string {
+	if setting.SSH.AllowedClientIPs == "" && setting.SSH.DeniedClientIPs == "" {
+		return ""
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return "Unable to determine your IP address, access denied"
+	}
+	if setting.SSH.DeniedClientIPs != "" && hostmatcher.ParseHostMatchList("server.SSH_DENIED_CLIENT_IPS", setting.SSH.DeniedClientIPs).MatchIPAddr(parsedIP) {
+		return fmt.Sprintf("Access from %s is not allowed", ip)
+	}
+	if setting.SSH.AllowedClientIPs != "" && !hostmatcher.ParseHostMatchList("server.SSH_ALLOWED_CLIENT_IPS", setting.SSH.AllowedClientIPs).MatchIPAddr(parsedIP) {
+		return fmt.Sprintf("Access from %s is not allowed", ip)
+	}
+	return ""
+}
+
+// noCommandBanner returns the message for a client connecting without a command, e.g. "ssh git@host".
+// With SSH_MINIMAL_BANNER it doesn't tell the type and name of the key or the user, which could help someone with a stolen key.
+// A deploy key bound to a single repository is told the clone URL of it, repoCloneURL, to show how to use the key.
+func noCommandBanner(key *asymkey_model.PublicKey, user *user_model.User, repoCloneURL string) string {
+	if setting.SSH.MinimalBanner {
+		return "Hi there! You've successfully authenticated, but Gitea does not provide shell access."
+	}
+
+	var banner string
+	switch key.Type {
+	case asymkey_model.KeyTypeDeploy:
+		banner = "Hi there! You've successfully authenticated with the deploy key named " + key.Name + ", but Gitea does not provide shell access."
+		if repoCloneURL != "" {
+			banner += "\nThe key can be used to clone the repository it is bound to: git clone " + repoCloneURL
+		}
+	case asymkey_model.KeyTypePrincipal:
+		banner = "Hi there! You've successfully authenticated with the principal " + key.Content + ", but Gitea does not provide shell access."
+	default:
+		banner = "Hi there, " + user.Name + "! You've successfully authenticated with the key named " + key.Name + ", but Gitea does not provide shell access."
+	}
+	return banner + "\nIf this is unexpected, please log in with password and setup Gitea under another user."
+}
+
+// disabledVerbMessage returns the message to show to the user if verb has been disabled by the configuration.
+// LFS and git-annex are enabled independently of each other, so only their own setting is checked.
+func disabledVerbMessage(verb string) string {
+	switch {
+	case verb == "git-upload-archive" && !setting.Git.AllowUploadArchive:
+		return "Remote archive access (git-upload-archive) is disabled"
+	case verb == lfsAuthenticateVerb && !setting.LFS.StartServer:
+		return "Git LFS is disabled on this server"
+	case verb == gitAnnexShellVerb && !setting.Annex.Enabled:
+		return "git-annex is disabled on this server"
+	}
+	return ""
+}
+
+// outdatedClientMessage returns the message to show to the user if the command has the form of an outdated or
+// misconfigured git client, e.g. "git upload-pack 'repo.git'" instead of "git-upload-pack 'repo.git'"
+func outdatedClientMessage(words []string) string {
+	if len(words) < 3 || words[0] != "git" {
+		return ""
+	}
+	switch words[1] {
+	case "upload-pack", "upload-archive", "receive-pack":
+	default:
+		return ""
+	}
+	return fmt.Sprintf("Your git client sent \"git %s\", which isn't supported, only \"git-%s\" is. Please upgrade your git client, or remove a custom --upload-pack or --receive-pack option or remote.*.uploadpack or remote.*.receivepack setting", words[1], words[1])
+}
+
+// missingRepoPathMessage returns the message to show to the user if the command of a known verb has no repository path,
+// as sent by clients whose remote URL doesn't name a repository, e.g. "git-upload-pack" instead of "git-upload-pack 'user/repo.git'"
+func missingRepoPathMessage(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	verb := words[0]
+	if verb == gitAnnexShellVerb {
+		if len(words) >= 3 {
+			return ""
+		}
+		return fmt.Sprintf("%s was sent without a repository path, the expected form is \"%s <command> <repo-path>\", e.g. \"%s configlist '/~/user/repo.git'\". Please check the URL of the git-annex remote, it must name the repository, e.g. ssh://git@example.com/user/repo.git", verb, verb, verb)
+	}
+	if _, has := allowedCommands[verb]; !has || len(words) >= 2 {
+		return ""
+	}
+	return fmt.Sprintf("%s was sent without a repository path, the expected form is \"%s <repo-path>\", e.g. \"%s 'user/repo.git'\". Please check the URL of the remote, it must name the repository, e.g. git@example.com:user/repo.git", verb, verb, verb)
+}
+
+// sshServerMechanism describes how serv was invoked:
+// either by the builtin SSH server or by an external sshd through authorized_keys
+func sshServerMechanism() string {
+	if os.Getenv(ssh_module.EnvBuiltinServer) == "true" {
+		return "builtin SSH server"
+	}
+	return "external sshd (authorized_keys)"
+}
+
+func runServ(c *cli.Context) (err error) {
 	ctx, cancel := installSignals()
 	defer cancel()
+	sessionStart := time.Now()
+
+	result := &servResult{}
+	if fd := c.Int("result-fd"); fd > 0 {
+		start := time.Now()
+		defer func() {
+			f := os.NewFile(uintptr(fd), "result-fd")
+			if f == nil {
+				log.Error("Invalid result file descriptor %d", fd)
+				return
+			}
+			defer f.Close()
+			if err := writeServResult(f, result, time.Since(start), err); err != nil {
+				log.Error("Unable to write the result to file descriptor %d: %v", fd, err)
+			}
+		}()
+	}
 
 	// FIXME: This needs to internationalised
 	setup(ctx, c.Bool("debug"))
 
+	// The user is only known once ServCommand has checked the key
+	var eventUser string
+	if setting.SSH.EventStream != "" {
+		start := time.Now()
+		defer func() {
+			if result.Verb == "" {
+				return
+			}
+			// serv may have been interrupted, so the event gets its own deadline
+			eventCtx, cancel := context.WithTimeout(context.Background(), servEventTimeout)
+			defer cancel()
+			if eventErr := private.ServPublishEvent(eventCtx, servEvent(result, eventUser, time.Since(start), err)); eventErr != nil {
+				log.Warn("Unable to publish the event of %s on %s: %v", result.Verb, result.Repo, eventErr)
+			}
+		}()
+	}
+
 	if setting.SSH.Disabled {
 		println("Gitea: SSH has been disabled")
 		return nil
 	}
 
+	log.Debug("SSH: serv invoked by %s", sshServerMechanism())
+
+	if msg := clientIPMessage(private.SSHClientIP()); msg != "" {
+		return fail(ctx, msg, "SSH client IP %q rejected: %s", private.SSHClientIP(), msg)
+	}
+
 	if len(c.Args()) < 1 {
 		if err := cli.ShowSubcommandHelp(c); err != nil {
 			fmt.Printf("error showing subcommand help: %v\n", err)
@@ -165,19 +489,11 @@ func runServ(c *cli.Context) error {
 
 	cmd := os.Getenv("SSH_ORIGINAL_COMMAND")
 	if len(cmd) == 0 {
-		key, user, err := private.ServNoCommand(ctx, keyID)
+		keyAndOwner, err := private.ServNoCommand(ctx, keyID)
 		if err != nil {
 			return fail(ctx, "Key check failed", "Failed to check provided key: %v", err)
 		}
-		switch key.Type {
-		case asymkey_model.KeyTypeDeploy:
-			println("Hi there! You've successfully authenticated with the deploy key named " + key.Name + ", but Gitea does not provide shell access.")
-		case asymkey_model.KeyTypePrincipal:
-			println("Hi there! You've successfully authenticated with the principal " + key.Content + ", but Gitea does not provide shell access.")
-		default:
-			println("Hi there, " + user.Name + "! You've successfully authenticated with the key named " + key.Name + ", but Gitea does not provide shell access.")
-		}
-		println("If this is unexpected, please log in with password and setup Gitea under another user.")
+		println(noCommandBanner(keyAndOwner.Key, keyAndOwner.Owner, keyAndOwner.RepoCloneURL))
 		return nil
 	} else if c.Bool("debug") {
 		log.Debug("SSH_ORIGINAL_COMMAND: %s", os.Getenv("SSH_ORIGINAL_COMMAND"))
@@ -196,165 +512,695 @@ func runServ(c *cli.Context) error {
 				return nil
 			}
 		}
+		if msg := missingRepoPathMessage(words); msg != "" {
+			return fail(ctx, msg, "Missing repository path in cmd: %s", cmd)
+		}
 		return fail(ctx, "Too few arguments", "Too few arguments in cmd: %s", cmd)
 	}
 
-	verb := words[0]
+	if msg := outdatedClientMessage(words); msg != "" {
+		return fail(ctx, msg, "Outdated client command: %s", cmd)
+	}
+
+	req := &servRequest{verb: words[0], words: words}
 	repoPath := words[1]
-	if repoPath[0] == '/' {
+
+	if req.verb == gitAnnexShellVerb {
+		if msg := disabledVerbMessage(req.verb); msg != "" {
+			return fail(ctx, msg, "git-annex request over SSH denied, git-annex support is disabled")
+		}
+		if msg := missingRepoPathMessage(words); msg != "" {
+			return fail(ctx, msg, "Missing repository path in cmd: %s", cmd)
+		}
+		// git-annex-shell takes the command first and the repository second, e.g.
+		// "git-annex-shell 'configlist' '/~/user/repo.git'", and prefixes paths relative to the home directory with "~/"
+		req.annexVerb = words[1]
+		repoPath = strings.TrimPrefix(strings.TrimPrefix(words[2], "/"), "~/")
+	}
+
+	if len(repoPath) > 0 && repoPath[0] == '/' {
 		repoPath = repoPath[1:]
 	}
 
-	var lfsVerb string
-	if verb == lfsAuthenticateVerb {
-		if !setting.LFS.StartServer {
-			return fail(ctx, "Unknown git command", "LFS authentication request over SSH denied, LFS support is disabled")
+	if req.verb == lfsAuthenticateVerb {
+		if msg := disabledVerbMessage(req.verb); msg != "" {
+			return fail(ctx, msg, "LFS authentication request over SSH denied, LFS support is disabled")
 		}
 
 		if len(words) > 2 {
-			lfsVerb = words[2]
+			req.lfsVerb = words[2]
 		}
 	}
 
+	if setting.Repository.GogsPathCompat {
+		repoPath = normalizeGogsRepoPath(repoPath)
+	}
+
 	// LowerCase and trim the repoPath as that's how they are stored.
 	repoPath = strings.ToLower(strings.TrimSpace(repoPath))
 
-	rr := strings.SplitN(repoPath, "/", 2)
-	if len(rr) != 2 {
-		return fail(ctx, "Invalid repository path", "Invalid repository path: %v", repoPath)
+	username, reponame, userMsg := parseRepoPath(repoPath)
+	if userMsg != "" {
+		return fail(ctx, userMsg, "%s: %q", userMsg, repoPath)
+	}
+
+	if c.Bool("enable-pprof") {
+		stopProfiler, err := startServProfiler(ctx, username)
+		if err != nil {
+			return err
+		}
+		defer stopProfiler()
 	}
 
-	username := strings.ToLower(rr[0])
-	reponame := strings.ToLower(strings.TrimSuffix(rr[1], ".git"))
+	if req.mode, err = servAccessMode(ctx, req); err != nil {
+		return err
+	}
 
-	if alphaDashDotPattern.MatchString(reponame) {
-		return fail(ctx, "Invalid repo name", "Invalid repo name: %s", reponame)
+	result.Verb = req.verb
+	result.Repo = username + "/" + reponame
+	result.AccessMode = req.mode.String()
+
+	results, extra := private.ServCommand(ctx, keyID, username, reponame, req.mode, req.verb, req.lfsVerb)
+	if extra.HasError() {
+		return failServCommand(ctx, keyID, req, username, reponame, extra)
+	}
+	eventUser = results.UserName
+	if err := checkServPolicies(ctx, req, results); err != nil {
+		return err
 	}
 
-	if c.Bool("enable-pprof") {
-		if err := os.MkdirAll(setting.PprofDataPath, os.ModePerm); err != nil {
-			return fail(ctx, "Error while trying to create PPROF_DATA_PATH", "Error while trying to create PPROF_DATA_PATH: %v", err)
+	if req.isAnnex(annexCapabilitiesVerb) {
+		return writeAnnexCapabilities(ctx, os.Stdout, results.RepoID)
+	}
+	if req.verb == gitAnnexShellVerb {
+		if err := checkAnnexCommand(ctx, req, results); err != nil {
+			return err
+		}
+	}
+
+	// LFS token authentication
+	if req.verb == lfsAuthenticateVerb {
+		return writeLFSToken(ctx, req, results)
+	}
+
+	if err := checkServRepo(ctx, req, results); err != nil {
+		return err
+	}
+
+	unlock, err := lockServCommand(ctx, req, results)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// git-annex-shell only sends content the repository has, so content kept in the object storage is fetched first
+	if req.isAnnex("sendkey") && hasAnnexStorage(results) {
+		if extra := private.AnnexStorageFetch(ctx, results.RepoID, annexKeys(words)); extra.HasError() {
+			return fail(ctx, extra.UserMsg, "AnnexStorageFetch failed: %s", extra.Error)
 		}
+	}
 
-		stopCPUProfiler, err := pprof.DumpCPUProfileForUsername(setting.PprofDataPath, username)
+	cmdCtx, guards, stopGuards := newServGuards(ctx, sessionStart, req, results)
+	defer stopGuards()
+
+	gitcmd := newServGitCommand(cmdCtx, req, results)
+	sniffer, refAdvertisement, err := pipeServCommand(ctx, gitcmd, req, results, guards, result)
+	if err != nil {
+		return err
+	}
+
+	if results.PreExecCommand != "" {
+		if err = runPreExecCommand(cmdCtx, results.PreExecCommand, gitcmd.Env); err != nil {
+			return err
+		}
+	}
+
+	if guards.idle != nil {
+		// only the transfer itself is watched, not the pre-exec command
+		guards.idle.Touch()
+		go guards.idle.Watch(cmdCtx)
+	}
+	var stopStatus func(error)
+	if setting.SSH.LiveStatus {
+		stopStatus = startServStatus(ctx, newServStatus(results, keyActivityVerb(req.verb, req.annexVerb)), result, setting.SSH.LiveStatusInterval)
+	}
+	err = runServCommand(ctx, cmdCtx, gitcmd, guards)
+	if stopStatus != nil {
+		stopStatus(err)
+	}
+	if refAdvertisement != nil {
+		logRefAdvertisement(refAdvertisement, results.OwnerName+"/"+results.RepoName)
+	}
+	recordServUsage(ctx, req, results, gitcmd)
+	if err != nil {
+		return err
+	}
+	if req.verb == gitAnnexShellVerb && hasAnnexStorage(results) {
+		if err = syncAnnexStorage(ctx, req.annexVerb, words, guards.opLimiter, results); err != nil {
+			return err
+		}
+	}
+	logServFinished(req.verb, req.annexVerb, results, time.Since(sessionStart))
+
+	if agent := sniffer.Agent(); agent != "" {
+		log.Debug("SSH: %s %s/%s by client agent %s", req.verb, results.OwnerName, results.RepoName, agent)
+		_ = private.SSHLog(ctx, false, fmt.Sprintf("%s %s/%s by client agent %s", req.verb, results.OwnerName, results.RepoName, agent))
+	}
+
+	return recordServCommand(ctx, req, results, guards.opLimiter)
+}
+
+// servRequest is the command the client asked serv to run
+type servRequest struct {
+	verb      string          // the command, e.g. "git-upload-pack"
+	annexVerb string          // the git-annex-shell command if verb is git-annex-shell, e.g. "sendkey"
+	lfsVerb   string          // the operation to authenticate for if verb is git-lfs-authenticate, e.g. "download"
+	words     []string        // the whole command line
+	mode      perm.AccessMode // the access the command needs
+}
+
+// isAnnex returns true if the request is the git-annex-shell command annexVerb
+func (req *servRequest) isAnnex(annexVerb string) bool {
+	return req.verb == gitAnnexShellVerb && req.annexVerb == annexVerb
+}
+
+// startServProfiler starts the CPU profiler for "serv --enable-pprof", the returned function stops it and dumps the memory profile
+func startServProfiler(ctx context.Context, username string) (func(), error) {
+	startCPUProfiler := func() (func(), error) {
+		return pprof.DumpCPUProfileForUsername(setting.PprofDataPath, username)
+	}
+	dumpMemProfile := func() error {
+		return pprof.DumpMemProfileForUsername(setting.PprofDataPath, username)
+	}
+	if setting.PprofStorage != nil {
+		store, err := storage.NewStorage(setting.PprofStorage.Type, setting.PprofStorage)
 		if err != nil {
-			return fail(ctx, "Unable to start CPU profiler", "Unable to start CPU profile: %v", err)
+			return nil, fail(ctx, "Error while trying to open the pprof storage", "Error while trying to open the pprof storage: %v", err)
 		}
-		defer func() {
-			stopCPUProfiler()
-			err := pprof.DumpMemProfileForUsername(setting.PprofDataPath, username)
-			if err != nil {
-				_ = fail(ctx, "Unable to dump Mem profile", "Unable to dump Mem Profile: %v", err)
-			}
-		}()
+		startCPUProfiler = func() (func(), error) {
+			return pprof.DumpCPUProfileToStorage(store, username)
+		}
+		dumpMemProfile = func() error {
+			return pprof.DumpMemProfileToStorage(store, username)
+		}
+	} else if err := os.MkdirAll(setting.PprofDataPath, os.ModePerm); err != nil {
+		return nil, fail(ctx, "Error while trying to create PPROF_DATA_PATH", "Error while trying to create PPROF_DATA_PATH: %v", err)
 	}
 
-	requestedMode, has := allowedCommands[verb]
+	stopCPUProfiler, err := startCPUProfiler()
+	if err != nil {
+		return nil, fail(ctx, "Unable to start CPU profiler", "Unable to start CPU profile: %v", err)
+	}
+	return func() {
+		stopCPUProfiler()
+		err := dumpMemProfile()
+		if err != nil {
+			_ = fail(ctx, "Unable to dump Mem profile", "Unable to dump Mem Profile: %v", err)
+		}
+	}, nil
+}
+
+// servAccessMode returns the access mode the request needs, which for git-lfs-authenticate and git-annex-shell depends on their operation
+func servAccessMode(ctx context.Context, req *servRequest) (perm.AccessMode, error) {
+	mode, has := allowedCommands[req.verb]
 	if !has {
-		return fail(ctx, "Unknown git command", "Unknown git command %s", verb)
+		return mode, fail(ctx, "Unknown git command", "Unknown git command %s", req.verb)
 	}
 
-	if verb == lfsAuthenticateVerb {
-		if lfsVerb == "upload" {
-			requestedMode = perm.AccessModeWrite
-		} else if lfsVerb == "download" {
-			requestedMode = perm.AccessModeRead
-		} else {
-			return fail(ctx, "Unknown LFS verb", "Unknown lfs verb %s", lfsVerb)
+	if msg := disabledVerbMessage(req.verb); msg != "" {
+		return mode, fail(ctx, msg, "Disabled git command %s requested", req.verb)
+	}
+
+	switch req.verb {
+	case lfsAuthenticateVerb:
+		if mode, has = lfsVerbs[req.lfsVerb]; !has {
+			return mode, fail(ctx, "Unknown LFS verb", "Unknown lfs verb %s", req.lfsVerb)
+		}
+	case gitAnnexShellVerb:
+		if mode, has = annexCommands[req.annexVerb]; !has {
+			return mode, fail(ctx, "Unknown annex verb", "Unknown git-annex-shell command %s", req.annexVerb)
+		}
+		if annexKeyVerbs[req.annexVerb] {
+			for _, key := range annexKeys(req.words) {
+				if !annex.IsValidKey(key) {
+					return mode, fail(ctx, "Malformed git-annex key", "Malformed git-annex key for %s: %q", req.annexVerb, base.EllipsisString(key, 300))
+				}
+			}
 		}
 	}
+	return mode, nil
+}
 
-	results, extra := private.ServCommand(ctx, keyID, username, reponame, requestedMode, verb, lfsVerb)
-	if extra.HasError() {
-		return fail(ctx, extra.UserMsg, "ServCommand failed: %s", extra.Error)
+// failServCommand returns the error telling the client why ServCommand denied the request
+func failServCommand(ctx context.Context, keyID int64, req *servRequest, username, reponame string, extra private.ResponseExtra) error {
+	userMsg := servCommandUserMsg(extra, username, reponame)
+	if req.isAnnex(annexConfiglistVerb) {
+		userMsg = annexProbeUserMsg(extra, username, reponame)
+	}
+	// a message hiding the existence of the repository isn't replaced by the configured one
+	if userMsg == extra.UserMsg {
+		userMsg = localizeDenial(ctx, extra.Reason, extra.Language, extra.Args, userMsg)
+		userMsg = denialMessage(extra.Reason, servMessageData{Owner: username, Repo: reponame, Message: userMsg})
+	}
+	if extra.StatusCode == http.StatusUnauthorized || extra.StatusCode == http.StatusForbidden {
+		return failAuth(ctx, keyID, userMsg, "ServCommand failed: %s", extra.Error)
 	}
+	return fail(ctx, userMsg, "ServCommand failed: %s", extra.Error)
+}
 
-	// LFS token authentication
-	if verb == lfsAuthenticateVerb {
-		url := fmt.Sprintf("%s%s/%s.git/info/lfs", setting.AppURL, url.PathEscape(results.OwnerName), url.PathEscape(results.RepoName))
-
-		now := time.Now()
-		claims := lfs.Claims{
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(now.Add(setting.LFS.HTTPAuthExpiry)),
-				NotBefore: jwt.NewNumericDate(now),
-			},
-			RepoID: results.RepoID,
-			Op:     lfsVerb,
-			UserID: results.UserID,
-		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-		// Sign and get the complete encoded token as a string using the secret
-		tokenString, err := token.SignedString(setting.LFS.JWTSecretBytes)
-		if err != nil {
-			return fail(ctx, "Failed to sign JWT Token", "Failed to sign JWT token: %v", err)
+// checkServPolicies checks the request against what the user, the repository and the server require beyond the permission,
+// and waits for a clone approval, a read-through fetch or a backup in progress if needed
+func checkServPolicies(ctx context.Context, req *servRequest, results *private.ServCommandResults) error {
+	if msg := unverifiedEmailMessage(results); msg != "" {
+		return fail(ctx, msg, "User %s has not verified the email address", results.UserName)
+	}
+	if msg := missingTwoFactorMessage(results); msg != "" {
+		return fail(ctx, msg, "User %s has not enrolled in two-factor authentication", results.UserName)
+	}
+	if msg := readOnlyCredentialMessage(results, req.mode); msg != "" {
+		return fail(ctx, msg, "User %s tried to write to %s/%s with a read-only key or account", results.UserName, results.OwnerName, results.RepoName)
+	}
+	if msg := unacceptedCLAMessage(results); msg != "" {
+		return fail(ctx, msg, "User %s has not accepted the CLA of %s/%s", results.UserName, results.OwnerName, results.RepoName)
+	}
+	if msg := repoLockedMessage(results, req.mode); msg != "" {
+		return fail(ctx, msg, "Repository %s/%s is locked for %s operations", results.OwnerName, results.RepoName, results.RepoLock)
+	}
+	if msg := diskHighWatermarkMessage(req.mode, req.annexVerb, req.lfsVerb); msg != "" {
+		return fail(ctx, msg, "Storage usage of %s is above [repository] DISK_HIGH_WATERMARK of %d%%", setting.RepoRootPath, setting.Repository.DiskHighWatermark)
+	}
+	if results.CloneApprovalRequired {
+		if err := awaitCloneApproval(ctx, results); err != nil {
+			return err
 		}
+	}
 
-		tokenAuthentication := &git_model.LFSTokenResponse{
-			Header: make(map[string]string),
-			Href:   url,
+	if setting.SSH.CostBudget > 0 && results.UserID > 0 {
+		cost := operationCost(req.verb, req.annexVerb, req.words, results)
+		if _, extra := private.ServBudget(ctx, results.UserID, cost); extra.HasError() {
+			userMsg := localizeDenial(ctx, extra.Reason, results.UserLanguage, extra.Args, extra.UserMsg)
+			userMsg = denialMessage(extra.Reason, servMessageData{Owner: results.OwnerName, Repo: results.RepoName, User: results.UserName, Message: userMsg})
+			return fail(ctx, userMsg, "ServBudget failed for %s costing %d: %s", req.verb, cost, extra.Error)
 		}
-		tokenAuthentication.Header["Authorization"] = fmt.Sprintf("Bearer %s", tokenString)
+	}
 
-		enc := json.NewEncoder(os.Stdout)
-		err = enc.Encode(tokenAuthentication)
-		if err != nil {
-			return fail(ctx, "Failed to encode LFS json response", "Failed to encode LFS json response: %v", err)
+	if setting.CacheService.GitReadThrough.Enabled {
+		if miss, keys := readThroughMiss(ctx, req.verb, req.annexVerb, req.mode, req.words, servRepoPath(results)); miss {
+			if _, extra := private.ServReadThrough(ctx, results.RepoID, results.IsWiki, keys); extra.HasError() {
+				return fail(ctx, extra.UserMsg, "ServReadThrough failed: %s", extra.Error)
+			}
 		}
-		return nil
 	}
 
-	var gitcmd *exec.Cmd
-	gitBinPath := filepath.Dir(git.GitExecutable) // e.g. /usr/bin
-	gitBinVerb := filepath.Join(gitBinPath, verb) // e.g. /usr/bin/git-upload-pack
-	if _, err := os.Stat(gitBinVerb); err != nil {
-		// if the command "git-upload-pack" doesn't exist, try to split "git-upload-pack" to use the sub-command with git
-		// ps: Windows only has "git.exe" in the bin path, so Windows always uses this way
-		verbFields := strings.SplitN(verb, "-", 2)
-		if len(verbFields) == 2 {
-			// use git binary with the sub-command part: "C:\...\bin\git.exe", "upload-pack", ...
-			gitcmd = exec.CommandContext(ctx, git.GitExecutable, verbFields[1], repoPath)
-		}
-	}
-	if gitcmd == nil {
-		// by default, use the verb (it has been checked above by allowedCommands)
-		gitcmd = exec.CommandContext(ctx, gitBinVerb, repoPath)
-	}
-
-	process.SetSysProcAttribute(gitcmd)
-	gitcmd.Dir = setting.RepoRootPath
-	gitcmd.Stdout = os.Stdout
-	gitcmd.Stdin = os.Stdin
-	gitcmd.Stderr = os.Stderr
-	gitcmd.Env = append(gitcmd.Env, os.Environ()...)
-	gitcmd.Env = append(gitcmd.Env,
-		repo_module.EnvRepoIsWiki+"="+strconv.FormatBool(results.IsWiki),
-		repo_module.EnvRepoName+"="+results.RepoName,
-		repo_module.EnvRepoUsername+"="+results.OwnerName,
-		repo_module.EnvPusherName+"="+results.UserName,
-		repo_module.EnvPusherEmail+"="+results.UserEmail,
-		repo_module.EnvPusherID+"="+strconv.FormatInt(results.UserID, 10),
-		repo_module.EnvRepoID+"="+strconv.FormatInt(results.RepoID, 10),
-		repo_module.EnvPRID+"="+fmt.Sprintf("%d", 0),
-		repo_module.EnvDeployKeyID+"="+fmt.Sprintf("%d", results.DeployKeyID),
-		repo_module.EnvKeyID+"="+fmt.Sprintf("%d", results.KeyID),
-		repo_module.EnvAppURL+"="+setting.AppURL,
-	)
-	// to avoid breaking, here only use the minimal environment variables for the "gitea serv" command.
-	// it could be re-considered whether to use the same git.CommonGitCmdEnvs() as "git" command later.
-	gitcmd.Env = append(gitcmd.Env, git.CommonCmdServEnvs()...)
-
-	if err = gitcmd.Run(); err != nil {
-		return fail(ctx, "Failed to execute git command", "Failed to execute git command: %v", err)
+	if req.mode >= perm.AccessModeWrite {
+		return awaitBackup(ctx, results)
+	}
+	return nil
+}
+
+// writeLFSToken writes the response of git-lfs-authenticate, the LFS endpoint of the repository with a token for it
+func writeLFSToken(ctx context.Context, req *servRequest, results *private.ServCommandResults) error {
+	if msg := lfsQuotaMessage(results, req.lfsVerb, req.mode); msg != "" {
+		return fail(ctx, msg, "Repository %s/%s has %d bytes of LFS objects, over its quota of %d", results.OwnerName, results.RepoName, results.LFSSize, results.LFSQuota)
+	}
+	url := fmt.Sprintf("%s%s/%s.git/info/lfs", setting.AppURL, url.PathEscape(results.OwnerName), url.PathEscape(results.RepoName))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, newLFSClaims(results, req.lfsVerb, req.mode, time.Now()))
+
+	// Sign and get the complete encoded token as a string using the secret
+	tokenString, err := token.SignedString(setting.LFS.JWTSecretBytes)
+	if err != nil {
+		return fail(ctx, "Failed to sign JWT Token", "Failed to sign JWT token: %v", err)
+	}
+
+	tokenAuthentication := &git_model.LFSTokenResponse{
+		Header: make(map[string]string),
+		Href:   url,
+	}
+	tokenAuthentication.Header["Authorization"] = fmt.Sprintf("Bearer %s", tokenString)
+
+	enc := json.NewEncoder(os.Stdout)
+	err = enc.Encode(tokenAuthentication)
+	if err != nil {
+		return fail(ctx, "Failed to encode LFS json response", "Failed to encode LFS json response: %v", err)
+	}
+	return nil
+}
+
+// checkServRepo warns the client about problems of the repository it should know about,
+// and refuses to run the command if the repository directory isn't usable
+func checkServRepo(ctx context.Context, req *servRequest, results *private.ServCommandResults) error {
+	if msg := lfsUnavailableWarning(req.verb, results); msg != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "Gitea:", msg)
+	}
+	if msg := largeCloneWarning(req.verb, results); msg != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "Gitea:", msg)
+	}
+
+	if userMsg := checkSymlinkedRepo(servRepoPath(results)); userMsg != "" {
+		return fail(ctx, userMsg, "%s: %s/%s", userMsg, results.OwnerName, results.RepoName)
+	}
+
+	if results.RepoUnhealthy {
+		if err := probeRepoHealth(servRepoPath(results)); err != nil {
+			return fail(ctx, "Repository data appears to be corrupted; contact an administrator", "Health probe of %s/%s failed: %v", results.OwnerName, results.RepoName, err)
+		}
+	}
+	return nil
+}
+
+// recordServUsage records what the command cost, whether it succeeded or not
+func recordServUsage(ctx context.Context, req *servRequest, results *private.ServCommandResults, gitcmd *exec.Cmd) {
+	if setting.SSH.TrackUsage && gitcmd.ProcessState != nil {
+		if usageErr := private.ServRecordUsage(ctx, results.RepoID, servUsage(keyActivityVerb(req.verb, req.annexVerb), gitcmd.ProcessState)); usageErr != nil {
+			log.Warn("Unable to record the resource usage of %s on %s/%s: %v", req.verb, results.OwnerName, results.RepoName, usageErr)
+		}
+	}
+	if needsAutoRepack(results) {
+		if gcErr := private.ServScheduleGC(ctx, results.RepoID); gcErr != nil {
+			log.Warn("Unable to schedule git gc of %s/%s: %v", results.OwnerName, results.RepoName, gcErr)
+		}
+	}
+}
+
+// recordServCommand records a command which succeeded in the repository and the key it used
+func recordServCommand(ctx context.Context, req *servRequest, results *private.ServCommandResults, opLimiter *annexOpLimiter) error {
+	if req.verb == gitAnnexShellVerb {
+		recordAnnexCommand(ctx, req, results, opLimiter)
+	}
+
+	if setting.SSH.TrackProtocols {
+		recordGitProtocol(ctx, req.verb, results)
+	}
+	touchRepo(ctx, results)
+	if setting.Service.TrackClones && req.verb == "git-upload-pack" && !results.IsWiki {
+		if err := private.ServRecordRead(ctx, results.RepoID, results.UserID); err != nil {
+			log.Warn("Unable to count the read of %s/%s: %v", results.OwnerName, results.RepoName, err)
+		}
 	}
 
 	// Update user key activity.
 	if results.KeyID > 0 {
-		if err = private.UpdatePublicKeyInRepo(ctx, results.KeyID, results.RepoID); err != nil {
+		if err := private.UpdatePublicKeyInRepo(ctx, results.KeyID, results.RepoID); err != nil {
 			return fail(ctx, "Failed to update public key", "UpdatePublicKeyInRepo: %v", err)
 		}
+		if setting.SSH.KeyActivityHistory {
+			if err := private.ServRecordKeyActivity(ctx, results.KeyID, results.RepoID, keyActivityVerb(req.verb, req.annexVerb)); err != nil {
+				log.Warn("Unable to record the activity of key %d: %v", results.KeyID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// servCommandUserMsg returns the message shown to the user when ServCommand refused the request.
+// Unless the existence of repositories may be disclosed, every denial looks like a missing repository.
+func servCommandUserMsg(extra private.ResponseExtra, ownerName, repoName string) string {
+	if setting.Service.DiscloseRepoExistence {
+		return extra.UserMsg
+	}
+	switch extra.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return fmt.Sprintf("Cannot find repository: %s/%s", ownerName, repoName)
+	}
+	return extra.UserMsg
+}
+
+// unverifiedEmailMessage returns the reason to reject a user who has not verified the email address yet.
+// Deploy keys and SSH certificate principals are not subject to the check.
+func unverifiedEmailMessage(results *private.ServCommandResults) string {
+	if !setting.Service.RequireVerifiedEmail || results.DeployKeyID != 0 || results.IsPrincipal || results.UserEmailVerified {
+		return ""
+	}
+	return fmt.Sprintf("Your email address has not been verified, please verify it at %suser/settings/account before using git over SSH", setting.AppURL)
+}
+
+// missingTwoFactorMessage returns the reason to reject a user who has not enrolled in two-factor authentication
+// although it is required for git. Deploy keys are not subject to the check.
+func missingTwoFactorMessage(results *private.ServCommandResults) string {
+	if !results.Require2FA || results.DeployKeyID != 0 || results.UserTwoFactorEnabled {
+		return ""
+	}
+	return fmt.Sprintf("Two-factor authentication is required to use git over SSH, please enable it at %suser/settings/security", setting.AppURL)
+}
+
+// readOnlyCredentialMessage returns the reason to reject a write in the mode by a user who has made the key
+// or the whole account read-only over SSH
+func readOnlyCredentialMessage(results *private.ServCommandResults, mode perm.AccessMode) string {
+	switch {
+	case mode < perm.AccessModeWrite:
+		return ""
+	case results.AccountReadOnly:
+		return "This account is read-only, it can't be used to write to repositories over SSH"
+	case results.KeyReadOnly:
+		return "This key is read-only, it can't be used to write to repositories"
 	}
+	return ""
+}
 
+// unacceptedCLAMessage returns the reason to reject a push by a user who has not accepted the contributor license agreement of the repository
+func unacceptedCLAMessage(results *private.ServCommandResults) string {
+	if results.UnacceptedCLA == "" {
+		return ""
+	}
+	return fmt.Sprintf("Pushing to %s/%s requires accepting its contributor license agreement at %s", results.OwnerName, results.RepoName, results.UnacceptedCLA)
+}
+
+// repoLockedMessage returns the reason to reject an operation in the mode on a repository an administrator has locked
+func repoLockedMessage(results *private.ServCommandResults, mode perm.AccessMode) string {
+	if results.RepoLock == private.RepoLockAll || (results.RepoLock == private.RepoLockWrite && mode >= perm.AccessModeWrite) {
+		return "Repository is temporarily locked by an administrator, please retry later"
+	}
+	return ""
+}
+
+// repoDiskUsage returns the usage of the filesystem of the repositories in percent, it is replaced in tests
+var repoDiskUsage = func() (float64, error) {
+	return util.DiskUsagePercent(setting.RepoRootPath)
+}
+
+// diskHighWatermarkMessage returns the reason to reject a write if the usage of the filesystem of the repositories
+// exceeds [repository] DISK_HIGH_WATERMARK, so that transfers don't fail halfway through on a full disk.
+// Dropping git-annex content frees space and LFS lock tokens can't upload anything, so they are still allowed.
+func diskHighWatermarkMessage(mode perm.AccessMode, annexVerb, lfsVerb string) string {
+	if setting.Repository.DiskHighWatermark <= 0 || mode < perm.AccessModeWrite || annexVerb == "dropkey" || (lfsVerb != "" && lfsTokenOp(lfsVerb, mode) != lfs.TokenOpUpload) {
+		return ""
+	}
+	usage, err := repoDiskUsage()
+	if err != nil {
+		// the check only protects the server, failing to do it mustn't stop the writes
+		log.Warn("Unable to get the storage usage of %s: %v", setting.RepoRootPath, err)
+		return ""
+	}
+	if usage <= float64(setting.Repository.DiskHighWatermark) {
+		return ""
+	}
+	return "Server storage is nearly full, writes temporarily disabled"
+}
+
+// keyActivityVerb returns how the operation is shown in the activity history of the key,
+// git-annex-shell operations include the git-annex command
+func keyActivityVerb(verb, annexVerb string) string {
+	if annexVerb == "" {
+		return verb
+	}
+	return verb + " " + annexVerb
+}
+
+// touchRepo records the access to the repository, unless it has been recorded within private.RepoTouchInterval,
+// in which case the main process wouldn't update the access time anyway
+func touchRepo(ctx context.Context, results *private.ServCommandResults) {
+	if time.Since(results.RepoLastAccess) < private.RepoTouchInterval {
+		return
+	}
+	if err := private.ServTouchRepo(ctx, results.RepoID); err != nil {
+		log.Warn("Unable to record the access to %s/%s: %v", results.OwnerName, results.RepoName, err)
+	}
+}
+
+// recordGitProtocol counts the git transport operation by the version of the protocol the client requested
+func recordGitProtocol(ctx context.Context, verb string, results *private.ServCommandResults) {
+	if verb == lfsAuthenticateVerb || verb == gitAnnexShellVerb {
+		return
+	}
+	if err := private.ServRecordProtocol(ctx, verb, gitProtocolVersion(os.Getenv("GIT_PROTOCOL"))); err != nil {
+		log.Warn("Unable to record the protocol version of %s on %s/%s: %v", verb, results.OwnerName, results.RepoName, err)
+	}
+}
+
+// gitProtocolVersion returns the version of the git transport protocol requested in GIT_PROTOCOL, a colon separated
+// list of parameters such as "version=2". Like git, the highest version requested which git knows is used.
+// Without it the client uses the original protocol, version 0.
+func gitProtocolVersion(gitProtocol string) string {
+	version := 0
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if !strings.HasPrefix(param, "version=") {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimPrefix(param, "version=")); err == nil && v > version && v <= 2 {
+			version = v
+		}
+	}
+	return strconv.Itoa(version)
+}
+
+// needsAutoRepack returns true if git gc has to be scheduled because the repository has more loose objects
+// than [git] AUTO_REPACK_LOOSE_OBJECTS. The main process runs it in the background, so the operation isn't held up.
+func needsAutoRepack(results *private.ServCommandResults) bool {
+	return setting.Git.AutoRepackOnAccess && !results.IsWiki && setting.Git.AutoRepackLooseObjects > 0 &&
+		results.LooseObjects > setting.Git.AutoRepackLooseObjects
+}
+
+// largeCloneWarning returns the notice to show to a client fetching a repository
+// larger than [git] WARN_LARGE_CLONE, so that the download size doesn't come as a surprise
+func largeCloneWarning(verb string, results *private.ServCommandResults) string {
+	if verb != "git-upload-pack" || setting.Git.WarnLargeClone <= 0 || results.RepoSize <= setting.Git.WarnLargeClone {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s is a large repository, a full clone downloads up to %s. Consider a shallow clone with --depth if you don't need the full history", results.OwnerName, results.RepoName, base.FileSize(results.RepoSize))
+}
+
+// operationCost returns the cost charged to the SSH_COST_BUDGET of the user for an operation:
+// 1 for cheap operations, plus 1 per MiB which may be sent like the whole repository for a clone.
+func operationCost(verb, annexVerb string, words []string, results *private.ServCommandResults) int64 {
+	var size int64
+	switch {
+	case verb == "git-upload-pack" || verb == "git-upload-archive":
+		size = results.RepoSize
+	case verb == gitAnnexShellVerb && annexVerb == "sendkey":
+		for _, key := range annexKeys(words) {
+			if keySize, ok := annex.KeySize(key); ok {
+				size += keySize
+			}
+		}
+	}
+	return 1 + size/(1024*1024)
+}
+
+// lfsUnavailableWarning returns the warning to show to a client fetching a repository
+// which has LFS objects that can't be downloaded because the LFS server is disabled
+func lfsUnavailableWarning(verb string, results *private.ServCommandResults) string {
+	if verb != "git-upload-pack" || !results.LFSUnavailable {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s/%s uses Git LFS but LFS is disabled on this server, LFS files will only be checked out as pointer files", results.OwnerName, results.RepoName)
+}
+
+// lfsQuotaMessage returns the reason to refuse an LFS token for lfsVerb granting mode if it could upload objects
+// while the LFS objects of the repository already reach its quota in [repository.lfs_quota].
+// Downloads and locks are still allowed, the LFS server enforces the quota for the objects of each upload as well.
+func lfsQuotaMessage(results *private.ServCommandResults, lfsVerb string, mode perm.AccessMode) string {
+	if lfsTokenOp(lfsVerb, mode) != lfs.TokenOpUpload || results.LFSQuota <= 0 || results.LFSSize < results.LFSQuota {
+		return ""
+	}
+	return fmt.Sprintf("LFS quota exceeded: the LFS objects of %s/%s take %s of its quota of %s, please remove unused LFS objects before uploading more",
+		results.OwnerName, results.RepoName, base.FileSize(results.LFSSize), base.FileSize(results.LFSQuota))
+}
+
+// newLFSClaims returns the claims of the LFS token issued at now.
+// The issuer and audience are only set if configured, e.g. for tokens consumed by a separate LFS server.
+func newLFSClaims(results *private.ServCommandResults, lfsVerb string, mode perm.AccessMode, now time.Time) lfs.Claims {
+	claims := lfs.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(lfsTokenExpiry(results, mode))),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    setting.LFS.JWTIssuer,
+		},
+		RepoID: results.RepoID,
+		Op:     lfsTokenOp(lfsVerb, mode),
+		UserID: results.UserID,
+	}
+	if setting.LFS.JWTAudience != "" {
+		claims.Audience = jwt.ClaimStrings{setting.LFS.JWTAudience}
+	}
+	return claims
+}
+
+// lfsTokenExpiry returns the validity period of the LFS token.
+// Deploy keys are used by CI and other services which clone over and over, their download tokens may live longer.
+func lfsTokenExpiry(results *private.ServCommandResults, mode perm.AccessMode) time.Duration {
+	if results.DeployKeyID > 0 && mode == perm.AccessModeRead && setting.LFS.ServiceHTTPAuthExpiry > 0 {
+		return setting.LFS.ServiceHTTPAuthExpiry
+	}
+	return setting.LFS.HTTPAuthExpiry
+}
+
+// servRepoPath returns the path of the repository (or wiki) directory on disk
+func servRepoPath(results *private.ServCommandResults) string {
+	if results.IsWiki {
+		return repo_model.WikiPath(results.OwnerName, results.RepoName)
+	}
+	return repo_model.RepoPath(results.OwnerName, results.RepoName)
+}
+
+// probeRepoHealth checks that the git data of the repository at repoPath can still be read,
+// so corrupted repositories and failing storage give a clear error instead of a cryptic one from git.
+func probeRepoHealth(repoPath string) error {
+	head, err := os.ReadFile(filepath.Join(repoPath, "HEAD"))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(head), "ref: ") && !git.IsValidSHAPattern(strings.TrimSpace(string(head))) {
+		return fmt.Errorf("invalid HEAD %q", strings.TrimSpace(string(head)))
+	}
+	if _, err := os.ReadDir(filepath.Join(repoPath, "objects")); err != nil {
+		return err
+	}
 	return nil
 }
+
+// checkSymlinkedRepo applies the SYMLINKED_REPOSITORIES policy to the repository directory at repoPath.
+// It returns a message for the user if the repository may not be served.
+func checkSymlinkedRepo(repoPath string) string {
+	if setting.Repository.SymlinkedRepositories == setting.RepoSymlinksAllow {
+		return ""
+	}
+
+	// If anything can't be resolved, e.g. because the repository doesn't exist yet, leave it to git to report problems
+	resolved, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return ""
+	}
+	root, err := filepath.EvalSymlinks(setting.RepoRootPath)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(setting.RepoRootPath, repoPath)
+	if err != nil {
+		return ""
+	}
+	if resolved == filepath.Join(root, rel) {
+		return ""
+	}
+
+	if setting.Repository.SymlinkedRepositories == setting.RepoSymlinksDeny {
+		return "Repository directory is a symbolic link, which is not allowed"
+	}
+	if !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "Repository directory links outside of the repository root, which is not allowed"
+	}
+	return ""
+}
+
+// readThroughMiss returns true if a read-through cache node has to fetch the repository at repoPath from the origin
+// before verb can read it, along with the git-annex keys whose content has to be fetched.
+// Writes aren't handled by the cache, they have to go to the origin.
+func readThroughMiss(ctx context.Context, verb, annexVerb string, mode perm.AccessMode, words []string, repoPath string) (bool, []string) {
+	switch {
+	case verb == "git-upload-pack" || verb == "git-upload-archive":
+		return repo_module.IsReadThroughMiss(repoPath), nil
+	case verb == gitAnnexShellVerb && annexVerb != annexCapabilitiesVerb && mode == perm.AccessModeRead:
+		var keys []string
+		if annexVerb == "sendkey" {
+			keys = annexKeys(words)
+		}
+		miss := repo_module.IsReadThroughMiss(repoPath)
+		for _, key := range keys {
+			if miss || !annex.HasContent(ctx, repoPath, key) {
+				return true, keys
+			}
+		}
+		return miss, keys
+	}
+	return false, nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"code.gitea.io/gitea/models/perm"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/json"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// recordAnnexKeys records the git-annex keys whose content has been received or dropped by the command for [annex] TRACK_KEYS
+func recordAnnexKeys(ctx context.Context, annexVerb string, words []string, results *private.ServCommandResults) {
+	if annexVerb != "recvkey" && annexVerb != "dropkey" {
+		return
+	}
+	for _, key := range annexKeys(words) {
+		recordAnnexKey(ctx, key, annexVerb == "recvkey", results)
+	}
+}
+
+// recordAnnexSessionKeys records whether the repository stores the content of the keys put or removed in a git-annex P2P session.
+// Operations of a session can fail without ending it, so it depends on whether the content is there afterwards.
+func recordAnnexSessionKeys(ctx context.Context, keys []string, results *private.ServCommandResults) {
+	repoPath := servRepoPath(results)
+	for _, key := range keys {
+		if !annex.IsValidKey(key) {
+			continue
+		}
+		_, err := os.Stat(annex.KeyPath(repoPath, key))
+		recordAnnexKey(ctx, key, err == nil, results)
+	}
+}
+
+// recordAnnexKey records whether the repository stores the content of the key
+func recordAnnexKey(ctx context.Context, key string, stored bool, results *private.ServCommandResults) {
+	if !stored {
+		if err := private.AnnexForgetKey(ctx, results.RepoID, key); err != nil {
+			log.Warn("Unable to forget git-annex key %s of %s/%s: %v", key, results.OwnerName, results.RepoName, err)
+		}
+		return
+	}
+	others, err := private.AnnexRecordKey(ctx, results.RepoID, key)
+	if err != nil {
+		log.Warn("Unable to record git-annex key %s of %s/%s: %v", key, results.OwnerName, results.RepoName, err)
+	} else if others > 0 {
+		log.Debug("git-annex content %s of %s/%s is also stored in %d other repositories", key, results.OwnerName, results.RepoName, others)
+	}
+}
+
+// annexProbeUserMsg returns the message shown when ServCommand refused a git-annex "configlist".
+// git-annex sends it first to find out whether it can use the remote at all, so rather than the error of
+// whichever check failed the user is told plainly that there is no access, without disclosing whether the repository exists.
+func annexProbeUserMsg(extra private.ResponseExtra, ownerName, repoName string) string {
+	switch extra.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return fmt.Sprintf("Access denied: %s/%s does not exist or your SSH key has no read access to it, so git-annex cannot use it as a remote", ownerName, repoName)
+	}
+	return servCommandUserMsg(extra, ownerName, repoName)
+}
+
+// protectedDropMessage is the reason to reject dropping git-annex content by a user who may not with [annex] PROTECT_DROPKEY
+const protectedDropMessage = "Dropping git-annex content deletes it from the server for good, only administrators of the repository may do it"
+
+// mayDropAnnexContent returns false if [annex] PROTECT_DROPKEY keeps the user from dropping git-annex content of the repository
+func mayDropAnnexContent(results *private.ServCommandResults) bool {
+	return !setting.Annex.ProtectDropkey || results.RepoAdmin
+}
+
+// annexObjectLimitMessage returns the reason to reject new git-annex content
+// if the repository already holds count objects and that reaches [annex] MAX_OBJECT_COUNT.
+func annexObjectLimitMessage(count int64) string {
+	if setting.Annex.MaxObjectCount <= 0 || count < setting.Annex.MaxObjectCount {
+		return ""
+	}
+	return fmt.Sprintf("This repository has reached its limit of %d git-annex objects, please remove unused content with \"git annex unused\", \"git annex dropunused\" and \"git annex forget\" before uploading more", setting.Annex.MaxObjectCount)
+}
+
+// annexObjectWarning returns the warning to show to the uploader of new git-annex content
+// if the repository already holds count objects and the new one reaches [annex] OBJECT_COUNT_WARNING
+func annexObjectWarning(count int64) string {
+	if setting.Annex.ObjectCountWarning <= 0 || count+1 < setting.Annex.ObjectCountWarning {
+		return ""
+	}
+	if setting.Annex.MaxObjectCount > 0 {
+		return fmt.Sprintf("Warning: this repository holds %d of at most %d git-annex objects, please remove unused content with \"git annex unused\", \"git annex dropunused\" and \"git annex forget\" before uploads are rejected", count+1, setting.Annex.MaxObjectCount)
+	}
+	return fmt.Sprintf("Warning: this repository holds %d git-annex objects, please remove unused content with \"git annex unused\", \"git annex dropunused\" and \"git annex forget\"", count+1)
+}
+
+// annexGCryptMessage returns the reason to reject the git-annex-shell command if it sets up
+// an encrypted gcrypt remote and [annex] ALLOW_GCRYPT is disabled.
+func annexGCryptMessage(annexVerb string) string {
+	if setting.Annex.AllowGCrypt || annexVerb != "gcryptsetup" {
+		return ""
+	}
+	return "Encrypted git-annex remotes (gcrypt) are not allowed on this server, please use an unencrypted remote"
+}
+
+// annexFileSizeMessage returns the reason to reject git-annex content with the key
+// if it is larger than [annex] MAX_FILE_SIZE. Keys that don't record the size are accepted.
+func annexFileSizeMessage(key string) string {
+	if setting.Annex.MaxFileSize <= 0 {
+		return ""
+	}
+	if size, ok := annex.KeySize(key); !ok || size <= setting.Annex.MaxFileSize {
+		return ""
+	}
+	return fmt.Sprintf("The git-annex content is larger than the limit of %d bytes", setting.Annex.MaxFileSize)
+}
+
+// annexObjectLimitDenial returns the message telling the user that the repository has reached [annex] MAX_OBJECT_COUNT
+func annexObjectLimitDenial(ctx context.Context, results *private.ServCommandResults, msg string) string {
+	msg = localizeDenial(ctx, private.DenialQuota, results.UserLanguage, []string{strconv.FormatInt(setting.Annex.MaxObjectCount, 10)}, msg)
+	return denialMessage(private.DenialQuota, servMessageData{Owner: results.OwnerName, Repo: results.RepoName, User: results.UserName, Message: msg})
+}
+
+// annexPutChecker returns the check of the keys put in a git-annex P2P session against the limits of recvkey.
+// The objects of the repository are only counted for each put if there is a limit on them.
+func annexPutChecker(ctx context.Context, results *private.ServCommandResults) func(key string) string {
+	if setting.Annex.MaxObjectCount <= 0 {
+		return annexFileSizeMessage
+	}
+	return func(key string) string {
+		if msg := annexFileSizeMessage(key); msg != "" {
+			return msg
+		}
+		count, extra := private.AnnexObjectCount(ctx, results.RepoID)
+		if extra.HasError() {
+			log.Error("AnnexObjectCount failed: %s", extra.Error)
+			return "Unable to check the git-annex object limit"
+		}
+		if msg := annexObjectLimitMessage(count); msg != "" {
+			return annexObjectLimitDenial(ctx, results, msg)
+		}
+		return ""
+	}
+}
+
+// hasAnnexStorage returns true if the git-annex content of the repository is kept in the [annex] object storage
+func hasAnnexStorage(results *private.ServCommandResults) bool {
+	return setting.Annex.Storage != nil && !results.IsWiki
+}
+
+// annexStorageFetcher returns the fetch of the keys got in a git-annex P2P session from the [annex] object storage,
+// which happens before git-annex-shell reads the request, so it finds the content in the repository
+func annexStorageFetcher(ctx context.Context, results *private.ServCommandResults) func(key string) string {
+	return func(key string) string {
+		if extra := private.AnnexStorageFetch(ctx, results.RepoID, []string{key}); extra.HasError() {
+			log.Error("AnnexStorageFetch failed: %s", extra.Error)
+			return extra.UserMsg
+		}
+		return ""
+	}
+}
+
+// syncAnnexStorage has the main process save the content received by a git-annex-shell command to the [annex] object storage
+// and delete the content it dropped from there. Operations of a P2P session can fail without ending it, so all its keys
+// are passed along both ways, the main process skips the ones whose content isn't in the repository, or still is.
+func syncAnnexStorage(ctx context.Context, annexVerb string, words []string, opLimiter *annexOpLimiter, results *private.ServCommandResults) error {
+	var saved, deleted []string
+	switch {
+	case annexVerb == "recvkey":
+		saved = annexKeys(words)
+	case annexVerb == "dropkey":
+		deleted = annexKeys(words)
+	case annexVerb == "p2pstdio" && opLimiter != nil:
+		saved, deleted = opLimiter.Keys(), opLimiter.Keys()
+	}
+	if len(saved) > 0 {
+		if extra := private.AnnexStorageSave(ctx, results.RepoID, saved); extra.HasError() {
+			return fail(ctx, extra.UserMsg, "AnnexStorageSave failed: %s", extra.Error)
+		}
+	}
+	if len(deleted) > 0 {
+		if extra := private.AnnexStorageDelete(ctx, results.RepoID, deleted); extra.HasError() {
+			return fail(ctx, extra.UserMsg, "AnnexStorageDelete failed: %s", extra.Error)
+		}
+	}
+	return nil
+}
+
+// annexCapabilities describes the git-annex features of the server to clients probing it with annexCapabilitiesVerb
+type annexCapabilities struct {
+	Type           string   `json:"type"`
+	Version        int      `json:"version"`
+	Backends       []string `json:"backends"`
+	P2P            bool     `json:"p2p"`
+	MaxFileSize    int64    `json:"maxFileSize"`    // 0 means no limit
+	MaxObjectCount int64    `json:"maxObjectCount"` // 0 means no limit
+	ObjectCount    int64    `json:"objectCount"`
+}
+
+// newAnnexCapabilities returns the git-annex capabilities of the server for a repository holding objectCount objects
+func newAnnexCapabilities(backends []string, objectCount int64) *annexCapabilities {
+	return &annexCapabilities{
+		Type:           "gitea",
+		Version:        1,
+		Backends:       backends,
+		P2P:            true,
+		MaxFileSize:    setting.Annex.MaxFileSize,
+		MaxObjectCount: setting.Annex.MaxObjectCount,
+		ObjectCount:    objectCount,
+	}
+}
+
+// writeAnnexCapabilities writes the git-annex capabilities of the server for the repository to w as JSON
+func writeAnnexCapabilities(ctx context.Context, w io.Writer, repoID int64) error {
+	backends, err := annex.Backends(ctx)
+	if err != nil {
+		return fail(ctx, "Unable to get the git-annex capabilities", "Unable to get the git-annex backends: %v", err)
+	}
+	count, extra := private.AnnexObjectCount(ctx, repoID)
+	if extra.HasError() {
+		return fail(ctx, "Unable to get the git-annex capabilities", "AnnexObjectCount failed: %s", extra.Error)
+	}
+	return json.NewEncoder(w).Encode(newAnnexCapabilities(backends, count))
+}
+
+// annexArgs returns the arguments for git-annex-shell, with the repository given as repoPath
+func annexArgs(words []string, repoPath string) []string {
+	args := make([]string, 0, len(words)-1)
+	args = append(args, words[1], repoPath)
+	return append(args, words[3:]...)
+}
+
+// annexKeys returns the keys of the content a git-annex-shell command like recvkey or dropkey is about,
+// skipping its options and the fields that follow "--"
+func annexKeys(words []string) []string {
+	var keys []string
+	for _, word := range words[3:] {
+		if word == "--" {
+			break
+		}
+		if !strings.HasPrefix(word, "-") {
+			keys = append(keys, word)
+		}
+	}
+	return keys
+}
+
+// annexShellEnvs restricts git-annex-shell to the git-annex commands on the repository,
+// and to the commands that don't modify it if only read access has been granted
+func annexShellEnvs(repoPath string, mode perm.AccessMode) []string {
+	envs := []string{
+		"GIT_ANNEX_SHELL_LIMITED=True",
+		"GIT_ANNEX_SHELL_DIRECTORY=" + repoPath,
+	}
+	if mode < perm.AccessModeWrite {
+		envs = append(envs, "GIT_ANNEX_SHELL_READONLY=True")
+	}
+	return envs
+}
+
+// checkAnnexCommand checks a git-annex-shell command against the [annex] limits before it runs
+func checkAnnexCommand(ctx context.Context, req *servRequest, results *private.ServCommandResults) error {
+	if msg := annexGCryptMessage(req.annexVerb); msg != "" {
+		return fail(ctx, msg, "Setting up a gcrypt remote on %s/%s is not allowed", results.OwnerName, results.RepoName)
+	}
+
+	if req.annexVerb == "recvkey" {
+		for _, key := range annexKeys(req.words) {
+			if msg := annexFileSizeMessage(key); msg != "" {
+				return fail(ctx, msg, "git-annex content %s is larger than %d bytes", key, setting.Annex.MaxFileSize)
+			}
+		}
+	}
+
+	if req.annexVerb == "recvkey" && (setting.Annex.MaxObjectCount > 0 || setting.Annex.ObjectCountWarning > 0) {
+		count, extra := private.AnnexObjectCount(ctx, results.RepoID)
+		if extra.HasError() {
+			return fail(ctx, "Unable to check the git-annex object limit", "AnnexObjectCount failed: %s", extra.Error)
+		}
+		if msg := annexObjectLimitMessage(count); msg != "" {
+			return fail(ctx, annexObjectLimitDenial(ctx, results, msg), "Repository %s/%s has %d git-annex objects, over the limit of %d", results.OwnerName, results.RepoName, count, setting.Annex.MaxObjectCount)
+		}
+		if msg := annexObjectWarning(count); msg != "" {
+			_, _ = fmt.Fprintln(os.Stderr, "Gitea:", msg)
+		}
+	}
+
+	if req.annexVerb == "dropkey" && !mayDropAnnexContent(results) {
+		return fail(ctx, protectedDropMessage, "User %s tried to drop git-annex content of %s/%s without administrator access", results.UserName, results.OwnerName, results.RepoName)
+	}
+	return nil
+}
+
+// recordAnnexCommand notifies the drops and records the keys of a git-annex-shell command which succeeded
+func recordAnnexCommand(ctx context.Context, req *servRequest, results *private.ServCommandResults, opLimiter *annexOpLimiter) {
+	if req.annexVerb == "dropkey" && setting.Annex.DropNotifyCommand != "" {
+		for _, key := range annexKeys(req.words) {
+			if err := private.AnnexDropNotify(ctx, results.RepoID, key); err != nil {
+				log.Warn("Unable to notify the drop of %s from %s/%s: %v", key, results.OwnerName, results.RepoName, err)
+			}
+		}
+	}
+
+	if setting.Annex.TrackKeys {
+		if req.annexVerb == "p2pstdio" && opLimiter != nil {
+			recordAnnexSessionKeys(ctx, opLimiter.Keys(), results)
+		} else {
+			recordAnnexKeys(ctx, req.annexVerb, req.words, results)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/process"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// servHookEnvs returns the environment telling the hooks of the git command about the repository and the pusher
+func servHookEnvs(results *private.ServCommandResults) []string {
+	return []string{
+		repo_module.EnvRepoIsWiki + "=" + strconv.FormatBool(results.IsWiki),
+		repo_module.EnvRepoIsPrivate + "=" + strconv.FormatBool(results.RepoIsPrivate),
+		repo_module.EnvRepoName + "=" + results.RepoName,
+		repo_module.EnvRepoUsername + "=" + results.OwnerName,
+		repo_module.EnvPusherName + "=" + results.UserName,
+		repo_module.EnvPusherEmail + "=" + results.UserEmail,
+		repo_module.EnvPusherID + "=" + strconv.FormatInt(results.UserID, 10),
+		repo_module.EnvRepoID + "=" + strconv.FormatInt(results.RepoID, 10),
+		repo_module.EnvPRID + "=" + fmt.Sprintf("%d", 0),
+		repo_module.EnvDeployKeyID + "=" + fmt.Sprintf("%d", results.DeployKeyID),
+		repo_module.EnvKeyID + "=" + fmt.Sprintf("%d", results.KeyID),
+		repo_module.EnvAppURL + "=" + setting.AppURL,
+		repo_module.EnvVerifyAuthorEmails + "=" + strconv.FormatBool(results.VerifyAuthorEmails),
+		repo_module.EnvEnforceLFSLocks + "=" + strconv.FormatBool(results.EnforceLFSLocks),
+	}
+}
+
+// servCommandTimeout returns how long the git command may run, the timeout of the repository
+// takes precedence over [server] SSH_COMMAND_TIMEOUT. 0 means there is no timeout.
+func servCommandTimeout(results *private.ServCommandResults) time.Duration {
+	if results.CommandTimeout != nil {
+		return *results.CommandTimeout
+	}
+	return setting.SSH.CommandTimeout
+}
+
+// alternateObjectDir returns the object directory of the base repository of a fork
+// which a read verb may use as an alternate, or "" if it isn't inside the repository root.
+func alternateObjectDir(verb, baseRepoPath string) string {
+	if baseRepoPath == "" || (verb != "git-upload-pack" && verb != "git-upload-archive") {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(baseRepoPath, "objects"))
+	if err != nil {
+		return ""
+	}
+	root, err := filepath.EvalSymlinks(setting.RepoRootPath)
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		log.Warn("Not using the objects of %s as alternates as they are outside of the repository root", baseRepoPath)
+		return ""
+	}
+	return dir
+}
+
+// gitNamespaceEnvs scopes the refs the git transport commands advertise and update to the namespace, if any
+func gitNamespaceEnvs(verb, namespace string) []string {
+	if namespace == "" || verb == gitAnnexShellVerb {
+		return nil
+	}
+	return []string{"GIT_NAMESPACE=" + namespace}
+}
+
+// disableableCapabilities are the protocol capabilities [git] DISABLED_CAPABILITIES may name,
+// with the verb advertising them and the git config value that stops git from doing so
+var disableableCapabilities = map[string]struct{ verb, config string }{
+	"allow-tip-sha1-in-want":       {"git-upload-pack", "uploadpack.allowTipSHA1InWant=false"},
+	"allow-reachable-sha1-in-want": {"git-upload-pack", "uploadpack.allowReachableSHA1InWant=false"},
+	"filter":                       {"git-upload-pack", "uploadpack.allowFilter=false"},
+	"ref-in-want":                  {"git-upload-pack", "uploadpack.allowRefInWant=false"},
+	"sideband-all":                 {"git-upload-pack", "uploadpack.allowSidebandAll=false"},
+	"atomic":                       {"git-receive-pack", "receive.advertiseAtomic=false"},
+	"push-options":                 {"git-receive-pack", "receive.advertisePushOptions=false"},
+}
+
+// servGitConfigs returns the git config values, as "key=value", to run the git command for verb with
+func servGitConfigs(verb string) []string {
+	var configs []string
+	switch verb {
+	case "git-upload-pack":
+		for _, ref := range setting.Git.UploadPackHideRefs {
+			configs = append(configs, "uploadpack.hideRefs="+ref)
+		}
+	case "git-receive-pack":
+		// push options like "git push -o ci.skip" are passed to the hooks, whatever the global git config says
+		configs = append(configs, "receive.advertisePushOptions=true")
+		// hidden refs are neither advertised to nor updatable by the pusher,
+		// which protects the refs Gitea manages itself such as refs/pull/*
+		for _, ref := range setting.Git.ReceivePackHideRefs {
+			if ref != "" {
+				configs = append(configs, "receive.hideRefs="+ref)
+			}
+		}
+	}
+	// the capabilities disabled by the administrator come last, so they override everything above
+	for _, name := range setting.Git.DisabledCapabilities {
+		capability, ok := disableableCapabilities[strings.ToLower(name)]
+		if !ok {
+			log.Warn("Unknown capability %q in [git] DISABLED_CAPABILITIES is ignored", name)
+			continue
+		}
+		if capability.verb == verb {
+			configs = append(configs, capability.config)
+		}
+	}
+	return configs
+}
+
+// gitConfigEnvs returns the environment variables passing the config values to a git command, supported since git v2.31
+func gitConfigEnvs(configs []string) []string {
+	if len(configs) == 0 {
+		return nil
+	}
+	if err := git.CheckGitVersionAtLeast("2.31"); err != nil {
+		log.Warn("Git config %v is ignored: %v", configs, err)
+		return nil
+	}
+
+	envs := make([]string, 0, len(configs)*2+1)
+	envs = append(envs, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(configs)))
+	for i, config := range configs {
+		key, value, _ := strings.Cut(config, "=")
+		envs = append(envs, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, key), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, value))
+	}
+	return envs
+}
+
+// runPreExecCommand runs the pre-exec command configured by the administrator for the repository.
+// If the command fails the operation is aborted and the user is shown what it wrote to stderr.
+func runPreExecCommand(ctx context.Context, command string, env []string) error {
+	args, err := shellquote.Split(command)
+	if err != nil || len(args) == 0 {
+		return fail(ctx, "Failed to run the repository's pre-exec command", "Invalid pre-exec command %q: %v", command, err)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	process.SetSysProcAttribute(cmd)
+	cmd.Dir = setting.RepoRootPath
+	cmd.Env = env
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		userMsg := strings.TrimSpace(stderr.String())
+		if userMsg == "" {
+			userMsg = "Operation rejected by the repository's pre-exec command"
+		}
+		return fail(ctx, userMsg, "Pre-exec command %q failed: %v", command, err)
+	}
+	return nil
+}
+
+// servGuards are what may stop a running git command before it finishes on its own.
+// The zero value doesn't stop the command at all.
+type servGuards struct {
+	commandTimeout  time.Duration // the timeout of the command, 0 if there is none
+	sessionDeadline time.Time     // the end of [server] SSH_MAX_SESSION_DURATION, zero if there is none
+	opLimiter       *annexOpLimiter
+	branchGuard     *pushGuard
+	idle            *idleWatcher
+	hold            *notifyHold
+}
+
+// newServGuards returns the guards of the command of verb, and the context the command has to be created with
+// so that they can stop it. The returned function releases the context and has to be called once the command has finished.
+func newServGuards(ctx context.Context, sessionStart time.Time, req *servRequest, results *private.ServCommandResults) (context.Context, *servGuards, func()) {
+	guards := &servGuards{commandTimeout: servCommandTimeout(results)}
+	cmdCtx := ctx
+	var cancels []context.CancelFunc
+	withCancel := func() context.CancelFunc {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithCancel(cmdCtx)
+		cancels = append(cancels, cancel)
+		return cancel
+	}
+
+	if setting.SSH.MaxSessionDuration > 0 {
+		// unlike the other timeouts this also counts the time spent before the command started, e.g. waiting for locks
+		guards.sessionDeadline = sessionStart.Add(setting.SSH.MaxSessionDuration)
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithDeadline(cmdCtx, guards.sessionDeadline)
+		cancels = append(cancels, cancel)
+	}
+	if guards.commandTimeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(cmdCtx, guards.commandTimeout)
+		cancels = append(cancels, cancel)
+	}
+
+	if req.isAnnex("p2pstdio") {
+		guards.opLimiter = newAnnexOpLimiter(ctx, results, withCancel)
+	}
+	if req.isAnnex("notifychanges") && setting.Annex.NotifyChangesTimeout > 0 {
+		guards.hold = newNotifyHold(setting.Annex.NotifyChangesTimeout, withCancel())
+	}
+	if setting.SSH.IdleTimeout > 0 {
+		guards.idle = newIdleWatcher(setting.SSH.IdleTimeout, withCancel())
+	}
+	if req.verb == "git-receive-pack" {
+		guards.branchGuard = newPushGuard(results, withCancel)
+	}
+
+	return cmdCtx, guards, func() {
+		if guards.hold != nil {
+			guards.hold.Stop()
+		}
+		for i := len(cancels) - 1; i >= 0; i-- {
+			cancels[i]()
+		}
+	}
+}
+
+// newServGitCommand returns the command running the request in the repository, created with cmdCtx
+func newServGitCommand(cmdCtx context.Context, req *servRequest, results *private.ServCommandResults) *exec.Cmd {
+	var gitcmd *exec.Cmd
+	gitBinPath := filepath.Dir(git.GitExecutable)     // e.g. /usr/bin
+	gitBinVerb := filepath.Join(gitBinPath, req.verb) // e.g. /usr/bin/git-upload-pack
+	if req.verb == gitAnnexShellVerb {
+		// git-annex-shell is not part of git, so it is looked up in the PATH
+		gitcmd = exec.CommandContext(cmdCtx, gitAnnexShellVerb, annexArgs(req.words, servRepoPath(results))...)
+	} else if _, err := os.Stat(gitBinVerb); err != nil {
+		// if the command "git-upload-pack" doesn't exist, try to split "git-upload-pack" to use the sub-command with git
+		// ps: Windows only has "git.exe" in the bin path, so Windows always uses this way
+		verbFields := strings.SplitN(req.verb, "-", 2)
+		if len(verbFields) == 2 {
+			// use git binary with the sub-command part: "C:\...\bin\git.exe", "upload-pack", ...
+			gitcmd = exec.CommandContext(cmdCtx, git.GitExecutable, verbFields[1], servRepoPath(results))
+		}
+	}
+	if gitcmd == nil {
+		// by default, use the verb (it has been checked above by allowedCommands)
+		// the repository is given by the parsed names, repoPath may still have whitespace around its segments
+		gitcmd = exec.CommandContext(cmdCtx, gitBinVerb, servRepoPath(results))
+	}
+
+	process.SetSysProcAttribute(gitcmd)
+	gitcmd.Dir = setting.RepoRootPath
+	applyCommandCredential(gitcmd)
+
+	gitcmd.Env = append(gitcmd.Env, os.Environ()...)
+	gitcmd.Env = append(gitcmd.Env, servHookEnvs(results)...)
+	// to avoid breaking, here only use the minimal environment variables for the "gitea serv" command.
+	// it could be re-considered whether to use the same git.CommonGitCmdEnvs() as "git" command later.
+	gitcmd.Env = append(gitcmd.Env, git.CommonCmdServEnvs()...)
+	gitcmd.Env = append(gitcmd.Env, gitConfigEnvs(servGitConfigs(req.verb))...)
+	if req.verb == gitAnnexShellVerb {
+		gitcmd.Env = append(gitcmd.Env, annexShellEnvs(servRepoPath(results), req.mode)...)
+	}
+	if dir := alternateObjectDir(req.verb, results.BaseRepoPath); dir != "" {
+		gitcmd.Env = append(gitcmd.Env, "GIT_ALTERNATE_OBJECT_DIRECTORIES="+dir)
+	}
+	gitcmd.Env = append(gitcmd.Env, gitNamespaceEnvs(req.verb, results.GitNamespace)...)
+	return gitcmd
+}
+
+// pipeServCommand connects gitcmd to the client and counts the bytes transferred in result.
+// The client's input passes through the guards, and through the returned sniffer picking the client agent out of it.
+// The returned counter (if any) measures the ref advertisement for the debug log.
+func pipeServCommand(ctx context.Context, gitcmd *exec.Cmd, req *servRequest, results *private.ServCommandResults, guards *servGuards, result *servResult) (*agentSniffer, *refAdvertisementCounter, error) {
+	var stdout io.Writer = os.Stdout
+	var clientInput io.Reader = os.Stdin
+	if guards.idle != nil {
+		stdout = &idleWriter{w: stdout, idle: guards.idle}
+		clientInput = &idleReader{r: clientInput, idle: guards.idle}
+	}
+	// the ref advertisement grows with the number of refs, its size helps to tell why a clone is slow
+	var refAdvertisement *refAdvertisementCounter
+	if req.verb == "git-upload-pack" && log.IsDebug() {
+		refAdvertisement = &refAdvertisementCounter{w: stdout}
+		stdout = refAdvertisement
+	}
+	gitcmd.Stdout = &countingWriter{w: stdout, n: &result.BytesOut}
+	gitcmd.Stderr = os.Stderr
+
+	// Pass the client's input through ourselves so the client agent can be picked out of the request.
+	// A pipe is used so that waiting for the command doesn't also wait for the client to close its input.
+	sniffer := &agentSniffer{r: &countingReader{r: clientInput, n: &result.BytesIn}}
+	if results.MinClientGitVersion != "" && req.verb != gitAnnexShellVerb {
+		sniffer.onAgent = func(agent string) {
+			if msg := clientVersionAdvisory(agent, results.MinClientGitVersion); msg != "" {
+				_, _ = fmt.Fprintln(os.Stderr, "Gitea:", msg)
+			}
+		}
+	}
+	var input io.Reader = sniffer
+	if guards.opLimiter != nil {
+		guards.opLimiter.r = sniffer
+		input = guards.opLimiter
+	}
+	if guards.branchGuard != nil {
+		guards.branchGuard.r = sniffer
+		input = guards.branchGuard
+	}
+	stdin, err := gitcmd.StdinPipe()
+	if err != nil {
+		return nil, nil, fail(ctx, servCommandFailure(gitcmd), "Unable to create stdin pipe: %v", err)
+	}
+	go func() {
+		_, _ = io.Copy(stdin, input)
+		_ = stdin.Close()
+	}()
+	return sniffer, refAdvertisement, nil
+}
+
+// runServCommand runs gitcmd, which must have been created with cmdCtx.
+// If the command is killed because cmdCtx reached the timeout or the session deadline of guards,
+// or because one of the other guards cancelled it, the client is told why rather than getting a generic execution failure.
+// A git-annex "notifychanges" command closed because its hold expired is not a failure, the client just reconnects.
+func runServCommand(ctx, cmdCtx context.Context, gitcmd *exec.Cmd, guards *servGuards) error {
+	// The client gets the stderr of the command as it is, the end of it is also kept for the server log
+	stderr := &tailWriter{max: maxLoggedStderrSize}
+	if gitcmd.Stderr != nil {
+		gitcmd.Stderr = io.MultiWriter(gitcmd.Stderr, stderr)
+	} else {
+		gitcmd.Stderr = stderr
+	}
+	if err := gitcmd.Run(); err != nil {
+		if hold := guards.hold; hold != nil && hold.Expired() {
+			log.Debug("Closed git-annex notifychanges after %v: %v", hold.timeout, err)
+			return nil
+		}
+		if idle := guards.idle; idle != nil && idle.Idle() {
+			return fail(ctx, fmt.Sprintf("Connection was idle for more than %v", idle.timeout), "Git command was idle for more than %v: %v", idle.timeout, err)
+		}
+		if branchGuard := guards.branchGuard; branchGuard != nil && branchGuard.Blocked() != "" {
+			return fail(ctx, branchGuard.Blocked(), "Rejected a push: %s: %v", branchGuard.Blocked(), err)
+		}
+		if opLimiter := guards.opLimiter; opLimiter != nil {
+			if err := opLimiter.failure(ctx, err); err != nil {
+				return err
+			}
+		}
+		if errors.Is(cmdCtx.Err(), context.DeadlineExceeded) && !guards.sessionDeadline.IsZero() && !time.Now().Before(guards.sessionDeadline) {
+			return fail(ctx, fmt.Sprintf("Session exceeded the maximum duration of %v and was terminated", setting.SSH.MaxSessionDuration), "SSH session exceeded the maximum duration of %v: %v", setting.SSH.MaxSessionDuration, err)
+		}
+		if errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+			return fail(ctx, fmt.Sprintf("Operation timed out after %v", guards.commandTimeout), "Git command timed out: %v", err)
+		}
+		failMsg := servCommandFailure(gitcmd)
+		failErr := fail(ctx, failMsg, "%s: %v", failMsg, err)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			_ = private.SSHLog(ctx, true, fmt.Sprintf("%s failed with: %s", filepath.Base(gitcmd.Path), msg))
+		}
+		return failErr
+	}
+	return nil
+}
+
+// servCommandFailure returns the message for a failure of gitcmd,
+// which names the git-annex operation for git-annex-shell so annex problems can be told apart from git problems
+func servCommandFailure(gitcmd *exec.Cmd) string {
+	if strings.TrimSuffix(filepath.Base(gitcmd.Path), ".exe") == gitAnnexShellVerb && len(gitcmd.Args) > 1 {
+		return "Failed to execute git-annex operation: " + gitcmd.Args[1]
+	}
+	return "Failed to execute git command"
+}
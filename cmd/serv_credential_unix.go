@@ -0,0 +1,34 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// applyCommandCredential makes cmd run as the user and group configured by SSH_COMMAND_UID and SSH_COMMAND_GID.
+// The supplementary groups are dropped. Nothing is changed if neither is configured.
+func applyCommandCredential(cmd *exec.Cmd) {
+	if setting.SSH.CommandUID < 0 && setting.SSH.CommandGID < 0 {
+		return
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if setting.SSH.CommandUID >= 0 {
+		uid = setting.SSH.CommandUID
+	}
+	if setting.SSH.CommandGID >= 0 {
+		gid = setting.SSH.CommandGID
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/process"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyCommandCredential(t *testing.T) {
+	oldUID, oldGID := setting.SSH.CommandUID, setting.SSH.CommandGID
+	defer func() {
+		setting.SSH.CommandUID, setting.SSH.CommandGID = oldUID, oldGID
+	}()
+
+	setting.SSH.CommandUID, setting.SSH.CommandGID = -1, -1
+	cmd := exec.Command("id")
+	applyCommandCredential(cmd)
+	assert.Nil(t, cmd.SysProcAttr)
+
+	// the process group set up for the command is kept
+	setting.SSH.CommandUID = 65534
+	cmd = exec.Command("id")
+	process.SetSysProcAttribute(cmd)
+	applyCommandCredential(cmd)
+	assert.True(t, cmd.SysProcAttr.Setpgid)
+	assert.EqualValues(t, 65534, cmd.SysProcAttr.Credential.Uid)
+	assert.EqualValues(t, os.Getgid(), cmd.SysProcAttr.Credential.Gid)
+
+	setting.SSH.CommandGID = 65533
+	cmd = exec.Command("id")
+	applyCommandCredential(cmd)
+	assert.EqualValues(t, 65534, cmd.SysProcAttr.Credential.Uid)
+	assert.EqualValues(t, 65533, cmd.SysProcAttr.Credential.Gid)
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the user of a command needs root privileges")
+	}
+	cmd = exec.Command("id", "-u")
+	applyCommandCredential(cmd)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "65534", strings.TrimSpace(string(out)))
+	cmd = exec.Command("id", "-g")
+	applyCommandCredential(cmd)
+	out, err = cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "65533", strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,13 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package cmd
+
+import (
+	"os/exec"
+)
+
+// applyCommandCredential does nothing on Windows, which can't run commands as another user this way
+func applyCommandCredential(cmd *exec.Cmd) {}
@@ -0,0 +1,285 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// lockRenewInterval is how often serv renews the leases of the locks it holds
+var lockRenewInterval = private.LockLease / 3
+
+// lockReleaseTimeout is how long serv waits at most for the main process to release a lock
+const lockReleaseTimeout = 5 * time.Second
+
+// pollInterval and maxPollInterval bound the interval of a pollBackoff
+var (
+	pollInterval    = 100 * time.Millisecond
+	maxPollInterval = 5 * time.Second
+)
+
+// pollBackoff spaces out the requests serv sends the main process while it waits for something, e.g. a lock held by
+// another command. The interval doubles from pollInterval up to maxPollInterval, so short waits end quickly
+// and long ones don't flood the main process.
+type pollBackoff struct {
+	interval time.Duration
+}
+
+// Wait waits until the next request, but not beyond deadline. It returns the error of ctx if ctx is done first.
+func (b *pollBackoff) Wait(ctx context.Context, deadline time.Time) error {
+	if b.interval == 0 {
+		b.interval = pollInterval
+	}
+	wait := b.interval
+	if left := time.Until(deadline); left < wait {
+		wait = left
+	}
+	b.interval *= 2
+	if b.interval > maxPollInterval {
+		b.interval = maxPollInterval
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// holdLock calls renew every lockRenewInterval until ctx is done or the returned function is called.
+// The returned function then calls release with a context of its own, because ctx may have been cancelled by a signal.
+func holdLock(ctx context.Context, renew, release func(ctx context.Context)) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				renew(ctx)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		releaseCtx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+		defer cancel()
+		release(releaseCtx)
+	}
+}
+
+// lockPush takes the push lock of the repository, waiting up to SerializePushesTimeout for a concurrent push to finish.
+// It returns a function to release the lock, which is renewed until then.
+func lockPush(ctx context.Context, repoID int64) (func(), error) {
+	deadline := time.Now().Add(setting.Repository.SerializePushesTimeout)
+	var backoff pollBackoff
+	for {
+		token, extra := private.ServPushLock(ctx, repoID)
+		if !extra.HasError() {
+			return holdLock(ctx, func(ctx context.Context) {
+				if err := private.ServPushLockRenew(ctx, repoID, token); err != nil {
+					log.Error("Unable to renew the push lock of repository %d: %v", repoID, err)
+				}
+			}, func(ctx context.Context) {
+				if err := private.ServPushUnlock(ctx, repoID, token); err != nil {
+					log.Error("Unable to release the push lock of repository %d: %v", repoID, err)
+				}
+			}), nil
+		}
+		if extra.StatusCode != http.StatusLocked || !time.Now().Before(deadline) {
+			return nil, fail(ctx, extra.UserMsg, "ServPushLock failed: %s", extra.Error)
+		}
+
+		if err := backoff.Wait(ctx, deadline); err != nil {
+			return nil, fail(ctx, extra.UserMsg, "ServPushLock cancelled: %v", err)
+		}
+	}
+}
+
+// lockAnnexKeys takes the locks of the git-annex keys in the repository, exclusively to drop their content or shared
+// to send it, waiting up to [annex] KEY_LOCK_TIMEOUT for concurrent commands on the same keys to finish.
+// The keys are locked in sorted order so commands on several keys can't deadlock. It returns a function to release the locks,
+// which are renewed until then.
+func lockAnnexKeys(ctx context.Context, repoID int64, keys []string, exclusive bool) (func(), error) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+
+	tokens := make(map[string]string, len(keys))
+	renew := func(ctx context.Context) {
+		for key, token := range tokens {
+			if err := private.AnnexKeyLockRenew(ctx, repoID, key, token); err != nil {
+				log.Error("Unable to renew the lock of git-annex key %s in repository %d: %v", key, repoID, err)
+			}
+		}
+	}
+	release := func(ctx context.Context) {
+		for key, token := range tokens {
+			if err := private.AnnexKeyUnlock(ctx, repoID, key, token); err != nil {
+				log.Error("Unable to release the lock of git-annex key %s in repository %d: %v", key, repoID, err)
+			}
+		}
+	}
+	unlock := func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+		defer cancel()
+		release(releaseCtx)
+	}
+
+	deadline := time.Now().Add(setting.Annex.KeyLockTimeout)
+	renewed := time.Now()
+	for _, key := range keys {
+		if _, has := tokens[key]; has {
+			continue
+		}
+		var backoff pollBackoff
+		for {
+			token, extra := private.AnnexKeyLock(ctx, repoID, key, exclusive)
+			if !extra.HasError() {
+				tokens[key] = token
+				break
+			}
+			if extra.StatusCode != http.StatusLocked || !time.Now().Before(deadline) {
+				unlock()
+				return nil, fail(ctx, extra.UserMsg, "AnnexKeyLock failed: %s", extra.Error)
+			}
+
+			if err := backoff.Wait(ctx, deadline); err != nil {
+				unlock()
+				return nil, fail(ctx, extra.UserMsg, "AnnexKeyLock cancelled: %v", err)
+			}
+			// the keys locked already must not expire while waiting for the others
+			if time.Since(renewed) >= lockRenewInterval {
+				renew(ctx)
+				renewed = time.Now()
+			}
+		}
+	}
+	return holdLock(ctx, renew, release), nil
+}
+
+// awaitBackup waits up to [repository] BACKUP_WRITE_TIMEOUT for a backup snapshot in progress to finish,
+// so that writes don't make the backup inconsistent. Only if the results report a backup in progress
+// the main process is asked again until it has finished.
+func awaitBackup(ctx context.Context, results *private.ServCommandResults) error {
+	if !results.BackupInProgress {
+		return nil
+	}
+	deadline := time.Now().Add(setting.Repository.BackupWriteTimeout)
+	var backoff pollBackoff
+	for {
+		if !time.Now().Before(deadline) {
+			return fail(ctx, "A backup is in progress and writes are paused, please retry later", "Rejected a write during a backup")
+		}
+
+		if err := backoff.Wait(ctx, deadline); err != nil {
+			return fail(ctx, "A backup is in progress and writes are paused, please retry later", "Waiting for the backup cancelled: %v", err)
+		}
+
+		inProgress, extra := private.ServBackupInProgress(ctx)
+		if extra.HasError() {
+			return fail(ctx, extra.UserMsg, "ServBackupInProgress failed: %s", extra.Error)
+		}
+		if !inProgress {
+			return nil
+		}
+	}
+}
+
+// awaitCloneApproval requests the approval of an administrator to read the repository,
+// waiting up to CloneApprovalTimeout for it before the client is rejected with the pending request.
+func awaitCloneApproval(ctx context.Context, results *private.ServCommandResults) error {
+	deadline := time.Now().Add(setting.Repository.CloneApprovalTimeout)
+	repoName := results.OwnerName + "/" + results.RepoName
+	announced := false
+	var backoff pollBackoff
+	for {
+		approval, extra := private.ServCloneApproval(ctx, results.RepoID, results.KeyID, results.UserName, repoName)
+		if extra.HasError() {
+			return fail(ctx, extra.UserMsg, "ServCloneApproval failed: %s", extra.Error)
+		}
+		if approval.Approved {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fail(ctx, fmt.Sprintf("Reading %s needs the approval of an administrator, approval request %s is pending. Please retry once it has been approved", repoName, approval.RequestID), "")
+		}
+		if !announced {
+			_, _ = fmt.Fprintf(os.Stderr, "Gitea: Reading %s needs the approval of an administrator, waiting up to %v for approval request %s\n", repoName, setting.Repository.CloneApprovalTimeout, approval.RequestID)
+			announced = true
+		}
+
+		if err := backoff.Wait(ctx, deadline); err != nil {
+			return fail(ctx, fmt.Sprintf("Approval request %s is still pending", approval.RequestID), "ServCloneApproval cancelled: %v", err)
+		}
+	}
+}
+
+// lockServCommand takes the locks the command needs: the push lock for a push with [repository] SERIALIZE_PUSHES,
+// a notifychanges slot with [annex] MAX_NOTIFY_CHANGES_PER_REPO, and the locks of the git-annex keys sent or dropped.
+// It returns a function to release them all.
+func lockServCommand(ctx context.Context, req *servRequest, results *private.ServCommandResults) (func(), error) {
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+
+	if req.verb == "git-receive-pack" && setting.Repository.SerializePushes {
+		unlockPush, err := lockPush(ctx, results.RepoID)
+		if err != nil {
+			return nil, err
+		}
+		unlocks = append(unlocks, unlockPush)
+	}
+
+	if req.isAnnex("notifychanges") && setting.Annex.MaxNotifyChangesPerRepo > 0 {
+		token, extra := private.AnnexNotifyChangesAcquire(ctx, results.RepoID)
+		if extra.HasError() {
+			unlock()
+			return nil, fail(ctx, extra.UserMsg, "AnnexNotifyChangesAcquire failed: %s", extra.Error)
+		}
+		unlocks = append(unlocks, holdLock(ctx, func(ctx context.Context) {
+			if setting.Annex.NotifyChangesTimeout > 0 {
+				return // the slot times out with the connection
+			}
+			if err := private.AnnexNotifyChangesRenew(ctx, results.RepoID, token); err != nil {
+				log.Error("Unable to renew the notifychanges slot of repository %d: %v", results.RepoID, err)
+			}
+		}, func(ctx context.Context) {
+			if err := private.AnnexNotifyChangesRelease(ctx, results.RepoID, token); err != nil {
+				log.Error("Unable to release the notifychanges slot of repository %d: %v", results.RepoID, err)
+			}
+		}))
+	}
+
+	if req.isAnnex("sendkey") || req.isAnnex("dropkey") {
+		unlockKeys, err := lockAnnexKeys(ctx, results.RepoID, annexKeys(req.words), req.annexVerb == "dropkey")
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlockKeys)
+	}
+	return unlock, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"code.gitea.io/gitea/modules/json"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/util"
+
+	"github.com/urfave/cli"
+)
+
+// servLogClass returns the class of verb in [ssh.log_levels]
+func servLogClass(verb string) string {
+	switch verb {
+	case "git-upload-pack":
+		return "fetch"
+	case "git-receive-pack":
+		return "push"
+	case "git-upload-archive":
+		return "archive"
+	case lfsAuthenticateVerb:
+		return "lfs"
+	case gitAnnexShellVerb:
+		return "annex"
+	}
+	return ""
+}
+
+// logServ is replaced in tests
+var logServ = log.Log
+
+// logServFinished logs a finished operation at the [ssh.log_levels] level of the class of verb
+func logServFinished(verb, annexVerb string, results *private.ServCommandResults, duration time.Duration) {
+	level, has := setting.SSH.LogLevels[servLogClass(verb)]
+	if !has {
+		level = log.DEBUG
+	}
+	if level == log.NONE {
+		return
+	}
+	logServ(1, level, "SSH: %s %s/%s by %s finished in %v", keyActivityVerb(verb, annexVerb), results.OwnerName, results.RepoName, results.UserName, duration)
+}
+
+// servUsage returns the resource usage of the finished git command run for verb.
+// The CPU times are known everywhere, the peak memory use only where the platform reports it.
+func servUsage(verb string, state *os.ProcessState) *private.ServUsage {
+	return &private.ServUsage{
+		Verb:       verb,
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     processMaxRSS(state),
+	}
+}
+
+// servResult is written as a JSON object to the --result-fd file descriptor when serv finishes,
+// so scripts wrapping serv can tell what happened
+type servResult struct {
+	Verb       string `json:"verb"`
+	Repo       string `json:"repo"`
+	AccessMode string `json:"accessMode"`
+	ExitCode   int    `json:"exitCode"`
+	BytesIn    int64  `json:"bytesIn"`
+	BytesOut   int64  `json:"bytesOut"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// servExitCode returns the exit code of serv for the error it returned
+func servExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitCoder, ok := err.(cli.ExitCoder); ok {
+		return exitCoder.ExitCode()
+	}
+	return 1
+}
+
+// writeServResult completes the result with the outcome of serv and writes it to w
+func writeServResult(w io.Writer, result *servResult, duration time.Duration, err error) error {
+	result.ExitCode = servExitCode(err)
+	result.BytesIn = atomic.LoadInt64(&result.BytesIn)
+	result.BytesOut = atomic.LoadInt64(&result.BytesOut)
+	result.DurationMs = duration.Milliseconds()
+	return json.NewEncoder(w).Encode(result)
+}
+
+// servEventTimeout is how long serv waits at most for the main process to take an event
+const servEventTimeout = time.Second
+
+// servEvent returns the event published to the [server] SSH_EVENT_STREAM for the outcome of serv
+func servEvent(result *servResult, userName string, duration time.Duration, err error) *private.ServEvent {
+	event := &private.ServEvent{
+		Repo:     result.Repo,
+		User:     userName,
+		Verb:     result.Verb,
+		Outcome:  "success",
+		ExitCode: servExitCode(err),
+		BytesIn:  atomic.LoadInt64(&result.BytesIn),
+		BytesOut: atomic.LoadInt64(&result.BytesOut),
+		Duration: duration,
+	}
+	if err != nil {
+		event.Outcome = "failure"
+	}
+	return event
+}
+
+// streamServStatus sends the state of the operation to the main process, it is replaced in tests
+var streamServStatus = private.ServStreamStatus
+
+// newServStatus returns the status of the operation with the verb on the repository of results
+func newServStatus(results *private.ServCommandResults, verb string) *private.ServStatus {
+	// the ID only tells the operations apart, so it doesn't matter if the random source fails
+	id, _ := util.CryptoRandomString(16)
+	return &private.ServStatus{
+		ID:   id,
+		Repo: results.OwnerName + "/" + results.RepoName,
+		User: results.UserName,
+		Verb: verb,
+	}
+}
+
+// startServStatus sends the start of the operation to the main process, followed by its progress every interval.
+// The returned function stops sending the progress and sends the end of the operation with the outcome of err.
+// The status is only informative, so failures to send it are just logged.
+func startServStatus(ctx context.Context, status *private.ServStatus, result *servResult, interval time.Duration) func(error) {
+	send := func(event string, exitCode int) {
+		update := *status
+		update.Event = event
+		update.BytesIn = atomic.LoadInt64(&result.BytesIn)
+		update.BytesOut = atomic.LoadInt64(&result.BytesOut)
+		update.ExitCode = exitCode
+		// serv may have been interrupted, so the status gets its own deadline
+		sendCtx, cancel := context.WithTimeout(context.Background(), servEventTimeout)
+		defer cancel()
+		if err := streamServStatus(sendCtx, &update); err != nil {
+			log.Debug("Unable to send the %s status of %s on %s: %v", event, status.Verb, status.Repo, err)
+		}
+	}
+
+	send(private.ServStatusStart, 0)
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				send(private.ServStatusProgress, 0)
+			}
+		}
+	}()
+	return func(err error) {
+		cancel()
+		<-stopped
+		send(private.ServStatusDone, servExitCode(err))
+	}
+}
@@ -0,0 +1,637 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	git_model "code.gitea.io/gitea/models/git"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/hashicorp/go-version"
+)
+
+// maxLoggedStderrSize limits how much of the stderr of a failed command is logged
+const maxLoggedStderrSize = 4096
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = w.buf[len(w.buf)-w.max:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.buf)
+}
+
+// maxAgentSniffSize limits how much of the client's input is searched for its agent
+const maxAgentSniffSize = 64 * 1024
+
+var agentPattern = regexp.MustCompile(`(?:^|[\s\x00])agent=([^\s\x00]+)`)
+
+// gitAgentVersionPattern picks the version out of the agents of git clients like "git/2.39.5" or "git/2.37.1.windows.1"
+var gitAgentVersionPattern = regexp.MustCompile(`^git/(\d+(?:\.\d+)*)`)
+
+// clientVersionAdvisory returns the warning to show to a git client with the agent if it is older than minVersion.
+// Agents of other clients, e.g. JGit, don't tell the git version, so they never get the warning.
+func clientVersionAdvisory(agent, minVersion string) string {
+	m := gitAgentVersionPattern.FindStringSubmatch(agent)
+	if m == nil {
+		return ""
+	}
+	clientVersion, err := version.NewVersion(m[1])
+	if err != nil {
+		return ""
+	}
+	recommended, err := version.NewVersion(minVersion)
+	if err != nil || !clientVersion.LessThan(recommended) {
+		return ""
+	}
+	return fmt.Sprintf("This repository recommends git %s or later, but your git client is version %s. Some of its features, e.g. partial clones, may not work as expected, please consider upgrading git.", minVersion, m[1])
+}
+
+// agentSniffer reads from r and picks the "agent" capability, e.g. "git/2.39.5", out of the pkt-lines
+// the client sends before its first flush. Git clients announce their agent there in all protocol versions.
+type agentSniffer struct {
+	r io.Reader
+	// onAgent is called with the agent once it has been found
+	onAgent func(agent string)
+
+	mu    sync.Mutex
+	buf   []byte
+	done  bool
+	agent string
+}
+
+func (s *agentSniffer) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.mu.Lock()
+		found := ""
+		if !s.done {
+			s.buf = append(s.buf, p[:n]...)
+			s.sniff()
+			found = s.agent
+		}
+		s.mu.Unlock()
+		if found != "" && s.onAgent != nil {
+			s.onAgent(found)
+		}
+	}
+	return n, err
+}
+
+// sniff parses the complete pkt-lines in the buffer
+func (s *agentSniffer) sniff() {
+	for !s.done && len(s.buf) >= 4 {
+		length, err := strconv.ParseUint(string(s.buf[:4]), 16, 16)
+		if err != nil || length == 0 {
+			// not a pkt-line stream or the first flush, either way there is no agent to find
+			s.done = true
+			break
+		}
+		if length < 4 {
+			// delim and response-end packets carry no data
+			s.buf = s.buf[4:]
+			continue
+		}
+		if uint64(len(s.buf)) < length {
+			break
+		}
+		if m := agentPattern.FindSubmatch(s.buf[4:length]); m != nil {
+			s.agent = string(m[1])
+			s.done = true
+		}
+		s.buf = s.buf[length:]
+	}
+	if s.done || len(s.buf) > maxAgentSniffSize {
+		s.done = true
+		s.buf = nil
+	}
+}
+
+// Agent returns the agent the client announced, or "" if there was none
+func (s *agentSniffer) Agent() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agent
+}
+
+// refAdvertisementCounter passes the output of git-upload-pack through and measures the ref advertisement it starts with:
+// the pkt-lines up to and including the first flush-pkt, or the capability advertisement with protocol v2
+type refAdvertisementCounter struct {
+	w io.Writer
+
+	mu       sync.Mutex
+	header   []byte
+	remain   uint64 // data of the current pkt-line still to come
+	size     int64
+	lines    int64
+	done     bool
+	complete bool
+}
+
+func (c *refAdvertisementCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.count(p)
+	c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// count parses the pkt-lines in p until the first flush-pkt
+func (c *refAdvertisementCounter) count(p []byte) {
+	for len(p) > 0 && !c.done {
+		if c.remain > 0 {
+			n := uint64(len(p))
+			if n > c.remain {
+				n = c.remain
+			}
+			c.size += int64(n)
+			c.remain -= n
+			p = p[n:]
+			continue
+		}
+
+		n := 4 - len(c.header)
+		if n > len(p) {
+			n = len(p)
+		}
+		c.header = append(c.header, p[:n]...)
+		c.size += int64(n)
+		p = p[n:]
+		if len(c.header) < 4 {
+			return
+		}
+		length, err := strconv.ParseUint(string(c.header), 16, 16)
+		c.header = c.header[:0]
+		switch {
+		case err != nil:
+			// not a pkt-line stream
+			c.done = true
+		case length == 0:
+			c.done = true
+			c.complete = true
+		case length >= 4:
+			c.lines++
+			c.remain = length - 4
+		}
+	}
+}
+
+// Size returns the size in bytes and the number of pkt-lines of the ref advertisement,
+// complete is false if it didn't end with a flush-pkt
+func (c *refAdvertisementCounter) Size() (size, lines int64, complete bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, c.lines, c.complete
+}
+
+// logRefAdvertisement logs the size of the ref advertisement git-upload-pack sent for the repository
+func logRefAdvertisement(c *refAdvertisementCounter, repo string) {
+	size, lines, complete := c.Size()
+	if !complete {
+		log.Debug("Ref advertisement of %s was incomplete after %d bytes in %d pkt-lines", repo, size, lines)
+		return
+	}
+	log.Debug("Ref advertisement of %s: %d bytes in %d pkt-lines", repo, size, lines)
+}
+
+// maxAnnexP2PLineSize limits how long a git-annex P2P protocol message may get while it is being read
+const maxAnnexP2PLineSize = 64 * 1024
+
+// annexP2POperations are the git-annex P2P protocol messages a client starts an operation with
+var annexP2POperations = map[string]bool{
+	"CHECKPRESENT":  true,
+	"LOCKCONTENT":   true,
+	"REMOVE":        true,
+	"REMOVE-BEFORE": true,
+	"GETTIMESTAMP":  true,
+	"GET":           true,
+	"PUT":           true,
+	"CONNECT":       true,
+	"NOTIFYCHANGE":  true,
+}
+
+// annexOpLimiter reads the git-annex P2P protocol messages the client sends from r, and once the client starts
+// more than max operations (unless max is 0), removes content if denyRemove is set, or puts or gets content checkPut or
+// checkGet (if any) tells a reason against, it cancels the session and stops reading. With trackKeys it collects the keys
+// put or removed in the session. The content following DATA messages is passed through without being parsed.
+type annexOpLimiter struct {
+	r          io.Reader
+	max        int64
+	denyRemove bool
+	checkPut   func(key string) string
+	checkGet   func(key string) string
+	trackKeys  bool
+	cancel     context.CancelFunc
+
+	keysMu sync.Mutex
+	keys   []string
+
+	line         []byte
+	dataLeft     int64
+	ops          int64
+	exceeded     atomic.Bool
+	removeDenied atomic.Bool
+	putDenied    atomic.Value // string
+	getDenied    atomic.Value // string
+}
+
+// newAnnexOpLimiter returns the limiter of a git-annex P2P session, or nil if nothing about the session has to be checked.
+// newCancel is only called if there is a limiter, it returns the function stopping the session.
+func newAnnexOpLimiter(ctx context.Context, results *private.ServCommandResults, newCancel func() context.CancelFunc) *annexOpLimiter {
+	storage := hasAnnexStorage(results)
+	if setting.Annex.MaxOpsPerSession <= 0 && mayDropAnnexContent(results) && setting.Annex.MaxFileSize <= 0 && setting.Annex.MaxObjectCount <= 0 && !setting.Annex.TrackKeys && !storage {
+		return nil
+	}
+	// content put in the session is held to the limits of recvkey
+	l := &annexOpLimiter{max: setting.Annex.MaxOpsPerSession, denyRemove: !mayDropAnnexContent(results), checkPut: annexPutChecker(ctx, results), trackKeys: setting.Annex.TrackKeys || storage, cancel: newCancel()}
+	if storage {
+		l.checkGet = annexStorageFetcher(ctx, results)
+	}
+	return l
+}
+
+func (l *annexOpLimiter) Read(p []byte) (int, error) {
+	if l.exceeded.Load() || l.removeDenied.Load() || l.PutDenied() != "" || l.GetDenied() != "" {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := l.r.Read(p)
+	if n > 0 && l.parse(p[:n]) {
+		l.cancel()
+		return 0, io.ErrClosedPipe
+	}
+	return n, err
+}
+
+// parse counts the operations started in b, returning true once there are too many or a denied removal, put or get is started
+func (l *annexOpLimiter) parse(b []byte) bool {
+	for len(b) > 0 {
+		if l.dataLeft > 0 {
+			skip := l.dataLeft
+			if skip > int64(len(b)) {
+				skip = int64(len(b))
+			}
+			b = b[skip:]
+			l.dataLeft -= skip
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			if len(l.line)+len(b) <= maxAnnexP2PLineSize {
+				l.line = append(l.line, b...)
+			}
+			return false
+		}
+		l.line = append(l.line, b[:i]...)
+		b = b[i+1:]
+		fields := strings.Fields(string(l.line))
+		l.line = l.line[:0]
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "DATA" && len(fields) > 1 {
+			l.dataLeft, _ = strconv.ParseInt(fields[1], 10, 64)
+		} else if annexP2POperations[fields[0]] {
+			if l.denyRemove && (fields[0] == "REMOVE" || fields[0] == "REMOVE-BEFORE") {
+				l.removeDenied.Store(true)
+				return true
+			}
+			// the key is the last field of "PUT AssociatedFile Key"
+			if fields[0] == "PUT" && len(fields) > 1 && l.checkPut != nil {
+				if msg := l.checkPut(fields[len(fields)-1]); msg != "" {
+					l.putDenied.Store(msg)
+					return true
+				}
+			}
+			// the key is the last field of "GET Offset AssociatedFile Key"
+			if fields[0] == "GET" && len(fields) > 1 && l.checkGet != nil {
+				if msg := l.checkGet(fields[len(fields)-1]); msg != "" {
+					l.getDenied.Store(msg)
+					return true
+				}
+			}
+			if l.trackKeys && len(fields) > 1 && (fields[0] == "PUT" || fields[0] == "REMOVE" || fields[0] == "REMOVE-BEFORE") {
+				l.keysMu.Lock()
+				l.keys = append(l.keys, fields[len(fields)-1])
+				l.keysMu.Unlock()
+			}
+			l.ops++
+			if l.max > 0 && l.ops > l.max {
+				l.exceeded.Store(true)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoveDenied returns true if the session was cancelled because it tried to remove content
+func (l *annexOpLimiter) RemoveDenied() bool {
+	return l.removeDenied.Load()
+}
+
+// Keys returns the keys the session put or removed content of, if trackKeys is set
+func (l *annexOpLimiter) Keys() []string {
+	l.keysMu.Lock()
+	defer l.keysMu.Unlock()
+	return append([]string(nil), l.keys...)
+}
+
+// PutDenied returns why the session was cancelled when it tried to put content which may not be stored
+func (l *annexOpLimiter) PutDenied() string {
+	msg, _ := l.putDenied.Load().(string)
+	return msg
+}
+
+// GetDenied returns why the session was cancelled when it tried to get content
+func (l *annexOpLimiter) GetDenied() string {
+	msg, _ := l.getDenied.Load().(string)
+	return msg
+}
+
+// Exceeded returns true if the session was cancelled because it started too many operations
+func (l *annexOpLimiter) Exceeded() bool {
+	return l.exceeded.Load()
+}
+
+// failure returns the error telling the client why l cancelled the session which failed with err, or nil if it didn't
+func (l *annexOpLimiter) failure(ctx context.Context, err error) error {
+	switch {
+	case l.RemoveDenied():
+		return fail(ctx, protectedDropMessage, "git-annex P2P session tried to remove content without administrator access: %v", err)
+	case l.PutDenied() != "":
+		return fail(ctx, l.PutDenied(), "git-annex P2P session tried to store content which isn't allowed: %s: %v", l.PutDenied(), err)
+	case l.GetDenied() != "":
+		return fail(ctx, l.GetDenied(), "git-annex P2P session failed to get content: %s: %v", l.GetDenied(), err)
+	case l.Exceeded():
+		return fail(ctx, fmt.Sprintf("Too many git-annex operations in one session, the limit is %d", l.max), "git-annex P2P session exceeded %d operations: %v", l.max, err)
+	}
+	return nil
+}
+
+// pushGuard reads the ref update commands a git-receive-pack client sends from r,
+// and if one of them is not allowed it cancels the push and stops reading before the command reaches git.
+// The commands are the pkt-lines before the first flush, so the pack data isn't inspected.
+type pushGuard struct {
+	r                  io.Reader
+	defaultBranch      string                         // the full ref name of the default branch if it may not be pushed to
+	protectAnnexBranch bool                           // whether the git-annex branch may not be deleted
+	branchRules        git_model.ProtectedBranchRules // branches whose rule requires status checks may not be pushed to
+	denyBranchCreation bool                           // whether new branches may not be created
+	cancel             context.CancelFunc
+
+	buf     []byte
+	done    bool
+	reason  string
+	blocked atomic.Bool
+}
+
+// newPushGuard returns the guard of a push to the repository, or nil if any ref update is allowed.
+// newCancel is only called if there is a guard, it returns the function stopping the push.
+func newPushGuard(results *private.ServCommandResults, newCancel func() context.CancelFunc) *pushGuard {
+	protectAnnexBranch := setting.Annex.Enabled && setting.Annex.ProtectMetadataBranch
+	if results.ProtectedDefaultBranch == "" && !protectAnnexBranch && len(results.BranchRules) == 0 && !results.DenyBranchCreation {
+		return nil
+	}
+	g := &pushGuard{protectAnnexBranch: protectAnnexBranch, branchRules: servBranchRules(results.BranchRules), denyBranchCreation: results.DenyBranchCreation, cancel: newCancel()}
+	if results.ProtectedDefaultBranch != "" {
+		g.defaultBranch = git.BranchPrefix + results.ProtectedDefaultBranch
+	}
+	return g
+}
+
+func (g *pushGuard) Read(p []byte) (int, error) {
+	if g.blocked.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := g.r.Read(p)
+	if n > 0 && !g.done {
+		if reason := g.parse(p[:n]); reason != "" {
+			g.reason = reason
+			g.blocked.Store(true)
+			g.cancel()
+			return 0, io.ErrClosedPipe
+		}
+	}
+	return n, err
+}
+
+// parse checks the complete commands in b, returning why the push is rejected if one of them is not allowed
+func (g *pushGuard) parse(b []byte) string {
+	g.buf = append(g.buf, b...)
+	for len(g.buf) >= 4 {
+		length, err := strconv.ParseUint(string(g.buf[:4]), 16, 16)
+		if err != nil || length == 0 {
+			// the end of the commands, or not a pkt-line stream at all
+			g.done = true
+			break
+		}
+		if length < 4 {
+			g.buf = g.buf[4:]
+			continue
+		}
+		if uint64(len(g.buf)) < length {
+			break
+		}
+		// "<old-oid> <new-oid> <ref>", the first command also carries the capabilities after a NUL
+		line, _, _ := bytes.Cut(g.buf[4:length], []byte{0})
+		if fields := strings.Fields(string(line)); len(fields) == 3 {
+			if g.defaultBranch != "" && fields[2] == g.defaultBranch {
+				return fmt.Sprintf("Pushing to the default branch %q is not allowed, please open a pull request instead", strings.TrimPrefix(g.defaultBranch, git.BranchPrefix))
+			}
+			if strings.HasPrefix(fields[2], git.BranchPrefix) {
+				branch := strings.TrimPrefix(fields[2], git.BranchPrefix)
+				if g.denyBranchCreation && strings.Trim(fields[0], "0") == "" {
+					return fmt.Sprintf("Creating the branch %q is not allowed, only the administrators of the repository may create branches", branch)
+				}
+				if rule := g.branchRules.GetFirstMatched(branch); rule != nil && rule.EnableStatusCheck {
+					return fmt.Sprintf("Branch %q requires status checks to pass before changes are merged, please push to another branch and open a pull request instead", branch)
+				}
+			}
+			if g.protectAnnexBranch && fields[2] == annex.BranchRefName && strings.Trim(fields[1], "0") == "" {
+				return "Deleting the git-annex branch is not allowed, it holds the git-annex metadata of the repository"
+			}
+		}
+		g.buf = g.buf[length:]
+	}
+	if g.done {
+		g.buf = nil
+	}
+	return ""
+}
+
+// Blocked returns why the push was cancelled, or an empty string if it wasn't
+func (g *pushGuard) Blocked() string {
+	if !g.blocked.Load() {
+		return ""
+	}
+	return g.reason
+}
+
+// servBranchRules returns the branch protection rules serv got from ServCommand as rules which can be matched
+func servBranchRules(rules []private.ServBranchRule) git_model.ProtectedBranchRules {
+	if len(rules) == 0 {
+		return nil
+	}
+	protectedBranchRules := make(git_model.ProtectedBranchRules, 0, len(rules))
+	for _, rule := range rules {
+		protectedBranchRules = append(protectedBranchRules, &git_model.ProtectedBranch{RuleName: rule.RuleName, EnableStatusCheck: rule.RequireStatusCheck})
+	}
+	return protectedBranchRules
+}
+
+// notifyHold cancels a git-annex "notifychanges" command once it has been held open for timeout
+type notifyHold struct {
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newNotifyHold(timeout time.Duration, cancel context.CancelFunc) *notifyHold {
+	h := &notifyHold{timeout: timeout}
+	h.timer = time.AfterFunc(timeout, func() {
+		h.expired.Store(true)
+		cancel()
+	})
+	return h
+}
+
+// Stop stops the timer if the command finished on its own
+func (h *notifyHold) Stop() {
+	h.timer.Stop()
+}
+
+// Expired returns true if the command was cancelled because it was held open for timeout
+func (h *notifyHold) Expired() bool {
+	return h.expired.Load()
+}
+
+// idleWatcher cancels a command once nothing has been read from or written to the client for timeout
+type idleWatcher struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	last atomic.Int64
+	idle atomic.Bool
+}
+
+func newIdleWatcher(timeout time.Duration, cancel context.CancelFunc) *idleWatcher {
+	w := &idleWatcher{timeout: timeout, cancel: cancel}
+	w.Touch()
+	return w
+}
+
+// Touch records activity on the connection
+func (w *idleWatcher) Touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// Watch checks for inactivity until ctx is done, cancelling the command if the connection went idle
+func (w *idleWatcher) Watch(ctx context.Context) {
+	interval := w.timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, w.last.Load())) >= w.timeout {
+				w.idle.Store(true)
+				w.cancel()
+				return
+			}
+		}
+	}
+}
+
+// Idle returns true if the command was cancelled because the connection went idle
+func (w *idleWatcher) Idle() bool {
+	return w.idle.Load()
+}
+
+// idleReader records reads from r as activity
+type idleReader struct {
+	r    io.Reader
+	idle *idleWatcher
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if n > 0 {
+		i.idle.Touch()
+	}
+	return n, err
+}
+
+// idleWriter records writes to w as activity
+type idleWriter struct {
+	w    io.Writer
+	idle *idleWatcher
+}
+
+func (i *idleWriter) Write(p []byte) (int, error) {
+	n, err := i.w.Write(p)
+	if n > 0 {
+		i.idle.Touch()
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read from r into n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to w into n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,2643 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"text/template"
+	"time"
+
+	asymkey_model "code.gitea.io/gitea/models/asymkey"
+	"code.gitea.io/gitea/models/perm"
+	repo_model "code.gitea.io/gitea/models/repo"
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/json"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+	ssh_module "code.gitea.io/gitea/modules/ssh"
+	"code.gitea.io/gitea/modules/test"
+	"code.gitea.io/gitea/modules/util"
+	"code.gitea.io/gitea/services/lfs"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+// captureStderr returns everything written to os.Stderr while f runs
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	oldStderr := os.Stderr
+	os.Stderr = w
+	defer func() {
+		os.Stderr = oldStderr
+	}()
+
+	f()
+
+	assert.NoError(t, w.Close())
+	out, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(out)
+}
+
+// mockInternalAPI points the internal API client at a test server served by handler
+func mockInternalAPI(handler http.HandlerFunc) func() {
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("{}"))
+		}
+	}
+	srv := httptest.NewServer(handler)
+	oldLocalURL, oldInternalToken := setting.LocalURL, setting.InternalToken
+	setting.LocalURL = srv.URL + "/"
+	setting.InternalToken = "internal-token"
+	return func() {
+		setting.LocalURL, setting.InternalToken = oldLocalURL, oldInternalToken
+		srv.Close()
+	}
+}
+
+func TestRunServCommandTimeout(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	oldCommandTimeout := setting.SSH.CommandTimeout
+	setting.SSH.CommandTimeout = 100 * time.Millisecond
+	defer func() {
+		setting.SSH.CommandTimeout = oldCommandTimeout
+	}()
+
+	ctx := context.Background()
+	cmdCtx, cancel := context.WithTimeout(ctx, setting.SSH.CommandTimeout)
+	defer cancel()
+
+	var err error
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{commandTimeout: setting.SSH.CommandTimeout})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Operation timed out after 100ms")
+
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, ctx, exec.CommandContext(ctx, "false"), &servGuards{})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Failed to execute git command")
+	assert.NotContains(t, stderr, "timed out")
+}
+
+func TestNewServGuards(t *testing.T) {
+	oldIdleTimeout, oldMaxSessionDuration, oldCommandTimeout := setting.SSH.IdleTimeout, setting.SSH.MaxSessionDuration, setting.SSH.CommandTimeout
+	oldAnnex := setting.Annex
+	defer func() {
+		setting.SSH.IdleTimeout, setting.SSH.MaxSessionDuration, setting.SSH.CommandTimeout = oldIdleTimeout, oldMaxSessionDuration, oldCommandTimeout
+		setting.Annex = oldAnnex
+	}()
+	setting.SSH.IdleTimeout = 0
+	setting.SSH.MaxSessionDuration = 0
+	setting.SSH.CommandTimeout = 0
+	setting.Annex.MaxOpsPerSession = 0
+	setting.Annex.NotifyChangesTimeout = 0
+	setting.Annex.ProtectMetadataBranch = false
+	ctx := context.Background()
+	sessionStart := time.Now()
+	admin := &private.ServCommandResults{RepoAdmin: true}
+
+	// without limits the command runs with the context of serv
+	cmdCtx, guards, stop := newServGuards(ctx, sessionStart, &servRequest{verb: "git-upload-pack"}, admin)
+	assert.Equal(t, ctx, cmdCtx)
+	assert.Equal(t, &servGuards{}, guards)
+	stop()
+
+	// only the guards of the command are set up
+	setting.SSH.IdleTimeout = time.Minute
+	setting.SSH.MaxSessionDuration = time.Hour
+	setting.SSH.CommandTimeout = time.Minute
+	setting.Annex.MaxOpsPerSession = 10
+	setting.Annex.NotifyChangesTimeout = time.Minute
+	cmdCtx, guards, stop = newServGuards(ctx, sessionStart, &servRequest{verb: "git-upload-pack"}, admin)
+	assert.NotNil(t, guards.idle)
+	assert.Nil(t, guards.opLimiter)
+	assert.Nil(t, guards.hold)
+	assert.Nil(t, guards.branchGuard)
+	assert.Equal(t, time.Minute, guards.commandTimeout)
+	assert.Equal(t, sessionStart.Add(time.Hour), guards.sessionDeadline)
+	deadline, ok := cmdCtx.Deadline()
+	assert.True(t, ok)
+	assert.False(t, deadline.After(sessionStart.Add(time.Hour)))
+	stop()
+	assert.Error(t, cmdCtx.Err())
+
+	_, guards, stop = newServGuards(ctx, sessionStart, &servRequest{verb: gitAnnexShellVerb, annexVerb: "p2pstdio"}, admin)
+	if assert.NotNil(t, guards.opLimiter) {
+		assert.EqualValues(t, 10, guards.opLimiter.max)
+		assert.False(t, guards.opLimiter.denyRemove)
+	}
+	stop()
+
+	_, guards, stop = newServGuards(ctx, sessionStart, &servRequest{verb: gitAnnexShellVerb, annexVerb: "notifychanges"}, admin)
+	assert.NotNil(t, guards.hold)
+	stop()
+	assert.False(t, guards.hold.Expired())
+
+	// pushes are only guarded if a ref update may be refused
+	_, guards, stop = newServGuards(ctx, sessionStart, &servRequest{verb: "git-receive-pack"}, admin)
+	assert.Nil(t, guards.branchGuard)
+	stop()
+	_, guards, stop = newServGuards(ctx, sessionStart, &servRequest{verb: "git-receive-pack"}, &private.ServCommandResults{ProtectedDefaultBranch: "main"})
+	if assert.NotNil(t, guards.branchGuard) {
+		assert.Equal(t, "refs/heads/main", guards.branchGuard.defaultBranch)
+	}
+	stop()
+}
+
+func TestServCommandTimeout(t *testing.T) {
+	oldCommandTimeout := setting.SSH.CommandTimeout
+	setting.SSH.CommandTimeout = time.Minute
+	defer func() {
+		setting.SSH.CommandTimeout = oldCommandTimeout
+	}()
+
+	// the timeout of the repository takes precedence over the global one, even if it is longer or disables it
+	assert.Equal(t, time.Minute, servCommandTimeout(&private.ServCommandResults{}))
+	for _, timeout := range []time.Duration{6 * time.Hour, time.Second, 0} {
+		timeout := timeout
+		assert.Equal(t, timeout, servCommandTimeout(&private.ServCommandResults{CommandTimeout: &timeout}))
+	}
+
+	setting.SSH.CommandTimeout = 0
+	longer := time.Hour
+	assert.Equal(t, time.Duration(0), servCommandTimeout(&private.ServCommandResults{}))
+	assert.Equal(t, time.Hour, servCommandTimeout(&private.ServCommandResults{CommandTimeout: &longer}))
+
+	// the client is told about the timeout that applied
+	defer mockInternalAPI(nil)()
+	ctx := context.Background()
+	shorter := 100 * time.Millisecond
+	commandTimeout := servCommandTimeout(&private.ServCommandResults{CommandTimeout: &shorter})
+	cmdCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	var err error
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{commandTimeout: commandTimeout})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Operation timed out after 100ms")
+}
+
+func TestRunServCommandMaxSessionDuration(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	oldMaxSessionDuration, oldCommandTimeout := setting.SSH.MaxSessionDuration, setting.SSH.CommandTimeout
+	setting.SSH.MaxSessionDuration, setting.SSH.CommandTimeout = 300*time.Millisecond, time.Minute
+	defer func() {
+		setting.SSH.MaxSessionDuration, setting.SSH.CommandTimeout = oldMaxSessionDuration, oldCommandTimeout
+	}()
+
+	// the session started before the command, so the command gets what is left of the session
+	ctx := context.Background()
+	sessionDeadline := time.Now().Add(setting.SSH.MaxSessionDuration - 100*time.Millisecond)
+	cmdCtx, cancel := context.WithDeadline(ctx, sessionDeadline)
+	defer cancel()
+	cmdCtx, cancelCommand := context.WithTimeout(cmdCtx, setting.SSH.CommandTimeout)
+	defer cancelCommand()
+
+	// an active transfer is terminated at the cap too
+	gitcmd := exec.CommandContext(cmdCtx, "yes")
+	gitcmd.Stdout = io.Discard
+	start := time.Now()
+	var err error
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, gitcmd, &servGuards{commandTimeout: setting.SSH.CommandTimeout, sessionDeadline: sessionDeadline})
+	})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, stderr, "Gitea: Session exceeded the maximum duration of 300ms and was terminated")
+	assert.NotContains(t, stderr, "Operation timed out")
+
+	// the command timeout is still reported as such while the session may go on
+	cmdCtx, cancelCommand = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelCommand()
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{commandTimeout: setting.SSH.CommandTimeout, sessionDeadline: time.Now().Add(time.Minute)})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Operation timed out after 1m0s")
+}
+
+func TestRunServCommandLogsStderr(t *testing.T) {
+	var logged []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/internal/ssh/log" {
+			var opt private.SSHLogOption
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&opt))
+			logged = append(logged, opt.Message)
+		}
+		_, _ = w.Write([]byte("{}"))
+	})()
+
+	ctx := context.Background()
+	var err error
+	stderr := captureStderr(t, func() {
+		gitcmd := exec.CommandContext(ctx, "sh", "-c", "echo 'fatal: not a git repository' >&2; exit 128")
+		gitcmd.Stderr = os.Stderr
+		err = runServCommand(ctx, ctx, gitcmd, &servGuards{})
+	})
+	assert.Error(t, err)
+	// the client still sees the stderr of the command unchanged
+	assert.True(t, strings.HasPrefix(stderr, "fatal: not a git repository\n"), stderr)
+	assert.Contains(t, stderr, "Gitea: Failed to execute git command")
+	if assert.Len(t, logged, 2) {
+		assert.Contains(t, logged[0], "Failed to execute git command: exit status 128")
+		assert.Equal(t, "sh failed with: fatal: not a git repository", logged[1])
+	}
+
+	// failures of git-annex-shell name the git-annex operation
+	logged = nil
+	annexShell := filepath.Join(t.TempDir(), gitAnnexShellVerb)
+	assert.NoError(t, os.WriteFile(annexShell, []byte("#!/bin/sh\necho 'git-annex-shell: key not present' >&2\nexit 1\n"), 0o755))
+	stderr = captureStderr(t, func() {
+		gitcmd := exec.CommandContext(ctx, annexShell, annexArgs([]string{gitAnnexShellVerb, "sendkey", "/user2/repo1.git", "SHA256E-s1--abc"}, "/repos/user2/repo1.git")...)
+		err = runServCommand(ctx, ctx, gitcmd, &servGuards{})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Failed to execute git-annex operation: sendkey")
+	assert.NotContains(t, stderr, "Failed to execute git command")
+	if assert.Len(t, logged, 2) {
+		assert.Contains(t, logged[0], "Failed to execute git-annex operation: sendkey: exit status 1")
+		assert.Equal(t, "git-annex-shell failed with: git-annex-shell: key not present", logged[1])
+	}
+
+	// only the end of long output is kept
+	tail := &tailWriter{max: 8}
+	_, _ = tail.Write([]byte("0123456789"))
+	_, _ = tail.Write([]byte("abc"))
+	assert.Equal(t, "56789abc", tail.String())
+}
+
+func TestSSHServerMechanism(t *testing.T) {
+	t.Setenv(ssh_module.EnvBuiltinServer, "")
+	assert.Equal(t, "external sshd (authorized_keys)", sshServerMechanism())
+
+	t.Setenv(ssh_module.EnvBuiltinServer, "true")
+	assert.Equal(t, "builtin SSH server", sshServerMechanism())
+}
+
+func TestFailAuth(t *testing.T) {
+	var logged private.SSHLogOption
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/internal/ssh/log" {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&logged))
+		}
+		_, _ = w.Write([]byte("{}"))
+	})()
+	t.Setenv("SSH_CONNECTION", "198.51.100.23 50022 192.0.2.1 22")
+
+	captureStderr(t, func() {
+		assert.Error(t, failAuth(context.Background(), 12, "not authorized", ""))
+	})
+	assert.True(t, logged.IsError)
+	assert.Equal(t, "Failed authentication attempt for key-12 from 198.51.100.23", logged.Message)
+
+	// the line is matched by the filter of the fail2ban setup documentation
+	failRegex := regexp.MustCompile(`.*(Failed authentication attempt|invalid credentials|Attempted access of unknown user).* from (\S+)`)
+	matches := failRegex.FindStringSubmatch("2023/05/01 12:00:00 ...ivate/ssh_log.go:28:SSHLog() [E] ssh: " + logged.Message)
+	if assert.Len(t, matches, 3) {
+		assert.Equal(t, "198.51.100.23", matches[2])
+	}
+
+	assert.Equal(t, "Failed authentication attempt for key-12 from unknown", authFailureLogLine(12, ""))
+}
+
+func TestClientIPMessage(t *testing.T) {
+	oldAllowedClientIPs := setting.SSH.AllowedClientIPs
+	oldDeniedClientIPs := setting.SSH.DeniedClientIPs
+	defer func() {
+		setting.SSH.AllowedClientIPs = oldAllowedClientIPs
+		setting.SSH.DeniedClientIPs = oldDeniedClientIPs
+	}()
+
+	// no restrictions
+	setting.SSH.AllowedClientIPs = ""
+	setting.SSH.DeniedClientIPs = ""
+	assert.Empty(t, clientIPMessage("203.0.113.7"))
+	assert.Empty(t, clientIPMessage(""))
+
+	setting.SSH.AllowedClientIPs = "10.0.0.0/8, 2001:db8::/32"
+	setting.SSH.DeniedClientIPs = "10.66.0.0/16"
+	assert.Empty(t, clientIPMessage("10.1.2.3"))
+	assert.Empty(t, clientIPMessage("2001:db8::1"))
+	assert.Equal(t, "Access from 10.66.1.2 is not allowed", clientIPMessage("10.66.1.2"))
+	assert.Equal(t, "Access from 203.0.113.7 is not allowed", clientIPMessage("203.0.113.7"))
+	assert.Equal(t, "Unable to determine your IP address, access denied", clientIPMessage(""))
+	assert.Equal(t, "Unable to determine your IP address, access denied", clientIPMessage("not-an-ip"))
+
+	// only a denylist
+	setting.SSH.AllowedClientIPs = ""
+	assert.Empty(t, clientIPMessage("203.0.113.7"))
+	assert.Equal(t, "Access from 10.66.1.2 is not allowed", clientIPMessage("10.66.1.2"))
+}
+
+func TestNoCommandBanner(t *testing.T) {
+	oldMinimalBanner := setting.SSH.MinimalBanner
+	defer func() {
+		setting.SSH.MinimalBanner = oldMinimalBanner
+	}()
+
+	user := &user_model.User{Name: "user2"}
+	userKey := &asymkey_model.PublicKey{Type: asymkey_model.KeyTypeUser, Name: "laptop"}
+	deployKey := &asymkey_model.PublicKey{Type: asymkey_model.KeyTypeDeploy, Name: "ci"}
+	principal := &asymkey_model.PublicKey{Type: asymkey_model.KeyTypePrincipal, Content: "user2@example.com"}
+
+	setting.SSH.MinimalBanner = false
+	assert.Equal(t, "Hi there, user2! You've successfully authenticated with the key named laptop, but Gitea does not provide shell access.\n"+
+		"If this is unexpected, please log in with password and setup Gitea under another user.", noCommandBanner(userKey, user, ""))
+	assert.Contains(t, noCommandBanner(deployKey, user, ""), "with the deploy key named ci,")
+	assert.NotContains(t, noCommandBanner(deployKey, user, ""), "git clone")
+	assert.Contains(t, noCommandBanner(principal, user, ""), "with the principal user2@example.com,")
+
+	// a deploy key bound to a single repository is told how to clone it
+	assert.Equal(t, "Hi there! You've successfully authenticated with the deploy key named ci, but Gitea does not provide shell access.\n"+
+		"The key can be used to clone the repository it is bound to: git clone ssh://git@example.com:2222/user2/repo1.git\n"+
+		"If this is unexpected, please log in with password and setup Gitea under another user.", noCommandBanner(deployKey, user, "ssh://git@example.com:2222/user2/repo1.git"))
+
+	setting.SSH.MinimalBanner = true
+	for _, key := range []*asymkey_model.PublicKey{userKey, deployKey, principal} {
+		banner := noCommandBanner(key, user, "ssh://git@example.com:2222/user2/repo1.git")
+		assert.Equal(t, "Hi there! You've successfully authenticated, but Gitea does not provide shell access.", banner)
+		assert.NotContains(t, banner, "user2")
+	}
+}
+
+func TestDisabledVerbMessage(t *testing.T) {
+	oldAllowUploadArchive := setting.Git.AllowUploadArchive
+	defer func() {
+		setting.Git.AllowUploadArchive = oldAllowUploadArchive
+	}()
+
+	setting.Git.AllowUploadArchive = true
+	assert.Empty(t, disabledVerbMessage("git-upload-archive"))
+	assert.Empty(t, disabledVerbMessage("git-upload-pack"))
+
+	setting.Git.AllowUploadArchive = false
+	assert.Equal(t, "Remote archive access (git-upload-archive) is disabled", disabledVerbMessage("git-upload-archive"))
+	assert.Empty(t, disabledVerbMessage("git-upload-pack"))
+	assert.Empty(t, disabledVerbMessage("git-receive-pack"))
+}
+
+func TestDisabledVerbMessageLFSAndAnnex(t *testing.T) {
+	oldStartServer, oldAnnexEnabled := setting.LFS.StartServer, setting.Annex.Enabled
+	defer func() {
+		setting.LFS.StartServer, setting.Annex.Enabled = oldStartServer, oldAnnexEnabled
+	}()
+
+	for _, c := range []struct {
+		lfs, annex bool
+	}{
+		{lfs: true, annex: true},
+		{lfs: true, annex: false},
+		{lfs: false, annex: true},
+		{lfs: false, annex: false},
+	} {
+		setting.LFS.StartServer, setting.Annex.Enabled = c.lfs, c.annex
+		name := fmt.Sprintf("lfs=%t annex=%t", c.lfs, c.annex)
+
+		if c.lfs {
+			assert.Empty(t, disabledVerbMessage(lfsAuthenticateVerb), name)
+		} else {
+			assert.Equal(t, "Git LFS is disabled on this server", disabledVerbMessage(lfsAuthenticateVerb), name)
+		}
+		if c.annex {
+			assert.Empty(t, disabledVerbMessage(gitAnnexShellVerb), name)
+		} else {
+			assert.Equal(t, "git-annex is disabled on this server", disabledVerbMessage(gitAnnexShellVerb), name)
+		}
+		for _, verb := range []string{"git-upload-pack", "git-receive-pack"} {
+			assert.Empty(t, disabledVerbMessage(verb), name)
+		}
+
+		// only clones of repositories with LFS objects warn about LFS being off, git-annex doesn't matter
+		results := &private.ServCommandResults{LFSUnavailable: !c.lfs}
+		assert.Equal(t, !c.lfs, lfsUnavailableWarning("git-upload-pack", results) != "", name)
+		assert.Empty(t, lfsUnavailableWarning(gitAnnexShellVerb, results), name)
+	}
+}
+
+func TestServCommandUserMsg(t *testing.T) {
+	oldDiscloseRepoExistence := setting.Service.DiscloseRepoExistence
+	defer func() {
+		setting.Service.DiscloseRepoExistence = oldDiscloseRepoExistence
+	}()
+
+	denied := private.ResponseExtra{StatusCode: http.StatusUnauthorized, UserMsg: "User: 2:user2 with Key: 1:key is not authorized to write user15/big_test_private_1."}
+	notFound := private.ResponseExtra{StatusCode: http.StatusNotFound, UserMsg: "Cannot find repository: user15/missing"}
+	broken := private.ResponseExtra{StatusCode: http.StatusInternalServerError, UserMsg: "Internal Server Error"}
+	pendingDeletion := private.ResponseExtra{StatusCode: http.StatusGone, UserMsg: "Repository is scheduled for deletion"}
+
+	setting.Service.DiscloseRepoExistence = true
+	assert.Equal(t, denied.UserMsg, servCommandUserMsg(denied, "user15", "big_test_private_1"))
+	assert.Equal(t, notFound.UserMsg, servCommandUserMsg(notFound, "user15", "missing"))
+	assert.Equal(t, broken.UserMsg, servCommandUserMsg(broken, "user15", "big_test_private_1"))
+	assert.Equal(t, pendingDeletion.UserMsg, servCommandUserMsg(pendingDeletion, "user15", "big_test_private_1"))
+
+	setting.Service.DiscloseRepoExistence = false
+	assert.Equal(t, "Cannot find repository: user15/big_test_private_1", servCommandUserMsg(denied, "user15", "big_test_private_1"))
+	assert.Equal(t, "Cannot find repository: user15/missing", servCommandUserMsg(notFound, "user15", "missing"))
+	assert.Equal(t, broken.UserMsg, servCommandUserMsg(broken, "user15", "big_test_private_1"))
+	assert.Equal(t, pendingDeletion.UserMsg, servCommandUserMsg(pendingDeletion, "user15", "big_test_private_1"))
+}
+
+func TestDenialMessage(t *testing.T) {
+	oldMessages := setting.SSH.Messages
+	defer func() {
+		setting.SSH.Messages = oldMessages
+	}()
+	setting.SSH.Messages = map[string]*template.Template{
+		private.DenialArchived:    template.Must(template.New("").Parse("{{.Owner}}/{{.Repo}} has been archived, ask the owner to unarchive it")),
+		private.DenialReadOnly:    template.Must(template.New("").Parse("{{.Owner}}/{{.Repo}} is a mirror, push to its origin instead")),
+		private.DenialQuota:       template.Must(template.New("").Parse("{{.Owner}}/{{.Repo}} is full: {{.Message}}")),
+		private.DenialRateLimit:   template.Must(template.New("").Parse("Slow down, {{.User}}")),
+		private.DenialDeactivated: template.Must(template.New("").Parse("Your account has been deactivated, contact support")),
+	}
+	data := servMessageData{Owner: "user2", Repo: "repo1", User: "user2", Message: "default message"}
+
+	for reason, msg := range map[string]string{
+		private.DenialArchived:    "user2/repo1 has been archived, ask the owner to unarchive it",
+		private.DenialReadOnly:    "user2/repo1 is a mirror, push to its origin instead",
+		private.DenialQuota:       "user2/repo1 is full: default message",
+		private.DenialRateLimit:   "Slow down, user2",
+		private.DenialDeactivated: "Your account has been deactivated, contact support",
+	} {
+		assert.Equal(t, msg, denialMessage(reason, data), reason)
+	}
+
+	// reasons without a configured message keep the default one
+	assert.Equal(t, "default message", denialMessage("", data))
+	assert.Equal(t, "default message", denialMessage("unknown", data))
+	setting.SSH.Messages = map[string]*template.Template{}
+	assert.Equal(t, "default message", denialMessage(private.DenialArchived, data))
+
+	// a template failing to render falls back to the default message
+	setting.SSH.Messages = map[string]*template.Template{
+		private.DenialArchived: template.Must(template.New("").Parse("{{.Missing}}")),
+	}
+	assert.Equal(t, "default message", denialMessage(private.DenialArchived, data))
+}
+
+func TestLocalizeDenial(t *testing.T) {
+	oldCustomPath, oldLangs, oldNames := setting.CustomPath, setting.Langs, setting.Names
+	defer func() {
+		setting.CustomPath, setting.Langs, setting.Names = oldCustomPath, oldLangs, oldNames
+		servLocalesOnce = sync.Once{}
+	}()
+	setting.CustomPath = t.TempDir()
+	setting.Langs = []string{"en-US", "de-DE"}
+	setting.Names = []string{"English", "Deutsch"}
+	servLocalesOnce = sync.Once{}
+
+	localeDir := filepath.Join(setting.CustomPath, "options", "locale")
+	assert.NoError(t, os.MkdirAll(localeDir, os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(localeDir, "locale_de-DE.ini"), []byte(`[ssh]
+denial.deactivated = Dein Konto ist deaktiviert.
+denial.archived = Das Repository %s/%s ist archiviert.
+`), 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	args := []string{"user2", "repo1"}
+
+	assert.Equal(t, "Dein Konto ist deaktiviert.", localizeDenial(ctx, private.DenialDeactivated, "de-DE", nil, "fallback"))
+	assert.Equal(t, "Das Repository user2/repo1 ist archiviert.", localizeDenial(ctx, private.DenialArchived, "de-DE", args, "fallback"))
+	assert.Equal(t, "Mirror Repository user2/repo1 is read-only", localizeDenial(ctx, private.DenialReadOnly, "de-DE", args, "fallback"))
+
+	// unknown users and languages get the default language
+	assert.Equal(t, "Repo: user2/repo1 is archived.", localizeDenial(ctx, private.DenialArchived, "", args, "fallback"))
+	assert.Equal(t, "Repo: user2/repo1 is archived.", localizeDenial(ctx, private.DenialArchived, "xx-XX", args, "fallback"))
+
+	// denials without a translation keep their message
+	assert.Equal(t, "fallback", localizeDenial(ctx, "", "de-DE", nil, "fallback"))
+	assert.Equal(t, "fallback", localizeDenial(ctx, "unknown", "de-DE", nil, "fallback"))
+}
+
+func TestAnnexProbeUserMsg(t *testing.T) {
+	oldDiscloseRepoExistence := setting.Service.DiscloseRepoExistence
+	defer func() {
+		setting.Service.DiscloseRepoExistence = oldDiscloseRepoExistence
+	}()
+
+	denied := private.ResponseExtra{StatusCode: http.StatusUnauthorized, UserMsg: "User: 2:user2 with Key: 1:key is not authorized to read user15/big_test_private_1."}
+	notFound := private.ResponseExtra{StatusCode: http.StatusNotFound, UserMsg: "Cannot find repository: user15/missing"}
+	broken := private.ResponseExtra{StatusCode: http.StatusInternalServerError, UserMsg: "Internal Server Error"}
+
+	// unauthorized and missing repositories get the same message, whether or not existence may be disclosed
+	for _, disclose := range []bool{true, false} {
+		setting.Service.DiscloseRepoExistence = disclose
+		assert.Equal(t, "Access denied: user15/big_test_private_1 does not exist or your SSH key has no read access to it, so git-annex cannot use it as a remote", annexProbeUserMsg(denied, "user15", "big_test_private_1"))
+		assert.Equal(t, "Access denied: user15/missing does not exist or your SSH key has no read access to it, so git-annex cannot use it as a remote", annexProbeUserMsg(notFound, "user15", "missing"))
+		assert.Equal(t, broken.UserMsg, annexProbeUserMsg(broken, "user15", "big_test_private_1"))
+	}
+
+	// the probe only needs read access
+	assert.Equal(t, perm.AccessModeRead, annexCommands[annexConfiglistVerb])
+}
+
+func TestUnverifiedEmailMessage(t *testing.T) {
+	oldRequireVerifiedEmail := setting.Service.RequireVerifiedEmail
+	oldAppURL := setting.AppURL
+	defer func() {
+		setting.Service.RequireVerifiedEmail = oldRequireVerifiedEmail
+		setting.AppURL = oldAppURL
+	}()
+	setting.AppURL = "https://try.gitea.io/"
+
+	verified := &private.ServCommandResults{UserName: "user2", UserID: 2, UserEmailVerified: true}
+	unverified := &private.ServCommandResults{UserName: "user11", UserID: 11}
+	deployKey := &private.ServCommandResults{UserName: "user11", UserID: 11, DeployKeyID: 1}
+	principal := &private.ServCommandResults{UserName: "user11", UserID: 11, IsPrincipal: true}
+
+	setting.Service.RequireVerifiedEmail = false
+	assert.Empty(t, unverifiedEmailMessage(verified))
+	assert.Empty(t, unverifiedEmailMessage(unverified))
+
+	setting.Service.RequireVerifiedEmail = true
+	assert.Empty(t, unverifiedEmailMessage(verified))
+	assert.Equal(t, "Your email address has not been verified, please verify it at https://try.gitea.io/user/settings/account before using git over SSH", unverifiedEmailMessage(unverified))
+	assert.Empty(t, unverifiedEmailMessage(deployKey))
+	assert.Empty(t, unverifiedEmailMessage(principal))
+}
+
+func TestParseRepoPath(t *testing.T) {
+	kases := []struct {
+		repoPath string
+		owner    string
+		repo     string
+		userMsg  string
+	}{
+		{repoPath: "user/repo.git", owner: "user", repo: "repo"},
+		{repoPath: "User/Repo", owner: "user", repo: "repo"},
+		{repoPath: "  user/repo.git", owner: "user", repo: "repo"},
+		{repoPath: "user/repo.git  ", owner: "user", repo: "repo"},
+		{repoPath: " user /repo.git", owner: "user", repo: "repo"},
+		{repoPath: "user/ repo .git", owner: "user", repo: "repo"},
+		{repoPath: "user/\trepo.git\n", owner: "user", repo: "repo"},
+		{repoPath: "us er/repo.git", userMsg: "Invalid repository path, the owner name must not contain whitespace"},
+		{repoPath: "user/re po.git", userMsg: "Invalid repository path, the repository name must not contain whitespace"},
+		{repoPath: "user/re\tpo.git", userMsg: "Invalid repository path, the repository name must not contain whitespace"},
+		{repoPath: " /repo.git", userMsg: "Invalid repository path"},
+		{repoPath: "user/ ", userMsg: "Invalid repository path"},
+		{repoPath: "user/repo/extra.git", userMsg: "Invalid repo name"},
+		{repoPath: "myrepo.git", userMsg: "Invalid repository path, the owner is missing. Please use the form <owner>/myrepo.git"},
+		{repoPath: "", userMsg: "Invalid repository path"},
+	}
+	for _, kase := range kases {
+		t.Run(kase.repoPath, func(t *testing.T) {
+			owner, repo, userMsg := parseRepoPath(kase.repoPath)
+			assert.Equal(t, kase.userMsg, userMsg)
+			assert.Equal(t, kase.owner, owner)
+			assert.Equal(t, kase.repo, repo)
+		})
+	}
+}
+
+func TestNormalizeGogsRepoPath(t *testing.T) {
+	for repoPath, expected := range map[string]string{
+		"user/repo.git":                             "user/repo.git",
+		"~/user/repo.git":                           "user/repo.git",
+		"/~/user/repo.git":                          "user/repo.git",
+		"gogs-repositories/user/repo.git":           "user/repo.git",
+		"~/gogs-repositories/user/repo.git":         "user/repo.git",
+		"/home/git/gogs-repositories/user/repo.git": "user/repo.git",
+		"home/git/gogs-repositories/user/repo.git/": "user/repo.git",
+		"user/repo.git/":                            "user/repo.git",
+		"user/repo.wiki.git":                        "user/repo.wiki.git",
+		"gogs-repositories/repo.git":                "repo.git",
+		"user/gogs-repositories.git":                "user/gogs-repositories.git",
+	} {
+		assert.Equal(t, expected, normalizeGogsRepoPath(repoPath), repoPath)
+	}
+
+	// the normalized paths resolve to the repository
+	owner, repo, userMsg := parseRepoPath(normalizeGogsRepoPath("/home/git/gogs-repositories/User/Repo.git/"))
+	assert.Empty(t, userMsg)
+	assert.Equal(t, "user", owner)
+	assert.Equal(t, "repo", repo)
+}
+
+func TestAwaitCloneApproval(t *testing.T) {
+	var mu sync.Mutex
+	polls := 0
+	approveAfter := -1
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if path.Base(path.Dir(r.URL.Path)) != "clone-approval" {
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		assert.Equal(t, "1", path.Base(r.URL.Path))
+		assert.Equal(t, "12", r.URL.Query().Get("keyid"))
+		assert.Equal(t, "user2/repo1", r.URL.Query().Get("repo"))
+		polls++
+		approved := approveAfter >= 0 && polls > approveAfter
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"RequestID":"abc123","Approved":%t}`, approved)))
+	})()
+
+	oldTimeout := setting.Repository.CloneApprovalTimeout
+	defer func() {
+		setting.Repository.CloneApprovalTimeout = oldTimeout
+	}()
+	ctx := context.Background()
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoID: 1, KeyID: 12, UserName: "user2", CloneApprovalRequired: true}
+
+	// without a timeout the client is rejected right away and told about the pending request
+	setting.Repository.CloneApprovalTimeout = 0
+	var err error
+	stderr := captureStderr(t, func() {
+		err = awaitCloneApproval(ctx, results)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Reading user2/repo1 needs the approval of an administrator, approval request abc123 is pending. Please retry once it has been approved")
+	assert.Equal(t, 1, polls)
+
+	// an approved request lets the read go ahead
+	polls, approveAfter = 0, 0
+	assert.NoError(t, awaitCloneApproval(ctx, results))
+
+	// with a timeout the client waits for the approval
+	setting.Repository.CloneApprovalTimeout = 10 * time.Second
+	polls, approveAfter = 0, 1
+	stderr = captureStderr(t, func() {
+		err = awaitCloneApproval(ctx, results)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, polls)
+	assert.Contains(t, stderr, "Gitea: Reading user2/repo1 needs the approval of an administrator, waiting up to 10s for approval request abc123")
+}
+
+func TestReadThroughMiss(t *testing.T) {
+	oldTTL := setting.CacheService.GitReadThrough.TTL
+	defer func() {
+		setting.CacheService.GitReadThrough.TTL = oldTTL
+	}()
+	setting.CacheService.GitReadThrough.TTL = time.Hour
+
+	ctx := context.Background()
+	repoPath := filepath.Join(t.TempDir(), "user2", "repo1.git")
+
+	// the repository isn't there yet
+	miss, keys := readThroughMiss(ctx, "git-upload-pack", "", perm.AccessModeRead, nil, repoPath)
+	assert.True(t, miss)
+	assert.Empty(t, keys)
+
+	// it has just been fetched
+	assert.NoError(t, os.MkdirAll(repoPath, os.ModePerm))
+	assert.NoError(t, repo_module.MarkReadThroughFetched(repoPath))
+	miss, _ = readThroughMiss(ctx, "git-upload-pack", "", perm.AccessModeRead, nil, repoPath)
+	assert.False(t, miss)
+	miss, _ = readThroughMiss(ctx, "git-upload-archive", "", perm.AccessModeRead, nil, repoPath)
+	assert.False(t, miss)
+
+	// git-annex content which isn't there has to be fetched too
+	words := []string{gitAnnexShellVerb, "sendkey", "/~/user2/repo1.git", "SHA256E-s14--aa.bin", "--", "rsyncopts"}
+	miss, keys = readThroughMiss(ctx, gitAnnexShellVerb, "sendkey", perm.AccessModeRead, words, repoPath)
+	assert.True(t, miss)
+	assert.Equal(t, []string{"SHA256E-s14--aa.bin"}, keys)
+	miss, keys = readThroughMiss(ctx, gitAnnexShellVerb, "configlist", perm.AccessModeRead, words[:3], repoPath)
+	assert.False(t, miss)
+	assert.Empty(t, keys)
+
+	// it was fetched too long ago
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(repoPath, repo_module.ReadThroughMarker), old, old))
+	miss, _ = readThroughMiss(ctx, "git-upload-pack", "", perm.AccessModeRead, nil, repoPath)
+	assert.True(t, miss)
+
+	// writes aren't handled by the cache
+	miss, _ = readThroughMiss(ctx, "git-receive-pack", "", perm.AccessModeWrite, nil, repoPath)
+	assert.False(t, miss)
+	miss, _ = readThroughMiss(ctx, gitAnnexShellVerb, "recvkey", perm.AccessModeWrite, words, repoPath)
+	assert.False(t, miss)
+}
+
+func TestLockPush(t *testing.T) {
+	var mu sync.Mutex
+	holders := map[string]string{}
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		repoID := path.Base(r.URL.Path)
+		switch path.Base(path.Dir(r.URL.Path)) {
+		case "push-lock":
+			if holders[repoID] != "" {
+				w.WriteHeader(http.StatusLocked)
+				_, _ = w.Write([]byte(`{"user_msg":"Another push to this repository is in progress, please retry later"}`))
+				return
+			}
+			holders[repoID] = "token-" + repoID
+			_, _ = w.Write([]byte(`{"Token":"token-` + repoID + `"}`))
+		case "push-unlock":
+			if holders[repoID] == r.URL.Query().Get("token") {
+				delete(holders, repoID)
+			}
+			_, _ = w.Write([]byte("success"))
+		default:
+			_, _ = w.Write([]byte("{}"))
+		}
+	})()
+
+	oldTimeout := setting.Repository.SerializePushesTimeout
+	defer func() {
+		setting.Repository.SerializePushesTimeout = oldTimeout
+	}()
+	ctx := context.Background()
+
+	// a concurrent push is rejected when it may not wait
+	setting.Repository.SerializePushesTimeout = 0
+	unlock, err := lockPush(ctx, 1)
+	assert.NoError(t, err)
+	stderr := captureStderr(t, func() {
+		_, err = lockPush(ctx, 1)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Another push to this repository is in progress")
+
+	// pushes to other repositories are not affected
+	unlockOther, err := lockPush(ctx, 2)
+	assert.NoError(t, err)
+	unlockOther()
+
+	// a concurrent push waits for the running one to finish
+	setting.Repository.SerializePushesTimeout = 5 * time.Second
+	done := make(chan error)
+	go func() {
+		unlock, err := lockPush(ctx, 1)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	unlock()
+	assert.NoError(t, <-done)
+
+	// the lock is released even if the command was cancelled, e.g. by a signal
+	cancelCtx, cancel := context.WithCancel(ctx)
+	unlock, err = lockPush(cancelCtx, 1)
+	assert.NoError(t, err)
+	cancel()
+	unlock()
+	mu.Lock()
+	assert.Empty(t, holders)
+	mu.Unlock()
+}
+
+func TestLockServCommand(t *testing.T) {
+	var mu sync.Mutex
+	var pushLocked bool
+	var keyLocks []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch path.Base(path.Dir(r.URL.Path)) {
+		case "push-lock":
+			pushLocked = true
+			_, _ = w.Write([]byte(`{"Token":"push-token"}`))
+		case "push-unlock":
+			pushLocked = false
+			_, _ = w.Write([]byte("success"))
+		case "key-lock":
+			key := r.URL.Query().Get("key")
+			if key == "SHA256E-s1--bb" {
+				w.WriteHeader(http.StatusLocked)
+				_, _ = w.Write([]byte(`{"user_msg":"The git-annex content is in use, please retry later"}`))
+				return
+			}
+			keyLocks = append(keyLocks, key)
+			_, _ = w.Write([]byte(`{"Token":"key-token"}`))
+		case "key-unlock":
+			keyLocks = util.SliceRemoveAll(keyLocks, r.URL.Query().Get("key"))
+			_, _ = w.Write([]byte("success"))
+		default:
+			_, _ = w.Write([]byte("{}"))
+		}
+	})()
+
+	oldSerializePushes, oldPushesTimeout, oldKeyLockTimeout := setting.Repository.SerializePushes, setting.Repository.SerializePushesTimeout, setting.Annex.KeyLockTimeout
+	defer func() {
+		setting.Repository.SerializePushes, setting.Repository.SerializePushesTimeout, setting.Annex.KeyLockTimeout = oldSerializePushes, oldPushesTimeout, oldKeyLockTimeout
+	}()
+	setting.Repository.SerializePushes = true
+	setting.Repository.SerializePushesTimeout = 0
+	setting.Annex.KeyLockTimeout = 0
+	ctx := context.Background()
+	results := &private.ServCommandResults{RepoID: 1}
+
+	// a push takes the push lock until it is released
+	unlock, err := lockServCommand(ctx, &servRequest{verb: "git-receive-pack"}, results)
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.True(t, pushLocked)
+	mu.Unlock()
+	unlock()
+	mu.Lock()
+	assert.False(t, pushLocked)
+	mu.Unlock()
+
+	// reads take no lock at all
+	unlock, err = lockServCommand(ctx, &servRequest{verb: "git-upload-pack"}, results)
+	assert.NoError(t, err)
+	unlock()
+
+	// the keys of sendkey are locked until they are released
+	unlock, err = lockServCommand(ctx, &servRequest{verb: gitAnnexShellVerb, annexVerb: "sendkey", words: []string{gitAnnexShellVerb, "sendkey", "/user2/repo1.git", "SHA256E-s1--aa"}}, results)
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"SHA256E-s1--aa"}, keyLocks)
+	mu.Unlock()
+	unlock()
+	mu.Lock()
+	assert.Empty(t, keyLocks)
+	mu.Unlock()
+
+	// a key which can't be locked fails the command
+	captureStderr(t, func() {
+		_, err = lockServCommand(ctx, &servRequest{verb: gitAnnexShellVerb, annexVerb: "dropkey", words: []string{gitAnnexShellVerb, "dropkey", "/user2/repo1.git", "SHA256E-s1--bb"}}, results)
+	})
+	assert.Error(t, err)
+	mu.Lock()
+	assert.Empty(t, keyLocks)
+	mu.Unlock()
+}
+
+func TestPollBackoff(t *testing.T) {
+	oldInterval, oldMaxInterval := pollInterval, maxPollInterval
+	defer func() {
+		pollInterval, maxPollInterval = oldInterval, oldMaxInterval
+	}()
+	pollInterval, maxPollInterval = 10*time.Millisecond, 40*time.Millisecond
+	ctx := context.Background()
+
+	// the interval doubles with every wait up to the maximum
+	var backoff pollBackoff
+	deadline := time.Now().Add(time.Minute)
+	start := time.Now()
+	for _, next := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond} {
+		assert.NoError(t, backoff.Wait(ctx, deadline))
+		assert.Equal(t, next, backoff.interval)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond)
+
+	// a wait doesn't go beyond the deadline
+	backoff = pollBackoff{interval: time.Minute}
+	start = time.Now()
+	assert.NoError(t, backoff.Wait(ctx, start.Add(20*time.Millisecond)))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// nor beyond the end of the command
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, backoff.Wait(cancelCtx, deadline), context.Canceled)
+}
+
+func TestHoldLock(t *testing.T) {
+	oldInterval := lockRenewInterval
+	defer func() {
+		lockRenewInterval = oldInterval
+	}()
+	lockRenewInterval = 10 * time.Millisecond
+
+	// the lock is renewed until it is released
+	var renewals atomic.Int32
+	released := false
+	release := holdLock(context.Background(), func(ctx context.Context) {
+		renewals.Add(1)
+	}, func(ctx context.Context) {
+		assert.NoError(t, ctx.Err())
+		released = true
+	})
+	time.Sleep(100 * time.Millisecond)
+	release()
+	assert.True(t, released)
+	count := renewals.Load()
+	assert.GreaterOrEqual(t, count, int32(2))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, count, renewals.Load())
+
+	// once the command is cancelled it is no longer renewed, but still released
+	ctx, cancel := context.WithCancel(context.Background())
+	renewals.Store(0)
+	released = false
+	release = holdLock(ctx, func(ctx context.Context) {
+		renewals.Add(1)
+	}, func(ctx context.Context) {
+		assert.NoError(t, ctx.Err())
+		released = true
+	})
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	assert.True(t, released)
+	assert.Zero(t, renewals.Load())
+}
+
+func TestAwaitBackup(t *testing.T) {
+	var inProgress atomic.Bool
+	var checks atomic.Int32
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/internal/serv/backup" {
+			checks.Add(1)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"InProgress":%t}`, inProgress.Load())))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	})()
+
+	oldTimeout := setting.Repository.BackupWriteTimeout
+	defer func() {
+		setting.Repository.BackupWriteTimeout = oldTimeout
+	}()
+	ctx := context.Background()
+
+	// without a backup writes go ahead without asking the main process
+	assert.NoError(t, awaitBackup(ctx, &private.ServCommandResults{}))
+	assert.Zero(t, checks.Load())
+	backup := &private.ServCommandResults{BackupInProgress: true}
+
+	// writes are rejected during a backup when they may not wait
+	inProgress.Store(true)
+	setting.Repository.BackupWriteTimeout = 0
+	var err error
+	stderr := captureStderr(t, func() {
+		err = awaitBackup(ctx, backup)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: A backup is in progress and writes are paused, please retry later")
+
+	// otherwise they are deferred until the backup window ends
+	setting.Repository.BackupWriteTimeout = 5 * time.Second
+	checks.Store(0)
+	done := make(chan error)
+	go func() {
+		done <- awaitBackup(ctx, backup)
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case err := <-done:
+		assert.Fail(t, "write went ahead during the backup", "%v", err)
+	default:
+	}
+	inProgress.Store(false)
+	assert.NoError(t, <-done)
+	assert.GreaterOrEqual(t, checks.Load(), int32(2))
+}
+
+func TestLockAnnexKeys(t *testing.T) {
+	var mu sync.Mutex
+	exclusive := map[string]bool{}
+	holders := map[string]map[string]bool{}
+	next := 0
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.URL.Query().Get("key")
+		switch path.Base(path.Dir(r.URL.Path)) {
+		case "key-lock":
+			wantExclusive := r.URL.Query().Get("exclusive") == "true"
+			if len(holders[key]) > 0 && (wantExclusive || exclusive[key]) {
+				w.WriteHeader(http.StatusLocked)
+				_, _ = w.Write([]byte(`{"user_msg":"The git-annex content is being sent or dropped by someone else, please retry later"}`))
+				return
+			}
+			if holders[key] == nil {
+				holders[key] = map[string]bool{}
+			}
+			next++
+			token := fmt.Sprintf("token-%d", next)
+			holders[key][token] = true
+			exclusive[key] = wantExclusive
+			_, _ = w.Write([]byte(`{"Token":"` + token + `"}`))
+		case "key-unlock":
+			delete(holders[key], r.URL.Query().Get("token"))
+			_, _ = w.Write([]byte("success"))
+		default:
+			_, _ = w.Write([]byte("{}"))
+		}
+	})()
+
+	oldTimeout := setting.Annex.KeyLockTimeout
+	defer func() {
+		setting.Annex.KeyLockTimeout = oldTimeout
+	}()
+	ctx := context.Background()
+
+	// a drop of a key that is being sent is rejected when it may not wait, without keeping the other keys locked
+	setting.Annex.KeyLockTimeout = 0
+	unlockSend, err := lockAnnexKeys(ctx, 1, []string{"key-b"}, false)
+	assert.NoError(t, err)
+	stderr := captureStderr(t, func() {
+		_, err = lockAnnexKeys(ctx, 1, []string{"key-b", "key-a"}, true)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: The git-annex content is being sent or dropped by someone else")
+	mu.Lock()
+	assert.Empty(t, holders["key-a"])
+	mu.Unlock()
+
+	// other sends of the same key are not affected
+	unlockOther, err := lockAnnexKeys(ctx, 1, []string{"key-b"}, false)
+	assert.NoError(t, err)
+	unlockOther()
+
+	// a simultaneous drop waits for the send to finish, and a send waits for the drop
+	setting.Annex.KeyLockTimeout = 5 * time.Second
+	sent := make(chan struct{})
+	dropping := make(chan struct{})
+	dropped := make(chan error)
+	go func() {
+		unlock, err := lockAnnexKeys(ctx, 1, []string{"key-b"}, true)
+		if err == nil {
+			select {
+			case <-sent:
+			default:
+				err = fmt.Errorf("dropped while the key was being sent")
+			}
+			close(dropping)
+			time.Sleep(500 * time.Millisecond)
+			unlock()
+		} else {
+			close(dropping)
+		}
+		dropped <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(sent)
+	unlockSend()
+	<-dropping
+	start := time.Now()
+	unlockSend, err = lockAnnexKeys(ctx, 1, []string{"key-b"}, false)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	unlockSend()
+	assert.NoError(t, <-dropped)
+	mu.Lock()
+	assert.Empty(t, holders["key-b"])
+	mu.Unlock()
+
+	// the locks are released even if the command was cancelled, e.g. by a signal
+	cancelCtx, cancel := context.WithCancel(ctx)
+	unlock, err := lockAnnexKeys(cancelCtx, 1, []string{"key-a", "key-b"}, true)
+	assert.NoError(t, err)
+	cancel()
+	unlock()
+	mu.Lock()
+	assert.Empty(t, holders["key-a"])
+	assert.Empty(t, holders["key-b"])
+	mu.Unlock()
+}
+
+func TestServRecordUsage(t *testing.T) {
+	var recorded []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		recorded = append(recorded, r.URL.Path+" "+string(body))
+		_, _ = w.Write([]byte("success"))
+	})()
+
+	gitcmd := exec.Command("git", "hash-object", "--stdin")
+	gitcmd.Stdin = strings.NewReader(strings.Repeat("content\n", 100000))
+	assert.NoError(t, gitcmd.Run())
+
+	usage := servUsage("git-upload-pack", gitcmd.ProcessState)
+	assert.Equal(t, "git-upload-pack", usage.Verb)
+	assert.Equal(t, gitcmd.ProcessState.UserTime(), usage.UserTime)
+	assert.Equal(t, gitcmd.ProcessState.SystemTime(), usage.SystemTime)
+	if runtime.GOOS != "windows" {
+		assert.Positive(t, usage.MaxRSS)
+	}
+
+	assert.NoError(t, private.ServRecordUsage(context.Background(), 3, usage))
+	if assert.Len(t, recorded, 1) {
+		assert.Contains(t, recorded[0], "/api/internal/serv/usage/3 ")
+		assert.Contains(t, recorded[0], `"Verb":"git-upload-pack"`)
+		assert.Contains(t, recorded[0], fmt.Sprintf(`"MaxRSS":%d`, usage.MaxRSS))
+	}
+}
+
+func TestRecordAnnexKeys(t *testing.T) {
+	var mu sync.Mutex
+	var recorded []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		recorded = append(recorded, r.URL.Path+" "+r.URL.Query().Get("key"))
+		mu.Unlock()
+		if path.Base(path.Dir(r.URL.Path)) == "record-key" {
+			_, _ = w.Write([]byte(`{"OtherRepos":2}`))
+			return
+		}
+		_, _ = w.Write([]byte("success"))
+	})()
+
+	ctx := context.Background()
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoID: 1}
+
+	// received content is recorded, dropped content is forgotten
+	recordAnnexKeys(ctx, "recvkey", []string{gitAnnexShellVerb, "recvkey", "/~/user2/repo1", "SHA256E-s1--aa", "--", "file=a"}, results)
+	recordAnnexKeys(ctx, "dropkey", []string{gitAnnexShellVerb, "dropkey", "/~/user2/repo1", "SHA256E-s1--bb", "SHA256E-s1--cc"}, results)
+	// other commands don't change what the repository stores
+	recordAnnexKeys(ctx, "sendkey", []string{gitAnnexShellVerb, "sendkey", "/~/user2/repo1", "SHA256E-s1--aa"}, results)
+	assert.Equal(t, []string{
+		"/api/internal/annex/record-key/1 SHA256E-s1--aa",
+		"/api/internal/annex/forget-key/1 SHA256E-s1--bb",
+		"/api/internal/annex/forget-key/1 SHA256E-s1--cc",
+	}, recorded)
+
+	// the keys of a P2P session are recorded as they are stored once it is over, since a PUT can fail without ending it
+	oldRepoRootPath := setting.RepoRootPath
+	defer func() {
+		setting.RepoRootPath = oldRepoRootPath
+	}()
+	setting.RepoRootPath = t.TempDir()
+	keyPath := annex.KeyPath(repo_model.RepoPath("user2", "repo1"), "SHA256E-s14--bb")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(keyPath), os.ModePerm))
+	assert.NoError(t, os.WriteFile(keyPath, []byte("annexed content"), 0o444))
+
+	session := "VERSION 1\nCHECKPRESENT SHA256E-s1--aa\nPUT file.bin SHA256E-s14--bb\nDATA 14\nPUT y SHA256E-PUT x SHA256E-s1--cc\nPUT \nREMOVE SHA256E-s1--dd\n"
+	limiter := &annexOpLimiter{r: strings.NewReader(session), trackKeys: true}
+	_, err := io.ReadAll(limiter)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SHA256E-s14--bb", "SHA256E-s1--cc", "SHA256E-s1--dd"}, limiter.Keys())
+	recorded = nil
+	recordAnnexSessionKeys(ctx, limiter.Keys(), results)
+	assert.Equal(t, []string{
+		"/api/internal/annex/record-key/1 SHA256E-s14--bb",
+		"/api/internal/annex/forget-key/1 SHA256E-s1--cc",
+		"/api/internal/annex/forget-key/1 SHA256E-s1--dd",
+	}, recorded)
+}
+
+func TestLFSVerbs(t *testing.T) {
+	for lfsVerb, mode := range map[string]perm.AccessMode{
+		"upload":   perm.AccessModeWrite,
+		"download": perm.AccessModeRead,
+		"lock":     perm.AccessModeWrite,
+		"unlock":   perm.AccessModeWrite,
+		"list":     perm.AccessModeRead,
+		"verify":   perm.AccessModeRead,
+	} {
+		assert.Equal(t, mode, lfsVerbs[lfsVerb], lfsVerb)
+	}
+	_, has := lfsVerbs["unknown"]
+	assert.False(t, has)
+
+	assert.Equal(t, lfs.TokenOpUpload, lfsTokenOp("upload", lfsVerbs["upload"]))
+	assert.Equal(t, lfs.TokenOpDownload, lfsTokenOp("download", lfsVerbs["download"]))
+	// lock tokens can't upload
+	assert.Equal(t, lfs.TokenOpLock, lfsTokenOp("lock", lfsVerbs["lock"]))
+	assert.Equal(t, lfs.TokenOpLock, lfsTokenOp("unlock", lfsVerbs["unlock"]))
+	assert.Equal(t, lfs.TokenOpDownload, lfsTokenOp("list", lfsVerbs["list"]))
+	assert.Equal(t, lfs.TokenOpDownload, lfsTokenOp("verify", lfsVerbs["verify"]))
+}
+
+func TestLFSQuotaMessage(t *testing.T) {
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", LFSQuota: 1 << 30, LFSSize: 1 << 30}
+	assert.Equal(t, "LFS quota exceeded: the LFS objects of user2/repo1 take 1.0 GiB of its quota of 1.0 GiB, please remove unused LFS objects before uploading more", lfsQuotaMessage(results, "upload", lfsVerbs["upload"]))
+	// downloading and locking over the quota are fine
+	assert.Empty(t, lfsQuotaMessage(results, "download", lfsVerbs["download"]))
+	assert.Empty(t, lfsQuotaMessage(results, "lock", lfsVerbs["lock"]))
+
+	results.LFSSize = 1<<30 - 1
+	assert.Empty(t, lfsQuotaMessage(results, "upload", lfsVerbs["upload"]))
+
+	// repositories without a quota
+	results.LFSQuota, results.LFSSize = 0, 1<<40
+	assert.Empty(t, lfsQuotaMessage(results, "upload", lfsVerbs["upload"]))
+}
+
+func TestNewLFSClaims(t *testing.T) {
+	oldLFS := setting.LFS
+	defer func() {
+		setting.LFS = oldLFS
+	}()
+	setting.LFS.HTTPAuthExpiry = time.Hour
+	setting.LFS.JWTSecretBytes = []byte("01234567890123456789012345678901")
+
+	results := &private.ServCommandResults{RepoID: 1, UserID: 2}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	setting.LFS.JWTIssuer = ""
+	setting.LFS.JWTAudience = ""
+	claims := newLFSClaims(results, "upload", perm.AccessModeWrite, now)
+	assert.Empty(t, claims.Issuer)
+	assert.Empty(t, claims.Audience)
+	assert.Equal(t, "upload", claims.Op)
+	assert.Equal(t, now.Add(time.Hour).Unix(), claims.ExpiresAt.Unix())
+
+	setting.LFS.JWTIssuer = "https://gitea.example.com/"
+	setting.LFS.JWTAudience = "lfs.example.com"
+	claims = newLFSClaims(results, "download", perm.AccessModeRead, now)
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(setting.LFS.JWTSecretBytes)
+	assert.NoError(t, err)
+
+	// the claims are part of the signed token
+	parsed := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(tokenString, parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gitea.example.com/", parsed["iss"])
+	assert.Equal(t, []any{"lfs.example.com"}, parsed["aud"])
+	assert.Equal(t, "download", parsed["Op"])
+	assert.EqualValues(t, 1, parsed["RepoID"])
+}
+
+func TestLFSTokenExpiry(t *testing.T) {
+	oldLFS := setting.LFS
+	defer func() {
+		setting.LFS = oldLFS
+	}()
+	setting.LFS.HTTPAuthExpiry = time.Hour
+	setting.LFS.ServiceHTTPAuthExpiry = 7 * 24 * time.Hour
+
+	interactive := &private.ServCommandResults{KeyID: 1, UserID: 2}
+	service := &private.ServCommandResults{KeyID: 1, DeployKeyID: 3}
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// only the download tokens of deploy keys live longer
+	assert.Equal(t, time.Hour, lfsTokenExpiry(interactive, perm.AccessModeRead))
+	assert.Equal(t, time.Hour, lfsTokenExpiry(interactive, perm.AccessModeWrite))
+	assert.Equal(t, 7*24*time.Hour, lfsTokenExpiry(service, perm.AccessModeRead))
+	assert.Equal(t, time.Hour, lfsTokenExpiry(service, perm.AccessModeWrite))
+	assert.Equal(t, now.Add(7*24*time.Hour).Unix(), newLFSClaims(service, "download", perm.AccessModeRead, now).ExpiresAt.Unix())
+	assert.Equal(t, now.Add(time.Hour).Unix(), newLFSClaims(interactive, "download", perm.AccessModeRead, now).ExpiresAt.Unix())
+
+	setting.LFS.ServiceHTTPAuthExpiry = 0
+	assert.Equal(t, time.Hour, lfsTokenExpiry(service, perm.AccessModeRead))
+}
+
+func TestRunPreExecCommand(t *testing.T) {
+	defer mockInternalAPI(nil)()
+	ctx := context.Background()
+	env := []string{"GITEA_REPO_NAME=repo1"}
+
+	assert.NoError(t, runPreExecCommand(ctx, `sh -c 'test "$GITEA_REPO_NAME" = repo1'`, env))
+
+	var err error
+	stderr := captureStderr(t, func() {
+		err = runPreExecCommand(ctx, `sh -c 'echo "Please accept the license of $GITEA_REPO_NAME first" >&2; exit 1'`, env)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Please accept the license of repo1 first")
+
+	stderr = captureStderr(t, func() {
+		err = runPreExecCommand(ctx, "false", env)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Operation rejected by the repository's pre-exec command")
+}
+
+func TestServGitConfigsHideRefs(t *testing.T) {
+	oldHideRefs := setting.Git.UploadPackHideRefs
+	defer func() {
+		setting.Git.UploadPackHideRefs = oldHideRefs
+	}()
+
+	// a repository with many tags
+	repoPath := t.TempDir()
+	gitCmd := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	gitCmd("init", "--bare", ".")
+	commitCmd := exec.Command("git", "-C", repoPath, "commit-tree", "-m", "init", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	commitCmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	commitID, err := commitCmd.Output()
+	assert.NoError(t, err)
+	gitCmd("update-ref", "refs/heads/main", strings.TrimSpace(string(commitID)))
+	for i := 0; i < 200; i++ {
+		gitCmd("update-ref", fmt.Sprintf("refs/tags/nightly/%d", i), strings.TrimSpace(string(commitID)))
+	}
+
+	advertisement := func() string {
+		cmd := exec.Command("git", "upload-pack", "--advertise-refs", repoPath)
+		cmd.Env = append(os.Environ(), gitConfigEnvs(servGitConfigs("git-upload-pack"))...)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return string(out)
+	}
+
+	setting.Git.UploadPackHideRefs = nil
+	assert.Empty(t, servGitConfigs("git-upload-pack"))
+	full := advertisement()
+	assert.Contains(t, full, "refs/tags/nightly/199")
+
+	setting.Git.UploadPackHideRefs = []string{"refs/tags/nightly"}
+	assert.Equal(t, []string{"uploadpack.hideRefs=refs/tags/nightly"}, servGitConfigs("git-upload-pack"))
+	assert.NotContains(t, servGitConfigs("git-receive-pack"), "uploadpack.hideRefs=refs/tags/nightly")
+	hidden := advertisement()
+	assert.Contains(t, hidden, "refs/heads/main")
+	assert.NotContains(t, hidden, "refs/tags/nightly/")
+	assert.Less(t, len(hidden)*10, len(full))
+}
+
+func TestServGitConfigsDisabledCapabilities(t *testing.T) {
+	oldCapabilities := setting.Git.DisabledCapabilities
+	oldUploadHideRefs := setting.Git.UploadPackHideRefs
+	defer func() {
+		setting.Git.DisabledCapabilities = oldCapabilities
+		setting.Git.UploadPackHideRefs = oldUploadHideRefs
+	}()
+	setting.Git.UploadPackHideRefs = nil
+
+	// a repository whose own config allows fetching unadvertised objects
+	repoPath := t.TempDir()
+	for _, args := range [][]string{{"init", "--bare", "."}, {"config", "uploadpack.allowTipSHA1InWant", "true"}} {
+		out, err := exec.Command("git", append([]string{"-C", repoPath}, args...)...).CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	commitCmd := exec.Command("git", "-C", repoPath, "commit-tree", "-m", "init", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	commitCmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	commitID, err := commitCmd.Output()
+	assert.NoError(t, err)
+	out, err := exec.Command("git", "-C", repoPath, "update-ref", "refs/heads/main", strings.TrimSpace(string(commitID))).CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	capabilities := func(verb string) string {
+		cmd := exec.Command("git", strings.TrimPrefix(verb, "git-"), "--advertise-refs", repoPath)
+		cmd.Env = append(os.Environ(), gitConfigEnvs(servGitConfigs(verb))...)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		// the capabilities follow the first ref after a NUL
+		_, capabilities, _ := strings.Cut(string(out), "\x00")
+		line, _, _ := strings.Cut(capabilities, "\n")
+		return " " + line + " "
+	}
+
+	setting.Git.DisabledCapabilities = nil
+	assert.Contains(t, capabilities("git-upload-pack"), " allow-tip-sha1-in-want ")
+	assert.Contains(t, capabilities("git-receive-pack"), " atomic ")
+	assert.Contains(t, capabilities("git-receive-pack"), " push-options ")
+
+	// the names are case-insensitive, unknown ones are ignored
+	setting.Git.DisabledCapabilities = []string{"Allow-Tip-SHA1-In-Want", "atomic", "no-such-capability"}
+	assert.Equal(t, []string{"uploadpack.allowTipSHA1InWant=false"}, servGitConfigs("git-upload-pack"))
+	receiveConfigs := servGitConfigs("git-receive-pack")
+	assert.Equal(t, "receive.advertiseAtomic=false", receiveConfigs[len(receiveConfigs)-1])
+	assert.NotContains(t, capabilities("git-upload-pack"), " allow-tip-sha1-in-want ")
+	assert.NotContains(t, capabilities("git-receive-pack"), " atomic ")
+	assert.Contains(t, capabilities("git-receive-pack"), " push-options ")
+
+	// disabling push options overrides Gitea always offering them
+	setting.Git.DisabledCapabilities = []string{"push-options"}
+	assert.NotContains(t, capabilities("git-receive-pack"), " push-options ")
+}
+
+func TestServGitConfigsHideInternalRefs(t *testing.T) {
+	oldUploadHideRefs := setting.Git.UploadPackHideRefs
+	oldReceiveHideRefs := setting.Git.ReceivePackHideRefs
+	defer func() {
+		setting.Git.UploadPackHideRefs = oldUploadHideRefs
+		setting.Git.ReceivePackHideRefs = oldReceiveHideRefs
+	}()
+
+	gitEnv := append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	gitCmd := func(dir string, env []string, args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	// a repository with a pull request and a keep-around ref next to its branch
+	repoPath := t.TempDir()
+	_, err := gitCmd(repoPath, gitEnv, "init", "--bare", ".")
+	assert.NoError(t, err)
+	commitID, err := gitCmd(repoPath, gitEnv, "commit-tree", "-m", "init", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	assert.NoError(t, err)
+	commitID = strings.TrimSpace(commitID)
+	for _, ref := range []string{"refs/heads/main", "refs/pull/1/head", "refs/keep-around/" + commitID} {
+		_, err = gitCmd(repoPath, gitEnv, "update-ref", ref, commitID)
+		assert.NoError(t, err)
+	}
+
+	setting.Git.UploadPackHideRefs = []string{"refs/pull", "refs/keep-around"}
+	setting.Git.ReceivePackHideRefs = []string{"refs/pull", "refs/keep-around"}
+	assert.Equal(t, []string{"receive.advertisePushOptions=true", "receive.hideRefs=refs/pull", "receive.hideRefs=refs/keep-around"}, servGitConfigs("git-receive-pack"))
+
+	// git doesn't pass config environment variables on to the other side of a local transport,
+	// so they are set for it explicitly like serv does
+	servSide := func(verb string) string {
+		return "env " + strings.Join(gitConfigEnvs(servGitConfigs(verb)), " ") + " " + verb
+	}
+
+	// a clone doesn't get the internal refs
+	clonePath := t.TempDir()
+	out, err := gitCmd(clonePath, gitEnv, "clone", "--mirror", "--upload-pack", servSide("git-upload-pack"), "file://"+repoPath, ".")
+	assert.NoError(t, err, out)
+	refs, err := gitCmd(clonePath, gitEnv, "for-each-ref", "--format=%(refname)")
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/heads/main\n", refs)
+
+	// a push can't update the internal refs, but can still update branches
+	newCommitID, err := gitCmd(clonePath, gitEnv, "commit-tree", "-p", commitID, "-m", "change", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	assert.NoError(t, err)
+	newCommitID = strings.TrimSpace(newCommitID)
+	out, err = gitCmd(clonePath, gitEnv, "push", "--receive-pack", servSide("git-receive-pack"), repoPath, newCommitID+":refs/pull/1/head")
+	assert.Error(t, err)
+	assert.Contains(t, out, "deny updating a hidden ref")
+	out, err = gitCmd(clonePath, gitEnv, "push", "--receive-pack", servSide("git-receive-pack"), repoPath, newCommitID+":refs/heads/feature")
+	assert.NoError(t, err, out)
+
+	setting.Git.ReceivePackHideRefs = []string{""}
+	assert.Equal(t, []string{"receive.advertisePushOptions=true"}, servGitConfigs("git-receive-pack"))
+}
+
+func TestRefAdvertisementCounter(t *testing.T) {
+	pktLine := func(data string) string {
+		return fmt.Sprintf("%04x%s", len(data)+4, data)
+	}
+	advertisement := pktLine("4b825dc642cb6eb9a060e54bf8d69288fbee4904 HEAD\x00multi_ack side-band-64k agent=git/2.39.5\n") +
+		pktLine("4b825dc642cb6eb9a060e54bf8d69288fbee4904 refs/heads/main\n") +
+		pktLine("4b825dc642cb6eb9a060e54bf8d69288fbee4904 refs/tags/v1.0\n") + "0000"
+	output := advertisement + pktLine("NAK\n") + "\x02PACK"
+
+	// the output is passed through unchanged, however it is split up
+	for _, chunkSize := range []int{1, 3, 7, len(output)} {
+		out := &bytes.Buffer{}
+		c := &refAdvertisementCounter{w: out}
+		for i := 0; i < len(output); i += chunkSize {
+			end := i + chunkSize
+			if end > len(output) {
+				end = len(output)
+			}
+			_, err := c.Write([]byte(output[i:end]))
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, output, out.String())
+		size, lines, complete := c.Size()
+		assert.EqualValues(t, len(advertisement), size, chunkSize)
+		assert.EqualValues(t, 3, lines, chunkSize)
+		assert.True(t, complete, chunkSize)
+	}
+
+	// protocol v2 only advertises the capabilities
+	c := &refAdvertisementCounter{w: io.Discard}
+	_, _ = c.Write([]byte(pktLine("version 2\n") + pktLine("ls-refs=unborn\n") + "0000"))
+	size, lines, complete := c.Size()
+	assert.EqualValues(t, 37, size)
+	assert.EqualValues(t, 2, lines)
+	assert.True(t, complete)
+
+	// git-upload-pack failed before the end of it
+	c = &refAdvertisementCounter{w: io.Discard}
+	_, _ = c.Write([]byte(pktLine("4b825dc642cb6eb9a060e54bf8d69288fbee4904 HEAD\n")))
+	_, _, complete = c.Size()
+	assert.False(t, complete)
+
+	// the measurement is logged
+	lc, cleanup := test.NewLogChecker(log.DEFAULT)
+	defer cleanup()
+	c = &refAdvertisementCounter{w: io.Discard}
+	_, _ = c.Write([]byte(advertisement))
+	lc.Filter("Ref advertisement of", " bytes in ", "was incomplete")
+	logRefAdvertisement(c, "user2/repo1")
+	filtered, _ := lc.Check(100 * time.Millisecond)
+	assert.Equal(t, []bool{true, true, false}, filtered)
+}
+
+func TestAgentSniffer(t *testing.T) {
+	pktLine := func(data string) string {
+		return fmt.Sprintf("%04x%s", len(data)+4, data)
+	}
+	kases := map[string]struct {
+		input string
+		agent string
+	}{
+		"upload-pack v0": {
+			input: pktLine("want 4b825dc642cb6eb9a060e54bf8d69288fbee4904 multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.39.5\n") + "0000",
+			agent: "git/2.39.5",
+		},
+		"upload-pack v2": {
+			input: pktLine("command=ls-refs\n") + pktLine("agent=git/2.40.0\n") + pktLine("object-format=sha1") + "0001" + pktLine("peel\n") + "0000",
+			agent: "git/2.40.0",
+		},
+		"receive-pack": {
+			input: pktLine("0000000000000000000000000000000000000000 4b825dc642cb6eb9a060e54bf8d69288fbee4904 refs/heads/main\x00 report-status side-band-64k object-format=sha1 agent=git/2.39.5") + "0000PACK",
+			agent: "git/2.39.5",
+		},
+		"no agent": {
+			input: pktLine("want 4b825dc642cb6eb9a060e54bf8d69288fbee4904 multi_ack\n") + "0000" + pktLine("agent=late\n"),
+		},
+		"not pkt-lines": {
+			input: "agent=git/2.39.5\n",
+		},
+	}
+	for name, kase := range kases {
+		t.Run(name, func(t *testing.T) {
+			var found []string
+			sniffer := &agentSniffer{r: iotest.OneByteReader(strings.NewReader(kase.input)), onAgent: func(agent string) {
+				found = append(found, agent)
+			}}
+			out, err := io.ReadAll(sniffer)
+			assert.NoError(t, err)
+			assert.Equal(t, kase.input, string(out))
+			assert.Equal(t, kase.agent, sniffer.Agent())
+			if kase.agent != "" {
+				assert.Equal(t, []string{kase.agent}, found)
+			} else {
+				assert.Empty(t, found)
+			}
+		})
+	}
+}
+
+func TestClientVersionAdvisory(t *testing.T) {
+	assert.Equal(t, "This repository recommends git 2.38 or later, but your git client is version 2.25.1. Some of its features, e.g. partial clones, may not work as expected, please consider upgrading git.",
+		clientVersionAdvisory("git/2.25.1", "2.38"))
+	assert.Contains(t, clientVersionAdvisory("git/2.37.1.windows.1", "2.38"), "your git client is version 2.37.1.")
+	assert.Empty(t, clientVersionAdvisory("git/2.38.0", "2.38"))
+	assert.Empty(t, clientVersionAdvisory("git/2.39.5", "2.38"))
+	assert.Empty(t, clientVersionAdvisory("git/2.40.0-Apple", "2.38"))
+
+	// other clients don't tell the git version
+	assert.Empty(t, clientVersionAdvisory("JGit/6.5.0", "2.38"))
+	assert.Empty(t, clientVersionAdvisory("git/isomorphic-git@1.0", "2.38"))
+	assert.Empty(t, clientVersionAdvisory("", "2.38"))
+}
+
+func TestCheckSymlinkedRepo(t *testing.T) {
+	oldRepoRootPath, oldPolicy := setting.RepoRootPath, setting.Repository.SymlinkedRepositories
+	defer func() {
+		setting.RepoRootPath, setting.Repository.SymlinkedRepositories = oldRepoRootPath, oldPolicy
+	}()
+
+	setting.RepoRootPath = t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(setting.RepoRootPath, "user", "repo.git"), os.ModePerm))
+	assert.NoError(t, os.MkdirAll(filepath.Join(setting.RepoRootPath, "tier", "inside.git"), os.ModePerm))
+	assert.NoError(t, os.MkdirAll(filepath.Join(outside, "outside.git"), os.ModePerm))
+	assert.NoError(t, os.Symlink(filepath.Join(setting.RepoRootPath, "tier", "inside.git"), filepath.Join(setting.RepoRootPath, "user", "inside.git")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "outside.git"), filepath.Join(setting.RepoRootPath, "user", "outside.git")))
+
+	plain := servRepoPath(&private.ServCommandResults{OwnerName: "user", RepoName: "repo"})
+	inside := servRepoPath(&private.ServCommandResults{OwnerName: "user", RepoName: "inside"})
+	outsideLink := servRepoPath(&private.ServCommandResults{OwnerName: "user", RepoName: "outside"})
+	missing := servRepoPath(&private.ServCommandResults{OwnerName: "user", RepoName: "missing"})
+
+	setting.Repository.SymlinkedRepositories = setting.RepoSymlinksAllow
+	for _, repoPath := range []string{plain, inside, outsideLink, missing} {
+		assert.Empty(t, checkSymlinkedRepo(repoPath))
+	}
+
+	setting.Repository.SymlinkedRepositories = setting.RepoSymlinksContained
+	assert.Empty(t, checkSymlinkedRepo(plain))
+	assert.Empty(t, checkSymlinkedRepo(inside))
+	assert.Equal(t, "Repository directory links outside of the repository root, which is not allowed", checkSymlinkedRepo(outsideLink))
+	assert.Empty(t, checkSymlinkedRepo(missing))
+
+	setting.Repository.SymlinkedRepositories = setting.RepoSymlinksDeny
+	assert.Empty(t, checkSymlinkedRepo(plain))
+	assert.Equal(t, "Repository directory is a symbolic link, which is not allowed", checkSymlinkedRepo(inside))
+	assert.Equal(t, "Repository directory is a symbolic link, which is not allowed", checkSymlinkedRepo(outsideLink))
+	assert.Empty(t, checkSymlinkedRepo(missing))
+
+	// a symlinked repository root on its own is fine
+	linkedRoot := filepath.Join(t.TempDir(), "root")
+	assert.NoError(t, os.Symlink(setting.RepoRootPath, linkedRoot))
+	setting.RepoRootPath = linkedRoot
+	assert.Empty(t, checkSymlinkedRepo(servRepoPath(&private.ServCommandResults{OwnerName: "user", RepoName: "repo"})))
+}
+
+func TestProbeRepoHealth(t *testing.T) {
+	healthy := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(healthy, "objects", "pack"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(healthy, "HEAD"), []byte("ref: refs/heads/master\n"), 0o644))
+	assert.NoError(t, probeRepoHealth(healthy))
+
+	detached := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(detached, "objects"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(detached, "HEAD"), []byte("65f1bf27bc3bf70f64657658635e66094edbcb4d\n"), 0o644))
+	assert.NoError(t, probeRepoHealth(detached))
+
+	// the broken repository lost its objects and has garbage in HEAD
+	broken := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(broken, "HEAD"), []byte("ref: refs/heads/master\n"), 0o644))
+	assert.Error(t, probeRepoHealth(broken))
+	assert.NoError(t, os.WriteFile(filepath.Join(broken, "objects"), []byte("not a directory"), 0o644))
+	assert.Error(t, probeRepoHealth(broken))
+	assert.NoError(t, os.Remove(filepath.Join(broken, "objects")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(broken, "objects"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(broken, "HEAD"), []byte{0, 0, 0, 0}, 0o644))
+	assert.Error(t, probeRepoHealth(broken))
+	assert.NoError(t, os.Remove(filepath.Join(broken, "HEAD")))
+	assert.Error(t, probeRepoHealth(broken))
+
+	assert.Error(t, probeRepoHealth(filepath.Join(t.TempDir(), "missing.git")))
+}
+
+func TestOutdatedClientMessage(t *testing.T) {
+	assert.Empty(t, outdatedClientMessage([]string{"git-upload-pack", "user/repo.git"}))
+	assert.Empty(t, outdatedClientMessage([]string{"git-annex-shell", "configlist", "/~/user/repo.git"}))
+	assert.Empty(t, outdatedClientMessage([]string{"git", "status", "user/repo.git"}))
+	assert.Empty(t, outdatedClientMessage([]string{"git", "upload-pack"}))
+
+	// the command of an old client, or of one configured with --upload-pack="git upload-pack"
+	assert.Equal(t, `Your git client sent "git upload-pack", which isn't supported, only "git-upload-pack" is. Please upgrade your git client, or remove a custom --upload-pack or --receive-pack option or remote.*.uploadpack or remote.*.receivepack setting`,
+		outdatedClientMessage([]string{"git", "upload-pack", "user/repo.git"}))
+	assert.Contains(t, outdatedClientMessage([]string{"git", "receive-pack", "user/repo.git"}), `only "git-receive-pack" is`)
+	assert.Contains(t, outdatedClientMessage([]string{"git", "upload-archive", "user/repo.git"}), `only "git-upload-archive" is`)
+}
+
+func TestMissingRepoPathMessage(t *testing.T) {
+	assert.Empty(t, missingRepoPathMessage(nil))
+	assert.Empty(t, missingRepoPathMessage([]string{"git-upload-pack", "user/repo.git"}))
+	assert.Empty(t, missingRepoPathMessage([]string{lfsAuthenticateVerb, "user/repo.git", "download"}))
+	assert.Empty(t, missingRepoPathMessage([]string{gitAnnexShellVerb, annexConfiglistVerb, "/~/user/repo.git"}))
+	assert.Empty(t, missingRepoPathMessage([]string{"unknown"}))
+
+	assert.Equal(t, `git-upload-pack was sent without a repository path, the expected form is "git-upload-pack <repo-path>", e.g. "git-upload-pack 'user/repo.git'". Please check the URL of the remote, it must name the repository, e.g. git@example.com:user/repo.git`,
+		missingRepoPathMessage([]string{"git-upload-pack"}))
+	assert.Contains(t, missingRepoPathMessage([]string{"git-receive-pack"}), `"git-receive-pack <repo-path>"`)
+	assert.Contains(t, missingRepoPathMessage([]string{lfsAuthenticateVerb}), `"git-lfs-authenticate <repo-path>"`)
+
+	// git-annex-shell takes its command before the repository path
+	msg := `git-annex-shell was sent without a repository path, the expected form is "git-annex-shell <command> <repo-path>", e.g. "git-annex-shell configlist '/~/user/repo.git'". Please check the URL of the git-annex remote, it must name the repository, e.g. ssh://git@example.com/user/repo.git`
+	assert.Equal(t, msg, missingRepoPathMessage([]string{gitAnnexShellVerb}))
+	assert.Equal(t, msg, missingRepoPathMessage([]string{gitAnnexShellVerb, annexConfiglistVerb}))
+}
+
+func TestOperationCost(t *testing.T) {
+	huge := &private.ServCommandResults{RepoSize: 300 * 1024 * 1024}
+	small := &private.ServCommandResults{RepoSize: 1024}
+
+	assert.EqualValues(t, 301, operationCost("git-upload-pack", "", []string{"git-upload-pack", "user/huge.git"}, huge))
+	assert.EqualValues(t, 301, operationCost("git-upload-archive", "", []string{"git-upload-archive", "user/huge.git"}, huge))
+	assert.EqualValues(t, 1, operationCost("git-upload-pack", "", []string{"git-upload-pack", "user/small.git"}, small))
+	assert.EqualValues(t, 1, operationCost("git-receive-pack", "", []string{"git-receive-pack", "user/huge.git"}, huge))
+	assert.EqualValues(t, 1, operationCost(gitAnnexShellVerb, annexConfiglistVerb, []string{gitAnnexShellVerb, annexConfiglistVerb, "/~/user/huge.git"}, huge))
+	assert.EqualValues(t, 1, operationCost(lfsAuthenticateVerb, "", []string{lfsAuthenticateVerb, "user/huge.git", "download"}, huge))
+
+	// git-annex content costs its size
+	assert.EqualValues(t, 5, operationCost(gitAnnexShellVerb, "sendkey", []string{gitAnnexShellVerb, "sendkey", "/~/user/small.git", "SHA256E-s4194304--aa.bin", "--", "rsyncoptions=x"}, small))
+	assert.EqualValues(t, 1, operationCost(gitAnnexShellVerb, "sendkey", []string{gitAnnexShellVerb, "sendkey", "/~/user/small.git", "URL--http&c%%example.com%file"}, small))
+}
+
+func TestWriteServResult(t *testing.T) {
+	result := &servResult{
+		Verb:       "git-upload-pack",
+		Repo:       "user/repo",
+		AccessMode: perm.AccessModeRead.String(),
+	}
+	counted := &countingWriter{w: io.Discard, n: &result.BytesOut}
+	_, _ = counted.Write([]byte("0000"))
+	_, _ = io.ReadAll(&countingReader{r: strings.NewReader("0009done\n"), n: &result.BytesIn})
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, writeServResult(out, result, 1500*time.Millisecond, cli.NewExitError("", 1)))
+	assert.JSONEq(t, `{"verb":"git-upload-pack","repo":"user/repo","accessMode":"read","exitCode":1,"bytesIn":9,"bytesOut":4,"durationMs":1500}`, out.String())
+
+	out.Reset()
+	assert.NoError(t, writeServResult(out, &servResult{Verb: "git-receive-pack"}, 0, nil))
+	assert.Contains(t, out.String(), `"exitCode":0`)
+}
+
+func TestNeedsAutoRepack(t *testing.T) {
+	oldAutoRepackOnAccess, oldAutoRepackLooseObjects := setting.Git.AutoRepackOnAccess, setting.Git.AutoRepackLooseObjects
+	defer func() {
+		setting.Git.AutoRepackOnAccess, setting.Git.AutoRepackLooseObjects = oldAutoRepackOnAccess, oldAutoRepackLooseObjects
+	}()
+	setting.Git.AutoRepackLooseObjects = 6700
+
+	setting.Git.AutoRepackOnAccess = false
+	assert.False(t, needsAutoRepack(&private.ServCommandResults{LooseObjects: 10000}))
+
+	setting.Git.AutoRepackOnAccess = true
+	assert.True(t, needsAutoRepack(&private.ServCommandResults{LooseObjects: 10000}))
+	assert.False(t, needsAutoRepack(&private.ServCommandResults{LooseObjects: 6700}))
+	assert.False(t, needsAutoRepack(&private.ServCommandResults{LooseObjects: 10000, IsWiki: true}))
+
+	setting.Git.AutoRepackLooseObjects = 0
+	assert.False(t, needsAutoRepack(&private.ServCommandResults{LooseObjects: 10000}))
+}
+
+func TestServEvent(t *testing.T) {
+	result := &servResult{Verb: "git-upload-pack", Repo: "user/repo"}
+	counted := &countingWriter{w: io.Discard, n: &result.BytesOut}
+	_, _ = counted.Write([]byte("0000"))
+	_, _ = io.ReadAll(&countingReader{r: strings.NewReader("0009done\n"), n: &result.BytesIn})
+
+	assert.Equal(t, &private.ServEvent{
+		Repo:     "user/repo",
+		User:     "user2",
+		Verb:     "git-upload-pack",
+		Outcome:  "success",
+		BytesIn:  9,
+		BytesOut: 4,
+		Duration: time.Second,
+	}, servEvent(result, "user2", time.Second, nil))
+
+	event := servEvent(&servResult{Verb: "git-receive-pack", Repo: "user/repo"}, "", 0, cli.NewExitError("", 2))
+	assert.Equal(t, "failure", event.Outcome)
+	assert.Equal(t, 2, event.ExitCode)
+	assert.Equal(t, 1, servEvent(result, "user2", 0, errors.New("failed")).ExitCode)
+}
+
+func TestServStatus(t *testing.T) {
+	var mu sync.Mutex
+	var statuses []private.ServStatus
+	defer func(old func(context.Context, *private.ServStatus) error) {
+		streamServStatus = old
+	}(streamServStatus)
+	streamServStatus = func(_ context.Context, status *private.ServStatus) error {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses = append(statuses, *status)
+		return nil
+	}
+	events := func() []private.ServStatus {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]private.ServStatus{}, statuses...)
+	}
+
+	status := newServStatus(&private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2"}, "git-upload-pack")
+	assert.Len(t, status.ID, 16)
+	result := &servResult{}
+	stop := startServStatus(context.Background(), status, result, 10*time.Millisecond)
+
+	// the start is sent before the command runs
+	if assert.Len(t, events(), 1) {
+		assert.Equal(t, private.ServStatus{ID: status.ID, Event: private.ServStatusStart, Repo: "user2/repo1", User: "user2", Verb: "git-upload-pack"}, events()[0])
+	}
+
+	// the progress follows while the command runs
+	atomic.AddInt64(&result.BytesOut, 1024)
+	assert.Eventually(t, func() bool {
+		statuses := events()
+		last := statuses[len(statuses)-1]
+		return last.Event == private.ServStatusProgress && last.BytesOut == 1024
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the end is sent with the outcome, and nothing after it
+	stop(cli.NewExitError("", 2))
+	count := len(events())
+	last := events()[count-1]
+	assert.Equal(t, private.ServStatusDone, last.Event)
+	assert.Equal(t, status.ID, last.ID)
+	assert.EqualValues(t, 1024, last.BytesOut)
+	assert.Equal(t, 2, last.ExitCode)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, events(), count)
+}
+
+func TestAnnexArgs(t *testing.T) {
+	words := []string{"git-annex-shell", "sendkey", "/user/repo.git", "SHA256E-s1--abc", "--", "fieldname=value"}
+	assert.Equal(t, []string{"sendkey", "/data/user/repo.git", "SHA256E-s1--abc", "--", "fieldname=value"}, annexArgs(words, "/data/user/repo.git"))
+	assert.Equal(t, []string{"configlist", "/data/user/repo.git"}, annexArgs([]string{"git-annex-shell", "configlist", "user/repo.git"}, "/data/user/repo.git"))
+}
+
+func TestAnnexCommands(t *testing.T) {
+	// any change of the access mode needed by a git-annex-shell command has to be deliberate
+	assert.Equal(t, map[string]perm.AccessMode{
+		"configlist":         perm.AccessModeRead,
+		"inannex":            perm.AccessModeRead,
+		"lockcontent":        perm.AccessModeRead,
+		"sendkey":            perm.AccessModeRead,
+		"transferinfo":       perm.AccessModeRead,
+		"notifychanges":      perm.AccessModeRead,
+		"gitea-capabilities": perm.AccessModeRead,
+		"recvkey":            perm.AccessModeWrite,
+		"dropkey":            perm.AccessModeWrite,
+		"commit":             perm.AccessModeWrite,
+		"gcryptsetup":        perm.AccessModeWrite,
+		"p2pstdio":           perm.AccessModeWrite,
+	}, annexCommands)
+
+	_, has := annexCommands["uninit"]
+	assert.False(t, has)
+}
+
+func TestAnnexShellEnvs(t *testing.T) {
+	envs := annexShellEnvs("/data/user/repo.git", perm.AccessModeRead)
+	assert.Contains(t, envs, "GIT_ANNEX_SHELL_LIMITED=True")
+	assert.Contains(t, envs, "GIT_ANNEX_SHELL_DIRECTORY=/data/user/repo.git")
+	assert.Contains(t, envs, "GIT_ANNEX_SHELL_READONLY=True")
+
+	envs = annexShellEnvs("/data/user/repo.git", perm.AccessModeWrite)
+	assert.Contains(t, envs, "GIT_ANNEX_SHELL_DIRECTORY=/data/user/repo.git")
+	assert.NotContains(t, envs, "GIT_ANNEX_SHELL_READONLY=True")
+
+	// p2pstdio can store and drop content, so it is only run with write access and never read-only
+	assert.Equal(t, perm.AccessModeWrite, annexCommands["p2pstdio"])
+	assert.Contains(t, annexShellEnvs("/data/user/repo.git", annexCommands["sendkey"]), "GIT_ANNEX_SHELL_READONLY=True")
+	assert.NotContains(t, annexShellEnvs("/data/user/repo.git", annexCommands["p2pstdio"]), "GIT_ANNEX_SHELL_READONLY=True")
+}
+
+func TestAnnexObjectLimitMessage(t *testing.T) {
+	oldMaxObjectCount := setting.Annex.MaxObjectCount
+	defer func() {
+		setting.Annex.MaxObjectCount = oldMaxObjectCount
+	}()
+
+	setting.Annex.MaxObjectCount = 0
+	assert.Empty(t, annexObjectLimitMessage(1000000))
+
+	setting.Annex.MaxObjectCount = 100
+	assert.Empty(t, annexObjectLimitMessage(0))
+	assert.Empty(t, annexObjectLimitMessage(99))
+	assert.Contains(t, annexObjectLimitMessage(100), "limit of 100 git-annex objects")
+	assert.Contains(t, annexObjectLimitMessage(150), "git annex dropunused")
+}
+
+func TestAnnexPutChecker(t *testing.T) {
+	count := 99
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/internal/annex/object-count/1", r.URL.Path)
+		_, _ = fmt.Fprintf(w, `{"count": %d}`, count)
+	})()
+
+	oldMaxFileSize, oldMaxObjectCount := setting.Annex.MaxFileSize, setting.Annex.MaxObjectCount
+	defer func() {
+		setting.Annex.MaxFileSize, setting.Annex.MaxObjectCount = oldMaxFileSize, oldMaxObjectCount
+	}()
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoID: 1}
+
+	setting.Annex.MaxFileSize = 10
+	setting.Annex.MaxObjectCount = 0
+	checkPut := annexPutChecker(context.Background(), results)
+	assert.Empty(t, checkPut("SHA256E-s10--aa"))
+	assert.Equal(t, "The git-annex content is larger than the limit of 10 bytes", checkPut("SHA256E-s11--aa"))
+
+	// puts are checked against the objects in the repository at the time, like recvkey
+	setting.Annex.MaxObjectCount = 100
+	checkPut = annexPutChecker(context.Background(), results)
+	assert.Empty(t, checkPut("SHA256E-s10--aa"))
+	count = 100
+	assert.Contains(t, checkPut("SHA256E-s10--aa"), "limit of 100 git-annex objects")
+	assert.Equal(t, "The git-annex content is larger than the limit of 10 bytes", checkPut("SHA256E-s11--aa"))
+}
+
+func TestAnnexObjectWarning(t *testing.T) {
+	oldMaxObjectCount, oldWarning := setting.Annex.MaxObjectCount, setting.Annex.ObjectCountWarning
+	defer func() {
+		setting.Annex.MaxObjectCount, setting.Annex.ObjectCountWarning = oldMaxObjectCount, oldWarning
+	}()
+
+	setting.Annex.MaxObjectCount = 100
+	setting.Annex.ObjectCountWarning = 0
+	assert.Empty(t, annexObjectWarning(98))
+
+	// uploads from the soft limit on are warned about, but only the hard limit rejects them
+	setting.Annex.ObjectCountWarning = 80
+	assert.Empty(t, annexObjectWarning(0))
+	assert.Empty(t, annexObjectWarning(78))
+	assert.Equal(t, `Warning: this repository holds 80 of at most 100 git-annex objects, please remove unused content with "git annex unused", "git annex dropunused" and "git annex forget" before uploads are rejected`, annexObjectWarning(79))
+	assert.Empty(t, annexObjectLimitMessage(99))
+	assert.NotEmpty(t, annexObjectWarning(99))
+	assert.NotEmpty(t, annexObjectLimitMessage(100))
+
+	// the warning works without a hard limit too
+	setting.Annex.MaxObjectCount = 0
+	assert.Equal(t, `Warning: this repository holds 1000 git-annex objects, please remove unused content with "git annex unused", "git annex dropunused" and "git annex forget"`, annexObjectWarning(999))
+	assert.Empty(t, annexObjectLimitMessage(1000))
+}
+
+func TestAnnexKeys(t *testing.T) {
+	words := []string{"git-annex-shell", "dropkey", "/user/repo.git", "--quiet", "--force", "SHA256E-s1--abc", "SHA256E-s2--def", "--", "remoteuuid=1234", "associatedfile=a.bin"}
+	assert.Equal(t, []string{"SHA256E-s1--abc", "SHA256E-s2--def"}, annexKeys(words))
+	assert.Empty(t, annexKeys([]string{"git-annex-shell", "dropkey", "/user/repo.git"}))
+}
+
+func TestAnnexFileSizeMessage(t *testing.T) {
+	oldMaxFileSize := setting.Annex.MaxFileSize
+	defer func() {
+		setting.Annex.MaxFileSize = oldMaxFileSize
+	}()
+
+	setting.Annex.MaxFileSize = 0
+	assert.Empty(t, annexFileSizeMessage("SHA256E-s1073741824--abc.bin"))
+
+	setting.Annex.MaxFileSize = 1024
+	assert.Empty(t, annexFileSizeMessage("SHA256E-s1024--abc.bin"))
+	assert.Equal(t, "The git-annex content is larger than the limit of 1024 bytes", annexFileSizeMessage("SHA256E-s1025--abc.bin"))
+	assert.Empty(t, annexFileSizeMessage("URL--https&c%%example.com%big.iso"))
+}
+
+func TestAnnexGCryptMessage(t *testing.T) {
+	oldAllowGCrypt := setting.Annex.AllowGCrypt
+	defer func() {
+		setting.Annex.AllowGCrypt = oldAllowGCrypt
+	}()
+
+	setting.Annex.AllowGCrypt = true
+	assert.Empty(t, annexGCryptMessage("gcryptsetup"))
+	assert.Empty(t, annexGCryptMessage("recvkey"))
+
+	setting.Annex.AllowGCrypt = false
+	assert.Equal(t, "Encrypted git-annex remotes (gcrypt) are not allowed on this server, please use an unencrypted remote", annexGCryptMessage("gcryptsetup"))
+	assert.Empty(t, annexGCryptMessage("recvkey"))
+	assert.Empty(t, annexGCryptMessage(annexConfiglistVerb))
+}
+
+func TestNewAnnexCapabilities(t *testing.T) {
+	oldMaxFileSize := setting.Annex.MaxFileSize
+	oldMaxObjectCount := setting.Annex.MaxObjectCount
+	defer func() {
+		setting.Annex.MaxFileSize = oldMaxFileSize
+		setting.Annex.MaxObjectCount = oldMaxObjectCount
+	}()
+
+	setting.Annex.MaxFileSize = 1024
+	setting.Annex.MaxObjectCount = 100
+	out := &bytes.Buffer{}
+	assert.NoError(t, json.NewEncoder(out).Encode(newAnnexCapabilities([]string{"SHA256E", "WORM"}, 42)))
+	assert.JSONEq(t, `{"type":"gitea","version":1,"backends":["SHA256E","WORM"],"p2p":true,"maxFileSize":1024,"maxObjectCount":100,"objectCount":42}`, out.String())
+
+	// the probe only needs read access
+	assert.Equal(t, perm.AccessModeRead, annexCommands[annexCapabilitiesVerb])
+}
+
+func TestAnnexOpLimiter(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	ctx := context.Background()
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the content of the DATA message looks like operations but must not be counted
+	session := "AUTH 1234-uuid token\nVERSION 1\nCHECKPRESENT SHA256E-s1--aa\nPUT file.bin SHA256E-s14--bb\nDATA 14\nGET 0 x y\nPUT \nVALID\n" +
+		"LOCKCONTENT SHA256E-s1--aa\nREMOVE SHA256E-s1--aa\n"
+	limiter := &annexOpLimiter{r: strings.NewReader(session), max: 4, cancel: cancel}
+	out, err := io.ReadAll(limiter)
+	assert.NoError(t, err)
+	assert.Equal(t, session, string(out))
+	assert.EqualValues(t, 4, limiter.ops)
+	assert.False(t, limiter.Exceeded())
+	assert.NoError(t, cmdCtx.Err())
+
+	// a message split across reads is still counted
+	limiter = &annexOpLimiter{r: io.MultiReader(strings.NewReader(session), strings.NewReader("GET 0 file.bin SHA2"), strings.NewReader("56E-s1--aa\n")), max: 4, cancel: cancel}
+	_, err = io.ReadAll(limiter)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.True(t, limiter.Exceeded())
+	assert.ErrorIs(t, cmdCtx.Err(), context.Canceled)
+
+	// the client is told why the session ended
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{opLimiter: limiter})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Too many git-annex operations in one session, the limit is 4")
+
+	// with [annex] PROTECT_DROPKEY a session of a user who may not drop content is ended when it removes content
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	limiter = &annexOpLimiter{r: strings.NewReader(session), denyRemove: true, cancel: cancel}
+	out, err = io.ReadAll(limiter)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.NotContains(t, string(out), "REMOVE")
+	assert.True(t, limiter.RemoveDenied())
+	assert.False(t, limiter.Exceeded())
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{opLimiter: limiter})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Dropping git-annex content deletes it from the server for good")
+
+	// content put in a session is checked like that of recvkey
+	oldMaxFileSize := setting.Annex.MaxFileSize
+	defer func() {
+		setting.Annex.MaxFileSize = oldMaxFileSize
+	}()
+	setting.Annex.MaxFileSize = 10
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	limiter = &annexOpLimiter{r: strings.NewReader(session), checkPut: annexFileSizeMessage, cancel: cancel}
+	out, err = io.ReadAll(limiter)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.NotContains(t, string(out), "PUT")
+	assert.Equal(t, "The git-annex content is larger than the limit of 10 bytes", limiter.PutDenied())
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{opLimiter: limiter})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: The git-annex content is larger than the limit of 10 bytes")
+
+	setting.Annex.MaxFileSize = 14
+	limiter = &annexOpLimiter{r: strings.NewReader(session), checkPut: annexFileSizeMessage, cancel: cancel}
+	out, err = io.ReadAll(limiter)
+	assert.NoError(t, err)
+	assert.Equal(t, session, string(out))
+	assert.Empty(t, limiter.PutDenied())
+
+	// content got in a session is fetched from the object storage first, the GET inside the DATA isn't
+	var got []string
+	limiter = &annexOpLimiter{r: strings.NewReader(session + "GET 0 file.bin SHA256E-s1--aa\n"), checkGet: func(key string) string {
+		got = append(got, key)
+		return ""
+	}, cancel: cancel}
+	_, err = io.ReadAll(limiter)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SHA256E-s1--aa"}, got)
+
+	// and the session ends if that fails
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	limiter = &annexOpLimiter{r: strings.NewReader(session + "GET 0 file.bin SHA256E-s1--aa\n"), checkGet: func(key string) string {
+		return "Unable to fetch the git-annex content from the object storage, please retry later"
+	}, cancel: cancel}
+	_, err = io.ReadAll(limiter)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, "Unable to fetch the git-annex content from the object storage, please retry later", limiter.GetDenied())
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{opLimiter: limiter})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Unable to fetch the git-annex content from the object storage, please retry later")
+}
+
+func TestSyncAnnexStorage(t *testing.T) {
+	requests := map[string][]string{}
+	failing := ""
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		op := path.Base(path.Dir(r.URL.Path))
+		if !strings.HasPrefix(op, "storage-") {
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		assert.Equal(t, "7", path.Base(r.URL.Path))
+		requests[op] = r.URL.Query()["key"]
+		if op == failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"user_msg":"Unable to save the git-annex content to the object storage, please retry"}`))
+			return
+		}
+		_, _ = w.Write([]byte("success"))
+	})()
+
+	ctx := context.Background()
+	results := &private.ServCommandResults{RepoID: 7}
+	words := []string{"git-annex-shell", "recvkey", "/user2/repo1.git", "SHA256E-s1--aa", "--"}
+
+	assert.NoError(t, syncAnnexStorage(ctx, "recvkey", words, nil, results))
+	assert.Equal(t, map[string][]string{"storage-save": {"SHA256E-s1--aa"}}, requests)
+
+	requests = map[string][]string{}
+	words[1] = "dropkey"
+	assert.NoError(t, syncAnnexStorage(ctx, "dropkey", words, nil, results))
+	assert.Equal(t, map[string][]string{"storage-delete": {"SHA256E-s1--aa"}}, requests)
+
+	// the keys of a session go both ways, the main process tells which content is still there
+	requests = map[string][]string{}
+	limiter := &annexOpLimiter{r: strings.NewReader("PUT file.bin SHA256E-s1--aa\nREMOVE SHA256E-s1--bb\n"), trackKeys: true}
+	_, err := io.ReadAll(limiter)
+	assert.NoError(t, err)
+	assert.NoError(t, syncAnnexStorage(ctx, "p2pstdio", []string{"git-annex-shell", "p2pstdio", "/user2/repo1.git"}, limiter, results))
+	assert.Equal(t, map[string][]string{
+		"storage-save":   {"SHA256E-s1--aa", "SHA256E-s1--bb"},
+		"storage-delete": {"SHA256E-s1--aa", "SHA256E-s1--bb"},
+	}, requests)
+
+	// other commands leave the object storage alone
+	requests = map[string][]string{}
+	assert.NoError(t, syncAnnexStorage(ctx, "sendkey", words, nil, results))
+	assert.Empty(t, requests)
+
+	// the client is told when the content couldn't be saved, so it tries again
+	failing = "storage-save"
+	words[1] = "recvkey"
+	stderr := captureStderr(t, func() {
+		err = syncAnnexStorage(ctx, "recvkey", words, nil, results)
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Unable to save the git-annex content to the object storage, please retry")
+}
+
+func TestMayDropAnnexContent(t *testing.T) {
+	oldProtect := setting.Annex.ProtectDropkey
+	defer func() {
+		setting.Annex.ProtectDropkey = oldProtect
+	}()
+	admin := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2", RepoAdmin: true}
+	writer := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user4"}
+
+	// unprotected, anyone who may write may drop
+	setting.Annex.ProtectDropkey = false
+	assert.True(t, mayDropAnnexContent(admin))
+	assert.True(t, mayDropAnnexContent(writer))
+
+	// protected, only administrators of the repository may
+	setting.Annex.ProtectDropkey = true
+	assert.True(t, mayDropAnnexContent(admin))
+	assert.False(t, mayDropAnnexContent(writer))
+}
+
+func TestLFSUnavailableWarning(t *testing.T) {
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", LFSUnavailable: true}
+	assert.Equal(t, "Warning: user2/repo1 uses Git LFS but LFS is disabled on this server, LFS files will only be checked out as pointer files", lfsUnavailableWarning("git-upload-pack", results))
+	assert.Empty(t, lfsUnavailableWarning("git-receive-pack", results))
+
+	results.LFSUnavailable = false
+	assert.Empty(t, lfsUnavailableWarning("git-upload-pack", results))
+}
+
+func TestReadOnlyCredentialMessage(t *testing.T) {
+	readOnlyKey := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2", UserID: 2, KeyReadOnly: true}
+	readOnlyAccount := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2", UserID: 2, AccountReadOnly: true}
+	writable := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2", UserID: 2}
+
+	// pushes and git-annex uploads and drops are rejected
+	assert.Equal(t, "This key is read-only, it can't be used to write to repositories", readOnlyCredentialMessage(readOnlyKey, annexCommands["recvkey"]))
+	assert.Equal(t, "This key is read-only, it can't be used to write to repositories", readOnlyCredentialMessage(readOnlyKey, allowedCommands["git-receive-pack"]))
+	assert.Equal(t, "This account is read-only, it can't be used to write to repositories over SSH", readOnlyCredentialMessage(readOnlyAccount, annexCommands["dropkey"]))
+	assert.Empty(t, readOnlyCredentialMessage(writable, allowedCommands["git-receive-pack"]))
+
+	// reads are allowed
+	assert.Empty(t, readOnlyCredentialMessage(readOnlyKey, allowedCommands["git-upload-pack"]))
+	assert.Empty(t, readOnlyCredentialMessage(readOnlyAccount, annexCommands["sendkey"]))
+}
+
+func TestUnacceptedCLAMessage(t *testing.T) {
+	accepted := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2", UserID: 2}
+	notAccepted := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user4", UserID: 4, UnacceptedCLA: "https://example.com/cla"}
+
+	assert.Empty(t, unacceptedCLAMessage(accepted))
+	assert.Equal(t, "Pushing to user2/repo1 requires accepting its contributor license agreement at https://example.com/cla", unacceptedCLAMessage(notAccepted))
+}
+
+func TestMissingTwoFactorMessage(t *testing.T) {
+	oldAppURL := setting.AppURL
+	defer func() {
+		setting.AppURL = oldAppURL
+	}()
+	setting.AppURL = "https://try.gitea.io/"
+
+	enrolled := &private.ServCommandResults{UserName: "user24", UserID: 24, UserTwoFactorEnabled: true, Require2FA: true}
+	notEnrolled := &private.ServCommandResults{UserName: "user2", UserID: 2, Require2FA: true}
+	deployKey := &private.ServCommandResults{UserName: "user2", UserID: 2, DeployKeyID: 1, Require2FA: true}
+	notRequired := &private.ServCommandResults{UserName: "user2", UserID: 2}
+
+	assert.Empty(t, missingTwoFactorMessage(enrolled))
+	assert.Equal(t, "Two-factor authentication is required to use git over SSH, please enable it at https://try.gitea.io/user/settings/security", missingTwoFactorMessage(notEnrolled))
+	assert.Empty(t, missingTwoFactorMessage(deployKey))
+	assert.Empty(t, missingTwoFactorMessage(notRequired))
+}
+
+func TestDiskHighWatermarkMessage(t *testing.T) {
+	const msg = "Server storage is nearly full, writes temporarily disabled"
+	oldWatermark, oldUsage := setting.Repository.DiskHighWatermark, repoDiskUsage
+	defer func() {
+		setting.Repository.DiskHighWatermark, repoDiskUsage = oldWatermark, oldUsage
+	}()
+	usage, usageErr := 96.5, error(nil)
+	repoDiskUsage = func() (float64, error) {
+		return usage, usageErr
+	}
+
+	setting.Repository.DiskHighWatermark = 0
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "", ""))
+
+	// writes are rejected above the watermark, reads still work
+	setting.Repository.DiskHighWatermark = 95
+	assert.Equal(t, msg, diskHighWatermarkMessage(perm.AccessModeWrite, "", ""))
+	assert.Equal(t, msg, diskHighWatermarkMessage(perm.AccessModeWrite, "recvkey", ""))
+	assert.Equal(t, msg, diskHighWatermarkMessage(perm.AccessModeWrite, "", "upload"))
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeRead, "", ""))
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeRead, "sendkey", ""))
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeRead, "", "download"))
+	// dropping content frees space and locks take none
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "dropkey", ""))
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "", "lock"))
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "", "unlock"))
+
+	usage = 95
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "", ""))
+
+	// writes go on if the usage is unknown
+	usage, usageErr = 100, errors.New("statfs failed")
+	assert.Empty(t, diskHighWatermarkMessage(perm.AccessModeWrite, "", ""))
+}
+
+func TestRepoLockedMessage(t *testing.T) {
+	const msg = "Repository is temporarily locked by an administrator, please retry later"
+	for _, tc := range []struct {
+		lock    string
+		mode    perm.AccessMode
+		blocked bool
+	}{
+		{"", allowedCommands["git-upload-pack"], false},
+		{"", allowedCommands["git-receive-pack"], false},
+		{private.RepoLockWrite, allowedCommands["git-upload-pack"], false},
+		{private.RepoLockWrite, allowedCommands["git-upload-archive"], false},
+		{private.RepoLockWrite, annexCommands["sendkey"], false},
+		{private.RepoLockWrite, lfsVerbs["download"], false},
+		{private.RepoLockWrite, allowedCommands["git-receive-pack"], true},
+		{private.RepoLockWrite, annexCommands["recvkey"], true},
+		{private.RepoLockWrite, lfsVerbs["upload"], true},
+		{private.RepoLockAll, allowedCommands["git-upload-pack"], true},
+		{private.RepoLockAll, annexCommands["sendkey"], true},
+		{private.RepoLockAll, allowedCommands["git-receive-pack"], true},
+	} {
+		results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoLock: tc.lock}
+		if tc.blocked {
+			assert.Equal(t, msg, repoLockedMessage(results, tc.mode), "%s %v", tc.lock, tc.mode)
+		} else {
+			assert.Empty(t, repoLockedMessage(results, tc.mode), "%s %v", tc.lock, tc.mode)
+		}
+	}
+}
+
+func TestKeyActivityVerb(t *testing.T) {
+	assert.Equal(t, "git-upload-pack", keyActivityVerb("git-upload-pack", ""))
+	assert.Equal(t, "git-annex-shell recvkey", keyActivityVerb(gitAnnexShellVerb, "recvkey"))
+}
+
+func TestGitNamespaceEnvs(t *testing.T) {
+	assert.Empty(t, gitNamespaceEnvs("git-upload-pack", ""))
+	assert.Empty(t, gitNamespaceEnvs(gitAnnexShellVerb, "tenant-a"))
+	assert.Equal(t, []string{"GIT_NAMESPACE=tenant-a"}, gitNamespaceEnvs("git-receive-pack", "tenant-a"))
+
+	// one repository holding the refs of two tenants
+	repoPath := t.TempDir()
+	gitEnv := append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	gitCmd := func(env []string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	gitCmd(gitEnv, "init", "--bare", repoPath)
+	commitID := gitCmd(gitEnv, "-C", repoPath, "commit-tree", "-m", "init", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	gitCmd(gitEnv, "-C", repoPath, "update-ref", "refs/namespaces/tenant-a/refs/heads/main", commitID)
+	gitCmd(gitEnv, "-C", repoPath, "update-ref", "refs/namespaces/tenant-b/refs/heads/secret", commitID)
+
+	// the transport commands only see the refs of their namespace, without the prefix
+	advertisement := gitCmd(append(gitEnv, gitNamespaceEnvs("git-upload-pack", "tenant-a")...), "upload-pack", "--advertise-refs", repoPath)
+	assert.Contains(t, advertisement, "refs/heads/main")
+	assert.NotContains(t, advertisement, "refs/namespaces/")
+	assert.NotContains(t, advertisement, "secret")
+
+	// and pushes update the refs inside their namespace
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	gitCmd(gitEnv, "init", clonePath)
+	gitCmd(gitEnv, "-C", clonePath, "commit", "--allow-empty", "-m", "feature")
+	gitCmd(append(gitEnv, gitNamespaceEnvs("git-receive-pack", "tenant-b")...), "-C", clonePath, "push", repoPath, "HEAD:refs/heads/feature")
+	assert.NotEmpty(t, gitCmd(gitEnv, "-C", repoPath, "for-each-ref", "refs/namespaces/tenant-b/refs/heads/feature"))
+	assert.Empty(t, gitCmd(gitEnv, "-C", repoPath, "for-each-ref", "refs/heads/"))
+}
+
+func TestAlternateObjectDir(t *testing.T) {
+	oldRepoRootPath := setting.RepoRootPath
+	defer func() {
+		setting.RepoRootPath = oldRepoRootPath
+	}()
+
+	setting.RepoRootPath = t.TempDir()
+	outside := t.TempDir()
+	base := filepath.Join(setting.RepoRootPath, "user", "base.git")
+	assert.NoError(t, os.MkdirAll(filepath.Join(base, "objects"), os.ModePerm))
+	assert.NoError(t, os.MkdirAll(filepath.Join(outside, "outside.git", "objects"), os.ModePerm))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "outside.git"), filepath.Join(setting.RepoRootPath, "user", "outside.git")))
+
+	root, err := filepath.EvalSymlinks(setting.RepoRootPath)
+	assert.NoError(t, err)
+	expected := filepath.Join(root, "user", "base.git", "objects")
+	assert.Equal(t, expected, alternateObjectDir("git-upload-pack", base))
+	assert.Equal(t, expected, alternateObjectDir("git-upload-archive", base))
+	assert.Empty(t, alternateObjectDir("git-receive-pack", base))
+	assert.Empty(t, alternateObjectDir("git-upload-pack", ""))
+	assert.Empty(t, alternateObjectDir("git-upload-pack", filepath.Join(setting.RepoRootPath, "user", "missing.git")))
+	assert.Empty(t, alternateObjectDir("git-upload-pack", filepath.Join(outside, "outside.git")))
+	assert.Empty(t, alternateObjectDir("git-upload-pack", filepath.Join(setting.RepoRootPath, "user", "outside.git")))
+}
+
+func TestPushGuard(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	ctx := context.Background()
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pktLine := func(s string) string {
+		return fmt.Sprintf("%04x%s", len(s)+4, s)
+	}
+	oldOID := strings.Repeat("1", 40)
+	newOID := strings.Repeat("2", 40)
+
+	// the pack data after the flush may contain anything
+	push := pktLine(oldOID+" "+newOID+" refs/heads/feature\x00report-status side-band-64k agent=git/2.39.5\n") +
+		pktLine(oldOID+" "+newOID+" refs/heads/mainline\n") + "0000" + "PACK " + oldOID + " " + newOID + " refs/heads/main"
+	guard := &pushGuard{r: strings.NewReader(push), defaultBranch: "refs/heads/main", cancel: cancel}
+	out, err := io.ReadAll(guard)
+	assert.NoError(t, err)
+	assert.Equal(t, push, string(out))
+	assert.Empty(t, guard.Blocked())
+	assert.NoError(t, cmdCtx.Err())
+
+	// a command split across reads is still checked, deletions are blocked too
+	deletion := pktLine(oldOID + " " + strings.Repeat("0", 40) + " refs/heads/main\n")
+	guard = &pushGuard{r: io.MultiReader(strings.NewReader(pktLine(oldOID+" "+newOID+" refs/heads/feature\x00report-status\n")), strings.NewReader(deletion[:30]), strings.NewReader(deletion[30:])), defaultBranch: "refs/heads/main", cancel: cancel}
+	_, err = io.ReadAll(guard)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.NotEmpty(t, guard.Blocked())
+	assert.ErrorIs(t, cmdCtx.Err(), context.Canceled)
+
+	// the client is told why the push was rejected
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{branchGuard: guard})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, `Gitea: Pushing to the default branch "main" is not allowed, please open a pull request instead`)
+
+	// the git-annex branch can be updated, but not deleted
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	update := pktLine(oldOID+" "+newOID+" refs/heads/git-annex\x00report-status\n") + "0000"
+	guard = &pushGuard{r: strings.NewReader(update), protectAnnexBranch: true, cancel: cancel}
+	out, err = io.ReadAll(guard)
+	assert.NoError(t, err)
+	assert.Equal(t, update, string(out))
+	assert.Empty(t, guard.Blocked())
+
+	annexDeletion := pktLine(oldOID+" "+strings.Repeat("0", 40)+" refs/heads/git-annex\x00report-status\n") + "0000"
+	guard = &pushGuard{r: strings.NewReader(annexDeletion), cancel: cancel}
+	_, err = io.ReadAll(guard)
+	assert.NoError(t, err)
+	assert.Empty(t, guard.Blocked())
+
+	guard = &pushGuard{r: strings.NewReader(annexDeletion), protectAnnexBranch: true, cancel: cancel}
+	_, err = io.ReadAll(guard)
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.ErrorIs(t, cmdCtx.Err(), context.Canceled)
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{branchGuard: guard})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, stderr, "Gitea: Deleting the git-annex branch is not allowed, it holds the git-annex metadata of the repository")
+
+	// branches whose first matching protection rule requires status checks can't be pushed to
+	rules := servBranchRules([]private.ServBranchRule{
+		{RuleName: "release/old"},
+		{RuleName: "main", RequireStatusCheck: true},
+		{RuleName: "release/*", RequireStatusCheck: true},
+	})
+	for ref, blocked := range map[string]bool{
+		"refs/heads/main":        true,
+		"refs/heads/release/1.0": true,
+		"refs/heads/release/old": false,
+		"refs/heads/feature":     false,
+		"refs/tags/main":         false,
+	} {
+		cmdCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		push := pktLine(oldOID+" "+newOID+" "+ref+"\x00report-status\n") + "0000"
+		guard = &pushGuard{r: strings.NewReader(push), branchRules: rules, cancel: cancel}
+		_, err = io.ReadAll(guard)
+		if !blocked {
+			assert.NoError(t, err, ref)
+			assert.Empty(t, guard.Blocked(), ref)
+			continue
+		}
+		assert.ErrorIs(t, err, io.ErrClosedPipe, ref)
+		branch := strings.TrimPrefix(ref, "refs/heads/")
+		assert.Equal(t, fmt.Sprintf("Branch %q requires status checks to pass before changes are merged, please push to another branch and open a pull request instead", branch), guard.Blocked(), ref)
+	}
+	assert.Nil(t, servBranchRules(nil))
+
+	// existing branches can still be updated and deleted if the creation of branches is denied
+	zeroOID := strings.Repeat("0", 40)
+	for command, blocked := range map[string]bool{
+		zeroOID + " " + newOID + " refs/heads/feature":  true,
+		oldOID + " " + newOID + " refs/heads/feature":   false,
+		oldOID + " " + zeroOID + " refs/heads/feature":  false,
+		zeroOID + " " + newOID + " refs/tags/v1.0":      false,
+		zeroOID + " " + newOID + " refs/for/main/topic": false,
+	} {
+		cmdCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		push := pktLine(command+"\x00report-status\n") + "0000"
+		guard = &pushGuard{r: strings.NewReader(push), denyBranchCreation: true, cancel: cancel}
+		_, err = io.ReadAll(guard)
+		if !blocked {
+			assert.NoError(t, err, command)
+			assert.Empty(t, guard.Blocked(), command)
+			assert.NoError(t, cmdCtx.Err(), command)
+			continue
+		}
+		assert.ErrorIs(t, err, io.ErrClosedPipe, command)
+		assert.ErrorIs(t, cmdCtx.Err(), context.Canceled, command)
+		stderr = captureStderr(t, func() {
+			err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{branchGuard: guard})
+		})
+		assert.Error(t, err)
+		assert.Contains(t, stderr, `Gitea: Creating the branch "feature" is not allowed, only the administrators of the repository may create branches`)
+	}
+}
+
+func TestServHookEnvs(t *testing.T) {
+	envs := servHookEnvs(&private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoID: 1})
+	assert.Contains(t, envs, "GITEA_REPO_IS_PRIVATE=false")
+	assert.Contains(t, envs, "GITEA_REPO_USER_NAME=user2")
+	assert.Contains(t, envs, "GITEA_REPO_NAME=repo1")
+	assert.Contains(t, envs, "GITEA_REPO_ID=1")
+
+	envs = servHookEnvs(&private.ServCommandResults{OwnerName: "user2", RepoName: "repo2", RepoID: 2, RepoIsPrivate: true})
+	assert.Contains(t, envs, "GITEA_REPO_IS_PRIVATE=true")
+	assert.NotContains(t, envs, "GITEA_REPO_IS_PRIVATE=false")
+}
+
+func TestLargeCloneWarning(t *testing.T) {
+	oldWarnLargeClone := setting.Git.WarnLargeClone
+	defer func() {
+		setting.Git.WarnLargeClone = oldWarnLargeClone
+	}()
+
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", RepoSize: 3 * 1024 * 1024 * 1024}
+	setting.Git.WarnLargeClone = 0
+	assert.Empty(t, largeCloneWarning("git-upload-pack", results))
+
+	setting.Git.WarnLargeClone = 1024 * 1024 * 1024
+	assert.Equal(t, "user2/repo1 is a large repository, a full clone downloads up to 3.0 GiB. Consider a shallow clone with --depth if you don't need the full history", largeCloneWarning("git-upload-pack", results))
+	assert.Empty(t, largeCloneWarning("git-receive-pack", results))
+
+	results.RepoSize = setting.Git.WarnLargeClone
+	assert.Empty(t, largeCloneWarning("git-upload-pack", results))
+}
+
+func TestIdleWatcher(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	ctx := context.Background()
+
+	// a child waiting for input that never comes is killed
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := newIdleWatcher(100*time.Millisecond, cancel)
+	go idle.Watch(cmdCtx)
+	gitcmd := exec.CommandContext(cmdCtx, "cat")
+	stdin, err := gitcmd.StdinPipe()
+	assert.NoError(t, err)
+	defer stdin.Close()
+
+	start := time.Now()
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, gitcmd, &servGuards{idle: idle})
+	})
+	assert.Error(t, err)
+	assert.True(t, idle.Idle())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, stderr, "Gitea: Connection was idle for more than 100ms")
+
+	// a child which keeps sending data runs for longer than the idle timeout
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	idle = newIdleWatcher(200*time.Millisecond, cancel)
+	go idle.Watch(cmdCtx)
+	gitcmd = exec.CommandContext(cmdCtx, "sh", "-c", "for i in 1 2 3 4 5; do echo $i; sleep 0.1; done")
+	gitcmd.Stdout = &idleWriter{w: io.Discard, idle: idle}
+	assert.NoError(t, runServCommand(ctx, cmdCtx, gitcmd, &servGuards{idle: idle}))
+	assert.False(t, idle.Idle())
+}
+
+func TestNotifyHold(t *testing.T) {
+	defer mockInternalAPI(nil)()
+
+	ctx := context.Background()
+
+	// a notifychanges held open for the timeout is closed without an error
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	hold := newNotifyHold(100*time.Millisecond, cancel)
+	defer hold.Stop()
+
+	var err error
+	start := time.Now()
+	stderr := captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "sleep", "5"), &servGuards{hold: hold})
+	})
+	assert.NoError(t, err)
+	assert.True(t, hold.Expired())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.NotContains(t, stderr, "Gitea:")
+
+	// a command finishing before the timeout is not affected, and failures are still reported
+	cmdCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	hold = newNotifyHold(time.Minute, cancel)
+	stderr = captureStderr(t, func() {
+		err = runServCommand(ctx, cmdCtx, exec.CommandContext(cmdCtx, "false"), &servGuards{hold: hold})
+	})
+	hold.Stop()
+	assert.Error(t, err)
+	assert.False(t, hold.Expired())
+	assert.Contains(t, stderr, "Gitea: Failed to execute git command")
+}
+
+func TestLogServFinished(t *testing.T) {
+	oldLogServ := logServ
+	oldLogLevels := setting.SSH.LogLevels
+	defer func() {
+		logServ = oldLogServ
+		setting.SSH.LogLevels = oldLogLevels
+	}()
+	setting.SSH.LogLevels = map[string]log.Level{
+		"fetch": log.DEBUG,
+		"push":  log.INFO,
+		"annex": log.NONE,
+	}
+
+	var levels []log.Level
+	var messages []string
+	logServ = func(skip int, level log.Level, format string, v ...interface{}) {
+		levels = append(levels, level)
+		messages = append(messages, fmt.Sprintf(format, v...))
+	}
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1", UserName: "user2"}
+
+	// pushes are logged at info, clones at debug
+	logServFinished("git-receive-pack", "", results, time.Second)
+	logServFinished("git-upload-pack", "", results, 2*time.Second)
+	assert.Equal(t, []log.Level{log.INFO, log.DEBUG}, levels)
+	assert.Equal(t, []string{
+		"SSH: git-receive-pack user2/repo1 by user2 finished in 1s",
+		"SSH: git-upload-pack user2/repo1 by user2 finished in 2s",
+	}, messages)
+
+	// classes set to none aren't logged, unconfigured ones are logged at debug
+	levels = nil
+	logServFinished(gitAnnexShellVerb, "sendkey", results, time.Second)
+	logServFinished("git-upload-archive", "", results, time.Second)
+	assert.Equal(t, []log.Level{log.DEBUG}, levels)
+}
+
+func TestGitProtocolVersion(t *testing.T) {
+	assert.Equal(t, "0", gitProtocolVersion(""))
+	assert.Equal(t, "2", gitProtocolVersion("version=2"))
+	assert.Equal(t, "1", gitProtocolVersion("version=1"))
+	assert.Equal(t, "2", gitProtocolVersion("version=2:version=1"))
+	assert.Equal(t, "0", gitProtocolVersion("version=foo"))
+	assert.Equal(t, "1", gitProtocolVersion("version=1:version=3"))
+}
+
+func TestTouchRepo(t *testing.T) {
+	var touched []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		touched = append(touched, r.URL.Path)
+		_, _ = w.Write([]byte("success"))
+	})()
+	ctx := context.Background()
+
+	touchRepo(ctx, &private.ServCommandResults{RepoID: 1})
+	touchRepo(ctx, &private.ServCommandResults{RepoID: 2, RepoLastAccess: time.Now().Add(-2 * private.RepoTouchInterval)})
+	// accessed recently, the main process wouldn't update it
+	touchRepo(ctx, &private.ServCommandResults{RepoID: 3, RepoLastAccess: time.Now().Add(-time.Second)})
+
+	assert.Equal(t, []string{"/api/internal/serv/touch/1", "/api/internal/serv/touch/2"}, touched)
+}
+
+func TestRecordGitProtocol(t *testing.T) {
+	var recorded []string
+	defer mockInternalAPI(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/internal/serv/protocol" {
+			recorded = append(recorded, r.URL.Query().Get("verb")+" v"+r.URL.Query().Get("version"))
+		}
+		_, _ = w.Write([]byte("{}"))
+	})()
+	ctx := context.Background()
+	results := &private.ServCommandResults{OwnerName: "user2", RepoName: "repo1"}
+
+	t.Setenv("GIT_PROTOCOL", "version=2")
+	recordGitProtocol(ctx, "git-upload-pack", results)
+	// only the git transport is counted
+	recordGitProtocol(ctx, gitAnnexShellVerb, results)
+	recordGitProtocol(ctx, lfsAuthenticateVerb, results)
+
+	t.Setenv("GIT_PROTOCOL", "")
+	recordGitProtocol(ctx, "git-receive-pack", results)
+
+	assert.Equal(t, []string{"git-upload-pack v2", "git-receive-pack v0"}, recorded)
+}
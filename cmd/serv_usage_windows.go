@@ -0,0 +1,13 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package cmd
+
+import "os"
+
+// processMaxRSS returns 0, the peak memory use of processes isn't reported on Windows
+func processMaxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -5,8 +5,6 @@ package main
 
 import (
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
 
 	"code.gitea.io/gitea/modules/log"
@@ -14,7 +12,6 @@ import (
 	"code.gitea.io/gitea/modules/util"
 
 	"github.com/urfave/cli"
-	ini "gopkg.in/ini.v1"
 )
 
 // EnvironmentPrefix environment variables prefixed with this represent ini values to write
@@ -95,61 +92,21 @@ func runEnvironmentToIni(c *cli.Context) error {
 	providedWorkPath := c.String("work-path")
 	setting.SetCustomPathAndConf(providedCustom, providedConf, providedWorkPath)
 
-	cfg := ini.Empty()
 	isFile, err := util.IsFile(setting.CustomConf)
 	if err != nil {
 		log.Fatal("Unable to check if %s is a file. Error: %v", setting.CustomConf, err)
 	}
-	if isFile {
-		if err := cfg.Append(setting.CustomConf); err != nil {
-			log.Fatal("Failed to load custom conf '%s': %v", setting.CustomConf, err)
-		}
-	} else {
+	if !isFile {
 		log.Warn("Custom config '%s' not found, ignore this if you're running first time", setting.CustomConf)
 	}
-	cfg.NameMapper = ini.SnackCase
-
-	changed := false
+	cfg, err := setting.NewConfigProviderFromFile(&setting.Options{CustomConf: setting.CustomConf, AllowEmpty: true})
+	if err != nil {
+		log.Fatal("Failed to load custom conf '%s': %v", setting.CustomConf, err)
+	}
 
 	prefix := c.String("prefix") + "__"
+	changed := setting.EnvironmentToConfig(cfg, prefix, os.Environ())
 
-	for _, kv := range os.Environ() {
-		idx := strings.IndexByte(kv, '=')
-		if idx < 0 {
-			continue
-		}
-		eKey := kv[:idx]
-		value := kv[idx+1:]
-		if !strings.HasPrefix(eKey, prefix) {
-			continue
-		}
-		eKey = eKey[len(prefix):]
-		sectionName, keyName := DecodeSectionKey(eKey)
-		if len(keyName) == 0 {
-			continue
-		}
-		section, err := cfg.GetSection(sectionName)
-		if err != nil {
-			section, err = cfg.NewSection(sectionName)
-			if err != nil {
-				log.Error("Error creating section: %s : %v", sectionName, err)
-				continue
-			}
-		}
-		key := section.Key(keyName)
-		if key == nil {
-			key, err = section.NewKey(keyName, value)
-			if err != nil {
-				log.Error("Error creating key: %s in section: %s with value: %s : %v", keyName, sectionName, value, err)
-				continue
-			}
-		}
-		oldValue := key.Value()
-		if !changed && oldValue != value {
-			changed = true
-		}
-		key.SetValue(value)
-	}
 	destination := c.String("out")
 	if len(destination) == 0 {
 		destination = setting.CustomConf
@@ -175,62 +132,3 @@ func runEnvironmentToIni(c *cli.Context) error {
 	}
 	return nil
 }
-
-const escapeRegexpString = "_0[xX](([0-9a-fA-F][0-9a-fA-F])+)_"
-
-var escapeRegex = regexp.MustCompile(escapeRegexpString)
-
-// DecodeSectionKey will decode a portable string encoded Section__Key pair
-// Portable strings are considered to be of the form [A-Z0-9_]*
-// We will encode a disallowed value as the UTF8 byte string preceded by _0X and
-// followed by _. E.g. _0X2C_ for a '-' and _0X2E_ for '.'
-// Section and Key are separated by a plain '__'.
-// The entire section can be encoded as a UTF8 byte string
-func DecodeSectionKey(encoded string) (string, string) {
-	section := ""
-	key := ""
-
-	inKey := false
-	last := 0
-	escapeStringIndices := escapeRegex.FindAllStringIndex(encoded, -1)
-	for _, unescapeIdx := range escapeStringIndices {
-		preceding := encoded[last:unescapeIdx[0]]
-		if !inKey {
-			if splitter := strings.Index(preceding, "__"); splitter > -1 {
-				section += preceding[:splitter]
-				inKey = true
-				key += preceding[splitter+2:]
-			} else {
-				section += preceding
-			}
-		} else {
-			key += preceding
-		}
-		toDecode := encoded[unescapeIdx[0]+3 : unescapeIdx[1]-1]
-		decodedBytes := make([]byte, len(toDecode)/2)
-		for i := 0; i < len(toDecode)/2; i++ {
-			// Can ignore error here as we know these should be hexadecimal from the regexp
-			byteInt, _ := strconv.ParseInt(toDecode[2*i:2*i+2], 16, 0)
-			decodedBytes[i] = byte(byteInt)
-		}
-		if inKey {
-			key += string(decodedBytes)
-		} else {
-			section += string(decodedBytes)
-		}
-		last = unescapeIdx[1]
-	}
-	remaining := encoded[last:]
-	if !inKey {
-		if splitter := strings.Index(remaining, "__"); splitter > -1 {
-			section += remaining[:splitter]
-			key += remaining[splitter+2:]
-		} else {
-			section += remaining
-		}
-	} else {
-		key += remaining
-	}
-	section = strings.ToLower(section)
-	return section, key
-}
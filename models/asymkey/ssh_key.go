@@ -67,6 +67,11 @@ func (key *PublicKey) OmitEmail() string {
 	return strings.Join(strings.Split(key.Content, " ")[:2], " ")
 }
 
+// IsReadOnly checks if the key can only be used to read repositories
+func (key *PublicKey) IsReadOnly() bool {
+	return key.Mode == perm.AccessModeRead
+}
+
 // AuthorizedString returns formatted public key string for authorized_keys file.
 //
 // TODO: Consider dropping this function
@@ -91,7 +96,8 @@ func addKey(ctx context.Context, key *PublicKey) (err error) {
 }
 
 // AddPublicKey adds new public key to database and authorized_keys file.
-func AddPublicKey(ownerID int64, name, content string, authSourceID int64) (*PublicKey, error) {
+// A key with mode perm.AccessModeRead can only be used to read repositories.
+func AddPublicKey(ownerID int64, name, content string, authSourceID int64, mode perm.AccessMode) (*PublicKey, error) {
 	log.Trace(content)
 
 	fingerprint, err := CalcFingerprint(content)
@@ -124,7 +130,7 @@ func AddPublicKey(ownerID int64, name, content string, authSourceID int64) (*Pub
 		Name:          name,
 		Fingerprint:   fingerprint,
 		Content:       content,
-		Mode:          perm.AccessModeWrite,
+		Mode:          mode,
 		Type:          KeyTypeUser,
 		LoginSourceID: authSourceID,
 	}
@@ -245,8 +251,10 @@ func DeletePublicKeys(ctx context.Context, keyIDs ...int64) error {
 		return nil
 	}
 
-	_, err := db.GetEngine(ctx).In("id", keyIDs).Delete(new(PublicKey))
-	return err
+	if _, err := db.GetEngine(ctx).In("id", keyIDs).Delete(new(PublicKey)); err != nil {
+		return err
+	}
+	return DeletePublicKeyActivities(ctx, keyIDs...)
 }
 
 // PublicKeysAreExternallyManaged returns whether the provided KeyID represents an externally managed Key
@@ -368,7 +376,7 @@ func AddPublicKeysBySource(usr *user_model.User, s *auth.Source, sshPublicKeys [
 			marshalled = marshalled[:len(marshalled)-1]
 			sshKeyName := fmt.Sprintf("%s-%s", s.Name, ssh.FingerprintSHA256(out))
 
-			if _, err := AddPublicKey(usr.ID, sshKeyName, marshalled, s.ID); err != nil {
+			if _, err := AddPublicKey(usr.ID, sshKeyName, marshalled, s.ID, perm.AccessModeWrite); err != nil {
 				if IsErrKeyAlreadyExist(err) {
 					log.Trace("AddPublicKeysBySource[%s]: Public SSH Key %s already exists for user", sshKeyName, usr.Name)
 				} else {
@@ -0,0 +1,76 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package asymkey
+
+import (
+	"context"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// PublicKeyActivity records an operation done over SSH with a public key
+type PublicKeyActivity struct {
+	ID          int64              `xorm:"pk autoincr"`
+	KeyID       int64              `xorm:"INDEX NOT NULL"`
+	RepoID      int64              `xorm:"INDEX"`
+	RepoName    string             // owner/name of the repository at the time of the operation
+	Verb        string             // e.g. "git-upload-pack" or "git-annex-shell recvkey"
+	CreatedUnix timeutil.TimeStamp `xorm:"INDEX"`
+}
+
+func init() {
+	db.RegisterModel(new(PublicKeyActivity))
+}
+
+// AddPublicKeyActivity records the operation done with the key in the repository.
+// To avoid excessive writes, the same operation in the same repository is not recorded again until interval has passed.
+func AddPublicKeyActivity(ctx context.Context, keyID, repoID int64, repoName, verb string, interval time.Duration) (bool, error) {
+	now := timeutil.TimeStampNow()
+	has, err := db.GetEngine(ctx).
+		Where("key_id = ? AND repo_id = ? AND verb = ? AND created_unix > ?", keyID, repoID, verb, now.Add(-int64(interval.Seconds()))).
+		Exist(new(PublicKeyActivity))
+	if err != nil || has {
+		return false, err
+	}
+	return true, db.Insert(ctx, &PublicKeyActivity{
+		KeyID:       keyID,
+		RepoID:      repoID,
+		RepoName:    repoName,
+		Verb:        verb,
+		CreatedUnix: now,
+	})
+}
+
+// GetPublicKeyActivities returns the latest operations done with the keys, at most limit for each key
+func GetPublicKeyActivities(ctx context.Context, keyIDs []int64, limit int) (map[int64][]*PublicKeyActivity, error) {
+	activities := make(map[int64][]*PublicKeyActivity, len(keyIDs))
+	for _, keyID := range keyIDs {
+		keyActivities := make([]*PublicKeyActivity, 0, limit)
+		if err := db.GetEngine(ctx).Where("key_id = ?", keyID).OrderBy("created_unix DESC, id DESC").Limit(limit).Find(&keyActivities); err != nil {
+			return nil, err
+		}
+		activities[keyID] = keyActivities
+	}
+	return activities, nil
+}
+
+// DeleteOldPublicKeyActivities deletes the operations recorded before olderThan ago
+func DeleteOldPublicKeyActivities(ctx context.Context, olderThan time.Duration) error {
+	if olderThan <= 0 {
+		return nil
+	}
+	_, err := db.GetEngine(ctx).Where("created_unix < ?", timeutil.TimeStampNow().Add(-int64(olderThan.Seconds()))).Delete(new(PublicKeyActivity))
+	return err
+}
+
+// DeletePublicKeyActivities deletes the operations recorded for the keys
+func DeletePublicKeyActivities(ctx context.Context, keyIDs ...int64) error {
+	if len(keyIDs) == 0 {
+		return nil
+	}
+	_, err := db.GetEngine(ctx).In("key_id", keyIDs).Delete(new(PublicKeyActivity))
+	return err
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package asymkey
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/models/unittest"
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicKeyActivity(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+	defer timeutil.Unset()
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeutil.Set(start)
+	added, err := AddPublicKeyActivity(db.DefaultContext, 1, 1, "user2/repo1", "git-upload-pack", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	// the same operation is throttled within the interval, others are not
+	timeutil.Set(start.Add(30 * time.Second))
+	added, err = AddPublicKeyActivity(db.DefaultContext, 1, 1, "user2/repo1", "git-upload-pack", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	added, err = AddPublicKeyActivity(db.DefaultContext, 1, 1, "user2/repo1", "git-annex-shell recvkey", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	timeutil.Set(start.Add(2 * time.Minute))
+	added, err = AddPublicKeyActivity(db.DefaultContext, 1, 1, "user2/repo1", "git-upload-pack", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	activities, err := GetPublicKeyActivities(db.DefaultContext, []int64{1, 2}, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, activities[1], 2) {
+		assert.Equal(t, "git-upload-pack", activities[1][0].Verb)
+		assert.EqualValues(t, start.Add(2*time.Minute).Unix(), activities[1][0].CreatedUnix)
+		assert.Equal(t, "git-annex-shell recvkey", activities[1][1].Verb)
+		assert.Equal(t, "user2/repo1", activities[1][1].RepoName)
+	}
+	assert.Empty(t, activities[2])
+
+	// only the activity older than a minute is deleted
+	assert.NoError(t, DeleteOldPublicKeyActivities(db.DefaultContext, time.Minute))
+	unittest.AssertCount(t, &PublicKeyActivity{KeyID: 1}, 1)
+
+	assert.NoError(t, DeletePublicKeys(db.DefaultContext, 1))
+	unittest.AssertCount(t, &PublicKeyActivity{KeyID: 1}, 0)
+}
@@ -491,6 +491,18 @@ var migrations = []Migration{
 	NewMigration("Add ArchivedUnix Column", v1_20.AddArchivedUnixToRepository),
 	// v256 -> v257
 	NewMigration("Add is_internal column to package", v1_20.AddIsInternalColumnToPackage),
+	// v257 -> v258
+	NewMigration("Add LastAccessUnix column to repository", v1_20.AddLastAccessUnixToRepository),
+	// v258 -> v259
+	NewMigration("Add PublicKeyActivity table", v1_20.AddPublicKeyActivityTable),
+	// v259 -> v260
+	NewMigration("Add repo_read_count table", v1_20.AddRepoReadCountTable),
+	// v260 -> v261
+	NewMigration("Add AnnexSize column to repository", v1_20.AddAnnexSizeToRepository),
+	// v261 -> v262
+	NewMigration("Add repo_annex_key table", v1_20.AddRepoAnnexKeyTable),
+	// v262 -> v263
+	NewMigration("Add repo_lock table", v1_20.AddRepoLockTable),
 }
 
 // GetCurrentDBVersion returns the current db version
@@ -0,0 +1,18 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"xorm.io/xorm"
+)
+
+func AddLastAccessUnixToRepository(x *xorm.Engine) error {
+	type Repository struct {
+		LastAccessUnix timeutil.TimeStamp `xorm:"INDEX DEFAULT 0"`
+	}
+
+	return x.Sync(new(Repository))
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"xorm.io/xorm"
+)
+
+func AddPublicKeyActivityTable(x *xorm.Engine) error {
+	type PublicKeyActivity struct {
+		ID          int64 `xorm:"pk autoincr"`
+		KeyID       int64 `xorm:"INDEX NOT NULL"`
+		RepoID      int64 `xorm:"INDEX"`
+		RepoName    string
+		Verb        string
+		CreatedUnix timeutil.TimeStamp `xorm:"INDEX"`
+	}
+
+	return x.Sync(new(PublicKeyActivity))
+}
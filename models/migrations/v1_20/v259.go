@@ -0,0 +1,21 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"xorm.io/xorm"
+)
+
+func AddRepoReadCountTable(x *xorm.Engine) error {
+	type RepoReadCount struct {
+		ID       int64              `xorm:"pk autoincr"`
+		RepoID   int64              `xorm:"UNIQUE(s) NOT NULL"`
+		DayUnix  timeutil.TimeStamp `xorm:"UNIQUE(s) NOT NULL"`
+		NumReads int64              `xorm:"NOT NULL DEFAULT 0"`
+	}
+
+	return x.Sync(new(RepoReadCount))
+}
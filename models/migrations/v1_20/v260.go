@@ -0,0 +1,16 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"xorm.io/xorm"
+)
+
+func AddAnnexSizeToRepository(x *xorm.Engine) error {
+	type Repository struct {
+		AnnexSize int64 `xorm:"NOT NULL DEFAULT 0"`
+	}
+
+	return x.Sync(new(Repository))
+}
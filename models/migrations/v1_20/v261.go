@@ -0,0 +1,22 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"xorm.io/xorm"
+)
+
+func AddRepoAnnexKeyTable(x *xorm.Engine) error {
+	type RepoAnnexKey struct {
+		ID          int64              `xorm:"pk autoincr"`
+		RepoID      int64              `xorm:"UNIQUE(s) NOT NULL"`
+		Key         string             `xorm:"VARCHAR(255) UNIQUE(s) INDEX NOT NULL"`
+		Size        int64              `xorm:"NOT NULL DEFAULT -1"`
+		CreatedUnix timeutil.TimeStamp `xorm:"created"`
+	}
+
+	return x.Sync(new(RepoAnnexKey))
+}
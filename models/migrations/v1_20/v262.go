@@ -0,0 +1,21 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package v1_20 //nolint
+
+import (
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"xorm.io/xorm"
+)
+
+func AddRepoLockTable(x *xorm.Engine) error {
+	type RepoLock struct {
+		ID        int64              `xorm:"pk autoincr"`
+		RepoID    int64              `xorm:"UNIQUE NOT NULL"`
+		Scope     string             `xorm:"VARCHAR(10) NOT NULL"`
+		UntilUnix timeutil.TimeStamp `xorm:"NOT NULL"`
+	}
+
+	return x.Sync(new(RepoLock))
+}
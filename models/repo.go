@@ -6,7 +6,9 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"strconv"
 
 	_ "image/jpeg" // Needed for jpeg support
@@ -30,6 +32,7 @@ import (
 	actions_module "code.gitea.io/gitea/modules/actions"
 	"code.gitea.io/gitea/modules/lfs"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/storage"
 
 	"xorm.io/builder"
@@ -138,12 +141,14 @@ func DeleteRepository(doer *user_model.User, uid, repoID int64) error {
 	if err := db.DeleteBeans(ctx,
 		&access_model.Access{RepoID: repo.ID},
 		&activities_model.Action{RepoID: repo.ID},
+		&repo_model.AnnexKey{RepoID: repoID},
 		&repo_model.Collaboration{RepoID: repoID},
 		&issues_model.Comment{RefRepoID: repoID},
 		&git_model.CommitStatus{RepoID: repoID},
 		&git_model.DeletedBranch{RepoID: repoID},
 		&git_model.LFSLock{RepoID: repoID},
 		&repo_model.LanguageStat{RepoID: repoID},
+		&repo_model.Lock{RepoID: repoID},
 		&issues_model.Milestone{RepoID: repoID},
 		&repo_model.Mirror{RepoID: repoID},
 		&activities_model.Notification{RepoID: repoID},
@@ -152,6 +157,7 @@ func DeleteRepository(doer *user_model.User, uid, repoID int64) error {
 		&repo_model.PushMirror{RepoID: repoID},
 		&repo_model.Release{RepoID: repoID},
 		&repo_model.RepoIndexerStatus{RepoID: repoID},
+		&repo_model.ReadCount{RepoID: repoID},
 		&repo_model.Redirect{RedirectRepoID: repoID},
 		&repo_model.RepoUnit{RepoID: repoID},
 		&repo_model.Star{RepoID: repoID},
@@ -306,6 +312,20 @@ func DeleteRepository(doer *user_model.User, uid, repoID int64) error {
 		system_model.RemoveStorageWithNotice(db.DefaultContext, storage.LFS, "Delete orphaned LFS file", lfsObj)
 	}
 
+	// Remove git-annex content kept in object storage
+	if setting.Annex.Storage != nil {
+		var annexPaths []string
+		if err := storage.Annex.IterateObjects(strconv.FormatInt(repoID, 10), func(path string, _ storage.Object) error {
+			annexPaths = append(annexPaths, path)
+			return nil
+		}); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error("Unable to list the git-annex content of repository %d in the object storage: %v", repoID, err)
+		}
+		for _, annexPath := range annexPaths {
+			system_model.RemoveStorageWithNotice(db.DefaultContext, storage.Annex, "Delete git-annex content", annexPath)
+		}
+	}
+
 	// Remove issue attachment files.
 	for _, attachment := range attachmentPaths {
 		system_model.RemoveStorageWithNotice(db.DefaultContext, storage.Attachments, "Delete issue attachment", attachment)
@@ -0,0 +1,54 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repo
+
+import (
+	"context"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// AnnexKey records that a repository stores the content of a git-annex key.
+// The same key in several repositories is the same content, which could be deduplicated.
+type AnnexKey struct {
+	ID          int64              `xorm:"pk autoincr"`
+	RepoID      int64              `xorm:"UNIQUE(s) NOT NULL"`
+	Key         string             `xorm:"VARCHAR(255) UNIQUE(s) INDEX NOT NULL"`
+	Size        int64              `xorm:"NOT NULL DEFAULT -1"` // the size recorded in the key, -1 if the key has none
+	CreatedUnix timeutil.TimeStamp `xorm:"created"`
+}
+
+// TableName sets the table name of the git-annex keys
+func (AnnexKey) TableName() string {
+	return "repo_annex_key"
+}
+
+func init() {
+	db.RegisterModel(new(AnnexKey))
+}
+
+// RecordAnnexKey records that the repository stores the content of the key.
+// It returns the number of other repositories storing the same content.
+func RecordAnnexKey(ctx context.Context, repoID int64, key string, size int64) (int64, error) {
+	has, err := db.GetEngine(ctx).Exist(&AnnexKey{RepoID: repoID, Key: key})
+	if err != nil {
+		return 0, err
+	}
+	if !has {
+		if err := db.Insert(ctx, &AnnexKey{RepoID: repoID, Key: key, Size: size}); err != nil {
+			// the same content may have been stored again in the meantime
+			if has, existErr := db.GetEngine(ctx).Exist(&AnnexKey{RepoID: repoID, Key: key}); existErr != nil || !has {
+				return 0, err
+			}
+		}
+	}
+	return db.GetEngine(ctx).Where("`key` = ? AND repo_id != ?", key, repoID).Count(new(AnnexKey))
+}
+
+// ForgetAnnexKey records that the repository no longer stores the content of the key
+func ForgetAnnexKey(ctx context.Context, repoID int64, key string) error {
+	_, err := db.GetEngine(ctx).Delete(&AnnexKey{RepoID: repoID, Key: key})
+	return err
+}
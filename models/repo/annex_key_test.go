@@ -0,0 +1,48 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repo_test
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/models/db"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnexKey(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	const key = "SHA256E-s3--2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824.txt"
+
+	// the first repository storing the content shares it with nobody
+	others, err := repo_model.RecordAnnexKey(db.DefaultContext, 1, key, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, others)
+
+	// recording it again doesn't count twice
+	others, err = repo_model.RecordAnnexKey(db.DefaultContext, 1, key, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, others)
+	unittest.AssertCount(t, &repo_model.AnnexKey{Key: key}, 1)
+
+	// other repositories storing the same content are counted
+	others, err = repo_model.RecordAnnexKey(db.DefaultContext, 2, key, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, others)
+	others, err = repo_model.RecordAnnexKey(db.DefaultContext, 3, key, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, others)
+	record := unittest.AssertExistsAndLoadBean(t, &repo_model.AnnexKey{RepoID: 2, Key: key})
+	assert.EqualValues(t, 3, record.Size)
+
+	// dropped content is no longer counted
+	assert.NoError(t, repo_model.ForgetAnnexKey(db.DefaultContext, 2, key))
+	unittest.AssertNotExistsBean(t, &repo_model.AnnexKey{RepoID: 2, Key: key})
+	others, err = repo_model.RecordAnnexKey(db.DefaultContext, 1, key, 3)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, others)
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repo
+
+import (
+	"context"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// Lock is a lock an administrator has put on the operations of a repository until a time
+type Lock struct {
+	ID        int64              `xorm:"pk autoincr"`
+	RepoID    int64              `xorm:"UNIQUE NOT NULL"`
+	Scope     string             `xorm:"VARCHAR(10) NOT NULL"`
+	UntilUnix timeutil.TimeStamp `xorm:"NOT NULL"`
+}
+
+// TableName sets the table name of the repository locks
+func (Lock) TableName() string {
+	return "repo_lock"
+}
+
+func init() {
+	db.RegisterModel(new(Lock))
+}
+
+// LockRepository locks the repository for the operations of the scope until the time, replacing any lock it has
+func LockRepository(ctx context.Context, repoID int64, scope string, until timeutil.TimeStamp) error {
+	return db.WithTx(ctx, func(ctx context.Context) error {
+		if _, err := db.GetEngine(ctx).Delete(&Lock{RepoID: repoID}); err != nil {
+			return err
+		}
+		return db.Insert(ctx, &Lock{RepoID: repoID, Scope: scope, UntilUnix: until})
+	})
+}
+
+// UnlockRepository unlocks the repository, returning false if it wasn't locked
+func UnlockRepository(ctx context.Context, repoID int64) (bool, error) {
+	lock, err := GetRepositoryLock(ctx, repoID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := db.GetEngine(ctx).Delete(&Lock{RepoID: repoID}); err != nil {
+		return false, err
+	}
+	return lock != "", nil
+}
+
+// GetRepositoryLock returns the scope of the lock of the repository, or an empty string if it isn't locked
+func GetRepositoryLock(ctx context.Context, repoID int64) (string, error) {
+	lock := &Lock{}
+	has, err := db.GetEngine(ctx).Where("repo_id = ? AND until_unix > ?", repoID, timeutil.TimeStampNow()).Get(lock)
+	if err != nil || !has {
+		return "", err
+	}
+	return lock.Scope, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repo
+
+import (
+	"context"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// ReadCount is the number of clones and fetches of a repository over SSH on a day
+type ReadCount struct {
+	ID       int64              `xorm:"pk autoincr"`
+	RepoID   int64              `xorm:"UNIQUE(s) NOT NULL"`
+	DayUnix  timeutil.TimeStamp `xorm:"UNIQUE(s) NOT NULL"` // midnight UTC of the day
+	NumReads int64              `xorm:"NOT NULL DEFAULT 0"`
+}
+
+// TableName sets the table name of the read counts
+func (ReadCount) TableName() string {
+	return "repo_read_count"
+}
+
+func init() {
+	db.RegisterModel(new(ReadCount))
+}
+
+func readCountDay(t time.Time) timeutil.TimeStamp {
+	return timeutil.TimeStamp(t.UTC().Truncate(24 * time.Hour).Unix())
+}
+
+// IncrementReadCount counts a clone or fetch of the repository at the given time
+func IncrementReadCount(ctx context.Context, repoID int64, now time.Time) error {
+	day := readCountDay(now)
+	increment := func() (bool, error) {
+		affected, err := db.GetEngine(ctx).Exec("UPDATE repo_read_count SET num_reads = num_reads + 1 WHERE repo_id = ? AND day_unix = ?", repoID, day)
+		if err != nil {
+			return false, err
+		}
+		n, err := affected.RowsAffected()
+		return n > 0, err
+	}
+
+	if incremented, err := increment(); err != nil || incremented {
+		return err
+	}
+	if err := db.Insert(ctx, &ReadCount{RepoID: repoID, DayUnix: day, NumReads: 1}); err != nil {
+		// another read of the same day may have inserted the row in the meantime
+		if incremented, incErr := increment(); incErr != nil || !incremented {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountReads returns the number of clones and fetches of the repository counted since the day of since
+func CountReads(ctx context.Context, repoID int64, since time.Time) (int64, error) {
+	total, err := db.GetEngine(ctx).Where("repo_id = ? AND day_unix >= ?", repoID, readCountDay(since)).SumInt(new(ReadCount), "num_reads")
+	return total, err
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repo_test
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCount(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+	lastWeek := now.Add(-7 * 24 * time.Hour)
+	for _, read := range []time.Time{lastWeek, yesterday, now, now, now} {
+		assert.NoError(t, repo_model.IncrementReadCount(db.DefaultContext, 1, read))
+	}
+	assert.NoError(t, repo_model.IncrementReadCount(db.DefaultContext, 2, now))
+
+	// the reads are aggregated per day
+	unittest.AssertCount(t, &repo_model.ReadCount{RepoID: 1}, 3)
+	count := unittest.AssertExistsAndLoadBean(t, &repo_model.ReadCount{RepoID: 1, DayUnix: unittest.AssertExistsAndLoadBean(t, &repo_model.ReadCount{RepoID: 2}).DayUnix})
+	assert.EqualValues(t, 3, count.NumReads)
+
+	reads, err := repo_model.CountReads(db.DefaultContext, 1, now)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, reads)
+	reads, err = repo_model.CountReads(db.DefaultContext, 1, yesterday)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, reads)
+	reads, err = repo_model.CountReads(db.DefaultContext, 1, lastWeek)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, reads)
+
+	reads, err = repo_model.CountReads(db.DefaultContext, 3, lastWeek)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, reads)
+}
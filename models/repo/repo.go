@@ -110,6 +110,7 @@ const (
 	RepositoryBeingMigrated                           // repository is migrating
 	RepositoryPendingTransfer                         // repository pending in ownership transfer state
 	RepositoryBroken                                  // repository is in a permanently broken state
+	RepositoryPendingDeletion                         // repository is scheduled for deletion
 )
 
 // Repository represents a git repository.
@@ -163,6 +164,7 @@ type Repository struct {
 	IsTemplate                      bool               `xorm:"INDEX NOT NULL DEFAULT false"`
 	TemplateID                      int64              `xorm:"INDEX"`
 	Size                            int64              `xorm:"NOT NULL DEFAULT 0"`
+	AnnexSize                       int64              `xorm:"NOT NULL DEFAULT 0"` // the part of Size taken by git-annex content
 	CodeIndexerStatus               *RepoIndexerStatus `xorm:"-"`
 	StatsIndexerStatus              *RepoIndexerStatus `xorm:"-"`
 	IsFsckEnabled                   bool               `xorm:"NOT NULL DEFAULT true"`
@@ -174,9 +176,10 @@ type Repository struct {
 	// Avatar: ID(10-20)-md5(32) - must fit into 64 symbols
 	Avatar string `xorm:"VARCHAR(64)"`
 
-	CreatedUnix  timeutil.TimeStamp `xorm:"INDEX created"`
-	UpdatedUnix  timeutil.TimeStamp `xorm:"INDEX updated"`
-	ArchivedUnix timeutil.TimeStamp `xorm:"DEFAULT 0"`
+	CreatedUnix    timeutil.TimeStamp `xorm:"INDEX created"`
+	UpdatedUnix    timeutil.TimeStamp `xorm:"INDEX updated"`
+	ArchivedUnix   timeutil.TimeStamp `xorm:"DEFAULT 0"`
+	LastAccessUnix timeutil.TimeStamp `xorm:"INDEX DEFAULT 0"`
 }
 
 func init() {
@@ -226,6 +229,11 @@ func (repo *Repository) IsBroken() bool {
 	return repo.Status == RepositoryBroken
 }
 
+// IsPendingDeletion indicates that the repository is scheduled for deletion
+func (repo *Repository) IsPendingDeletion() bool {
+	return repo.Status == RepositoryPendingDeletion
+}
+
 // MarkAsBrokenEmpty marks the repo as broken and empty
 func (repo *Repository) MarkAsBrokenEmpty() {
 	repo.Status = RepositoryBroken
@@ -671,6 +679,25 @@ func GetRepositoryByName(ownerID int64, name string) (*Repository, error) {
 	return repo, err
 }
 
+// IsPublicRepositoryUnchanged returns whether the public repository, loaded earlier with its owner, is still public
+// and hasn't been renamed, changed its status or been updated since, e.g. by a change of its settings,
+// and whether its owner hasn't been renamed or changed its visibility either.
+func IsPublicRepositoryUnchanged(ctx context.Context, repo *Repository, owner *user_model.User) (bool, error) {
+	return db.GetEngine(ctx).Table("repository").
+		Join("INNER", "`user`", "`user`.id = repository.owner_id").
+		Where(builder.Eq{
+			"repository.id":         repo.ID,
+			"repository.lower_name": repo.LowerName,
+			"repository.is_private": false,
+			"repository.status":     repo.Status,
+			"`user`.lower_name":     owner.LowerName,
+			"`user`.visibility":     owner.Visibility,
+		}).
+		// repositories inserted without an update time have none
+		And("COALESCE(repository.updated_unix, 0) = ?", repo.UpdatedUnix).
+		Exist()
+}
+
 // getRepositoryURLPathSegments returns segments (owner, reponame) extracted from a url
 func getRepositoryURLPathSegments(repoURL string) []string {
 	if strings.HasPrefix(repoURL, setting.AppURL) {
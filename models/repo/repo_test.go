@@ -5,6 +5,7 @@ package repo_test
 
 import (
 	"testing"
+	"time"
 
 	"code.gitea.io/gitea/models/db"
 	repo_model "code.gitea.io/gitea/models/repo"
@@ -12,6 +13,7 @@ import (
 	"code.gitea.io/gitea/models/unittest"
 	user_model "code.gitea.io/gitea/models/user"
 	"code.gitea.io/gitea/modules/markup"
+	"code.gitea.io/gitea/modules/timeutil"
 	"code.gitea.io/gitea/modules/util"
 
 	"github.com/stretchr/testify/assert"
@@ -37,6 +39,34 @@ func TestGetRepositoryCount(t *testing.T) {
 	assert.Equal(t, privateCount+publicCount, count)
 }
 
+func TestTouchRepository(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+	defer timeutil.Unset()
+
+	start := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeutil.Set(start)
+	touched, err := repo_model.TouchRepository(db.DefaultContext, 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, touched)
+	repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 1})
+	assert.EqualValues(t, start.Unix(), repo.LastAccessUnix)
+
+	// throttled within the interval
+	timeutil.Set(start.Add(30 * time.Second))
+	touched, err = repo_model.TouchRepository(db.DefaultContext, 1, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, touched)
+	repo = unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 1})
+	assert.EqualValues(t, start.Unix(), repo.LastAccessUnix)
+
+	timeutil.Set(start.Add(time.Minute))
+	touched, err = repo_model.TouchRepository(db.DefaultContext, 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, touched)
+	repo = unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 1})
+	assert.EqualValues(t, start.Add(time.Minute).Unix(), repo.LastAccessUnix)
+}
+
 func TestGetPublicRepositoryCount(t *testing.T) {
 	assert.NoError(t, unittest.PrepareTestDatabase())
 
@@ -12,6 +12,7 @@ import (
 	"code.gitea.io/gitea/models/db"
 	user_model "code.gitea.io/gitea/models/user"
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/timeutil"
 	"code.gitea.io/gitea/modules/util"
 )
 
@@ -41,6 +42,18 @@ func UpdateRepositoryUpdatedTime(repoID int64, updateTime time.Time) error {
 	return err
 }
 
+// TouchRepository records that the repository has just been accessed.
+// To avoid excessive writes, the access time is not updated again until interval has passed.
+func TouchRepository(ctx context.Context, repoID int64, interval time.Duration) (bool, error) {
+	now := timeutil.TimeStampNow()
+	affected, err := db.GetEngine(ctx).Exec("UPDATE repository SET last_access_unix = ? WHERE id = ? AND last_access_unix <= ?", now, repoID, now.Add(-int64(interval.Seconds())))
+	if err != nil {
+		return false, err
+	}
+	n, err := affected.RowsAffected()
+	return n > 0, err
+}
+
 // UpdateRepositoryCols updates repository's columns
 func UpdateRepositoryCols(ctx context.Context, repo *Repository, cols ...string) error {
 	_, err := db.GetEngine(ctx).ID(repo.ID).Cols(cols...).Update(repo)
@@ -185,9 +198,10 @@ func ChangeRepositoryName(doer *user_model.User, repo *Repository, newRepoName s
 }
 
 // UpdateRepoSize updates the repository size, calculating it using getDirectorySize
-func UpdateRepoSize(ctx context.Context, repoID, size int64) error {
-	_, err := db.GetEngine(ctx).ID(repoID).Cols("size").NoAutoTime().Update(&Repository{
-		Size: size,
+func UpdateRepoSize(ctx context.Context, repoID, size, annexSize int64) error {
+	_, err := db.GetEngine(ctx).ID(repoID).Cols("size", "annex_size").NoAutoTime().Update(&Repository{
+		Size:      size,
+		AnnexSize: annexSize,
 	})
 	return err
 }
@@ -224,6 +224,11 @@ func IsEmailUsed(ctx context.Context, email string) (bool, error) {
 	return db.GetEngine(ctx).Where("lower_email=?", strings.ToLower(email)).Get(&EmailAddress{})
 }
 
+// IsPrimaryEmailActivated returns true if the primary email address of the user has been activated.
+func IsPrimaryEmailActivated(ctx context.Context, uid int64) (bool, error) {
+	return db.GetEngine(ctx).Where("uid=? AND is_primary=? AND is_activated=?", uid, true, true).Exist(&EmailAddress{})
+}
+
 // AddEmailAddress adds an email address to given user.
 func AddEmailAddress(ctx context.Context, email *EmailAddress) error {
 	email.Email = strings.TrimSpace(email.Email)
@@ -42,6 +42,18 @@ func TestIsEmailUsed(t *testing.T) {
 	assert.False(t, isExist)
 }
 
+func TestIsPrimaryEmailActivated(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	activated, err := user_model.IsPrimaryEmailActivated(db.DefaultContext, 2)
+	assert.NoError(t, err)
+	assert.True(t, activated)
+
+	activated, err = user_model.IsPrimaryEmailActivated(db.DefaultContext, 11)
+	assert.NoError(t, err)
+	assert.False(t, activated)
+}
+
 func TestAddEmailAddress(t *testing.T) {
 	assert.NoError(t, unittest.PrepareTestDatabase())
 
@@ -12,4 +12,8 @@ const (
 	UserActivityPubPrivPem = "activitypub.priv_pem"
 	// UserActivityPubPubPem is user's public key
 	UserActivityPubPubPem = "activitypub.pub_pem"
+	// SettingsKeySSHReadOnly is "true" if the user can only read repositories over SSH, whatever the keys
+	SettingsKeySSHReadOnly = "ssh.read_only"
+	// SettingsKeyAcceptedCLAPrefix followed by the name of a [repository.cla] entry is the URL of the CLA the user accepted for it
+	SettingsKeyAcceptedCLAPrefix = "cla.accepted."
 )
@@ -0,0 +1,195 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package annex provides helpers for repositories that use git-annex.
+package annex
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"code.gitea.io/gitea/modules/git"
+)
+
+// BranchRefName is the branch git-annex keeps its metadata in
+const BranchRefName = git.BranchPrefix + "git-annex"
+
+// MaxKeyLength is the maximum length of a key in bytes, git-annex stores content in files named after the key
+const MaxKeyLength = 255
+
+// IsInitialized returns true if git-annex has been initialized in the repository
+func IsInitialized(ctx context.Context, repoPath string) bool {
+	stdout, _, err := git.NewCommand(ctx, "config", "--get", "annex.uuid").RunStdString(&git.RunOpts{Dir: repoPath})
+	return err == nil && strings.TrimSpace(stdout) != ""
+}
+
+// Init initializes git-annex in the repository, so that git-annex-shell can serve it.
+// Clients only initialize remotes by themselves if they are allowed to write to them,
+// so the repository is initialized once the git-annex branch has been pushed to it.
+func Init(ctx context.Context, repoPath string) error {
+	_, _, err := git.NewCommand(ctx, "annex", "init", "--quiet").RunStdString(&git.RunOpts{Dir: repoPath})
+	return err
+}
+
+// HasContent returns true if the content of the key is present in the repository
+func HasContent(ctx context.Context, repoPath, key string) bool {
+	stdout, _, err := git.NewCommand(ctx, "annex", "contentlocation").AddDynamicArguments(key).RunStdString(&git.RunOpts{Dir: repoPath})
+	return err == nil && strings.TrimSpace(stdout) != ""
+}
+
+// Get copies the content of the key into the repository from the remote
+func Get(ctx context.Context, repoPath, key, remote string) error {
+	_, _, err := git.NewCommand(ctx, "annex", "get", "--quiet").AddOptionValues("--from", remote).AddOptionValues("--key", key).RunStdString(&git.RunOpts{Dir: repoPath})
+	return err
+}
+
+// ObjectCount returns the number of git-annex objects stored in the (bare) repository
+func ObjectCount(repoPath string) (int64, error) {
+	var count int64
+	err := filepath.WalkDir(filepath.Join(repoPath, "annex", "objects"), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return count, err
+}
+
+// ContentSize returns the number of bytes of git-annex content stored in the (bare) repository
+func ContentSize(repoPath string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(filepath.Join(repoPath, "annex", "objects"), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// KeySize returns the size of the content a key like "SHA256E-s1048576--9f86d08...bin" refers to.
+// Not every key records the size, e.g. the keys of URLs added with --fast don't.
+func KeySize(key string) (int64, bool) {
+	fields, _, _ := strings.Cut(key, "--")
+	for _, field := range strings.Split(fields, "-")[1:] {
+		if !strings.HasPrefix(field, "s") {
+			continue
+		}
+		if size, err := strconv.ParseInt(field[1:], 10, 64); err == nil {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// IsValidKey returns true if key is well-formed like "SHA256E-s1048576--9f86d08...bin": a backend name of
+// upper case letters and digits, optional fields separated by "-", and a name after "--", no longer than MaxKeyLength.
+// Control characters, white space and slashes are not allowed anywhere in the key.
+func IsValidKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength || !utf8.ValidString(key) {
+		return false
+	}
+	for _, r := range key {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) || r == '/' || r == '\\' {
+			return false
+		}
+	}
+
+	fields, _, hasName := strings.Cut(key, "--")
+	if !hasName {
+		return false
+	}
+	backend, _, _ := strings.Cut(fields, "-")
+	if backend == "" {
+		return false
+	}
+	for _, r := range backend {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// UnusedKey is content stored in the repository that no ref refers to anymore
+type UnusedKey struct {
+	Number int // the number "git annex dropunused" knows the key by
+	Key    string
+}
+
+// Unused returns the keys of the content stored in the repository that isn't referenced by any branch or tag,
+// the numbers of the keys are only valid until Unused is called on the repository again
+func Unused(ctx context.Context, repoPath string) ([]UnusedKey, error) {
+	stdout, _, err := git.NewCommand(ctx, "annex", "unused").RunStdString(&git.RunOpts{Dir: repoPath})
+	if err != nil {
+		return nil, err
+	}
+	return parseUnused(stdout), nil
+}
+
+// parseUnused returns the keys listed by "git annex unused", one per line after their number:
+//
+//	Some annexed data is no longer used by any files:
+//	  NUMBER  KEY
+//	  1       SHA256E-s6--e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c
+func parseUnused(output string) []UnusedKey {
+	var keys []UnusedKey
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !IsValidKey(fields[1]) {
+			continue
+		}
+		if number, err := strconv.Atoi(fields[0]); err == nil && number > 0 {
+			keys = append(keys, UnusedKey{Number: number, Key: fields[1]})
+		}
+	}
+	return keys
+}
+
+// DropUnused removes the content of an unused key from the repository. Like every drop, git-annex refuses it
+// unless enough other copies of the content exist by the numcopies and trust settings of the repository.
+func DropUnused(ctx context.Context, repoPath string, key UnusedKey) error {
+	_, _, err := git.NewCommand(ctx, "annex", "dropunused", "--quiet").AddDynamicArguments(strconv.Itoa(key.Number)).RunStdString(&git.RunOpts{Dir: repoPath})
+	return err
+}
+
+// Backends returns the key-value backends the installed git-annex supports
+func Backends(ctx context.Context) ([]string, error) {
+	stdout, _, err := git.NewCommand(ctx, "annex", "version").RunStdString(nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseBackends(stdout), nil
+}
+
+func parseBackends(versionOutput string) []string {
+	for _, line := range strings.Split(versionOutput, "\n") {
+		if strings.HasPrefix(line, "key/value backends:") {
+			return strings.Fields(strings.TrimPrefix(line, "key/value backends:"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectCount(t *testing.T) {
+	repoPath := t.TempDir()
+
+	count, err := ObjectCount(repoPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, count)
+
+	for _, key := range []string{"SHA256E-s1--aa", "SHA256E-s2--bb"} {
+		dir := filepath.Join(repoPath, "annex", "objects", "f8", "7d", key)
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, key), []byte("content"), 0o444))
+	}
+
+	count, err = ObjectCount(repoPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, count)
+}
+
+func TestContentSize(t *testing.T) {
+	repoPath := t.TempDir()
+
+	size, err := ContentSize(repoPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, size)
+
+	for key, content := range map[string]string{"SHA256E-s1--aa": "a", "SHA256E-s7--bb": "content"} {
+		dir := filepath.Join(repoPath, "annex", "objects", "f8", "7d", key)
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, key), []byte(content), 0o444))
+	}
+
+	size, err = ContentSize(repoPath)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 8, size)
+}
+
+func TestKeySize(t *testing.T) {
+	size, ok := KeySize("SHA256E-s1048576--9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.bin")
+	assert.True(t, ok)
+	assert.EqualValues(t, 1048576, size)
+
+	size, ok = KeySize("SHA256E-s1048576-S262144-C2--9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.bin")
+	assert.True(t, ok)
+	assert.EqualValues(t, 1048576, size)
+
+	// the name of the key doesn't count
+	_, ok = KeySize("URL--http&c%%example.com%file-s100")
+	assert.False(t, ok)
+}
+
+func TestIsValidKey(t *testing.T) {
+	for _, key := range []string{
+		"SHA256E-s1048576--9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.bin",
+		"SHA256E-s1048576-S262144-C2--9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.bin",
+		"URL--http&c%%example.com%file",
+		"WORM-s3-m1684000000--bär.txt",
+		"SHA1--" + strings.Repeat("a", MaxKeyLength-6),
+	} {
+		assert.True(t, IsValidKey(key), key)
+	}
+
+	for _, key := range []string{
+		"",
+		"SHA256E-s1048576",
+		"--9f86d08",
+		"sha256e-s1--9f86d08",
+		"SHA256E-s1--../../../etc/passwd",
+		"SHA256E-s1--a b",
+		"SHA256E-s1--a\tb",
+		"SHA256E-s1--a\\b",
+		"SHA256E-s1--a\x00b",
+		"SHA256E-s1--\xff",
+		"SHA1--" + strings.Repeat("a", MaxKeyLength-5),
+	} {
+		assert.False(t, IsValidKey(key), key)
+	}
+}
+
+func TestParseUnused(t *testing.T) {
+	output := `unused . (checking for unused data...) (checking main...) (checking v1.0...)
+  Some annexed data is no longer used by any files:
+    NUMBER  KEY
+    1       SHA256E-s6--e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c.txt
+    2       WORM-s3-m1681234567--old.bin
+  (To see where this data was previously used, run: git annex whereused --historical --unused
+
+  To remove unwanted data: git-annex dropunused NUMBER
+ok
+`
+	assert.Equal(t, []UnusedKey{
+		{Number: 1, Key: "SHA256E-s6--e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c.txt"},
+		{Number: 2, Key: "WORM-s3-m1681234567--old.bin"},
+	}, parseUnused(output))
+
+	assert.Empty(t, parseUnused("unused . (checking for unused data...) (checking main...) ok\n"))
+}
+
+func TestParseBackends(t *testing.T) {
+	output := `git-annex version: 10.20230126
+build flags: Assistant Webapp Pairing Inotify DBus DesktopNotify TorrentParser MagicMime Benchmark Feeds Testsuite S3 WebDAV
+dependency versions: aws-0.22.1 bloomfilter-2.0.1.0 cryptonite-0.29 DAV-1.3.4 feed-1.3.2.1 ghc-9.0.2 http-client-0.7.13.1 persistent-sqlite-2.13.1.0 torrent-10000.1.1 uuid-1.3.15 yesod-1.6.2.1
+key/value backends: SHA256E SHA256 SHA512E SHA512 WORM URL X*
+remote types: git gcrypt p2p S3 bup directory rsync web bittorrent webdav adb tahoe glacier ddar git-lfs httpalso borg hook external
+operating system: linux x86_64
+`
+	assert.Equal(t, []string{"SHA256E", "SHA256", "SHA512E", "SHA512", "WORM", "URL", "X*"}, parseBackends(output))
+	assert.Empty(t, parseBackends(""))
+}
+
+func TestKeyPath(t *testing.T) {
+	key := "SHA256E-s6--e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c.txt"
+	assert.Equal(t, filepath.Join("repo.git", "annex", "objects", "b2a", "257", key, key), KeyPath("repo.git", key))
+}
+
+func TestKeyChecksum(t *testing.T) {
+	newHash, checksum := keyChecksum("SHA256E-s6--d3eb539a556352f3f47881d71fb0e5777b2f3e9a4251d283c18c67ce996774b7.tar.gz")
+	assert.NotNil(t, newHash)
+	assert.Equal(t, "d3eb539a556352f3f47881d71fb0e5777b2f3e9a4251d283c18c67ce996774b7", checksum)
+
+	newHash, checksum = keyChecksum("MD5-s6--1a2b")
+	assert.NotNil(t, newHash)
+	assert.Equal(t, "1a2b", checksum)
+
+	// keys without a checksum and chunks can only be checked by their size
+	for _, key := range []string{"WORM-s6-m1682000000--file.txt", "URL--https&c%%example.com%file", "SHA256E-s1048576-S262144-C2--d3eb539a.bin"} {
+		newHash, _ = keyChecksum(key)
+		assert.Nil(t, newHash, key)
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestPutContentMismatch(t *testing.T) {
+	repoPath := t.TempDir()
+	key := "SHA256E-s6--d3eb539a556352f3f47881d71fb0e5777b2f3e9a4251d283c18c67ce996774b7.txt"
+
+	err := PutContent(context.Background(), repoPath, key, strings.NewReader("dummy"), 0)
+	assert.ErrorIs(t, err, ErrContentMismatch)
+	err = PutContent(context.Background(), repoPath, key, strings.NewReader("dumm!\n"), 0)
+	assert.ErrorIs(t, err, ErrContentMismatch)
+	assert.NoFileExists(t, KeyPath(repoPath, key))
+
+	// reading stops one byte past the size of the key, or the limit for keys without a size
+	body := &countingReader{r: strings.NewReader(strings.Repeat("x", 1000))}
+	err = PutContent(context.Background(), repoPath, key, body, 0)
+	assert.ErrorIs(t, err, ErrContentMismatch)
+	assert.EqualValues(t, 7, body.n)
+	body = &countingReader{r: strings.NewReader(strings.Repeat("x", 1000))}
+	err = PutContent(context.Background(), repoPath, "WORM-m1682000000--file.txt", body, 100)
+	assert.ErrorIs(t, err, ErrContentTooLarge)
+	assert.EqualValues(t, 101, body.n)
+	entries, err := os.ReadDir(filepath.Join(repoPath, "annex", "tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.gitea.io/gitea/modules/git"
+)
+
+// ErrContentMismatch is returned by PutContent if the content doesn't have the size or checksum the key records
+var ErrContentMismatch = errors.New("content doesn't match the key")
+
+// ErrContentTooLarge is returned by PutContent if the content of a key without a recorded size exceeds the limit
+var ErrContentTooLarge = errors.New("content exceeds the size limit")
+
+// keyHashes are the hash functions of the backends whose keys record the checksum of the content
+var keyHashes = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA1":   sha1.New,
+	"SHA224": sha256.New224,
+	"SHA256": sha256.New,
+	"SHA384": sha512.New384,
+	"SHA512": sha512.New,
+}
+
+// KeyPath returns where the content of the key is stored in the (bare) repository. Bare repositories use the
+// "hashdirlower" layout of git-annex: two directories named after the MD5 checksum of the key, then the key twice.
+func KeyPath(repoPath, key string) string {
+	sum := md5.Sum([]byte(key))
+	dirs := hex.EncodeToString(sum[:])
+	return filepath.Join(repoPath, "annex", "objects", dirs[:3], dirs[3:6], key, key)
+}
+
+// keyChecksum returns the hash function and the checksum of the content of a key, if its backend records one.
+// The extension of the "E" backends like SHA256E follows the checksum. Chunks of a key aren't checked.
+func keyChecksum(key string) (func() hash.Hash, string) {
+	fields, name, _ := strings.Cut(key, "--")
+	backend, rest, _ := strings.Cut(fields, "-")
+	for _, field := range strings.Split(rest, "-") {
+		if strings.HasPrefix(field, "S") || strings.HasPrefix(field, "C") {
+			return nil, ""
+		}
+	}
+	newHash, ok := keyHashes[strings.TrimSuffix(backend, "E")]
+	if !ok {
+		return nil, ""
+	}
+	if strings.HasSuffix(backend, "E") {
+		name, _, _ = strings.Cut(name, ".")
+	}
+	return newHash, name
+}
+
+// PutContent stores the content of the key in the repository and records that the repository has it.
+// Content which doesn't match the size or checksum recorded in the key is rejected with ErrContentMismatch,
+// content of keys without a recorded size which is larger than maxSize with ErrContentTooLarge, 0 means no limit.
+// No more than one byte past the limit is read. Content which is already present is kept.
+func PutContent(ctx context.Context, repoPath, key string, content io.Reader, maxSize int64) error {
+	keyPath := KeyPath(repoPath, key)
+	if _, err := os.Stat(keyPath); err == nil {
+		return nil
+	}
+
+	tmpDir := filepath.Join(repoPath, "annex", "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "upload-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	w := io.Writer(tmp)
+	newHash, checksum := keyChecksum(key)
+	var h hash.Hash
+	if newHash != nil {
+		h = newHash()
+		w = io.MultiWriter(tmp, h)
+	}
+	size, hasSize := KeySize(key)
+	if hasSize {
+		content = io.LimitReader(content, size+1)
+	} else if maxSize > 0 {
+		content = io.LimitReader(content, maxSize+1)
+	}
+	written, err := io.Copy(w, content)
+	if err != nil {
+		return err
+	}
+	if hasSize && size != written {
+		return fmt.Errorf("%w: got %d bytes instead of %d", ErrContentMismatch, written, size)
+	}
+	if !hasSize && maxSize > 0 && written > maxSize {
+		return fmt.Errorf("%w of %d bytes", ErrContentTooLarge, maxSize)
+	}
+	if h != nil && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), checksum) {
+		return fmt.Errorf("%w: checksum mismatch", ErrContentMismatch)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// git-annex keeps its objects read-only
+	if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), keyPath); err != nil {
+		return err
+	}
+
+	uuid, _, err := git.NewCommand(ctx, "config", "--get", "annex.uuid").RunStdString(&git.RunOpts{Dir: repoPath})
+	if err != nil {
+		return err
+	}
+	_, _, err = git.NewCommand(ctx, "annex", "setpresentkey").AddDynamicArguments(key, strings.TrimSpace(uuid), "1").RunStdString(&git.RunOpts{Dir: repoPath})
+	return err
+}
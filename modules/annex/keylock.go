@@ -0,0 +1,88 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"sync"
+	"time"
+)
+
+type keyLockID struct {
+	repoID int64
+	key    string
+}
+
+// keyLock is held by any number of commands sending the content of a key, or by one command dropping it
+type keyLock struct {
+	exclusive bool
+	holders   map[string]time.Time // token to expiry
+}
+
+// keyLocks holds the locks of the git-annex keys being sent or dropped
+var keyLocks = struct {
+	sync.Mutex
+	locks map[keyLockID]*keyLock
+}{
+	locks: map[keyLockID]*keyLock{},
+}
+
+// TryLockKey takes the lock of the key in the repository with the token, exclusively or shared with other
+// shared holders, for the lease unless it is renewed. It returns false if the lock is held in a conflicting way.
+func TryLockKey(repoID int64, key, token string, exclusive bool, lease time.Duration) bool {
+	keyLocks.Lock()
+	defer keyLocks.Unlock()
+
+	id := keyLockID{repoID: repoID, key: key}
+	now := time.Now()
+	lock, has := keyLocks.locks[id]
+	if has {
+		for holder, expires := range lock.holders {
+			if !now.Before(expires) {
+				delete(lock.holders, holder)
+			}
+		}
+		if len(lock.holders) > 0 && (exclusive || lock.exclusive) {
+			return false
+		}
+	}
+	if !has || len(lock.holders) == 0 {
+		lock = &keyLock{holders: map[string]time.Time{}}
+		keyLocks.locks[id] = lock
+	}
+	lock.exclusive = exclusive
+	lock.holders[token] = now.Add(lease)
+	return true
+}
+
+// RenewKeyLock extends the lock of the key in the repository held with the token by the lease,
+// it returns false if the lock isn't held with the token or has expired
+func RenewKeyLock(repoID int64, key, token string, lease time.Duration) bool {
+	keyLocks.Lock()
+	defer keyLocks.Unlock()
+
+	lock, has := keyLocks.locks[keyLockID{repoID: repoID, key: key}]
+	if !has {
+		return false
+	}
+	now := time.Now()
+	if expires, has := lock.holders[token]; !has || !now.Before(expires) {
+		return false
+	}
+	lock.holders[token] = now.Add(lease)
+	return true
+}
+
+// UnlockKey releases the lock of the key in the repository if it is held with the token
+func UnlockKey(repoID int64, key, token string) {
+	keyLocks.Lock()
+	defer keyLocks.Unlock()
+
+	id := keyLockID{repoID: repoID, key: key}
+	if lock, has := keyLocks.locks[id]; has {
+		delete(lock.holders, token)
+		if len(lock.holders) == 0 {
+			delete(keyLocks.locks, id)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLock(t *testing.T) {
+	const key = "SHA256E-s3--2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824.txt"
+
+	// sends share the lock, a drop needs it alone
+	assert.True(t, TryLockKey(1, key, "send-a", false, time.Hour))
+	assert.True(t, TryLockKey(1, key, "send-b", false, time.Hour))
+	assert.False(t, TryLockKey(1, key, "drop-a", true, time.Hour))
+	UnlockKey(1, key, "send-a")
+	assert.False(t, TryLockKey(1, key, "drop-a", true, time.Hour))
+	UnlockKey(1, key, "send-b")
+	assert.True(t, TryLockKey(1, key, "drop-a", true, time.Hour))
+	assert.False(t, TryLockKey(1, key, "send-c", false, time.Hour))
+	assert.False(t, TryLockKey(1, key, "drop-b", true, time.Hour))
+
+	// other keys and repositories are not affected
+	assert.True(t, TryLockKey(1, key+"2", "drop-c", true, time.Hour))
+	assert.True(t, TryLockKey(2, key, "drop-d", true, time.Hour))
+
+	// releasing with the wrong token does nothing
+	UnlockKey(1, key, "send-c")
+	assert.False(t, TryLockKey(1, key, "send-c", false, time.Hour))
+	UnlockKey(1, key, "drop-a")
+	assert.True(t, TryLockKey(1, key, "send-c", false, time.Hour))
+
+	// locks that are never released expire
+	keyLocks.Lock()
+	keyLocks.locks[keyLockID{repoID: 1, key: key}].holders["send-c"] = time.Now().Add(-time.Second)
+	keyLocks.Unlock()
+	assert.True(t, TryLockKey(1, key, "drop-e", true, time.Hour))
+
+	// only the holders renew their locks, and only until they have expired
+	assert.True(t, RenewKeyLock(1, key, "drop-e", time.Hour))
+	assert.False(t, RenewKeyLock(1, key, "send-c", time.Hour))
+	assert.False(t, RenewKeyLock(1, key+"3", "drop-e", time.Hour))
+	assert.True(t, TryLockKey(1, key+"3", "drop-f", true, -time.Second))
+	assert.False(t, RenewKeyLock(1, key+"3", "drop-f", time.Hour))
+	UnlockKey(1, key+"3", "drop-f")
+
+	UnlockKey(1, key, "drop-e")
+	UnlockKey(1, key+"2", "drop-c")
+	UnlockKey(2, key, "drop-d")
+}
+
+func TestKeyLockConcurrentDropAndSend(t *testing.T) {
+	const key = "SHA256E-s5--concurrent"
+
+	var senders, droppers, overlaps int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		exclusive := i%2 == 0
+		token := fmt.Sprintf("token-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !TryLockKey(3, key, token, exclusive, time.Hour) {
+				time.Sleep(time.Millisecond)
+			}
+			if exclusive {
+				if atomic.AddInt32(&droppers, 1) != 1 || atomic.LoadInt32(&senders) != 0 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&droppers, -1)
+			} else {
+				atomic.AddInt32(&senders, 1)
+				if atomic.LoadInt32(&droppers) != 0 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&senders, -1)
+			}
+			UnlockKey(3, key, token)
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, overlaps, "a drop ran at the same time as another drop or send of the same key")
+	keyLocks.Lock()
+	assert.NotContains(t, keyLocks.locks, keyLockID{repoID: 3, key: key})
+	keyLocks.Unlock()
+}
@@ -0,0 +1,261 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/process"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// p2phttpUser is the user the proxy authenticates as with the "git annex p2phttp" servers, which only listen on localhost
+const p2phttpUser = "gitea"
+
+// p2phttpStartTimeout is how long starting a "git annex p2phttp" server may take until it accepts connections
+const p2phttpStartTimeout = 10 * time.Second
+
+// p2phttpWriteOps are the operations of the P2P protocol over HTTP which change the content a repository stores,
+// all others only read it
+var p2phttpWriteOps = map[string]bool{
+	"put":           true,
+	"putoffset":     true,
+	"remove":        true,
+	"remove-before": true,
+}
+
+// P2PHTTPRequest is what a request of the P2P protocol over HTTP asks for
+type P2PHTTPRequest struct {
+	Op  string
+	Key string
+}
+
+// IsWrite returns whether the request changes the content the repository stores
+func (r P2PHTTPRequest) IsWrite() bool {
+	return p2phttpWriteOps[r.Op]
+}
+
+// IsRemove returns whether the request drops the content of the key
+func (r P2PHTTPRequest) IsRemove() bool {
+	return r.Op == "remove" || r.Op == "remove-before"
+}
+
+// ParseP2PHTTPRequest parses the path of a request of the P2P protocol over HTTP after "/git-annex/",
+// which is "<uuid>/v<version>/<op>" with the key in the query or, for the "key" operation, as the last element.
+// Requests which aren't about a single valid key are refused, except "gettimestamp", which isn't about any key.
+func ParseP2PHTTPRequest(path string, query url.Values) (P2PHTTPRequest, bool) {
+	parts := strings.SplitN(path, "/", 4)
+	if len(parts) < 3 || parts[0] == "" || !strings.HasPrefix(parts[1], "v") {
+		return P2PHTTPRequest{}, false
+	}
+	if _, err := strconv.Atoi(parts[1][1:]); err != nil {
+		return P2PHTTPRequest{}, false
+	}
+	r := P2PHTTPRequest{Op: parts[2]}
+	if r.Op == "key" {
+		if len(parts) != 4 {
+			return P2PHTTPRequest{}, false
+		}
+		r.Key = parts[3]
+	} else {
+		if len(parts) != 3 {
+			return P2PHTTPRequest{}, false
+		}
+		r.Key = query.Get("key")
+	}
+	if r.Op == "gettimestamp" {
+		return r, r.Key == ""
+	}
+	return r, IsValidKey(r.Key)
+}
+
+// p2phttpServer is a "git annex p2phttp" process serving one repository on a local port
+type p2phttpServer struct {
+	proxy    *httputil.ReverseProxy
+	cancel   context.CancelFunc
+	done     chan struct{}
+	lastUsed time.Time
+	active   int
+}
+
+// p2phttpServers holds the running "git annex p2phttp" servers, keyed by the path of their repository
+var p2phttpServers = struct {
+	sync.Mutex
+	servers map[string]*p2phttpServer
+}{
+	servers: map[string]*p2phttpServer{},
+}
+
+// ServeP2PHTTP passes the request of the git-annex P2P protocol over HTTP, whose path has to start with "/git-annex/",
+// on to a "git annex p2phttp" server of the repository. The server is started if it isn't running yet,
+// and stopped once it hasn't served a request for idleTimeout, if that isn't 0.
+// The request has to be authenticated and authorized already, the server lets anything through.
+func ServeP2PHTTP(w http.ResponseWriter, req *http.Request, repoPath string, idleTimeout time.Duration) error {
+	server, err := acquireP2PHTTPServer(repoPath, idleTimeout)
+	if err != nil {
+		return err
+	}
+	defer releaseP2PHTTPServer(server)
+
+	server.proxy.ServeHTTP(w, req)
+	return nil
+}
+
+// acquireP2PHTTPServer returns the running server of the repository, starting it if there is none, and marks it as in use
+func acquireP2PHTTPServer(repoPath string, idleTimeout time.Duration) (*p2phttpServer, error) {
+	p2phttpServers.Lock()
+	defer p2phttpServers.Unlock()
+
+	server, has := p2phttpServers.servers[repoPath]
+	if has {
+		select {
+		case <-server.done:
+			// it has exited on its own, e.g. because git-annex was upgraded
+			has = false
+		default:
+		}
+	}
+	if !has {
+		var err error
+		if server, err = startP2PHTTPServer(repoPath, idleTimeout); err != nil {
+			return nil, err
+		}
+		p2phttpServers.servers[repoPath] = server
+	}
+	server.active++
+	return server, nil
+}
+
+// releaseP2PHTTPServer marks a request served by the server as done
+func releaseP2PHTTPServer(server *p2phttpServer) {
+	p2phttpServers.Lock()
+	defer p2phttpServers.Unlock()
+
+	server.active--
+	server.lastUsed = time.Now()
+}
+
+// startP2PHTTPServer starts "git annex p2phttp" in the repository on a free local port and waits for it to accept connections
+func startP2PHTTPServer(repoPath string, idleTimeout time.Duration) (*p2phttpServer, error) {
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find a free port: %w", err)
+	}
+	password, err := util.CryptoRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(graceful.GetManager().ShutdownContext())
+	ctx, _, finished := process.GetManager().AddTypedContext(ctx, "git annex p2phttp in "+repoPath, process.SystemProcessType, true)
+	// git-annex is run directly rather than through git, so that stopping it doesn't leave it behind as an orphan
+	cmd := exec.CommandContext(ctx, "git-annex", "p2phttp", "--bind", "127.0.0.1", "--port", strconv.Itoa(port), "--authenv-http")
+	process.SetSysProcAttribute(cmd)
+	cmd.Dir = repoPath
+	cmd.Env = append(os.Environ(), "GIT_ANNEX_P2PHTTP_USERNAME="+p2phttpUser, "GIT_ANNEX_P2PHTTP_PASSWORD="+password)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		finished()
+		cancel()
+		return nil, fmt.Errorf("unable to start git annex p2phttp: %w", err)
+	}
+
+	server := &p2phttpServer{cancel: cancel, done: make(chan struct{}), lastUsed: time.Now()}
+	go func() {
+		defer finished()
+		err := cmd.Wait()
+		close(server.done)
+		if ctx.Err() == nil {
+			log.Warn("git annex p2phttp in %s exited: %v, %s", repoPath, err, stderr.String())
+		}
+	}()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	if err := waitForP2PHTTPServer(addr, server.done); err != nil {
+		cancel()
+		<-server.done
+		return nil, fmt.Errorf("git annex p2phttp in %s didn't start: %w, %s", repoPath, err, stderr.String())
+	}
+
+	target := &url.URL{Scheme: "http", Host: addr}
+	server.proxy = httputil.NewSingleHostReverseProxy(target)
+	direct := server.proxy.Director
+	server.proxy.Director = func(req *http.Request) {
+		direct(req)
+		// the client authenticated with Gitea, the server only knows the proxy
+		req.Header.Del("Cookie")
+		req.SetBasicAuth(p2phttpUser, password)
+	}
+	if idleTimeout > 0 {
+		go server.stopWhenIdle(repoPath, idleTimeout)
+	}
+	return server, nil
+}
+
+// waitForP2PHTTPServer waits until the server accepts connections at addr, or has exited
+func waitForP2PHTTPServer(addr string, done <-chan struct{}) error {
+	deadline := time.Now().Add(p2phttpStartTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-done:
+			return fmt.Errorf("exited early")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// stopWhenIdle stops the server once it hasn't served a request for idleTimeout
+func (server *p2phttpServer) stopWhenIdle(repoPath string, idleTimeout time.Duration) {
+	ticker := time.NewTicker(idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.done:
+		case <-ticker.C:
+			p2phttpServers.Lock()
+			idle := server.active == 0 && time.Since(server.lastUsed) >= idleTimeout
+			if idle && p2phttpServers.servers[repoPath] == server {
+				delete(p2phttpServers.servers, repoPath)
+			}
+			p2phttpServers.Unlock()
+			if !idle {
+				continue
+			}
+			server.cancel()
+		}
+		return
+	}
+}
+
+// freeLocalPort returns a port on localhost nothing listens on at the moment
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseP2PHTTPRequest(t *testing.T) {
+	const uuid = "f11773f0-11e1-45b2-9805-06db1b4b6b2f"
+	const key = "SHA256E-s6--5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03.txt"
+
+	cases := []struct {
+		path    string
+		query   url.Values
+		request P2PHTTPRequest
+		valid   bool
+	}{
+		{path: uuid + "/v4/key/" + key, request: P2PHTTPRequest{Op: "key", Key: key}, valid: true},
+		{path: uuid + "/v4/checkpresent", query: url.Values{"key": {key}}, request: P2PHTTPRequest{Op: "checkpresent", Key: key}, valid: true},
+		{path: uuid + "/v3/put", query: url.Values{"key": {key}}, request: P2PHTTPRequest{Op: "put", Key: key}, valid: true},
+		{path: uuid + "/v4/remove", query: url.Values{"key": {key}}, request: P2PHTTPRequest{Op: "remove", Key: key}, valid: true},
+		{path: uuid + "/v4/gettimestamp", request: P2PHTTPRequest{Op: "gettimestamp"}, valid: true},
+		{path: uuid + "/v4/put"},
+		{path: uuid + "/v4/put", query: url.Values{"key": {"../config"}}},
+		{path: uuid + "/v4/key/" + key + "/more"},
+		{path: uuid + "/v4/checkpresent/" + key},
+		{path: uuid + "/latest/put", query: url.Values{"key": {key}}},
+		{path: "/v4/put", query: url.Values{"key": {key}}},
+		{path: uuid},
+	}
+	for _, c := range cases {
+		request, valid := ParseP2PHTTPRequest(c.path, c.query)
+		assert.Equal(t, c.valid, valid, c.path)
+		if c.valid {
+			assert.Equal(t, c.request, request, c.path)
+		}
+	}
+
+	assert.True(t, P2PHTTPRequest{Op: "putoffset"}.IsWrite())
+	assert.True(t, P2PHTTPRequest{Op: "remove-before"}.IsWrite())
+	assert.True(t, P2PHTTPRequest{Op: "remove-before"}.IsRemove())
+	assert.False(t, P2PHTTPRequest{Op: "put"}.IsRemove())
+	assert.False(t, P2PHTTPRequest{Op: "lockcontent"}.IsWrite())
+}
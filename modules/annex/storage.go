@@ -0,0 +1,76 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+
+	"code.gitea.io/gitea/modules/storage"
+)
+
+// With [annex] STORAGE_TYPE the content of the repositories is kept in storage.Annex as well, so that it outlives
+// the disk of the node, e.g. of a container. git-annex-shell and "git annex p2phttp" only serve content in the
+// repository, so content received is stored in the object storage afterwards, content dropped is deleted from it,
+// and content to send is fetched from it beforehand if the repository doesn't have it.
+
+// StoragePath returns where the content of the key of the repository is kept in the object storage
+func StoragePath(repoID int64, key string) string {
+	return path.Join(strconv.FormatInt(repoID, 10), key)
+}
+
+// FetchFromStorage copies the content of the key from the object storage into the repository at repoPath,
+// unless the repository has it already. It returns false if neither has the content.
+// The content has to match the size and checksum recorded in the key.
+func FetchFromStorage(ctx context.Context, repoID int64, repoPath, key string) (bool, error) {
+	if _, err := os.Stat(KeyPath(repoPath, key)); err == nil {
+		return true, nil
+	}
+	if _, err := storage.Annex.Stat(StoragePath(repoID, key)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	content, err := storage.Annex.Open(StoragePath(repoID, key))
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	return true, PutContent(ctx, repoPath, key, content, 0)
+}
+
+// SaveToStorage copies the content of the key in the repository at repoPath to the object storage.
+// Keys whose content the repository doesn't have, e.g. because receiving it failed, are skipped.
+func SaveToStorage(repoID int64, repoPath, key string) error {
+	content, err := os.Open(KeyPath(repoPath, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer content.Close()
+	fi, err := content.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = storage.Annex.Save(StoragePath(repoID, key), content, fi.Size())
+	return err
+}
+
+// DeleteFromStorage deletes the content of the key from the object storage after it has been dropped from the
+// repository at repoPath. Keys whose content the repository still has, e.g. because dropping it failed, are skipped.
+func DeleteFromStorage(repoID int64, repoPath, key string) error {
+	if _, err := os.Stat(KeyPath(repoPath, key)); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := storage.Annex.Delete(StoragePath(repoID, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package annex
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnexStorage(t *testing.T) {
+	oldAnnex := storage.Annex
+	defer func() {
+		storage.Annex = oldAnnex
+	}()
+	var err error
+	storage.Annex, err = storage.NewLocalStorage(context.Background(), storage.LocalStorageConfig{Path: t.TempDir()})
+	assert.NoError(t, err)
+
+	repoPath := t.TempDir()
+	const key = "SHA256E-s5--b5a2c96250612366ea272ffac6d9744aaf4b45aacd96aa7cfcb931ee3b558259.txt"
+	const otherKey = "SHA256E-s6--0000000000000000000000000000000000000000000000000000000000000000.txt"
+	keyPath := KeyPath(repoPath, key)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(keyPath), 0o755))
+	assert.NoError(t, os.WriteFile(keyPath, []byte("dummy"), 0o444))
+
+	// content the repository has is saved, content it doesn't have is skipped
+	assert.NoError(t, SaveToStorage(1, repoPath, key))
+	assert.NoError(t, SaveToStorage(1, repoPath, otherKey))
+	obj, err := storage.Annex.Open(StoragePath(1, key))
+	if assert.NoError(t, err) {
+		content, err := io.ReadAll(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, "dummy", string(content))
+		obj.Close()
+	}
+	_, err = storage.Annex.Stat(StoragePath(1, otherKey))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// content the repository has is neither fetched nor deleted
+	has, err := FetchFromStorage(context.Background(), 1, repoPath, key)
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.NoError(t, DeleteFromStorage(1, repoPath, key))
+	_, err = storage.Annex.Stat(StoragePath(1, key))
+	assert.NoError(t, err)
+
+	// content neither has is missing
+	has, err = FetchFromStorage(context.Background(), 1, repoPath, otherKey)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// content fetched from the storage has to match the key
+	_, err = storage.Annex.Save(StoragePath(1, otherKey), strings.NewReader("broken"), 6)
+	assert.NoError(t, err)
+	_, err = FetchFromStorage(context.Background(), 1, repoPath, otherKey)
+	assert.ErrorIs(t, err, ErrContentMismatch)
+	_, err = os.Stat(KeyPath(repoPath, otherKey))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// dropped content is deleted from the storage
+	assert.NoError(t, os.Chmod(filepath.Dir(keyPath), 0o755))
+	assert.NoError(t, os.Remove(keyPath))
+	assert.NoError(t, DeleteFromStorage(1, repoPath, key))
+	_, err = storage.Annex.Stat(StoragePath(1, key))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NoError(t, DeleteFromStorage(1, repoPath, key))
+
+	// the content of other repositories is kept apart
+	_, err = storage.Annex.Stat(StoragePath(2, key))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
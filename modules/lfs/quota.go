@@ -0,0 +1,20 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package lfs
+
+import (
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// RepoQuota returns the LFS quota of the repository from [repository.lfs_quota],
+// the one of the repository taking precedence over the one of its owner
+func RepoQuota(ownerName, repoName string) (int64, bool) {
+	if quota, has := setting.Repository.LFSQuotas[strings.ToLower(ownerName+"/"+repoName)]; has {
+		return quota, true
+	}
+	quota, has := setting.Repository.LFSQuotas[strings.ToLower(ownerName)]
+	return quota, has
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package lfs
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoQuota(t *testing.T) {
+	oldQuotas := setting.Repository.LFSQuotas
+	defer func() {
+		setting.Repository.LFSQuotas = oldQuotas
+	}()
+	setting.Repository.LFSQuotas = map[string]int64{
+		"user2":       1 << 30,
+		"user2/repo1": 1 << 20,
+	}
+
+	quota, has := RepoQuota("User2", "Repo1")
+	assert.True(t, has)
+	assert.EqualValues(t, 1<<20, quota)
+
+	// the other repositories of the owner get its quota
+	quota, has = RepoQuota("user2", "repo2")
+	assert.True(t, has)
+	assert.EqualValues(t, 1<<30, quota)
+
+	_, has = RepoQuota("user3", "repo3")
+	assert.False(t, has)
+}
@@ -4,12 +4,15 @@
 package pprof
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"time"
 
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/storage"
 )
 
 // DumpMemProfileForUsername dumps a memory profile at pprofDataPath as memprofile_<username>_<temporary id>
@@ -43,3 +46,35 @@ func DumpCPUProfileForUsername(pprofDataPath, username string) (func(), error) {
 		}
 	}, nil
 }
+
+// profileObjectName returns a unique object name for a profile, like the temporary files above
+func profileObjectName(kind, username string) string {
+	return fmt.Sprintf("%s_%s_%d", kind, username, time.Now().UnixNano())
+}
+
+// DumpMemProfileToStorage dumps a memory profile into store as memprofile_<username>_<timestamp>
+func DumpMemProfileToStorage(store storage.ObjectStorage, username string) error {
+	var buf bytes.Buffer
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(&buf); err != nil {
+		return err
+	}
+	_, err := store.Save(profileObjectName("memprofile", username), &buf, int64(buf.Len()))
+	return err
+}
+
+// DumpCPUProfileToStorage dumps a CPU profile into store as cpuprofile_<username>_<timestamp>
+// the profile is buffered in memory, the stop function it returns stops the profile and saves it
+func DumpCPUProfileToStorage(store storage.ObjectStorage, username string) (func(), error) {
+	name := profileObjectName("cpuprofile", username)
+	buf := &bytes.Buffer{}
+	if err := pprof.StartCPUProfile(buf); err != nil {
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		if _, err := store.Save(name, buf, int64(buf.Len())); err != nil {
+			log.Error("Unable to save CPU profile %s: %v", name, err)
+		}
+	}, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package pprof
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpProfilesToStorage(t *testing.T) {
+	store, err := storage.NewLocalStorage(context.Background(), storage.LocalStorageConfig{Path: t.TempDir()})
+	assert.NoError(t, err)
+
+	stopCPUProfiler, err := DumpCPUProfileToStorage(store, "user2")
+	assert.NoError(t, err)
+	stopCPUProfiler()
+	assert.NoError(t, DumpMemProfileToStorage(store, "user2"))
+
+	var names []string
+	assert.NoError(t, store.IterateObjects("", func(path string, obj storage.Object) error {
+		defer obj.Close()
+		fi, err := obj.Stat()
+		assert.NoError(t, err)
+		assert.NotZero(t, fi.Size())
+		names = append(names, path)
+		return nil
+	}))
+	if assert.Len(t, names, 2) {
+		assert.True(t, strings.HasPrefix(names[0], "cpuprofile_user2_") || strings.HasPrefix(names[1], "cpuprofile_user2_"))
+		assert.True(t, strings.HasPrefix(names[0], "memprofile_user2_") || strings.HasPrefix(names[1], "memprofile_user2_"))
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"code.gitea.io/gitea/modules/httplib"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// AnnexObjectCountResult is the response from AnnexObjectCount
+type AnnexObjectCountResult struct {
+	Count int64
+}
+
+// AnnexObjectCount returns the number of git-annex objects stored in the repository
+func AnnexObjectCount(ctx context.Context, repoID int64) (int64, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/object-count/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "GET")
+	result, extra := requestJSONResp(req, &AnnexObjectCountResult{})
+	if extra.HasError() {
+		return 0, extra
+	}
+	return result.Count, extra
+}
+
+// AnnexDropNotify notifies that the git-annex content with the key has been dropped from the repository.
+// The configured notification command runs in the background, so this doesn't wait for it.
+func AnnexDropNotify(ctx context.Context, repoID int64, key string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/drop-notify/%d?key=%s", repoID, url.QueryEscape(key))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// AnnexRecordKeyResult is the response from AnnexRecordKey
+type AnnexRecordKeyResult struct {
+	OtherRepos int64
+}
+
+// AnnexRecordKey records that the repository stores the content of the git-annex key,
+// returning the number of other repositories storing the same content
+func AnnexRecordKey(ctx context.Context, repoID int64, key string) (int64, error) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/record-key/%d?key=%s", repoID, url.QueryEscape(key))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	result, extra := requestJSONResp(req, &AnnexRecordKeyResult{})
+	if extra.HasError() {
+		return 0, extra.Error
+	}
+	return result.OtherRepos, nil
+}
+
+// AnnexForgetKey records that the repository no longer stores the content of the git-annex key
+func AnnexForgetKey(ctx context.Context, repoID int64, key string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/forget-key/%d?key=%s", repoID, url.QueryEscape(key))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// AnnexKeyLockResult is the response from AnnexKeyLock
+type AnnexKeyLockResult struct {
+	Token string
+}
+
+// AnnexKeyLock takes the lock of the git-annex key in the repository, returning the token to release it with.
+// Dropping the content takes the lock exclusively, sending it shares the lock with other senders.
+// If the lock is held in a conflicting way the returned ResponseExtra has the StatusLocked status code.
+func AnnexKeyLock(ctx context.Context, repoID int64, key string, exclusive bool) (string, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/key-lock/%d?key=%s&exclusive=%t", repoID, url.QueryEscape(key), exclusive)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	result, extra := requestJSONResp(req, &AnnexKeyLockResult{})
+	if extra.HasError() {
+		return "", extra
+	}
+	return result.Token, extra
+}
+
+// AnnexKeyLockRenew extends the lease of the lock of the git-annex key in the repository held with the token by another LockLease
+func AnnexKeyLockRenew(ctx context.Context, repoID int64, key, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/key-lock-renew/%d?key=%s&token=%s", repoID, url.QueryEscape(key), url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// AnnexKeyUnlock releases the lock of the git-annex key in the repository
+func AnnexKeyUnlock(ctx context.Context, repoID int64, key, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/key-unlock/%d?key=%s&token=%s", repoID, url.QueryEscape(key), url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// AnnexNotifyChangesResult is the response from AnnexNotifyChangesAcquire
+type AnnexNotifyChangesResult struct {
+	Token string
+}
+
+// AnnexNotifyChangesAcquire takes one of the [annex] MAX_NOTIFY_CHANGES_PER_REPO "notifychanges" slots of the repository,
+// returning the token to release it with. If all slots are taken the returned ResponseExtra has the StatusTooManyRequests status code.
+func AnnexNotifyChangesAcquire(ctx context.Context, repoID int64) (string, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/notify-changes-acquire/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	result, extra := requestJSONResp(req, &AnnexNotifyChangesResult{})
+	if extra.HasError() {
+		return "", extra
+	}
+	return result.Token, extra
+}
+
+// AnnexNotifyChangesRenew extends the lease of the "notifychanges" slot of the repository held with the token
+func AnnexNotifyChangesRenew(ctx context.Context, repoID int64, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/notify-changes-renew/%d?token=%s", repoID, url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// AnnexNotifyChangesRelease releases the "notifychanges" slot of the repository
+func AnnexNotifyChangesRelease(ctx context.Context, repoID int64, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/notify-changes-release/%d?token=%s", repoID, url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// annexStorageRequest returns a request to copy the content of the git-annex keys of the repository from or to the object storage
+func annexStorageRequest(ctx context.Context, op string, repoID int64, keys []string) *httplib.Request {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/annex/storage-%s/%d?", op, repoID)
+	for i, key := range keys {
+		if i > 0 {
+			reqURL += "&"
+		}
+		reqURL += "key=" + url.QueryEscape(key)
+	}
+	req := newInternalRequest(ctx, reqURL, "POST")
+	// transferring large content takes a while
+	req.SetReadWriteTimeout(time.Duration(setting.Git.Timeout.Clone+60) * time.Second)
+	return req
+}
+
+// AnnexStorageFetch copies the content of the git-annex keys the repository doesn't have from the [annex] object storage into it
+func AnnexStorageFetch(ctx context.Context, repoID int64, keys []string) ResponseExtra {
+	_, extra := requestJSONResp(annexStorageRequest(ctx, "fetch", repoID, keys), &responseText{})
+	return extra
+}
+
+// AnnexStorageSave copies the content of the git-annex keys the repository has received to the [annex] object storage
+func AnnexStorageSave(ctx context.Context, repoID int64, keys []string) ResponseExtra {
+	_, extra := requestJSONResp(annexStorageRequest(ctx, "save", repoID, keys), &responseText{})
+	return extra
+}
+
+// AnnexStorageDelete deletes the content of the git-annex keys the repository has dropped from the [annex] object storage
+func AnnexStorageDelete(ctx context.Context, repoID int64, keys []string) ResponseExtra {
+	_, extra := requestJSONResp(annexStorageRequest(ctx, "delete", repoID, keys), &responseText{})
+	return extra
+}
@@ -28,6 +28,7 @@ type GitPushOptions map[string]string
 const (
 	GitPushOptionRepoPrivate  = "repo.private"
 	GitPushOptionRepoTemplate = "repo.template"
+	GitPushOptionDryRun       = "dry-run"
 )
 
 // Bool checks for a key in the map and parses as a boolean
@@ -55,6 +56,8 @@ type HookOptions struct {
 	DeployKeyID                     int64 // if the pusher is a DeployKey, then UserID is the repo's org user.
 	IsWiki                          bool
 	ActionPerm                      int
+	VerifyAuthorEmails              bool // the author and committer emails of pushed commits must be verified emails of the pusher
+	EnforceLFSLocks                 bool // pushes changing files locked by another user are rejected
 }
 
 // SSHLogOption ssh log options
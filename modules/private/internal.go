@@ -24,16 +24,39 @@ import (
 type Response struct {
 	Err     string `json:"err,omitempty"`      // server-side error log message, it won't be exposed to end users
 	UserMsg string `json:"user_msg,omitempty"` // meaningful error message for end users, it will be shown in git client's output.
+	Reason  string `json:"reason,omitempty"`   // reason code of a denial, the message shown for it may be configured in [ssh.messages]
+
+	// Language is the language of the user a denial is for, empty if the user isn't known
+	Language string `json:"lang,omitempty"`
+	// Args are the values filled into the translation of the message of a denial, e.g. the name of the repository
+	Args []string `json:"args,omitempty"`
 }
 
-func getClientIP() string {
+// Reason codes of denials of SSH operations, the messages shown for them may be configured in [ssh.messages]
+const (
+	DenialArchived    = "archived"    // writes to an archived repository
+	DenialReadOnly    = "read_only"   // writes to a mirror
+	DenialQuota       = "quota"       // the git-annex object limit of the repository has been reached
+	DenialRateLimit   = "rate_limit"  // the SSH cost budget of the user has been used up
+	DenialDeactivated = "deactivated" // the account of the user is disabled
+)
+
+// SSHClientIP returns the IP address of the SSH client from SSH_CONNECTION, or an empty string if it is unknown
+func SSHClientIP() string {
 	sshConnEnv := strings.TrimSpace(os.Getenv("SSH_CONNECTION"))
 	if len(sshConnEnv) == 0 {
-		return "127.0.0.1"
+		return ""
 	}
 	return strings.Fields(sshConnEnv)[0]
 }
 
+func getClientIP() string {
+	if ip := SSHClientIP(); ip != "" {
+		return ip
+	}
+	return "127.0.0.1"
+}
+
 func newInternalRequest(ctx context.Context, url, method string, body ...any) *httplib.Request {
 	if setting.InternalToken == "" {
 		log.Fatal(`The INTERNAL_TOKEN setting is missing from the configuration file: %q.
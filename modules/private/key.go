@@ -6,6 +6,7 @@ package private
 import (
 	"context"
 	"fmt"
+	"net/url"
 
 	"code.gitea.io/gitea/modules/setting"
 )
@@ -19,6 +20,14 @@ func UpdatePublicKeyInRepo(ctx context.Context, keyID, repoID int64) error {
 	return extra.Error
 }
 
+// ServRecordKeyActivity records the operation done over SSH with the key in the repository
+func ServRecordKeyActivity(ctx context.Context, keyID, repoID int64, verb string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/ssh/%d/activity/%d?verb=%s", keyID, repoID, url.QueryEscape(verb))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
 // AuthorizedPublicKeyByContent searches content as prefix (leak e-mail part)
 // and returns public key found.
 func AuthorizedPublicKeyByContent(ctx context.Context, content string) (string, ResponseExtra) {
@@ -45,6 +45,49 @@ func FlushQueues(ctx context.Context, timeout time.Duration, nonBlocking bool) R
 	return requestJSONUserMsg(req, "Flushed")
 }
 
+// ApproveClone approves a pending clone approval request
+func ApproveClone(ctx context.Context, requestID string) ResponseExtra {
+	reqURL := setting.LocalURL + "api/internal/manager/approve-clone/" + url.PathEscape(requestID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	if !extra.HasError() {
+		extra.UserMsg = "Approved"
+	}
+	return extra
+}
+
+// BackupStart pauses writes over SSH for at most maxDuration while a backup snapshot is taken
+func BackupStart(ctx context.Context, maxDuration time.Duration) ResponseExtra {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/backup-start?duration=%d", maxDuration)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	return requestJSONUserMsg(req, "")
+}
+
+// BackupEnd resumes writes over SSH after a backup snapshot
+func BackupEnd(ctx context.Context) ResponseExtra {
+	reqURL := setting.LocalURL + "api/internal/manager/backup-end"
+	req := newInternalRequest(ctx, reqURL, "POST")
+	return requestJSONUserMsg(req, "Writes over SSH are resumed")
+}
+
+// LockRepo locks the repository for the operations over SSH of the scope, for at most maxDuration
+func LockRepo(ctx context.Context, repoName, scope string, maxDuration time.Duration) ResponseExtra {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/lock-repo?repo=%s&scope=%s&duration=%d", url.QueryEscape(repoName), url.QueryEscape(scope), maxDuration)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	return requestJSONUserMsg(req, "")
+}
+
+// UnlockRepo unlocks a repository locked with LockRepo
+func UnlockRepo(ctx context.Context, repoName string) ResponseExtra {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/unlock-repo?repo=%s", url.QueryEscape(repoName))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	if !extra.HasError() {
+		extra.UserMsg = fmt.Sprintf("Repository %s is unlocked", repoName)
+	}
+	return extra
+}
+
 // PauseLogging pauses logging
 func PauseLogging(ctx context.Context) ResponseExtra {
 	reqURL := setting.LocalURL + "api/internal/manager/pause-logging"
@@ -100,6 +143,30 @@ func RemoveLogger(ctx context.Context, group, name string) ResponseExtra {
 	return requestJSONUserMsg(req, "Removed")
 }
 
+// ServUsageStats writes the resource usage of the SSH operations per repository and operation since the start of this gitea instance
+func ServUsageStats(ctx context.Context, out io.Writer, json bool) ResponseExtra {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/serv-usage?json=%t", json)
+
+	req := newInternalRequest(ctx, reqURL, "GET")
+	callback := func(resp *http.Response, extra *ResponseExtra) {
+		_, extra.Error = io.Copy(out, resp.Body)
+	}
+	_, extra := requestJSONResp(req, &callback)
+	return extra
+}
+
+// ServProtocolStats writes the number of SSH operations per git transport protocol version and operation since the start of this gitea instance
+func ServProtocolStats(ctx context.Context, out io.Writer, json bool) ResponseExtra {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/serv-protocols?json=%t", json)
+
+	req := newInternalRequest(ctx, reqURL, "GET")
+	callback := func(resp *http.Response, extra *ResponseExtra) {
+		_, extra.Error = io.Copy(out, resp.Body)
+	}
+	_, extra := requestJSONResp(req, &callback)
+	return extra
+}
+
 // Processes return the current processes from this gitea instance
 func Processes(ctx context.Context, out io.Writer, flat, noSystem, stacktraces, json bool, cancel string) ResponseExtra {
 	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/manager/processes?flat=%t&no-system=%t&stacktraces=%t&json=%t&cancel-pid=%s", flat, noSystem, stacktraces, json, url.QueryEscape(cancel))
@@ -22,6 +22,9 @@ type responseText struct {
 type ResponseExtra struct {
 	StatusCode int
 	UserMsg    string
+	Reason     string
+	Language   string
+	Args       []string
 	Error      error
 }
 
@@ -70,6 +73,9 @@ func requestJSONResp[T any](req *httplib.Request, res *T) (ret *T, extra Respons
 			return nil, extra
 		}
 		extra.UserMsg = respErr.UserMsg
+		extra.Reason = respErr.Reason
+		extra.Language = respErr.Language
+		extra.Args = respErr.Args
 		if extra.UserMsg == "" {
 			extra.UserMsg = "Internal Server Error (no message for end users)"
 		}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"time"
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
 	"code.gitea.io/gitea/models/perm"
@@ -18,17 +19,26 @@ import (
 type KeyAndOwner struct {
 	Key   *asymkey_model.PublicKey `json:"key"`
 	Owner *user_model.User         `json:"user"`
+
+	// RepoCloneURL is the SSH clone URL of the repository a deploy key is bound to, if it is bound to only one
+	RepoCloneURL string `json:"repo_clone_url,omitempty"`
 }
 
 // ServNoCommand returns information about the provided key
-func ServNoCommand(ctx context.Context, keyID int64) (*asymkey_model.PublicKey, *user_model.User, error) {
+func ServNoCommand(ctx context.Context, keyID int64) (*KeyAndOwner, error) {
 	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/none/%d", keyID)
 	req := newInternalRequest(ctx, reqURL, "GET")
 	keyAndOwner, extra := requestJSONResp(req, &KeyAndOwner{})
 	if extra.HasError() {
-		return nil, nil, extra.Error
+		return nil, extra.Error
 	}
-	return keyAndOwner.Key, keyAndOwner.Owner, nil
+	return keyAndOwner, nil
+}
+
+// ServBranchRule is a branch protection rule, as far as serv needs to know it
+type ServBranchRule struct {
+	RuleName           string
+	RequireStatusCheck bool
 }
 
 // ServCommandResults are the results of a call to the private route serv
@@ -39,12 +49,104 @@ type ServCommandResults struct {
 	KeyName     string // this field is ambiguous, it can be the name of DeployKey, or the name of the PublicKey
 	UserName    string
 	UserEmail   string
-	UserID      int64
-	OwnerName   string
-	RepoName    string
-	RepoID      int64
+	// UserLanguage is the language the user has chosen for the web interface, the messages shown to the user are translated to it
+	UserLanguage string
+	UserID       int64
+	OwnerName    string
+	RepoName     string
+	RepoID       int64
+
+	// RepoIsPrivate is true if the repository is private
+	RepoIsPrivate bool
+	// IsPrincipal is true if the key is an SSH certificate principal
+	IsPrincipal bool
+	// UserEmailVerified is true if the primary email address of the user has been activated
+	UserEmailVerified bool
+	// UserTwoFactorEnabled is true if the user has enrolled in TOTP or WebAuthn two-factor authentication
+	UserTwoFactorEnabled bool
+	// Require2FA is true if users must have enrolled in two-factor authentication to use git over SSH
+	Require2FA bool
+
+	// PreExecCommand is run before the git command, a non-zero exit aborts the operation
+	PreExecCommand string
+
+	// GitNamespace scopes the refs of the git command to a namespace of the repository, see gitnamespaces(7)
+	GitNamespace string
+
+	// MinClientGitVersion is the git version clients of the repository are recommended to have at least
+	MinClientGitVersion string
+
+	// CommandTimeout overrides [server] SSH_COMMAND_TIMEOUT for the repository if it is set, 0 disables the timeout
+	CommandTimeout *time.Duration
+
+	// LFSUnavailable is true if the repository has LFS objects but the LFS server is disabled
+	LFSUnavailable bool
+
+	// LFSQuota is the maximum size in bytes of the LFS objects of the repository, 0 means no quota.
+	// It and LFSSize, the size of the LFS objects, are only set when git-lfs authenticates for writing.
+	LFSQuota int64
+	LFSSize  int64
+
+	// BaseRepoPath is the path of the base repository of a fork, its objects may be used as alternates
+	BaseRepoPath string
+
+	// ProtectedDefaultBranch is the default branch if the repository only accepts changes to it through pull requests
+	ProtectedDefaultBranch string
+
+	// DenyBranchCreation is true if the push may only update and delete existing branches
+	DenyBranchCreation bool
+
+	// KeyReadOnly is true if the user has made the key read-only, only set for writes
+	KeyReadOnly bool
+	// AccountReadOnly is true if the user has made all of their keys read-only, only set for writes
+	AccountReadOnly bool
+	// RepoAdmin is true if the user has administrator access to the repository, only set for writes
+	RepoAdmin bool
+
+	// UnacceptedCLA is the URL of the contributor license agreement the user has to accept before pushing, if any
+	UnacceptedCLA string
+
+	// VerifyAuthorEmails is true if the author and committer emails of pushed commits must be verified emails of the user
+	VerifyAuthorEmails bool
+
+	// EnforceLFSLocks is true if pushes changing files locked by another user have to be rejected
+	EnforceLFSLocks bool
+
+	// BranchRules are the branch protection rules of the repository in priority order,
+	// if pushes to branches requiring status checks have to be rejected
+	BranchRules []ServBranchRule
+
+	// RepoSize is the size of the git repository in bytes
+	RepoSize int64
+
+	// RepoUnhealthy is true if the last health check of the repository failed, its data should be probed before use
+	RepoUnhealthy bool
+
+	// LooseObjects is the estimated number of loose objects of the repository, only set if [git] AUTO_REPACK_ON_ACCESS is enabled
+	LooseObjects int64
+
+	// CloneApprovalRequired is true if reading the repository needs the approval of an administrator every time
+	CloneApprovalRequired bool
+
+	// RepoLock is the scope of the lock an administrator has put on the repository, RepoLockWrite or RepoLockAll
+	RepoLock string
+
+	// BackupInProgress is true if writes over SSH are paused because a backup snapshot is in progress, only set for writes
+	BackupInProgress bool
+
+	// RepoLastAccess is when the repository was last accessed, it isn't touched again until RepoTouchInterval has passed
+	RepoLastAccess time.Time
 }
 
+// RepoTouchInterval is how often the last access time of a repository is updated at most
+const RepoTouchInterval = time.Minute
+
+// The scopes of the lock an administrator can put on a repository with "gitea manager lock-repo"
+const (
+	RepoLockWrite = "write" // writes are rejected, reads go on
+	RepoLockAll   = "all"   // all operations are rejected
+)
+
 // ServCommand preps for a serv call
 func ServCommand(ctx context.Context, keyID int64, ownerName, repoName string, mode perm.AccessMode, verbs ...string) (*ServCommandResults, ResponseExtra) {
 	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/command/%d/%s/%s?mode=%d",
@@ -61,3 +163,200 @@ func ServCommand(ctx context.Context, keyID int64, ownerName, repoName string, m
 	req := newInternalRequest(ctx, reqURL, "GET")
 	return requestJSONResp(req, &ServCommandResults{})
 }
+
+// LockLease is how long the locks taken by serv are held unless serv renews them, so that the locks of a serv command
+// that was killed are released soon
+const LockLease = time.Minute
+
+// ServPushLockResult is the response from ServPushLock
+type ServPushLockResult struct {
+	Token string
+}
+
+// ServPushLock takes the push lock of the repository, returning the token to release it with.
+// If another push holds the lock the returned ResponseExtra has the StatusLocked status code.
+func ServPushLock(ctx context.Context, repoID int64) (string, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/push-lock/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	result, extra := requestJSONResp(req, &ServPushLockResult{})
+	if extra.HasError() {
+		return "", extra
+	}
+	return result.Token, extra
+}
+
+// ServCloneApprovalResult is the response from ServCloneApproval
+type ServCloneApprovalResult struct {
+	RequestID string
+	Approved  bool
+}
+
+// ServCloneApproval requests the approval of the key to read the repository, or checks whether the pending request has been approved.
+// userName and repoName are only used to tell the administrators who wants to read what.
+func ServCloneApproval(ctx context.Context, repoID, keyID int64, userName, repoName string) (*ServCloneApprovalResult, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/clone-approval/%d?keyid=%d&user=%s&repo=%s", repoID, keyID, url.QueryEscape(userName), url.QueryEscape(repoName))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	return requestJSONResp(req, &ServCloneApprovalResult{})
+}
+
+// ServReadThroughResult is the response from ServReadThrough
+type ServReadThroughResult struct {
+	Hit bool
+}
+
+// ServReadThrough makes a read-through cache node fetch the repository, or its wiki, and the content of the git-annex keys from the origin.
+// It returns true if everything was present already.
+func ServReadThrough(ctx context.Context, repoID int64, isWiki bool, keys []string) (bool, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/read-through/%d?wiki=%t", repoID, isWiki)
+	for _, key := range keys {
+		reqURL += "&key=" + url.QueryEscape(key)
+	}
+	req := newInternalRequest(ctx, reqURL, "POST")
+	// cloning a large repository takes a while
+	req.SetReadWriteTimeout(time.Duration(setting.Git.Timeout.Clone+60) * time.Second)
+	result, extra := requestJSONResp(req, &ServReadThroughResult{})
+	if extra.HasError() {
+		return false, extra
+	}
+	return result.Hit, extra
+}
+
+// ServBudgetResult is the response from ServBudget
+type ServBudgetResult struct {
+	Remaining int64
+}
+
+// ServBudget charges the cost of an SSH operation to the budget of the user.
+// If the budget is used up the returned ResponseExtra has the StatusTooManyRequests status code.
+func ServBudget(ctx context.Context, userID, cost int64) (*ServBudgetResult, ResponseExtra) {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/budget/%d?cost=%d", userID, cost)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	return requestJSONResp(req, &ServBudgetResult{})
+}
+
+// ServBackupInProgressResult is the response from ServBackupInProgress
+type ServBackupInProgressResult struct {
+	InProgress bool
+}
+
+// ServBackupInProgress returns true if writes over SSH are paused because a backup snapshot is in progress
+func ServBackupInProgress(ctx context.Context) (bool, ResponseExtra) {
+	reqURL := setting.LocalURL + "api/internal/serv/backup"
+	req := newInternalRequest(ctx, reqURL, "GET")
+	result, extra := requestJSONResp(req, &ServBackupInProgressResult{})
+	if extra.HasError() {
+		return false, extra
+	}
+	return result.InProgress, extra
+}
+
+// ServTouchRepo records that the repository has just been accessed
+func ServTouchRepo(ctx context.Context, repoID int64) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/touch/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServUsage is the resource usage of the git command run for an SSH operation
+type ServUsage struct {
+	Verb       string
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64 // in bytes, 0 if unknown
+}
+
+// ServRecordUsage records the resource usage of an SSH operation on the repository
+func ServRecordUsage(ctx context.Context, repoID int64, usage *ServUsage) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/usage/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "POST", usage)
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServRecordProtocol counts an SSH operation of the verb by a client which negotiated the version of the git transport protocol
+func ServRecordProtocol(ctx context.Context, verb, version string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/protocol?verb=%s&version=%s", url.QueryEscape(verb), url.QueryEscape(version))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServEvent is the outcome of an SSH operation, published to the [server] SSH_EVENT_STREAM
+type ServEvent struct {
+	Repo     string        `json:"repo"`
+	User     string        `json:"user"`
+	Verb     string        `json:"verb"`
+	Outcome  string        `json:"outcome"` // "success" or "failure"
+	ExitCode int           `json:"exitCode"`
+	BytesIn  int64         `json:"bytesIn"`
+	BytesOut int64         `json:"bytesOut"`
+	Duration time.Duration `json:"duration"`
+}
+
+// ServPublishEvent hands the outcome of an SSH operation to the main process, which publishes it in the background
+func ServPublishEvent(ctx context.Context, event *ServEvent) error {
+	reqURL := setting.LocalURL + "api/internal/serv/event"
+	req := newInternalRequest(ctx, reqURL, "POST", event)
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// The events of ServStatus
+const (
+	ServStatusStart    = "start"
+	ServStatusProgress = "progress"
+	ServStatusDone     = "done"
+)
+
+// ServStatus is the state of an ongoing SSH operation, sent to the main process when [server] SSH_LIVE_STATUS is enabled
+type ServStatus struct {
+	ID       string `json:"id"` // identifies the operation across its events
+	Event    string `json:"event"`
+	Repo     string `json:"repo"`
+	User     string `json:"user"`
+	Verb     string `json:"verb"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+	ExitCode int    `json:"exitCode"` // only set for ServStatusDone
+}
+
+// ServStreamStatus sends the state of an ongoing SSH operation to the main process, which shows it to the administrators
+func ServStreamStatus(ctx context.Context, status *ServStatus) error {
+	reqURL := setting.LocalURL + "api/internal/serv/status"
+	req := newInternalRequest(ctx, reqURL, "POST", status)
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServScheduleGC asks the main process to run git gc on the repository in the background
+func ServScheduleGC(ctx context.Context, repoID int64) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/gc/%d", repoID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServRecordRead counts a clone or fetch of the repository by the user
+func ServRecordRead(ctx context.Context, repoID, userID int64) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/read/%d?user_id=%d", repoID, userID)
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServPushLockRenew extends the lease of the push lock of the repository held with the token by another LockLease
+func ServPushLockRenew(ctx context.Context, repoID int64, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/push-lock-renew/%d?token=%s", repoID, url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
+
+// ServPushUnlock releases the push lock of the repository
+func ServPushUnlock(ctx context.Context, repoID int64, token string) error {
+	reqURL := setting.LocalURL + fmt.Sprintf("api/internal/serv/push-unlock/%d?token=%s", repoID, url.QueryEscape(token))
+	req := newInternalRequest(ctx, reqURL, "POST")
+	_, extra := requestJSONResp(req, &responseText{})
+	return extra.Error
+}
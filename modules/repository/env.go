@@ -6,6 +6,7 @@ package repository
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	repo_model "code.gitea.io/gitea/models/repo"
@@ -15,19 +16,24 @@ import (
 
 // env keys for git hooks need
 const (
-	EnvRepoName     = "GITEA_REPO_NAME"
-	EnvRepoUsername = "GITEA_REPO_USER_NAME"
-	EnvRepoID       = "GITEA_REPO_ID"
-	EnvRepoIsWiki   = "GITEA_REPO_IS_WIKI"
-	EnvPusherName   = "GITEA_PUSHER_NAME"
-	EnvPusherEmail  = "GITEA_PUSHER_EMAIL"
-	EnvPusherID     = "GITEA_PUSHER_ID"
-	EnvKeyID        = "GITEA_KEY_ID" // public key ID
-	EnvDeployKeyID  = "GITEA_DEPLOY_KEY_ID"
-	EnvPRID         = "GITEA_PR_ID"
-	EnvIsInternal   = "GITEA_INTERNAL_PUSH"
-	EnvAppURL       = "GITEA_ROOT_URL"
-	EnvActionPerm   = "GITEA_ACTION_PERM"
+	EnvRepoName      = "GITEA_REPO_NAME"
+	EnvRepoUsername  = "GITEA_REPO_USER_NAME"
+	EnvRepoID        = "GITEA_REPO_ID"
+	EnvRepoIsWiki    = "GITEA_REPO_IS_WIKI"
+	EnvRepoIsPrivate = "GITEA_REPO_IS_PRIVATE"
+	EnvPusherName    = "GITEA_PUSHER_NAME"
+	EnvPusherEmail   = "GITEA_PUSHER_EMAIL"
+	EnvPusherID      = "GITEA_PUSHER_ID"
+	EnvKeyID         = "GITEA_KEY_ID" // public key ID
+	EnvDeployKeyID   = "GITEA_DEPLOY_KEY_ID"
+	EnvPRID          = "GITEA_PR_ID"
+	EnvIsInternal    = "GITEA_INTERNAL_PUSH"
+	EnvAppURL        = "GITEA_ROOT_URL"
+	EnvActionPerm    = "GITEA_ACTION_PERM"
+	// EnvVerifyAuthorEmails is set by serv if the author and committer emails of pushed commits must be verified emails of the pusher
+	EnvVerifyAuthorEmails = "GITEA_VERIFY_AUTHOR_EMAILS"
+	// EnvEnforceLFSLocks is set by serv if pushes changing files locked by another user have to be rejected
+	EnvEnforceLFSLocks = "GITEA_ENFORCE_LFS_LOCKS"
 )
 
 // InternalPushingEnvironment returns an os environment to switch off hooks on push
@@ -63,6 +69,7 @@ func FullPushingEnvironment(author, committer *user_model.User, repo *repo_model
 		EnvRepoName+"="+repoName,
 		EnvRepoUsername+"="+repo.OwnerName,
 		EnvRepoIsWiki+"="+isWiki,
+		EnvRepoIsPrivate+"="+strconv.FormatBool(repo.IsPrivate),
 		EnvPusherName+"="+committer.Name,
 		EnvPusherID+"="+fmt.Sprintf("%d", committer.ID),
 		EnvRepoID+"="+fmt.Sprintf("%d", repo.ID),
@@ -0,0 +1,32 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// UnhealthyMarker is the file in a repository recording why its last health check failed
+const UnhealthyMarker = "gitea-unhealthy"
+
+// IsMarkedUnhealthy returns true if the last health check of the repository failed
+func IsMarkedUnhealthy(repoPath string) bool {
+	_, err := os.Stat(filepath.Join(repoPath, UnhealthyMarker))
+	return err == nil
+}
+
+// MarkUnhealthy records that the health check of the repository failed
+func MarkUnhealthy(repoPath, reason string) error {
+	return os.WriteFile(filepath.Join(repoPath, UnhealthyMarker), []byte(reason+"\n"), 0o644)
+}
+
+// MarkHealthy removes the record of a failed health check of the repository
+func MarkHealthy(repoPath string) error {
+	if err := os.Remove(filepath.Join(repoPath, UnhealthyMarker)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
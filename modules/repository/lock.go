@@ -0,0 +1,36 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"context"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// maxRepoLock is how long a repository is locked at most, so it is unlocked if the administrator forgets to
+const maxRepoLock = 24 * time.Hour
+
+// LockRepo locks the repository for the operations of the scope, for the duration or until it is unlocked.
+// The lock is kept in the database, so it holds on all Gitea instances sharing it and across restarts.
+func LockRepo(ctx context.Context, repoID int64, scope string, duration time.Duration) (time.Time, error) {
+	if duration <= 0 || duration > maxRepoLock {
+		duration = maxRepoLock
+	}
+
+	until := time.Now().Add(duration)
+	return until, repo_model.LockRepository(ctx, repoID, scope, timeutil.TimeStamp(until.Unix()))
+}
+
+// UnlockRepo unlocks the repository, returning false if it wasn't locked
+func UnlockRepo(ctx context.Context, repoID int64) (bool, error) {
+	return repo_model.UnlockRepository(ctx, repoID)
+}
+
+// GetRepoLock returns the scope of the lock of the repository, or an empty string if it isn't locked
+func GetRepoLock(ctx context.Context, repoID int64) (string, error) {
+	return repo_model.GetRepositoryLock(ctx, repoID)
+}
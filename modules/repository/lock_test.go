@@ -0,0 +1,60 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoLock(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+	ctx := db.DefaultContext
+
+	assertLock := func(repoID int64, expected string) {
+		lock, err := GetRepoLock(ctx, repoID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, lock)
+	}
+
+	assertLock(1, "")
+	unlocked, err := UnlockRepo(ctx, 1)
+	assert.NoError(t, err)
+	assert.False(t, unlocked)
+
+	until, err := LockRepo(ctx, 1, private.RepoLockWrite, time.Hour)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), until, time.Minute)
+	assertLock(1, private.RepoLockWrite)
+	assertLock(2, "")
+
+	// locking again changes the scope
+	_, err = LockRepo(ctx, 1, private.RepoLockAll, time.Hour)
+	assert.NoError(t, err)
+	assertLock(1, private.RepoLockAll)
+	unittest.AssertCount(t, &repo_model.Lock{RepoID: 1}, 1)
+	unlocked, err = UnlockRepo(ctx, 1)
+	assert.NoError(t, err)
+	assert.True(t, unlocked)
+	assertLock(1, "")
+
+	// locks end by themselves, at the latest after maxRepoLock
+	until, err = LockRepo(ctx, 1, private.RepoLockAll, 0)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(maxRepoLock), until, time.Minute)
+	assert.NoError(t, repo_model.LockRepository(ctx, 1, private.RepoLockAll, timeutil.TimeStampNow().Add(-1)))
+	assertLock(1, "")
+	unlocked, err = UnlockRepo(ctx, 1)
+	assert.NoError(t, err)
+	assert.False(t, unlocked)
+	unittest.AssertNotExistsBean(t, &repo_model.Lock{RepoID: 1})
+}
@@ -0,0 +1,25 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// EstimateLooseObjects estimates the number of loose objects of the repository the way "git gc --auto" does:
+// object IDs are spread evenly, so the objects in one of the 256 fan-out directories stand for all of them
+func EstimateLooseObjects(repoPath string) int64 {
+	entries, err := os.ReadDir(filepath.Join(repoPath, "objects", "17"))
+	if err != nil {
+		return 0
+	}
+	var count int64
+	for _, entry := range entries {
+		if !entry.IsDir() && len(entry.Name()) == 38 {
+			count++
+		}
+	}
+	return count * 256
+}
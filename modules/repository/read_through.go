@@ -0,0 +1,31 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// ReadThroughMarker is the file in a repository of a read-through cache node whose modification time records
+// when the repository was last fetched from the origin
+const ReadThroughMarker = "gitea-read-through"
+
+// IsReadThroughMiss returns true if the repository of a read-through cache node has to be fetched from the origin
+// before it is read, because it isn't present yet or was last fetched longer than [cache.git_read_through] ITEM_TTL ago.
+func IsReadThroughMiss(repoPath string) bool {
+	info, err := os.Stat(filepath.Join(repoPath, ReadThroughMarker))
+	if err != nil {
+		return true
+	}
+	return time.Since(info.ModTime()) >= setting.CacheService.GitReadThrough.TTL
+}
+
+// MarkReadThroughFetched records that the repository of a read-through cache node has just been fetched from the origin
+func MarkReadThroughFetched(repoPath string) error {
+	return os.WriteFile(filepath.Join(repoPath, ReadThroughMarker), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644)
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package setting
+
+import "time"
+
+// Annex represents the configuration for git-annex
+var Annex = struct {
+	Enabled           bool   `ini:"ENABLED"`
+	MaxFileSize       int64  `ini:"MAX_FILE_SIZE"`       // in bytes, 0 means no limit
+	MaxObjectCount    int64  `ini:"MAX_OBJECT_COUNT"`    // 0 means no limit
+	MaxOpsPerSession  int64  `ini:"MAX_OPS_PER_SESSION"` // operations in one P2P session, 0 means no limit
+	DropNotifyCommand string `ini:"DROP_NOTIFY_COMMAND"` // run in the background after content has been dropped
+	// ObjectCountWarning is the number of git-annex objects from which uploads are still accepted but warned about, 0 means no warning
+	ObjectCountWarning int64 `ini:"OBJECT_COUNT_WARNING"`
+	// KeyLockTimeout is how long sending or dropping content waits for a concurrent drop or sends of the same key
+	KeyLockTimeout time.Duration `ini:"KEY_LOCK_TIMEOUT"`
+	// ProtectMetadataBranch rejects pushes deleting or rewriting the git-annex branch, git-annex itself only ever fast-forwards it
+	ProtectMetadataBranch bool `ini:"PROTECT_METADATA_BRANCH"`
+	// AllowGCrypt allows setting up gcrypt-encrypted remotes with "gcryptsetup", whose content can't be inspected on the server
+	AllowGCrypt bool `ini:"ALLOW_GCRYPT"`
+	// NotifyChangesTimeout is how long a "notifychanges" connection is held open before it is closed, 0 means no limit
+	NotifyChangesTimeout time.Duration `ini:"NOTIFY_CHANGES_TIMEOUT"`
+	// MaxNotifyChangesPerRepo limits the "notifychanges" connections open at once for each repository, 0 means no limit
+	MaxNotifyChangesPerRepo int `ini:"MAX_NOTIFY_CHANGES_PER_REPO"`
+	// ProtectDropkey only lets repository administrators drop content, which deletes it from the server for good
+	ProtectDropkey bool `ini:"PROTECT_DROPKEY"`
+	// TrackKeys records which repositories store the content of which keys, so that the same content in several repositories can be found
+	TrackKeys bool `ini:"TRACK_KEYS"`
+	// P2PHTTP serves the git-annex P2P protocol over HTTP with "git annex p2phttp", so that git-annex can store content over HTTP(S)
+	P2PHTTP bool `ini:"P2PHTTP"`
+	// P2PHTTPIdleTimeout is how long the "git annex p2phttp" server of a repository keeps running without requests
+	P2PHTTPIdleTimeout time.Duration `ini:"P2PHTTP_IDLE_TIMEOUT"`
+	// Storage keeps the git-annex content in object storage as well, so it outlives the disk of the node, nil unless annex is enabled and STORAGE_TYPE is set.
+	// The repositories still hold the content git-annex-shell serves, content missing there is fetched from the storage.
+	Storage *Storage `ini:"-"`
+}{
+	KeyLockTimeout:     30 * time.Second,
+	AllowGCrypt:        true,
+	P2PHTTPIdleTimeout: 5 * time.Minute,
+}
+
+func loadAnnexFrom(rootCfg ConfigProvider) {
+	mustMapSetting(rootCfg, "annex", &Annex)
+
+	annexSec := rootCfg.Section("annex")
+	Annex.Storage = nil
+	if storageType := annexSec.Key("STORAGE_TYPE").String(); Annex.Enabled && storageType != "" {
+		storage := getStorage(rootCfg, "annex", storageType, annexSec)
+		Annex.Storage = &storage
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package setting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadAnnexFrom(t *testing.T) {
+	oldAnnex := Annex
+	defer func() {
+		Annex = oldAnnex
+	}()
+
+	cfg, err := NewConfigProviderFromData(``)
+	assert.NoError(t, err)
+	loadAnnexFrom(cfg)
+	assert.False(t, Annex.Enabled)
+	assert.False(t, Annex.P2PHTTP)
+	assert.Equal(t, 5*time.Minute, Annex.P2PHTTPIdleTimeout)
+
+	cfg, err = NewConfigProviderFromData(`
+[annex]
+ENABLED = true
+P2PHTTP = true
+P2PHTTP_IDLE_TIMEOUT = 1m
+`)
+	assert.NoError(t, err)
+	loadAnnexFrom(cfg)
+	assert.True(t, Annex.Enabled)
+	assert.True(t, Annex.P2PHTTP)
+	assert.Equal(t, time.Minute, Annex.P2PHTTPIdleTimeout)
+}
+
+func Test_loadAnnexStorageFrom(t *testing.T) {
+	oldAnnex := Annex
+	defer func() {
+		Annex = oldAnnex
+	}()
+
+	cfg, err := NewConfigProviderFromData(`
+[annex]
+ENABLED = true
+[storage]
+STORAGE_TYPE = minio
+`)
+	assert.NoError(t, err)
+	loadAnnexFrom(cfg)
+	// the default storage doesn't move git-annex content by itself
+	assert.Nil(t, Annex.Storage)
+
+	cfg, err = NewConfigProviderFromData(`
+[annex]
+ENABLED = true
+STORAGE_TYPE = minio
+[storage.minio]
+MINIO_BUCKET = annex-bucket
+`)
+	assert.NoError(t, err)
+	loadAnnexFrom(cfg)
+	if assert.NotNil(t, Annex.Storage) {
+		assert.EqualValues(t, "minio", Annex.Storage.Type)
+		assert.EqualValues(t, "annex-bucket", Annex.Storage.Section.Key("MINIO_BUCKET").String())
+		assert.EqualValues(t, "annex/", Annex.Storage.Section.Key("MINIO_BASE_PATH").String())
+	}
+
+	// nor is there any without git-annex
+	cfg, err = NewConfigProviderFromData(`
+[annex]
+ENABLED = false
+STORAGE_TYPE = minio
+`)
+	assert.NoError(t, err)
+	loadAnnexFrom(cfg)
+	assert.Nil(t, Annex.Storage)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/util"
 )
 
 // Cache represents cache settings
@@ -28,6 +29,12 @@ var CacheService = struct {
 		TTL          time.Duration `ini:"ITEM_TTL"`
 		CommitsCount int64
 	} `ini:"cache.last_commit"`
+
+	GitReadThrough struct {
+		Enabled   bool
+		OriginURL string
+		TTL       time.Duration `ini:"ITEM_TTL"`
+	} `ini:"cache.git_read_through"`
 }{
 	Cache: Cache{
 		Enabled:  true,
@@ -44,6 +51,14 @@ var CacheService = struct {
 		TTL:          8760 * time.Hour,
 		CommitsCount: 1000,
 	},
+	GitReadThrough: struct {
+		Enabled   bool
+		OriginURL string
+		TTL       time.Duration `ini:"ITEM_TTL"`
+	}{
+		Enabled: false,
+		TTL:     5 * time.Minute,
+	},
 }
 
 // MemcacheMaxTTL represents the maximum memcache TTL
@@ -89,6 +104,14 @@ func loadCacheFrom(rootCfg ConfigProvider) {
 	if CacheService.LastCommit.Enabled {
 		log.Info("Last Commit Cache Service Enabled")
 	}
+
+	if CacheService.GitReadThrough.Enabled {
+		if CacheService.GitReadThrough.OriginURL == "" {
+			log.Fatal("[cache.git_read_through] ORIGIN_URL must be set when ENABLED is true")
+		}
+		CacheService.GitReadThrough.OriginURL = strings.TrimSuffix(CacheService.GitReadThrough.OriginURL, "/") + "/"
+		log.Info("Git Read-Through Cache Enabled, origin: %s", util.SanitizeCredentialURLs(CacheService.GitReadThrough.OriginURL))
+	}
 }
 
 // TTLSeconds returns the TTLSeconds or unix timestamp for memcache
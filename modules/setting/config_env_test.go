@@ -0,0 +1,83 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package setting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeEnvSectionKey(t *testing.T) {
+	section, key := DecodeEnvSectionKey("SEC__KEY")
+	assert.Equal(t, "sec", section)
+	assert.Equal(t, "KEY", key)
+
+	section, key = DecodeEnvSectionKey("LOG_0x2E_CONSOLE__STDERR")
+	assert.Equal(t, "log.console", section)
+	assert.Equal(t, "STDERR", key)
+
+	section, key = DecodeEnvSectionKey("SEC")
+	assert.Equal(t, "sec", section)
+	assert.Empty(t, key)
+}
+
+func TestEnvironmentToConfig(t *testing.T) {
+	oldAllowUploadArchive := Git.AllowUploadArchive
+	defer func() {
+		Git.AllowUploadArchive = oldAllowUploadArchive
+	}()
+
+	cfg, err := NewConfigProviderFromData(`
+[git]
+ALLOW_UPLOAD_ARCHIVE = true
+`)
+	assert.NoError(t, err)
+
+	changed := EnvironmentToConfig(cfg, EnvConfigKeyPrefixGitea, []string{"GITEA_WORK_DIR=/var/lib/gitea", "OTHER__git__ALLOW_UPLOAD_ARCHIVE=false"})
+	assert.False(t, changed)
+	loadGitFrom(cfg)
+	assert.True(t, Git.AllowUploadArchive)
+
+	changed = EnvironmentToConfig(cfg, EnvConfigKeyPrefixGitea, []string{"GITEA__git__ALLOW_UPLOAD_ARCHIVE=false", "GITEA__ssh_0x2E_minimum_key_sizes__ED25519=256"})
+	assert.True(t, changed)
+	loadGitFrom(cfg)
+	assert.False(t, Git.AllowUploadArchive)
+	assert.Equal(t, "256", cfg.Section("ssh.minimum_key_sizes").Key("ED25519").String())
+}
+
+func TestInitEnvironmentOverrides(t *testing.T) {
+	oldCfgProvider, oldCustomConf, oldAnnexEnabled := CfgProvider, CustomConf, Annex.Enabled
+	defer func() {
+		CfgProvider, CustomConf, Annex.Enabled = oldCfgProvider, oldCustomConf, oldAnnexEnabled
+	}()
+
+	CustomConf = filepath.Join(t.TempDir(), "app.ini")
+	assert.NoError(t, os.WriteFile(CustomConf, []byte("[annex]\nENABLED = true\n"), 0o600))
+	t.Setenv("GITEA__annex__ENABLED", "false")
+	t.Setenv("GITEA__oauth2__JWT_SECRET", "env-secret")
+
+	// commands like serv load their settings with Init, so the overrides apply to them
+	Init(&Options{CustomConf: CustomConf, DisableLoadCommonSettings: true})
+	loadAnnexFrom(CfgProvider)
+	assert.False(t, Annex.Enabled)
+	assert.Equal(t, "env-secret", CfgProvider.Section("oauth2").Key("JWT_SECRET").String())
+
+	// but they are not written to the file, while other changes are
+	CfgProvider.Section("security").Key("INTERNAL_TOKEN").SetValue("generated")
+	assert.NoError(t, CfgProvider.Save())
+	content, err := os.ReadFile(CustomConf)
+	assert.NoError(t, err)
+	saved, err := NewConfigProviderFromData(string(content))
+	assert.NoError(t, err)
+	assert.Equal(t, "true", saved.Section("annex").Key("ENABLED").String())
+	assert.False(t, saved.Section("oauth2").HasKey("JWT_SECRET"))
+	assert.Equal(t, "generated", saved.Section("security").Key("INTERNAL_TOKEN").String())
+
+	// and still apply afterwards
+	assert.Equal(t, "false", CfgProvider.Section("annex").Key("ENABLED").String())
+	assert.Equal(t, "env-secret", CfgProvider.Section("oauth2").Key("JWT_SECRET").String())
+}
@@ -31,12 +31,21 @@ type ConfigProvider interface {
 	NewSection(name string) (ConfigSection, error)
 	GetSection(name string) (ConfigSection, error)
 	Save() error
+	SaveTo(filename string) error
 }
 
 type iniFileConfigProvider struct {
 	opts *Options
 	*ini.File
-	newFile bool // whether the file has not existed previously
+	newFile      bool          // whether the file has not existed previously
+	envOverrides []envOverride // the keys set from environment variables, which Save doesn't write to the file
+}
+
+// envOverride is a key set from an environment variable and the value it had in the file
+type envOverride struct {
+	section, key string
+	inFile       bool
+	value        string
 }
 
 // NewConfigProviderFromData this function is only for testing
@@ -65,6 +74,11 @@ type Options struct {
 	DisableLoadCommonSettings bool
 }
 
+// NewConfigProviderFromFile loads the configuration from the file without applying the environment overrides
+func NewConfigProviderFromFile(opts *Options) (ConfigProvider, error) {
+	return newConfigProviderFromFile(opts)
+}
+
 // newConfigProviderFromFile load configuration from file.
 // NOTE: do not print any log except error.
 func newConfigProviderFromFile(opts *Options) (*iniFileConfigProvider, error) {
@@ -114,6 +128,31 @@ func (p *iniFileConfigProvider) GetSection(name string) (ConfigSection, error) {
 	return p.File.GetSection(name)
 }
 
+// environmentToConfig applies the settings of the environment variables with the prefix like EnvironmentToConfig,
+// remembering the values they replaced so that Save keeps them in the file
+func (p *iniFileConfigProvider) environmentToConfig(prefix string, envs []string) {
+	seen := make(map[string]bool)
+	for _, kv := range envs {
+		eKey, _, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(eKey, prefix) {
+			continue
+		}
+		sectionName, keyName := DecodeEnvSectionKey(eKey[len(prefix):])
+		if len(keyName) == 0 || seen[sectionName+"\x00"+keyName] {
+			continue
+		}
+		seen[sectionName+"\x00"+keyName] = true
+
+		override := envOverride{section: sectionName, key: keyName}
+		if section, err := p.File.GetSection(sectionName); err == nil && section.HasKey(keyName) {
+			override.inFile = true
+			override.value = section.Key(keyName).Value()
+		}
+		p.envOverrides = append(p.envOverrides, override)
+	}
+	EnvironmentToConfig(p, prefix, envs)
+}
+
 // Save save the content into file
 func (p *iniFileConfigProvider) Save() error {
 	if p.opts.CustomConf == "" {
@@ -123,6 +162,26 @@ func (p *iniFileConfigProvider) Save() error {
 		return nil
 	}
 
+	// the environment overrides only apply to the running process, they mustn't end up in the file, e.g. secrets
+	overridden := make([]string, len(p.envOverrides))
+	for i, override := range p.envOverrides {
+		section := p.File.Section(override.section)
+		overridden[i] = section.Key(override.key).Value()
+		if override.inFile {
+			section.Key(override.key).SetValue(override.value)
+			continue
+		}
+		section.DeleteKey(override.key)
+		if override.section != "" && len(section.Keys()) == 0 && len(section.ChildSections()) == 0 {
+			p.File.DeleteSection(override.section)
+		}
+	}
+	defer func() {
+		for i, override := range p.envOverrides {
+			p.File.Section(override.section).Key(override.key).SetValue(overridden[i])
+		}
+	}()
+
 	if p.newFile {
 		if err := os.MkdirAll(filepath.Dir(CustomConf), os.ModePerm); err != nil {
 			return fmt.Errorf("failed to create '%s': %v", CustomConf, err)
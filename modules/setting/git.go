@@ -32,6 +32,16 @@ var Git = struct {
 	LargeObjectThreshold      int64
 	DisableCoreProtectNTFS    bool
 	DisablePartialClone       bool
+	AllowUploadArchive        bool
+	UploadPackHideRefs        []string
+	ReceivePackHideRefs       []string
+	DisabledCapabilities      []string
+	WarnLargeClone            int64
+	MaxPushOptions            int
+	MaxPushOptionSize         int
+	AutoRepackOnAccess        bool
+	AutoRepackLooseObjects    int64
+	AutoRepackInterval        time.Duration
 	Timeout                   struct {
 		Default int
 		Migrate int
@@ -61,6 +71,16 @@ var Git = struct {
 	PullRequestPushMessage:    true,
 	LargeObjectThreshold:      1024 * 1024,
 	DisablePartialClone:       false,
+	AllowUploadArchive:        true,
+	UploadPackHideRefs:        []string{},
+	ReceivePackHideRefs:       []string{"refs/pull", "refs/keep-around"},
+	DisabledCapabilities:      []string{},
+	WarnLargeClone:            0,
+	MaxPushOptions:            32,
+	MaxPushOptionSize:         1024,
+	AutoRepackOnAccess:        false,
+	AutoRepackLooseObjects:    6700,
+	AutoRepackInterval:        time.Hour,
 	Timeout: struct {
 		Default int
 		Migrate int
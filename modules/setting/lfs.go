@@ -17,8 +17,12 @@ var LFS = struct {
 	JWTSecretBase64 string        `ini:"LFS_JWT_SECRET"`
 	JWTSecretBytes  []byte        `ini:"-"`
 	HTTPAuthExpiry  time.Duration `ini:"LFS_HTTP_AUTH_EXPIRY"`
-	MaxFileSize     int64         `ini:"LFS_MAX_FILE_SIZE"`
-	LocksPagingNum  int           `ini:"LFS_LOCKS_PAGING_NUM"`
+	// ServiceHTTPAuthExpiry is the validity period of the download tokens of deploy keys, 0 uses HTTPAuthExpiry
+	ServiceHTTPAuthExpiry time.Duration `ini:"LFS_SERVICE_HTTP_AUTH_EXPIRY"`
+	JWTIssuer             string        `ini:"LFS_JWT_ISSUER"`
+	JWTAudience           string        `ini:"LFS_JWT_AUDIENCE"`
+	MaxFileSize           int64         `ini:"LFS_MAX_FILE_SIZE"`
+	LocksPagingNum        int           `ini:"LFS_LOCKS_PAGING_NUM"`
 
 	Storage
 }{}
@@ -46,6 +50,9 @@ func loadLFSFrom(rootCfg ConfigProvider) {
 	}
 
 	LFS.HTTPAuthExpiry = sec.Key("LFS_HTTP_AUTH_EXPIRY").MustDuration(24 * time.Hour)
+	if LFS.ServiceHTTPAuthExpiry < 0 {
+		log.Fatal("LFS_SERVICE_HTTP_AUTH_EXPIRY must not be negative")
+	}
 
 	if LFS.StartServer {
 		LFS.JWTSecretBytes = make([]byte, 32)
@@ -4,12 +4,17 @@
 package setting
 
 import (
+	"math"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"code.gitea.io/gitea/modules/log"
+
+	"github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-version"
 )
 
 // enumerates all the policy repository creating
@@ -19,6 +24,13 @@ const (
 	RepoCreatingPublic             = "public"
 )
 
+// enumerates all the policies for symlinked repository directories
+const (
+	RepoSymlinksAllow     = "allow"     // follow symbolic links wherever they point to
+	RepoSymlinksContained = "contained" // follow symbolic links only if they resolve inside the repository root
+	RepoSymlinksDeny      = "deny"      // reject symlinked repository directories
+)
+
 // ItemsPerPage maximum items per page in forks, watchers and stars of a repo
 const ItemsPerPage = 40
 
@@ -51,6 +63,29 @@ var (
 		AllowDeleteOfUnadoptedRepositories      bool
 		DisableDownloadSourceArchives           bool
 		AllowForkWithoutMaximumLimit            bool
+		SerializePushes                         bool
+		SerializePushesTimeout                  time.Duration
+		SymlinkedRepositories                   string
+		MaxPushObjects                          int64
+		ShareForkObjects                        bool
+		PullRequestOnlyRepositories             []string
+		BranchCreationRestrictedRepositories    []string
+		VerifiedAuthorEmailRepositories         []string
+		LFSLockEnforcedRepositories             []string
+		NamePolicyCommand                       string
+		GogsPathCompat                          bool
+		CloneApprovalRepositories               []string
+		CloneApprovalTimeout                    time.Duration
+		AllowDryRunPush                         bool
+		RejectPushesToStatusCheckBranches       bool
+		BackupWriteTimeout                      time.Duration
+		DiskHighWatermark                       int
+		PreExecCommands                         map[string]string        `ini:"-"` // keyed by lower-cased "owner/repo"
+		GitNamespaces                           map[string]string        `ini:"-"` // keyed by lower-cased "owner/repo"
+		MinClientGitVersions                    map[string]string        `ini:"-"` // keyed by lower-cased "owner/repo"
+		CommandTimeouts                         map[string]time.Duration `ini:"-"` // keyed by lower-cased "owner/repo"
+		LFSQuotas                               map[string]int64         `ini:"-"` // in bytes, keyed by lower-cased "owner/repo" or "owner"
+		CLAs                                    map[string]string        `ini:"-"` // URLs of the CLAs, keyed by lower-cased "owner/repo" or "owner"
 
 		// Repository editor settings
 		Editor struct {
@@ -164,6 +199,22 @@ var (
 		DisableStars:                            false,
 		DefaultBranch:                           "main",
 		AllowForkWithoutMaximumLimit:            true,
+		SerializePushes:                         false,
+		SerializePushesTimeout:                  30 * time.Second,
+		SymlinkedRepositories:                   RepoSymlinksAllow,
+		MaxPushObjects:                          0,
+		ShareForkObjects:                        false,
+		PullRequestOnlyRepositories:             []string{},
+		BranchCreationRestrictedRepositories:    []string{},
+		VerifiedAuthorEmailRepositories:         []string{},
+		LFSLockEnforcedRepositories:             []string{},
+		NamePolicyCommand:                       "",
+		GogsPathCompat:                          false,
+		CloneApprovalRepositories:               []string{},
+		CloneApprovalTimeout:                    0,
+		AllowDryRunPush:                         false,
+		RejectPushesToStatusCheckBranches:       false,
+		BackupWriteTimeout:                      30 * time.Second,
 
 		// Repository editor settings
 		Editor: struct {
@@ -305,6 +356,70 @@ func loadRepositoryFrom(rootCfg ConfigProvider) {
 	} else if err = rootCfg.Section("repository.pull-request").MapTo(&Repository.PullRequest); err != nil {
 		log.Fatal("Failed to map Repository.PullRequest settings: %v", err)
 	}
+	if Repository.DiskHighWatermark < 0 || Repository.DiskHighWatermark > 100 {
+		log.Fatal("DISK_HIGH_WATERMARK must be a percentage between 0 and 100")
+	}
+
+	switch Repository.SymlinkedRepositories {
+	case RepoSymlinksAllow, RepoSymlinksContained, RepoSymlinksDeny:
+	default:
+		log.Warn("Unknown [repository] SYMLINKED_REPOSITORIES %q, falling back to %q", Repository.SymlinkedRepositories, RepoSymlinksAllow)
+		Repository.SymlinkedRepositories = RepoSymlinksAllow
+	}
+
+	preExecKeys := rootCfg.Section("repository.pre_exec").Keys()
+	Repository.PreExecCommands = make(map[string]string, len(preExecKeys))
+	for _, key := range preExecKeys {
+		Repository.PreExecCommands[strings.ToLower(key.Name())] = key.Value()
+	}
+
+	namespaceKeys := rootCfg.Section("repository.git_namespace").Keys()
+	Repository.GitNamespaces = make(map[string]string, len(namespaceKeys))
+	for _, key := range namespaceKeys {
+		namespace := strings.Trim(key.Value(), "/")
+		if !isValidGitNamespace(namespace) {
+			log.Fatal("Invalid git namespace %q for %s in [repository.git_namespace]", key.Value(), key.Name())
+		}
+		Repository.GitNamespaces[strings.ToLower(key.Name())] = namespace
+	}
+
+	minVersionKeys := rootCfg.Section("repository.min_client_git_version").Keys()
+	Repository.MinClientGitVersions = make(map[string]string, len(minVersionKeys))
+	for _, key := range minVersionKeys {
+		if _, err := version.NewVersion(key.Value()); err != nil {
+			log.Fatal("Invalid git version %q for %s in [repository.min_client_git_version]: %v", key.Value(), key.Name(), err)
+		}
+		Repository.MinClientGitVersions[strings.ToLower(key.Name())] = key.Value()
+	}
+
+	timeoutKeys := rootCfg.Section("repository.command_timeout").Keys()
+	Repository.CommandTimeouts = make(map[string]time.Duration, len(timeoutKeys))
+	for _, key := range timeoutKeys {
+		timeout, err := time.ParseDuration(key.Value())
+		if err != nil || timeout < 0 {
+			log.Fatal("Invalid command timeout %q for %s in [repository.command_timeout]: %v", key.Value(), key.Name(), err)
+		}
+		Repository.CommandTimeouts[strings.ToLower(key.Name())] = timeout
+	}
+
+	quotaKeys := rootCfg.Section("repository.lfs_quota").Keys()
+	Repository.LFSQuotas = make(map[string]int64, len(quotaKeys))
+	for _, key := range quotaKeys {
+		quota, err := humanize.ParseBytes(key.Value())
+		if err != nil || quota == 0 || quota > math.MaxInt64 {
+			log.Fatal("Invalid LFS quota %q for %s in [repository.lfs_quota]: %v", key.Value(), key.Name(), err)
+		}
+		Repository.LFSQuotas[strings.ToLower(key.Name())] = int64(quota)
+	}
+
+	claKeys := rootCfg.Section("repository.cla").Keys()
+	Repository.CLAs = make(map[string]string, len(claKeys))
+	for _, key := range claKeys {
+		if key.Value() == "" {
+			log.Fatal("Missing the URL of the CLA for %s in [repository.cla]", key.Name())
+		}
+		Repository.CLAs[strings.ToLower(key.Name())] = key.Value()
+	}
 
 	if !rootCfg.Section("packages").Key("ENABLED").MustBool(true) {
 		Repository.DisabledRepoUnits = append(Repository.DisabledRepoUnits, "repo.packages")
@@ -359,3 +474,22 @@ func loadRepositoryFrom(rootCfg ConfigProvider) {
 
 	RepoArchive.Storage = getStorage(rootCfg, "repo-archive", "", nil)
 }
+
+// isValidGitNamespace returns true if namespace is a GIT_NAMESPACE whose components like "tenant/project"
+// are safe to become part of ref names like "refs/namespaces/tenant/refs/namespaces/project/refs/heads/main"
+func isValidGitNamespace(namespace string) bool {
+	if namespace == "" {
+		return false
+	}
+	for _, component := range strings.Split(namespace, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") || strings.Contains(component, "..") {
+			return false
+		}
+		for _, r := range component {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' && r != '.' {
+				return false
+			}
+		}
+	}
+	return true
+}
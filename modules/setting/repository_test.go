@@ -0,0 +1,106 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package setting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadRepositoryPreExecCommands(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.pre_exec]
+MyOrg/Secret-Project = /usr/local/bin/check-license-accepted --strict
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]string{
+		"myorg/secret-project": "/usr/local/bin/check-license-accepted --strict",
+	}, Repository.PreExecCommands)
+}
+
+func Test_loadRepositoryGitNamespaces(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.git_namespace]
+MyOrg/Tenant-A = tenant-a
+myorg/tenant-b = /tenants/b/
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]string{
+		"myorg/tenant-a": "tenant-a",
+		"myorg/tenant-b": "tenants/b",
+	}, Repository.GitNamespaces)
+}
+
+func Test_isValidGitNamespace(t *testing.T) {
+	for _, namespace := range []string{"tenant", "tenant-a/project_1", "v1.2"} {
+		assert.True(t, isValidGitNamespace(namespace), namespace)
+	}
+	for _, namespace := range []string{"", "a//b", "../other", "a/..", ".hidden", "a.lock", "a b", "a:b", "a*", "a~1", "a\\b"} {
+		assert.False(t, isValidGitNamespace(namespace), namespace)
+	}
+}
+
+func Test_loadRepositoryMinClientGitVersions(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.min_client_git_version]
+MyOrg/Monorepo = 2.38
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]string{
+		"myorg/monorepo": "2.38",
+	}, Repository.MinClientGitVersions)
+}
+
+func Test_loadRepositoryCommandTimeouts(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.command_timeout]
+MyOrg/Datasets = 6h
+myorg/archive = 0s
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]time.Duration{
+		"myorg/datasets": 6 * time.Hour,
+		"myorg/archive":  0,
+	}, Repository.CommandTimeouts)
+}
+
+func Test_loadRepositoryCLAs(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.cla]
+MyOrg = https://example.com/cla
+myorg/docs = https://example.com/docs-cla
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]string{
+		"myorg":      "https://example.com/cla",
+		"myorg/docs": "https://example.com/docs-cla",
+	}, Repository.CLAs)
+}
+
+func Test_loadRepositoryLFSQuotas(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[repository.lfs_quota]
+MyOrg = 10 GiB
+myorg/datasets = 1073741824
+`)
+	assert.NoError(t, err)
+	loadRepositoryFrom(cfg)
+
+	assert.Equal(t, map[string]int64{
+		"myorg":          10 << 30,
+		"myorg/datasets": 1 << 30,
+	}, Repository.LFSQuotas)
+}
@@ -84,6 +84,7 @@ var (
 	UnixSocketPermission       uint32
 	EnablePprof                bool
 	PprofDataPath              string
+	PprofStorage               *Storage // nil unless PPROF_STORAGE_TYPE is set
 	EnableAcme                 bool
 	AcmeTOS                    bool
 	AcmeLiveDirectory          string
@@ -335,6 +336,11 @@ func loadServerFrom(rootCfg ConfigProvider) {
 	if !filepath.IsAbs(PprofDataPath) {
 		PprofDataPath = filepath.Join(AppWorkPath, PprofDataPath)
 	}
+	PprofStorage = nil
+	if storageType := sec.Key("PPROF_STORAGE_TYPE").String(); storageType != "" {
+		storage := getStorage(rootCfg, "pprof", storageType, nil)
+		PprofStorage = &storage
+	}
 
 	landingPage := sec.Key("LANDING_PAGE").MustString("home")
 	switch landingPage {
@@ -77,6 +77,13 @@ var Service = struct {
 	DefaultOrgMemberVisible                 bool
 	UserDeleteWithCommentsMaxTime           time.Duration
 	ValidSiteURLSchemes                     []string
+	DiscloseRepoExistence                   bool
+	RequireVerifiedEmail                    bool
+	Require2FAForGit                        bool
+	PublicReadFastPath                      bool
+	PublicReadFastPathTTL                   time.Duration
+	TrackClones                             bool
+	TrackClonesInterval                     time.Duration
 
 	// OpenID settings
 	EnableOpenIDSignIn bool
@@ -192,6 +199,13 @@ func loadServiceFrom(rootCfg ConfigProvider) {
 		}
 	}
 	Service.ValidSiteURLSchemes = schemes
+	Service.DiscloseRepoExistence = sec.Key("DISCLOSE_REPO_EXISTENCE").MustBool(true)
+	Service.RequireVerifiedEmail = sec.Key("REQUIRE_VERIFIED_EMAIL").MustBool()
+	Service.Require2FAForGit = sec.Key("REQUIRE_2FA_FOR_GIT").MustBool()
+	Service.PublicReadFastPath = sec.Key("PUBLIC_READ_FAST_PATH").MustBool()
+	Service.PublicReadFastPathTTL = sec.Key("PUBLIC_READ_FAST_PATH_TTL").MustDuration(10 * time.Second)
+	Service.TrackClones = sec.Key("TRACK_CLONES").MustBool()
+	Service.TrackClonesInterval = sec.Key("TRACK_CLONES_INTERVAL").MustDuration(time.Hour)
 
 	mustMapSetting(rootCfg, "service.explore", &Service.Explore)
 
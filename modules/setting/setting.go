@@ -206,11 +206,13 @@ func Init(opts *Options) {
 	if opts.CustomConf == "" {
 		opts.CustomConf = CustomConf
 	}
-	var err error
-	CfgProvider, err = newConfigProviderFromFile(opts)
+	cfg, err := newConfigProviderFromFile(opts)
 	if err != nil {
 		log.Fatal("Init[%v]: %v", opts, err)
 	}
+	// Apply the environment overrides in every command, so that e.g. "serv" run by the SSH server sees the same settings as "web"
+	cfg.environmentToConfig(EnvConfigKeyPrefixGitea, os.Environ())
+	CfgProvider = cfg
 	if !opts.DisableLoadCommonSettings {
 		loadCommonSettingsFrom(CfgProvider)
 	}
@@ -230,6 +232,7 @@ func loadCommonSettingsFrom(cfg ConfigProvider) {
 	loadSecurityFrom(cfg)
 	loadAttachmentFrom(cfg)
 	loadLFSFrom(cfg)
+	loadAnnexFrom(cfg)
 	loadTimeFrom(cfg)
 	loadRepositoryFrom(cfg)
 	loadPictureFrom(cfg)
@@ -50,6 +50,29 @@ var SSH = struct {
 	TrustedUserCAKeysParsed               []gossh.PublicKey  `ini:"-"`
 	PerWriteTimeout                       time.Duration      `ini:"SSH_PER_WRITE_TIMEOUT"`
 	PerWritePerKbTimeout                  time.Duration      `ini:"SSH_PER_WRITE_PER_KB_TIMEOUT"`
+	CommandTimeout                        time.Duration      `ini:"SSH_COMMAND_TIMEOUT"`
+	IdleTimeout                           time.Duration      `ini:"SSH_IDLE_TIMEOUT"`
+	MaxSessionDuration                    time.Duration      `ini:"SSH_MAX_SESSION_DURATION"`
+	CommandUID                            int                `ini:"SSH_COMMAND_UID"`
+	CommandGID                            int                `ini:"SSH_COMMAND_GID"`
+	CostBudget                            int64              `ini:"SSH_COST_BUDGET"`
+	CostBudgetWindow                      time.Duration      `ini:"SSH_COST_BUDGET_WINDOW"`
+	MinimalBanner                         bool               `ini:"SSH_MINIMAL_BANNER"`
+	EventStream                           string             `ini:"SSH_EVENT_STREAM"`
+	EventStreamName                       string             `ini:"SSH_EVENT_STREAM_NAME"`
+	LiveStatus                            bool               `ini:"SSH_LIVE_STATUS"`
+	LiveStatusInterval                    time.Duration      `ini:"SSH_LIVE_STATUS_INTERVAL"`
+	TrackUsage                            bool               `ini:"SSH_TRACK_USAGE"`
+	TrackProtocols                        bool               `ini:"SSH_TRACK_PROTOCOLS"`
+	AllowedClientIPs                      string             `ini:"SSH_ALLOWED_CLIENT_IPS"`
+	DeniedClientIPs                       string             `ini:"SSH_DENIED_CLIENT_IPS"`
+	KeyActivityHistory                    bool               `ini:"SSH_KEY_ACTIVITY_HISTORY"`
+	KeyActivityInterval                   time.Duration      `ini:"SSH_KEY_ACTIVITY_INTERVAL"`
+
+	// Messages are the templates of the messages shown for denials, keyed by reason code
+	Messages map[string]*template.Template `ini:"-"`
+	// LogLevels are the levels finished operations are logged at, keyed by class of the verb
+	LogLevels map[string]log.Level `ini:"-"`
 }{
 	Disabled:                      false,
 	StartBuiltinServer:            false,
@@ -173,6 +196,9 @@ func loadSSHFrom(rootCfg ConfigProvider) {
 		}
 	}
 
+	SSH.Messages = loadSSHMessages(rootCfg)
+	SSH.LogLevels = loadSSHLogLevels(rootCfg)
+
 	SSH.AuthorizedKeysBackup = sec.Key("SSH_AUTHORIZED_KEYS_BACKUP").MustBool(true)
 	SSH.CreateAuthorizedKeysFile = sec.Key("SSH_CREATE_AUTHORIZED_KEYS_FILE").MustBool(true)
 
@@ -190,8 +216,62 @@ func loadSSHFrom(rootCfg ConfigProvider) {
 
 	SSH.PerWriteTimeout = sec.Key("SSH_PER_WRITE_TIMEOUT").MustDuration(PerWriteTimeout)
 	SSH.PerWritePerKbTimeout = sec.Key("SSH_PER_WRITE_PER_KB_TIMEOUT").MustDuration(PerWritePerKbTimeout)
+	SSH.CommandTimeout = sec.Key("SSH_COMMAND_TIMEOUT").MustDuration(0)
+	SSH.IdleTimeout = sec.Key("SSH_IDLE_TIMEOUT").MustDuration(0)
+	SSH.MaxSessionDuration = sec.Key("SSH_MAX_SESSION_DURATION").MustDuration(0)
+	SSH.CommandUID = sec.Key("SSH_COMMAND_UID").MustInt(-1)
+	SSH.CommandGID = sec.Key("SSH_COMMAND_GID").MustInt(-1)
+	SSH.CostBudget = sec.Key("SSH_COST_BUDGET").MustInt64(0)
+	SSH.CostBudgetWindow = sec.Key("SSH_COST_BUDGET_WINDOW").MustDuration(time.Hour)
+	SSH.EventStreamName = sec.Key("SSH_EVENT_STREAM_NAME").MustString("gitea-ssh-events")
+	SSH.LiveStatusInterval = sec.Key("SSH_LIVE_STATUS_INTERVAL").MustDuration(5 * time.Second)
+	if SSH.LiveStatus && SSH.LiveStatusInterval <= 0 {
+		log.Fatal("SSH_LIVE_STATUS_INTERVAL must be positive")
+	}
+	if SSH.CostBudget > 0 && SSH.CostBudgetWindow <= 0 {
+		log.Fatal("SSH_COST_BUDGET_WINDOW must be positive")
+	}
+	SSH.KeyActivityHistory = sec.Key("SSH_KEY_ACTIVITY_HISTORY").MustBool(true)
+	SSH.KeyActivityInterval = sec.Key("SSH_KEY_ACTIVITY_INTERVAL").MustDuration(time.Minute)
 
 	// ensure parseRunModeSetting has been executed before this
 	SSH.BuiltinServerUser = rootCfg.Section("server").Key("BUILTIN_SSH_SERVER_USER").MustString(RunUser)
 	SSH.User = rootCfg.Section("server").Key("SSH_USER").MustString(SSH.BuiltinServerUser)
 }
+
+// loadSSHMessages parses the [ssh.messages] templates of the messages shown to SSH clients, keyed by the reason of the denial
+func loadSSHMessages(rootCfg ConfigProvider) map[string]*template.Template {
+	messages := map[string]*template.Template{}
+	for _, key := range rootCfg.Section("ssh.messages").Keys() {
+		tmpl, err := template.New(key.Name()).Parse(key.String())
+		if err != nil {
+			log.Fatal("Invalid message %s in [ssh.messages]: %v", key.Name(), err)
+		}
+		messages[strings.ToLower(key.Name())] = tmpl
+	}
+	return messages
+}
+
+// sshLogLevelClasses are the classes of verbs in [ssh.log_levels]
+var sshLogLevelClasses = []string{"fetch", "push", "archive", "lfs", "annex"}
+
+// loadSSHLogLevels parses the [ssh.log_levels] levels finished operations are logged at, keyed by class of the verb.
+// Classes which are not configured are logged at debug level.
+func loadSSHLogLevels(rootCfg ConfigProvider) map[string]log.Level {
+	levels := make(map[string]log.Level, len(sshLogLevelClasses))
+	for _, class := range sshLogLevelClasses {
+		levels[class] = log.DEBUG
+	}
+	for _, key := range rootCfg.Section("ssh.log_levels").Keys() {
+		class := strings.ToLower(key.Name())
+		if _, has := levels[class]; !has {
+			log.Fatal("Unknown class %s in [ssh.log_levels], it must be one of %s", key.Name(), strings.Join(sshLogLevelClasses, ", "))
+		}
+		level := strings.ToLower(key.String())
+		if !util.SliceContainsString(log.Levels(), level) {
+			log.Fatal("Invalid log level %q for %s in [ssh.log_levels]", key.String(), key.Name())
+		}
+		levels[class] = log.FromString(level)
+	}
+	return levels
+}
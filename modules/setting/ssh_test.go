@@ -0,0 +1,47 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package setting
+
+import (
+	"strings"
+	"testing"
+
+	"code.gitea.io/gitea/modules/log"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadSSHMessages(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[ssh.messages]
+ARCHIVED = {{.Owner}}/{{.Repo}} has been archived
+rate_limit = Slow down
+`)
+	assert.NoError(t, err)
+	messages := loadSSHMessages(cfg)
+
+	assert.Len(t, messages, 2)
+	sb := &strings.Builder{}
+	assert.NoError(t, messages["archived"].Execute(sb, map[string]string{"Owner": "user2", "Repo": "repo1"}))
+	assert.Equal(t, "user2/repo1 has been archived", sb.String())
+	assert.Contains(t, messages, "rate_limit")
+}
+
+func Test_loadSSHLogLevels(t *testing.T) {
+	cfg, err := NewConfigProviderFromData(`
+[ssh.log_levels]
+PUSH = Info
+annex = none
+`)
+	assert.NoError(t, err)
+	levels := loadSSHLogLevels(cfg)
+
+	assert.Equal(t, map[string]log.Level{
+		"fetch":   log.DEBUG,
+		"push":    log.INFO,
+		"archive": log.DEBUG,
+		"lfs":     log.DEBUG,
+		"annex":   log.NONE,
+	}, levels)
+}
@@ -202,3 +202,31 @@ STORAGE_TYPE = minio
 
 	assert.EqualValues(t, "minio", storage.Type)
 }
+
+func Test_getPprofStorage(t *testing.T) {
+	iniStr := `
+[server]
+PPROF_STORAGE_TYPE = minio
+
+[storage.pprof]
+MINIO_BUCKET = gitea-pprof
+`
+	cfg, err := NewConfigProviderFromData(iniStr)
+	assert.NoError(t, err)
+
+	loadServerFrom(cfg)
+	defer func() {
+		PprofStorage = nil
+	}()
+
+	if assert.NotNil(t, PprofStorage) {
+		assert.EqualValues(t, "minio", PprofStorage.Type)
+		assert.EqualValues(t, "gitea-pprof", PprofStorage.Section.Key("MINIO_BUCKET").String())
+		assert.EqualValues(t, "pprof/", PprofStorage.Section.Key("MINIO_BASE_PATH").String())
+	}
+
+	cfg, err = NewConfigProviderFromData("")
+	assert.NoError(t, err)
+	loadServerFrom(cfg)
+	assert.Nil(t, PprofStorage)
+}
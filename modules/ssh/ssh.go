@@ -37,6 +37,9 @@ type contextKey string
 
 const giteaKeyID = contextKey("gitea-key-id")
 
+// EnvBuiltinServer is set in the environment of the serv command when it is invoked by the builtin SSH server
+const EnvBuiltinServer = "GITEA_BUILTIN_SSH_SERVER"
+
 func getExitStatusFromError(err error) int {
 	if err == nil {
 		return 0
@@ -61,6 +64,19 @@ func getExitStatusFromError(err error) int {
 	return waitStatus.ExitStatus()
 }
 
+// sshConnectionEnv formats the addresses of a connection like OpenSSH does for SSH_CONNECTION: "client-ip client-port server-ip server-port"
+func sshConnectionEnv(remoteAddr, localAddr net.Addr) string {
+	remoteHost, remotePort, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return ""
+	}
+	localHost, localPort, err := net.SplitHostPort(localAddr.String())
+	if err != nil {
+		return ""
+	}
+	return strings.Join([]string{remoteHost, remotePort, localHost, localPort}, " ")
+}
+
 func sessionHandler(session ssh.Session) {
 	keyID := fmt.Sprintf("%d", session.Context().Value(giteaKeyID).(int64))
 
@@ -88,7 +104,11 @@ func sessionHandler(session ssh.Session) {
 		"SSH_ORIGINAL_COMMAND="+command,
 		"SKIP_MINWINSVC=1",
 		"GIT_PROTOCOL="+gitProtocol,
+		EnvBuiltinServer+"=true",
 	)
+	if sshConnection := sshConnectionEnv(session.RemoteAddr(), session.LocalAddr()); sshConnection != "" {
+		cmd.Env = append(cmd.Env, "SSH_CONNECTION="+sshConnection)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
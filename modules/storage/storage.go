@@ -128,6 +128,9 @@ var (
 
 	// Actions represents actions storage
 	Actions ObjectStorage = uninitializedStorage
+
+	// Annex represents the object storage of git-annex content
+	Annex ObjectStorage = uninitializedStorage
 )
 
 // Init init the stoarge
@@ -140,6 +143,7 @@ func Init() error {
 		initRepoArchives,
 		initPackages,
 		initActions,
+		initAnnex,
 	} {
 		if err := f(); err != nil {
 			return err
@@ -218,3 +222,13 @@ func initActions() (err error) {
 	Actions, err = NewStorage(setting.Actions.Storage.Type, &setting.Actions.Storage)
 	return err
 }
+
+func initAnnex() (err error) {
+	if setting.Annex.Storage == nil {
+		Annex = discardStorage("git-annex object storage isn't enabled")
+		return nil
+	}
+	log.Info("Initialising git-annex storage with type: %s", setting.Annex.Storage.Type)
+	Annex, err = NewStorage(setting.Annex.Storage.Type, setting.Annex.Storage)
+	return err
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package util
+
+import "syscall"
+
+// DiskUsagePercent returns how much of the filesystem holding path is used in percent, like df reports it.
+// The space reserved for root counts as used, as git running as the unprivileged user can't use it.
+func DiskUsagePercent(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	used := uint64(stat.Blocks) - uint64(stat.Bfree)
+	available := uint64(stat.Bavail)
+	if used+available == 0 {
+		return 0, nil
+	}
+	return float64(used) * 100 / float64(used+available), nil
+}
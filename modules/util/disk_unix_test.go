@@ -0,0 +1,22 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package util
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskUsagePercent(t *testing.T) {
+	usage, err := DiskUsagePercent(t.TempDir())
+	assert.NoError(t, err)
+	assert.True(t, usage >= 0 && usage <= 100, "usage %f is not a percentage", usage)
+
+	_, err = DiskUsagePercent(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -201,7 +201,11 @@ func CreateUserPublicKey(ctx *context.APIContext, form api.CreateKeyOption, uid
 		return
 	}
 
-	key, err := asymkey_model.AddPublicKey(uid, form.Title, content, 0)
+	mode := perm.AccessModeWrite
+	if form.ReadOnly {
+		mode = perm.AccessModeRead
+	}
+	key, err := asymkey_model.AddPublicKey(uid, form.Title, content, 0, mode)
 	if err != nil {
 		repo.HandleAddKeyError(ctx, err)
 		return
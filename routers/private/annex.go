@@ -0,0 +1,158 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/process"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// annexDropNotifyTimeout is how long the drop notification command may run
+const annexDropNotifyTimeout = time.Minute
+
+// AnnexObjectCount returns the number of git-annex objects stored in the repository
+func AnnexObjectCount(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %d", repoID),
+			})
+			return
+		}
+		log.Error("Unable to get repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get repository %d: %v", repoID, err),
+		})
+		return
+	}
+
+	count, err := annex.ObjectCount(repo.RepoPath())
+	if err != nil {
+		log.Error("Unable to count the git-annex objects of %s: %v", repo.FullName(), err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to count the git-annex objects of %s: %v", repo.FullName(), err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.AnnexObjectCountResult{Count: count})
+}
+
+// AnnexDropNotify runs the configured drop notification command in the background
+func AnnexDropNotify(ctx *context.PrivateContext) {
+	if setting.Annex.DropNotifyCommand == "" {
+		ctx.PlainText(http.StatusOK, "success")
+		return
+	}
+
+	repoID := ctx.ParamsInt64(":repoid")
+	key := ctx.FormString("key")
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %d", repoID),
+			})
+			return
+		}
+		log.Error("Unable to get repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get repository %d: %v", repoID, err),
+		})
+		return
+	}
+
+	go func() {
+		if err := runAnnexDropNotify(graceful.GetManager().ShutdownContext(), setting.Annex.DropNotifyCommand, repo.ID, repo.FullName(), key); err != nil {
+			log.Error("Drop notification of %s in %s failed: %v", key, repo.FullName(), err)
+		}
+	}()
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// AnnexRecordKey records that a repository stores the content of a git-annex key
+func AnnexRecordKey(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	key := ctx.FormString("key")
+	if !annex.IsValidKey(key) {
+		ctx.JSON(http.StatusBadRequest, private.Response{
+			Err: fmt.Sprintf("Malformed git-annex key: %q", key),
+		})
+		return
+	}
+
+	size, has := annex.KeySize(key)
+	if !has {
+		size = -1
+	}
+	others, err := repo_model.RecordAnnexKey(ctx, repoID, key, size)
+	if err != nil {
+		log.Error("Unable to record git-annex key %s of repository %d: %v", key, repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to record git-annex key %s of repository %d: %v", key, repoID, err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.AnnexRecordKeyResult{OtherRepos: others})
+}
+
+// AnnexForgetKey records that a repository no longer stores the content of a git-annex key
+func AnnexForgetKey(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	key := ctx.FormString("key")
+	if err := repo_model.ForgetAnnexKey(ctx, repoID, key); err != nil {
+		log.Error("Unable to forget git-annex key %s of repository %d: %v", key, repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to forget git-annex key %s of repository %d: %v", key, repoID, err),
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// runAnnexDropNotify runs the drop notification command, which is told about the drop through the environment
+func runAnnexDropNotify(ctx gocontext.Context, command string, repoID int64, repoFullName, key string) error {
+	args, err := shellquote.Split(command)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	ctx, _, finished := process.GetManager().AddContextTimeout(ctx, annexDropNotifyTimeout, fmt.Sprintf("Drop notification of %s in %s", key, repoFullName))
+	defer finished()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	process.SetSysProcAttribute(cmd)
+	cmd.Env = append(os.Environ(),
+		"GITEA_REPO_ID="+strconv.FormatInt(repoID, 10),
+		"GITEA_REPO_NAME="+repoFullName,
+		"GITEA_ANNEX_KEY="+key,
+	)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
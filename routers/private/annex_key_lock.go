@@ -0,0 +1,53 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"net/http"
+
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// AnnexKeyLock takes the lock of a git-annex key, exclusively to drop its content or shared to send it
+func AnnexKeyLock(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+
+	token, err := util.CryptoRandomString(32)
+	if err != nil {
+		log.Error("Unable to generate git-annex key lock token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	if !annex.TryLockKey(repoID, ctx.FormString("key"), token, ctx.FormBool("exclusive"), private.LockLease) {
+		ctx.JSON(http.StatusLocked, private.Response{
+			UserMsg: "The git-annex content is being sent or dropped by someone else, please retry later",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.AnnexKeyLockResult{Token: token})
+}
+
+// AnnexKeyLockRenew extends the lease of the lock of a git-annex key
+func AnnexKeyLockRenew(ctx *context.PrivateContext) {
+	if !annex.RenewKeyLock(ctx.ParamsInt64(":repoid"), ctx.FormString("key"), ctx.FormString("token"), private.LockLease) {
+		ctx.JSON(http.StatusNotFound, private.Response{
+			Err: "The git-annex key lock is not held with this token",
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// AnnexKeyUnlock releases the lock of a git-annex key
+func AnnexKeyUnlock(ctx *context.PrivateContext) {
+	annex.UnlockKey(ctx.ParamsInt64(":repoid"), ctx.FormString("key"), ctx.FormString("token"))
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// annexNotifyChangesLease is how long a "notifychanges" slot is held if it is never released, e.g. because the serv command was killed.
+// With an [annex] NOTIFY_CHANGES_TIMEOUT the slot times out with the connection, otherwise serv renews it while the connection is open.
+func annexNotifyChangesLease() time.Duration {
+	if setting.Annex.NotifyChangesTimeout > 0 {
+		return setting.Annex.NotifyChangesTimeout
+	}
+	return private.LockLease
+}
+
+// annexNotifyChanges holds the "notifychanges" slots taken in each repository, keyed by repository ID and then by token
+var annexNotifyChanges = struct {
+	sync.Mutex
+	slots map[int64]map[string]time.Time
+}{
+	slots: map[int64]map[string]time.Time{},
+}
+
+// tryAcquireNotifyChanges takes a "notifychanges" slot of the repository with the token unless max slots are taken
+func tryAcquireNotifyChanges(repoID int64, token string, max int) bool {
+	annexNotifyChanges.Lock()
+	defer annexNotifyChanges.Unlock()
+
+	now := time.Now()
+	slots, has := annexNotifyChanges.slots[repoID]
+	if !has {
+		slots = map[string]time.Time{}
+		annexNotifyChanges.slots[repoID] = slots
+	}
+	for holder, expires := range slots {
+		if !now.Before(expires) {
+			delete(slots, holder)
+		}
+	}
+	if len(slots) >= max {
+		return false
+	}
+	slots[token] = now.Add(annexNotifyChangesLease())
+	return true
+}
+
+// renewNotifyChanges extends the lease of the "notifychanges" slot of the repository taken with the token,
+// it returns false if the slot isn't held with the token or has expired
+func renewNotifyChanges(repoID int64, token string) bool {
+	annexNotifyChanges.Lock()
+	defer annexNotifyChanges.Unlock()
+
+	now := time.Now()
+	expires, has := annexNotifyChanges.slots[repoID][token]
+	if !has || !now.Before(expires) {
+		return false
+	}
+	annexNotifyChanges.slots[repoID][token] = now.Add(annexNotifyChangesLease())
+	return true
+}
+
+// releaseNotifyChanges releases the "notifychanges" slot of the repository taken with the token
+func releaseNotifyChanges(repoID int64, token string) {
+	annexNotifyChanges.Lock()
+	defer annexNotifyChanges.Unlock()
+
+	if slots, has := annexNotifyChanges.slots[repoID]; has {
+		delete(slots, token)
+		if len(slots) == 0 {
+			delete(annexNotifyChanges.slots, repoID)
+		}
+	}
+}
+
+// AnnexNotifyChangesAcquire takes a "notifychanges" slot of a repository
+func AnnexNotifyChangesAcquire(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+
+	token, err := util.CryptoRandomString(32)
+	if err != nil {
+		log.Error("Unable to generate notifychanges token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	if setting.Annex.MaxNotifyChangesPerRepo > 0 && !tryAcquireNotifyChanges(repoID, token, setting.Annex.MaxNotifyChangesPerRepo) {
+		ctx.JSON(http.StatusTooManyRequests, private.Response{
+			UserMsg: "Too many clients are waiting for changes to this repository, please retry later",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.AnnexNotifyChangesResult{Token: token})
+}
+
+// AnnexNotifyChangesRenew extends the lease of a "notifychanges" slot of a repository
+func AnnexNotifyChangesRenew(ctx *context.PrivateContext) {
+	if !renewNotifyChanges(ctx.ParamsInt64(":repoid"), ctx.FormString("token")) {
+		ctx.JSON(http.StatusNotFound, private.Response{
+			Err: "The notifychanges slot is not held with this token",
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// AnnexNotifyChangesRelease releases a "notifychanges" slot of a repository
+func AnnexNotifyChangesRelease(ctx *context.PrivateContext) {
+	releaseNotifyChanges(ctx.ParamsInt64(":repoid"), ctx.FormString("token"))
+	ctx.PlainText(http.StatusOK, "success")
+}
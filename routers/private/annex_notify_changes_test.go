@@ -0,0 +1,43 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnexNotifyChangesSlots(t *testing.T) {
+	// only max connections wait at once in each repository
+	assert.True(t, tryAcquireNotifyChanges(1, "a", 2))
+	assert.True(t, tryAcquireNotifyChanges(1, "b", 2))
+	assert.False(t, tryAcquireNotifyChanges(1, "c", 2))
+	assert.True(t, tryAcquireNotifyChanges(2, "d", 2))
+
+	// releasing with an unknown token does nothing
+	releaseNotifyChanges(1, "c")
+	assert.False(t, tryAcquireNotifyChanges(1, "c", 2))
+	releaseNotifyChanges(1, "a")
+	assert.True(t, tryAcquireNotifyChanges(1, "c", 2))
+
+	// slots that are never released expire
+	annexNotifyChanges.Lock()
+	annexNotifyChanges.slots[1]["b"] = time.Now().Add(-time.Second)
+	annexNotifyChanges.Unlock()
+	assert.True(t, tryAcquireNotifyChanges(1, "e", 2))
+
+	// only the holders renew their slots, and only until they have expired
+	assert.True(t, renewNotifyChanges(1, "e"))
+	assert.False(t, renewNotifyChanges(1, "b"))
+	assert.False(t, renewNotifyChanges(3, "e"))
+
+	releaseNotifyChanges(1, "c")
+	releaseNotifyChanges(1, "e")
+	releaseNotifyChanges(2, "d")
+	annexNotifyChanges.Lock()
+	assert.Empty(t, annexNotifyChanges.slots)
+	annexNotifyChanges.Unlock()
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// annexStorageRepo returns the repository whose git-annex content is copied from or to the object storage, along with the keys.
+// If nil is returned the error has been written.
+func annexStorageRepo(ctx *context.PrivateContext) (*repo_model.Repository, []string) {
+	if setting.Annex.Storage == nil {
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: "The git-annex object storage is disabled",
+		})
+		return nil, nil
+	}
+
+	keys := ctx.FormStrings("key")
+	for _, key := range keys {
+		if !annex.IsValidKey(key) {
+			ctx.JSON(http.StatusBadRequest, private.Response{
+				Err: fmt.Sprintf("Malformed git-annex key: %q", key),
+			})
+			return nil, nil
+		}
+	}
+
+	repoID := ctx.ParamsInt64(":repoid")
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %d", repoID),
+			})
+			return nil, nil
+		}
+		log.Error("Unable to get repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get repository %d: %v", repoID, err),
+		})
+		return nil, nil
+	}
+	return repo, keys
+}
+
+// AnnexStorageFetch copies the git-annex content a repository is about to send from the object storage into it,
+// if the repository doesn't have it. Content the object storage doesn't have either is left to git-annex-shell to report.
+func AnnexStorageFetch(ctx *context.PrivateContext) {
+	repo, keys := annexStorageRepo(ctx)
+	if repo == nil {
+		return
+	}
+	for _, key := range keys {
+		if _, err := annex.FetchFromStorage(ctx, repo.ID, repo.RepoPath(), key); err != nil {
+			log.Error("Unable to fetch the content of git-annex key %s of %-v from the object storage: %v", key, repo, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err:     fmt.Sprintf("Unable to fetch the content of git-annex key %s of %s from the object storage: %v", key, repo.FullName(), err),
+				UserMsg: "Unable to fetch the git-annex content from the object storage, please retry later",
+			})
+			return
+		}
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// AnnexStorageSave copies the git-annex content a repository has received to the object storage
+func AnnexStorageSave(ctx *context.PrivateContext) {
+	repo, keys := annexStorageRepo(ctx)
+	if repo == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := annex.SaveToStorage(repo.ID, repo.RepoPath(), key); err != nil {
+			log.Error("Unable to save the content of git-annex key %s of %-v to the object storage: %v", key, repo, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err:     fmt.Sprintf("Unable to save the content of git-annex key %s of %s to the object storage: %v", key, repo.FullName(), err),
+				UserMsg: "Unable to save the git-annex content to the object storage, please retry",
+			})
+			return
+		}
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// AnnexStorageDelete deletes the git-annex content a repository has dropped from the object storage
+func AnnexStorageDelete(ctx *context.PrivateContext) {
+	repo, keys := annexStorageRepo(ctx)
+	if repo == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := annex.DeleteFromStorage(repo.ID, repo.RepoPath(), key); err != nil {
+			log.Error("Unable to delete the content of git-annex key %s of %-v from the object storage: %v", key, repo, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err:     fmt.Sprintf("Unable to delete the content of git-annex key %s of %s from the object storage: %v", key, repo.FullName(), err),
+				UserMsg: "Unable to delete the git-annex content from the object storage, please retry",
+			})
+			return
+		}
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunAnnexDropNotify(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "notified")
+	command := `sh -c 'echo "$GITEA_REPO_ID $GITEA_REPO_NAME $GITEA_ANNEX_KEY" > "$0"' ` + out
+
+	assert.NoError(t, runAnnexDropNotify(context.Background(), command, 1, "user2/repo1", "SHA256E-s1--abc"))
+	notified, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 user2/repo1 SHA256E-s1--abc\n", string(notified))
+
+	err = runAnnexDropNotify(context.Background(), `sh -c 'echo replica unreachable >&2; exit 1'`, 1, "user2/repo1", "SHA256E-s1--abc")
+	assert.ErrorContains(t, err, "replica unreachable")
+
+	assert.Error(t, runAnnexDropNotify(context.Background(), "", 1, "user2/repo1", "SHA256E-s1--abc"))
+}
@@ -11,6 +11,7 @@ import (
 
 	issues_model "code.gitea.io/gitea/models/issues"
 	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
 	gitea_context "code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/git"
 	"code.gitea.io/gitea/modules/log"
@@ -90,6 +91,16 @@ func HookPostReceive(ctx *gitea_context.PrivateContext) {
 		}
 	}
 
+	// Initialize git-annex once its branch has been pushed, git-annex-shell can only serve initialized repositories
+	if setting.Annex.Enabled && util.SliceContainsString(opts.RefFullNames, annex.BranchRefName) {
+		repoPath := repo_model.RepoPath(ownerName, repoName)
+		if !annex.IsInitialized(ctx, repoPath) {
+			if err := annex.Init(ctx, repoPath); err != nil {
+				log.Error("Unable to initialize git-annex in %s/%s: %v", ownerName, repoName, err)
+			}
+		}
+	}
+
 	// Handle Push Options
 	if len(opts.GitPushOptions) > 0 {
 		// load the repository
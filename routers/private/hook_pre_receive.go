@@ -4,9 +4,11 @@
 package private
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"code.gitea.io/gitea/models"
@@ -17,10 +19,12 @@ import (
 	access_model "code.gitea.io/gitea/models/perm/access"
 	"code.gitea.io/gitea/models/unit"
 	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/annex"
 	gitea_context "code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/git"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/web"
 	pull_service "code.gitea.io/gitea/services/pull"
 )
@@ -112,12 +116,23 @@ func HookPreReceive(ctx *gitea_context.PrivateContext) {
 		opts:           opts,
 	}
 
+	if !ourCtx.AssertPushObjectsLimit() {
+		return
+	}
+
 	// Iterate across the provided old commit IDs
 	for i := range opts.OldCommitIDs {
 		oldCommitID := opts.OldCommitIDs[i]
 		newCommitID := opts.NewCommitIDs[i]
 		refFullName := opts.RefFullNames[i]
 
+		if opts.VerifyAuthorEmails && newCommitID != git.EmptySHA && !ourCtx.assertAuthorEmails(oldCommitID, newCommitID) {
+			return
+		}
+		if opts.EnforceLFSLocks && newCommitID != git.EmptySHA && !ourCtx.assertLFSLocks(oldCommitID, newCommitID) {
+			return
+		}
+
 		switch {
 		case strings.HasPrefix(refFullName, git.BranchPrefix):
 			preReceiveBranch(ourCtx, oldCommitID, newCommitID, refFullName)
@@ -136,6 +151,243 @@ func HookPreReceive(ctx *gitea_context.PrivateContext) {
 	ctx.PlainText(http.StatusOK, "ok")
 }
 
+// AssertPushObjectsLimit returns true if the push does not contain more objects than allowed.
+// If false is returned ctx has had the "JSON" function called
+func (ctx *preReceiveContext) AssertPushObjectsLimit() bool {
+	if setting.Repository.MaxPushObjects <= 0 || ctx.opts.GitQuarantinePath == "" {
+		return true
+	}
+
+	userMsg, err := checkPushObjectsLimit(ctx, ctx.Repo.Repository.RepoPath(), ctx.env)
+	if err != nil {
+		log.Error("Unable to count the pushed objects in %-v: %v", ctx.Repo.Repository, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to count the pushed objects: %v", err),
+		})
+		return false
+	}
+	if userMsg != "" {
+		log.Warn("Forbidden: Push to %-v: %s", ctx.Repo.Repository, userMsg)
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: userMsg,
+		})
+		return false
+	}
+	return true
+}
+
+// checkPushObjectsLimit returns the reason to reject the push if it contains more objects than allowed.
+// The object directory of env is the quarantine directory holding the pushed objects during pre-receive.
+func checkPushObjectsLimit(ctx context.Context, repoPath string, env []string) (string, error) {
+	stdout, _, err := git.NewCommand(ctx, "count-objects", "-v").RunStdString(&git.RunOpts{Dir: repoPath, Env: env})
+	if err != nil {
+		return "", err
+	}
+
+	var count int64
+	for _, line := range strings.Split(stdout, "\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok || (name != "count" && name != "in-pack") {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("unexpected count-objects output %q: %w", line, err)
+		}
+		count += n
+	}
+
+	if count > setting.Repository.MaxPushObjects {
+		return fmt.Sprintf("push contains %d objects, which exceeds the limit of %d objects", count, setting.Repository.MaxPushObjects), nil
+	}
+	return "", nil
+}
+
+// assertAuthorEmails returns true if the author and committer emails of the commits pushed with the update
+// are verified emails or the placeholder email of the pusher. If false is returned ctx has had the "JSON" function called
+func (ctx *preReceiveContext) assertAuthorEmails(oldCommitID, newCommitID string) bool {
+	if !ctx.loadPusherAndPermission() {
+		// if error occurs, loadPusherAndPermission had written the error response
+		return false
+	}
+
+	repo := ctx.Repo.Repository
+	emails, err := user_model.GetEmailAddresses(ctx.opts.UserID)
+	if err != nil {
+		log.Error("Unable to get the emails of user %d: %v", ctx.opts.UserID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get the emails of user %d: %v", ctx.opts.UserID, err),
+		})
+		return false
+	}
+	userMsg, err := checkAuthorEmails(ctx, repo.RepoPath(), ctx.env, oldCommitID, newCommitID, verifiedEmails(ctx.user, emails))
+	if err != nil {
+		log.Error("Unable to check the emails of the commits from %s to %s in %-v: %v", oldCommitID, newCommitID, repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to check the emails of the commits from %s to %s: %v", oldCommitID, newCommitID, err),
+		})
+		return false
+	}
+	if userMsg != "" {
+		log.Warn("Forbidden: Push of user %d to %-v: %s", ctx.opts.UserID, repo, userMsg)
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: userMsg,
+		})
+		return false
+	}
+	return true
+}
+
+// verifiedEmails returns the lower-cased activated emails of the user along with its placeholder email,
+// which the web editor uses for users keeping their email private
+func verifiedEmails(u *user_model.User, emails []*user_model.EmailAddress) map[string]bool {
+	verified := make(map[string]bool, len(emails)+1)
+	for _, email := range emails {
+		if email.IsActivated {
+			verified[strings.ToLower(email.Email)] = true
+		}
+	}
+	verified[strings.ToLower(u.GetPlaceholderEmail())] = true
+	return verified
+}
+
+// checkAuthorEmails returns the reason to reject the update if one of the new commits has an author or committer email
+// which isn't among the verified emails, which must be lower-cased. Commits of a new ref are the ones not on any existing ref.
+func checkAuthorEmails(ctx context.Context, repoPath string, env []string, oldCommitID, newCommitID string, verified map[string]bool) (string, error) {
+	cmd := git.NewCommand(ctx, "log", "--format=%H%x00%ae%x00%ce")
+	if oldCommitID == git.EmptySHA {
+		cmd.AddDynamicArguments(newCommitID).AddArguments("--not", "--all")
+	} else {
+		cmd.AddDynamicArguments(oldCommitID + ".." + newCommitID)
+	}
+	stdout, _, err := cmd.RunStdString(&git.RunOpts{Dir: repoPath, Env: env})
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 {
+			continue
+		}
+		for i, kind := range []string{"author", "committer"} {
+			if email := fields[i+1]; !verified[strings.ToLower(email)] {
+				return fmt.Sprintf("commit %s has the %s email %q, which isn't one of your verified emails", fields[0], kind, email), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// assertLFSLocks returns true if the commits pushed with the update don't change files with an LFS lock held by
+// someone other than the pusher. Deploy keys hold no locks. If false is returned ctx has had the "JSON" function called
+func (ctx *preReceiveContext) assertLFSLocks(oldCommitID, newCommitID string) bool {
+	repo := ctx.Repo.Repository
+	locks, err := git_model.GetLFSLockByRepoID(ctx, repo.ID, 0, 0)
+	if err != nil {
+		log.Error("Unable to get the LFS locks of %-v: %v", repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get the LFS locks of %s: %v", repo.FullName(), err),
+		})
+		return false
+	}
+	if len(locks) == 0 {
+		return true
+	}
+
+	pusherID := ctx.opts.UserID
+	if ctx.opts.DeployKeyID != 0 {
+		pusherID = 0
+	}
+	lockedBy := make(map[string]string, len(locks))
+	for _, lock := range locks {
+		if lock.OwnerID == pusherID {
+			continue
+		}
+		owner, err := user_model.GetPossibleUserByID(ctx, lock.OwnerID)
+		if err != nil {
+			log.Error("Unable to get the owner %d of the LFS lock of %s in %-v: %v", lock.OwnerID, lock.Path, repo, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err: fmt.Sprintf("Unable to get the owner of the LFS lock of %s: %v", lock.Path, err),
+			})
+			return false
+		}
+		lockedBy[strings.ToLower(lock.Path)] = owner.Name
+	}
+
+	userMsg, err := checkLFSLocks(ctx, repo.RepoPath(), ctx.env, oldCommitID, newCommitID, lockedBy)
+	if err != nil {
+		log.Error("Unable to check the files changed by the commits from %s to %s in %-v: %v", oldCommitID, newCommitID, repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to check the files changed by the commits from %s to %s: %v", oldCommitID, newCommitID, err),
+		})
+		return false
+	}
+	if userMsg != "" {
+		log.Warn("Forbidden: Push of user %d to %-v: %s", ctx.opts.UserID, repo, userMsg)
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: userMsg,
+		})
+		return false
+	}
+	return true
+}
+
+// checkLFSLocks returns the reason to reject the update if one of the new commits changes a file in lockedBy, which maps
+// the lower-cased paths of the locks the pusher doesn't hold to their owners. Commits of a new ref are the ones not on any existing ref.
+func checkLFSLocks(ctx context.Context, repoPath string, env []string, oldCommitID, newCommitID string, lockedBy map[string]string) (string, error) {
+	cmd := git.NewCommand(ctx, "log", "--format=", "--name-only", "--no-renames", "-z")
+	if oldCommitID == git.EmptySHA {
+		cmd.AddDynamicArguments(newCommitID).AddArguments("--not", "--all")
+	} else {
+		cmd.AddDynamicArguments(oldCommitID + ".." + newCommitID)
+	}
+	stdout, _, err := cmd.RunStdString(&git.RunOpts{Dir: repoPath, Env: env})
+	if err != nil {
+		return "", err
+	}
+	for _, path := range strings.Split(stdout, "\x00") {
+		path = strings.TrimLeft(path, "\n")
+		if owner, ok := lockedBy[strings.ToLower(path)]; ok && path != "" {
+			return fmt.Sprintf("%s is locked by %s, only they can push changes to it", path, owner), nil
+		}
+	}
+	return "", nil
+}
+
+// assertAnnexBranchUpdate returns true if the update of the git-annex branch can be one made by git-annex,
+// which only ever adds commits to it. Deleting or rewriting the branch would lose the git-annex metadata.
+// If false is returned ctx has had the "JSON" function called
+func (ctx *preReceiveContext) assertAnnexBranchUpdate(oldCommitID, newCommitID string) bool {
+	repo := ctx.Repo.Repository
+	if newCommitID == git.EmptySHA {
+		log.Warn("Forbidden: the git-annex branch of %-v cannot be deleted", repo)
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: "the git-annex branch holds the git-annex metadata and cannot be deleted",
+		})
+		return false
+	}
+	if oldCommitID == git.EmptySHA {
+		return true
+	}
+
+	output, _, err := git.NewCommand(ctx, "rev-list", "--max-count=1").AddDynamicArguments(oldCommitID, "^"+newCommitID).RunStdString(&git.RunOpts{Dir: repo.RepoPath(), Env: ctx.env})
+	if err != nil {
+		log.Error("Unable to detect force push between: %s and %s in %-v Error: %v", oldCommitID, newCommitID, repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Fail to detect force push: %v", err),
+		})
+		return false
+	}
+	if len(output) > 0 {
+		log.Warn("Forbidden: the git-annex branch of %-v cannot be force pushed", repo)
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: "the git-annex branch holds the git-annex metadata and cannot be force pushed, git-annex only ever adds to it",
+		})
+		return false
+	}
+	return true
+}
+
 func preReceiveBranch(ctx *preReceiveContext, oldCommitID, newCommitID, refFullName string) {
 	branchName := strings.TrimPrefix(refFullName, git.BranchPrefix)
 	ctx.branchName = branchName
@@ -155,6 +407,10 @@ func preReceiveBranch(ctx *preReceiveContext, oldCommitID, newCommitID, refFullN
 		return
 	}
 
+	if refFullName == annex.BranchRefName && setting.Annex.Enabled && setting.Annex.ProtectMetadataBranch && !ctx.assertAnnexBranchUpdate(oldCommitID, newCommitID) {
+		return
+	}
+
 	protectBranch, err := git_model.GetFirstMatchProtectedBranchRule(ctx, repo.ID, branchName)
 	if err != nil {
 		log.Error("Unable to get protected branch: %s in %-v Error: %v", branchName, repo, err)
@@ -0,0 +1,182 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPushObjectsLimit(t *testing.T) {
+	oldHomePath := setting.Git.HomePath
+	oldMaxPushObjects := setting.Repository.MaxPushObjects
+	defer func() {
+		setting.Git.HomePath = oldHomePath
+		setting.Repository.MaxPushObjects = oldMaxPushObjects
+	}()
+
+	setting.Git.HomePath = t.TempDir()
+	assert.NoError(t, git.InitSimple(context.Background()))
+
+	repoPath := filepath.Join(t.TempDir(), "repo.git")
+	assert.NoError(t, exec.Command("git", "init", "--bare", repoPath).Run())
+
+	// the pushed objects are written to the quarantine directory, existing objects must not count
+	quarantinePath := filepath.Join(t.TempDir(), "incoming")
+	assert.NoError(t, os.MkdirAll(quarantinePath, os.ModePerm))
+	env := append(os.Environ(), "GIT_OBJECT_DIRECTORY="+quarantinePath, "GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(repoPath, "objects"))
+	hashObject := func(content string, env []string) {
+		cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+		cmd.Dir = repoPath
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(content)
+		assert.NoError(t, cmd.Run())
+	}
+	hashObject("existing", os.Environ())
+	hashObject("one", env)
+	hashObject("two", env)
+	hashObject("three", env)
+
+	setting.Repository.MaxPushObjects = 3
+	userMsg, err := checkPushObjectsLimit(context.Background(), repoPath, env)
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+
+	setting.Repository.MaxPushObjects = 2
+	userMsg, err = checkPushObjectsLimit(context.Background(), repoPath, env)
+	assert.NoError(t, err)
+	assert.Equal(t, "push contains 3 objects, which exceeds the limit of 2 objects", userMsg)
+}
+
+func TestVerifiedEmails(t *testing.T) {
+	oldNoReplyAddress := setting.Service.NoReplyAddress
+	defer func() {
+		setting.Service.NoReplyAddress = oldNoReplyAddress
+	}()
+	setting.Service.NoReplyAddress = "noreply.example.org"
+
+	u := &user_model.User{LowerName: "user2"}
+	verified := verifiedEmails(u, []*user_model.EmailAddress{
+		{Email: "User2@Example.com", IsActivated: true},
+		{Email: "user2@unverified.example.com", IsActivated: false},
+	})
+	assert.Equal(t, map[string]bool{"user2@example.com": true, "user2@noreply.example.org": true}, verified)
+
+	// the placeholder email is accepted even without any email address
+	assert.Equal(t, map[string]bool{"user2@noreply.example.org": true}, verifiedEmails(u, nil))
+}
+
+func TestCheckAuthorEmails(t *testing.T) {
+	oldHomePath := setting.Git.HomePath
+	defer func() {
+		setting.Git.HomePath = oldHomePath
+	}()
+	setting.Git.HomePath = t.TempDir()
+	assert.NoError(t, git.InitSimple(context.Background()))
+
+	repoPath := t.TempDir()
+	gitCmd := func(env []string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(author, committer string) string {
+		return gitCmd([]string{
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=" + author,
+			"GIT_COMMITTER_NAME=c", "GIT_COMMITTER_EMAIL=" + committer,
+		}, "commit-tree", "-m", "msg", "-p", "HEAD", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	}
+	gitCmd(nil, "init")
+	gitCmd([]string{"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=old@example.com", "GIT_COMMITTER_NAME=c", "GIT_COMMITTER_EMAIL=old@example.com"}, "commit", "--allow-empty", "-m", "existing")
+	existing := gitCmd(nil, "rev-parse", "HEAD")
+	verified := map[string]bool{"user2@example.com": true, "user2@noreply.example.org": true}
+
+	// commits already on a ref aren't checked again
+	matching := commit("User2@example.com", "user2@noreply.example.org")
+	userMsg, err := checkAuthorEmails(context.Background(), repoPath, nil, existing, matching, verified)
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+	userMsg, err = checkAuthorEmails(context.Background(), repoPath, nil, git.EmptySHA, matching, verified)
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+
+	mismatching := commit("someone@example.com", "user2@example.com")
+	userMsg, err = checkAuthorEmails(context.Background(), repoPath, nil, existing, mismatching, verified)
+	assert.NoError(t, err)
+	assert.Equal(t, "commit "+mismatching+" has the author email \"someone@example.com\", which isn't one of your verified emails", userMsg)
+
+	mismatching = commit("user2@example.com", "")
+	userMsg, err = checkAuthorEmails(context.Background(), repoPath, nil, git.EmptySHA, mismatching, verified)
+	assert.NoError(t, err)
+	assert.Equal(t, "commit "+mismatching+" has the committer email \"\", which isn't one of your verified emails", userMsg)
+}
+
+func TestCheckLFSLocks(t *testing.T) {
+	oldHomePath := setting.Git.HomePath
+	defer func() {
+		setting.Git.HomePath = oldHomePath
+	}()
+	setting.Git.HomePath = t.TempDir()
+	assert.NoError(t, git.InitSimple(context.Background()))
+
+	repoPath := t.TempDir()
+	gitCmd := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=c", "GIT_COMMITTER_EMAIL=c@example.com")
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(path, content string) string {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(repoPath, path)), os.ModePerm))
+		assert.NoError(t, os.WriteFile(filepath.Join(repoPath, path), []byte(content), 0o644))
+		gitCmd("add", path)
+		gitCmd("commit", "-m", "change "+path)
+		return gitCmd("rev-parse", "HEAD")
+	}
+	gitCmd("init")
+	existing := commit("assets/model.bin", "v1")
+	gitCmd("branch", "existing")
+
+	// the lock of the holder isn't in lockedBy, so the holder may push to the locked path
+	changed := commit("assets/model.bin", "v2")
+	userMsg, err := checkLFSLocks(context.Background(), repoPath, nil, existing, changed, map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+
+	lockedBy := map[string]string{"assets/model.bin": "user2"}
+	userMsg, err = checkLFSLocks(context.Background(), repoPath, nil, existing, changed, lockedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "assets/model.bin is locked by user2, only they can push changes to it", userMsg)
+
+	// locked paths are matched case-insensitively, like the locks themselves
+	renamed := commit("Assets/Model.bin", "v3")
+	userMsg, err = checkLFSLocks(context.Background(), repoPath, nil, changed, renamed, lockedBy)
+	assert.NoError(t, err)
+	assert.Equal(t, "Assets/Model.bin is locked by user2, only they can push changes to it", userMsg)
+
+	// other paths may be pushed by anyone, and commits already on a ref aren't checked again
+	other := commit("docs/readme.md", "hello")
+	userMsg, err = checkLFSLocks(context.Background(), repoPath, nil, renamed, other, lockedBy)
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+	gitCmd("branch", "-f", "existing", "HEAD")
+	userMsg, err = checkLFSLocks(context.Background(), repoPath, nil, git.EmptySHA, other, lockedBy)
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+}
@@ -58,6 +58,7 @@ func Routes() *web.Route {
 
 	r.Post("/ssh/authorized_keys", AuthorizedPublicKeyByContent)
 	r.Post("/ssh/{id}/update/{repoid}", UpdatePublicKeyInRepo)
+	r.Post("/ssh/{id}/activity/{repoid}", ServRecordKeyActivity)
 	r.Post("/ssh/log", bind(private.SSHLogOption{}), SSHLog)
 	r.Post("/hook/pre-receive/{owner}/{repo}", RepoAssignment, bind(private.HookOptions{}), HookPreReceive)
 	r.Post("/hook/post-receive/{owner}/{repo}", context.OverrideContext, bind(private.HookOptions{}), HookPostReceive)
@@ -65,6 +66,33 @@ func Routes() *web.Route {
 	r.Post("/hook/set-default-branch/{owner}/{repo}/{branch}", RepoAssignment, SetDefaultBranch)
 	r.Get("/serv/none/{keyid}", ServNoCommand)
 	r.Get("/serv/command/{keyid}/{owner}/{repo}", ServCommand)
+	r.Post("/serv/push-lock/{repoid}", ServPushLock)
+	r.Post("/serv/push-lock-renew/{repoid}", ServPushLockRenew)
+	r.Post("/serv/push-unlock/{repoid}", ServPushUnlock)
+	r.Post("/serv/clone-approval/{repoid}", ServCloneApproval)
+	r.Post("/serv/read-through/{repoid}", ServReadThrough)
+	r.Post("/serv/budget/{userid}", ServBudget)
+	r.Post("/serv/touch/{repoid}", ServTouchRepo)
+	r.Get("/serv/backup", ServBackupInProgress)
+	r.Post("/serv/usage/{repoid}", bind(private.ServUsage{}), ServRecordUsage)
+	r.Post("/serv/protocol", ServRecordProtocol)
+	r.Post("/serv/event", bind(private.ServEvent{}), ServPublishEvent)
+	r.Post("/serv/status", bind(private.ServStatus{}), ServStreamStatus)
+	r.Post("/serv/gc/{repoid}", ServScheduleGC)
+	r.Post("/serv/read/{repoid}", ServRecordRead)
+	r.Get("/annex/object-count/{repoid}", AnnexObjectCount)
+	r.Post("/annex/drop-notify/{repoid}", AnnexDropNotify)
+	r.Post("/annex/record-key/{repoid}", AnnexRecordKey)
+	r.Post("/annex/forget-key/{repoid}", AnnexForgetKey)
+	r.Post("/annex/key-lock/{repoid}", AnnexKeyLock)
+	r.Post("/annex/key-lock-renew/{repoid}", AnnexKeyLockRenew)
+	r.Post("/annex/key-unlock/{repoid}", AnnexKeyUnlock)
+	r.Post("/annex/notify-changes-acquire/{repoid}", AnnexNotifyChangesAcquire)
+	r.Post("/annex/notify-changes-renew/{repoid}", AnnexNotifyChangesRenew)
+	r.Post("/annex/notify-changes-release/{repoid}", AnnexNotifyChangesRelease)
+	r.Post("/annex/storage-fetch/{repoid}", AnnexStorageFetch)
+	r.Post("/annex/storage-save/{repoid}", AnnexStorageSave)
+	r.Post("/annex/storage-delete/{repoid}", AnnexStorageDelete)
 	r.Post("/manager/shutdown", Shutdown)
 	r.Post("/manager/restart", Restart)
 	r.Post("/manager/flush-queues", bind(private.FlushOptions{}), FlushQueues)
@@ -75,6 +103,13 @@ func Routes() *web.Route {
 	r.Post("/manager/add-logger", bind(private.LoggerOptions{}), AddLogger)
 	r.Post("/manager/remove-logger/{group}/{name}", RemoveLogger)
 	r.Get("/manager/processes", Processes)
+	r.Post("/manager/approve-clone/{id}", ApproveClone)
+	r.Get("/manager/serv-usage", ServUsageStats)
+	r.Get("/manager/serv-protocols", ServProtocolStats)
+	r.Post("/manager/backup-start", BackupStart)
+	r.Post("/manager/backup-end", BackupEnd)
+	r.Post("/manager/lock-repo", LockRepo)
+	r.Post("/manager/unlock-repo", UnlockRepo)
 	r.Post("/mail/send", SendEmail)
 	r.Post("/restore_repo", RestoreRepo)
 	r.Post("/actions/generate_actions_runner_token", GenerateActionsRunnerToken)
@@ -7,8 +7,10 @@ import (
 	"net/http"
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
+	repo_model "code.gitea.io/gitea/models/repo"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/timeutil"
 )
 
@@ -59,3 +61,26 @@ func AuthorizedPublicKeyByContent(ctx *context.PrivateContext) {
 	}
 	ctx.PlainText(http.StatusOK, publicKey.AuthorizedString())
 }
+
+// ServRecordKeyActivity records the operation done over SSH with the key in the repository
+func ServRecordKeyActivity(ctx *context.PrivateContext) {
+	keyID := ctx.ParamsInt64(":id")
+	repoID := ctx.ParamsInt64(":repoid")
+	verb := ctx.FormString("verb")
+
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+	if _, err = asymkey_model.AddPublicKeyActivity(ctx, keyID, repo.ID, repo.FullName(), verb, setting.SSH.KeyActivityInterval); err != nil {
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	ctx.PlainText(http.StatusOK, "success")
+}
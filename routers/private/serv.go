@@ -9,6 +9,8 @@ import (
 	"strings"
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
+	auth_model "code.gitea.io/gitea/models/auth"
+	git_model "code.gitea.io/gitea/models/git"
 	"code.gitea.io/gitea/models/perm"
 	access_model "code.gitea.io/gitea/models/perm/access"
 	repo_model "code.gitea.io/gitea/models/repo"
@@ -16,9 +18,12 @@ import (
 	user_model "code.gitea.io/gitea/models/user"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/git"
+	lfs_module "code.gitea.io/gitea/modules/lfs"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/private"
+	repo_module "code.gitea.io/gitea/modules/repository"
 	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/util"
 	repo_service "code.gitea.io/gitea/services/repository"
 	wiki_service "code.gitea.io/gitea/services/wiki"
 )
@@ -66,12 +71,34 @@ func ServNoCommand(ctx *context.PrivateContext) {
 		}
 		if !user.IsActive || user.ProhibitLogin {
 			ctx.JSON(http.StatusForbidden, private.Response{
-				UserMsg: "Your account is disabled.",
+				UserMsg:  "Your account is disabled.",
+				Reason:   private.DenialDeactivated,
+				Language: user.Language,
 			})
 			return
 		}
 		results.Owner = user
 	}
+
+	// Tell the user of a deploy key how to use it if there is only one repository it can be used for
+	if key.Type == asymkey_model.KeyTypeDeploy {
+		deployKeys, err := asymkey_model.ListDeployKeys(ctx, &asymkey_model.ListDeployKeysOptions{KeyID: key.ID})
+		if err != nil {
+			log.Error("Unable to get the deploy keys of public key: %d Error: %v", keyID, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err: err.Error(),
+			})
+			return
+		}
+		if len(deployKeys) == 1 {
+			repo, err := repo_model.GetRepositoryByID(ctx, deployKeys[0].RepoID)
+			if err != nil {
+				log.Error("Unable to get repository %d of deploy key %d Error: %v", deployKeys[0].RepoID, deployKeys[0].ID, err)
+			} else {
+				results.RepoCloneURL = repo.CloneLink().SSH
+			}
+		}
+	}
 	ctx.JSON(http.StatusOK, &results)
 }
 
@@ -81,6 +108,8 @@ func ServCommand(ctx *context.PrivateContext) {
 	ownerName := ctx.Params(":owner")
 	repoName := ctx.Params(":repo")
 	mode := perm.AccessMode(ctx.FormInt("mode"))
+	// mode is lowered to read below for pushes when git supports proc-receive, requestedMode is what the client asked for
+	requestedMode := mode
 
 	// Set the basic parts of the results to return
 	results := private.ServCommandResults{
@@ -107,21 +136,33 @@ func ServCommand(ctx *context.PrivateContext) {
 		results.RepoName = repoName[:len(repoName)-5]
 	}
 
-	owner, err := user_model.GetUserByName(ctx, results.OwnerName)
-	if err != nil {
-		if user_model.IsErrUserNotExist(err) {
-			// User is fetching/cloning a non-existent repository
-			log.Warn("Failed authentication attempt (cannot find repository: %s/%s) from %s", results.OwnerName, results.RepoName, ctx.RemoteAddr())
-			ctx.JSON(http.StatusNotFound, private.Response{
-				UserMsg: fmt.Sprintf("Cannot find repository: %s/%s", results.OwnerName, results.RepoName),
+	// Reads of public repositories may reuse the repository looked up for an earlier read
+	var owner *user_model.User
+	var repo *repo_model.Repository
+	var err error
+	fromCache := false
+	if setting.Service.PublicReadFastPath && requestedMode == perm.AccessModeRead {
+		owner, repo = getPublicRead(ctx, results.OwnerName, results.RepoName)
+		fromCache = repo != nil
+	}
+
+	if !fromCache {
+		owner, err = user_model.GetUserByName(ctx, results.OwnerName)
+		if err != nil {
+			if user_model.IsErrUserNotExist(err) {
+				// User is fetching/cloning a non-existent repository
+				log.Warn("Failed authentication attempt (cannot find repository: %s/%s) from %s", results.OwnerName, results.RepoName, ctx.RemoteAddr())
+				ctx.JSON(http.StatusNotFound, private.Response{
+					UserMsg: fmt.Sprintf("Cannot find repository: %s/%s", results.OwnerName, results.RepoName),
+				})
+				return
+			}
+			log.Error("Unable to get repository owner: %s/%s Error: %v", results.OwnerName, results.RepoName, err)
+			ctx.JSON(http.StatusForbidden, private.Response{
+				UserMsg: fmt.Sprintf("Unable to get repository owner: %s/%s %v", results.OwnerName, results.RepoName, err),
 			})
 			return
 		}
-		log.Error("Unable to get repository owner: %s/%s Error: %v", results.OwnerName, results.RepoName, err)
-		ctx.JSON(http.StatusForbidden, private.Response{
-			UserMsg: fmt.Sprintf("Unable to get repository owner: %s/%s %v", results.OwnerName, results.RepoName, err),
-		})
-		return
 	}
 	if !owner.IsOrganization() && !owner.IsActive {
 		ctx.JSON(http.StatusForbidden, private.Response{
@@ -132,7 +173,9 @@ func ServCommand(ctx *context.PrivateContext) {
 
 	// Now get the Repository and set the results section
 	repoExist := true
-	repo, err := repo_model.GetRepositoryByName(owner.ID, results.RepoName)
+	if !fromCache {
+		repo, err = repo_model.GetRepositoryByName(owner.ID, results.RepoName)
+	}
 	if err != nil {
 		if repo_model.IsErrRepoNotExist(err) {
 			repoExist = false
@@ -159,6 +202,7 @@ func ServCommand(ctx *context.PrivateContext) {
 		repo.Owner = owner
 		repo.OwnerName = ownerName
 		results.RepoID = repo.ID
+		results.RepoIsPrivate = repo.IsPrivate
 
 		if repo.IsBeingCreated() {
 			ctx.JSON(http.StatusInternalServerError, private.Response{
@@ -178,6 +222,8 @@ func ServCommand(ctx *context.PrivateContext) {
 		if mode > perm.AccessModeRead && repo.IsMirror {
 			ctx.JSON(http.StatusForbidden, private.Response{
 				UserMsg: fmt.Sprintf("Mirror Repository %s/%s is read-only", results.OwnerName, results.RepoName),
+				Reason:  private.DenialReadOnly,
+				Args:    []string{results.OwnerName, results.RepoName},
 			})
 			return
 		}
@@ -262,21 +308,63 @@ func ServCommand(ctx *context.PrivateContext) {
 
 		if !user.IsActive || user.ProhibitLogin {
 			ctx.JSON(http.StatusForbidden, private.Response{
-				UserMsg: "Your account is disabled.",
+				UserMsg:  "Your account is disabled.",
+				Reason:   private.DenialDeactivated,
+				Language: user.Language,
 			})
 			return
 		}
 
 		results.UserName = user.Name
+		results.UserLanguage = user.Language
 		if !user.KeepEmailPrivate {
 			results.UserEmail = user.Email
 		}
+		results.IsPrincipal = key.Type == asymkey_model.KeyTypePrincipal
+		if mode > perm.AccessModeRead {
+			results.KeyReadOnly = key.IsReadOnly()
+			readOnly, err := user_model.GetUserSetting(user.ID, user_model.SettingsKeySSHReadOnly)
+			if err != nil {
+				log.Error("Unable to check whether %-v is read-only over SSH Error: %v", user, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to check whether user %d:%s is read-only over SSH Error: %v", user.ID, user.Name, err),
+				})
+				return
+			}
+			results.AccountReadOnly = readOnly == "true"
+		}
+		results.UserEmailVerified, err = user_model.IsPrimaryEmailActivated(ctx, user.ID)
+		if err != nil {
+			log.Error("Unable to check the email address of %-v Error: %v", user, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err: fmt.Sprintf("Unable to check the email address of user %d:%s Error: %v", user.ID, user.Name, err),
+			})
+			return
+		}
+
+		results.Require2FA = setting.Service.Require2FAForGit
+		if results.Require2FA {
+			results.UserTwoFactorEnabled, err = auth_model.HasTwoFactorByUID(user.ID)
+			if err == nil && !results.UserTwoFactorEnabled {
+				results.UserTwoFactorEnabled, err = auth_model.HasWebAuthnRegistrationsByUID(user.ID)
+			}
+			if err != nil {
+				log.Error("Unable to check the two-factor authentication of %-v Error: %v", user, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to check the two-factor authentication of user %d:%s Error: %v", user.ID, user.Name, err),
+				})
+				return
+			}
+		}
 	}
 
 	// Don't allow pushing if the repo is archived
 	if repoExist && mode > perm.AccessModeRead && repo.IsArchived {
 		ctx.JSON(http.StatusUnauthorized, private.Response{
-			UserMsg: fmt.Sprintf("Repo: %s/%s is archived.", results.OwnerName, results.RepoName),
+			UserMsg:  fmt.Sprintf("Repo: %s/%s is archived.", results.OwnerName, results.RepoName),
+			Reason:   private.DenialArchived,
+			Language: results.UserLanguage,
+			Args:     []string{results.OwnerName, results.RepoName},
 		})
 		return
 	}
@@ -319,9 +407,18 @@ func ServCommand(ctx *context.PrivateContext) {
 				})
 				return
 			}
+			results.RepoAdmin = perm.IsAdmin()
 		}
 	}
 
+	// Checked only after the permissions so that the state of the repository isn't disclosed to anyone who can't access it
+	if repoExist && repo.IsPendingDeletion() {
+		ctx.JSON(http.StatusGone, private.Response{
+			UserMsg: "Repository is scheduled for deletion",
+		})
+		return
+	}
+
 	// We already know we aren't using a deploy key
 	if !repoExist {
 		owner, err := user_model.GetUserByName(ctx, ownerName)
@@ -345,6 +442,32 @@ func ServCommand(ctx *context.PrivateContext) {
 			return
 		}
 
+		if err := repo_service.CheckPushCreateRepo(ctx, user, owner); err != nil {
+			log.Warn("Rejected push-creating %s/%s by %-v: %v", results.OwnerName, results.RepoName, user, err)
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %s/%s", results.OwnerName, results.RepoName),
+			})
+			return
+		}
+
+		// Only names following the naming policy may be created, checked after the permissions so the policy isn't disclosed to anyone
+		if setting.Repository.NamePolicyCommand != "" {
+			userMsg, err := checkNamePolicy(ctx, setting.Repository.NamePolicyCommand, owner.Name, results.RepoName)
+			if err != nil {
+				log.Error("Unable to check the name %s/%s against the naming policy: %v", owner.Name, results.RepoName, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to check the name %s/%s against the naming policy: %v", owner.Name, results.RepoName, err),
+				})
+				return
+			}
+			if userMsg != "" {
+				ctx.JSON(http.StatusForbidden, private.Response{
+					UserMsg: userMsg,
+				})
+				return
+			}
+		}
+
 		repo, err = repo_service.PushCreateRepo(ctx, user, owner, results.RepoName)
 		if err != nil {
 			log.Error("pushCreateRepo: %v", err)
@@ -354,6 +477,7 @@ func ServCommand(ctx *context.PrivateContext) {
 			return
 		}
 		results.RepoID = repo.ID
+		results.RepoIsPrivate = repo.IsPrivate
 	}
 
 	if results.IsWiki {
@@ -381,6 +505,144 @@ func ServCommand(ctx *context.PrivateContext) {
 			return
 		}
 	}
+	results.PreExecCommand = setting.Repository.PreExecCommands[strings.ToLower(results.OwnerName+"/"+results.RepoName)]
+	if !results.IsWiki {
+		results.GitNamespace = setting.Repository.GitNamespaces[strings.ToLower(results.OwnerName+"/"+results.RepoName)]
+	}
+	if results.RepoLock, err = repo_module.GetRepoLock(ctx, repo.ID); err != nil {
+		log.Error("Unable to get the lock of %-v: %v", repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get the lock of %s/%s: %v", ownerName, repoName, err),
+		})
+		return
+	}
+	if requestedMode >= perm.AccessModeWrite {
+		results.BackupInProgress = isBackupInProgress()
+	}
+	results.MinClientGitVersion = setting.Repository.MinClientGitVersions[strings.ToLower(results.OwnerName+"/"+results.RepoName)]
+	if timeout, has := setting.Repository.CommandTimeouts[strings.ToLower(results.OwnerName+"/"+results.RepoName)]; has {
+		results.CommandTimeout = &timeout
+	}
+
+	if repo != nil {
+		results.RepoLastAccess = repo.LastAccessUnix.AsTime()
+	}
+	if repo != nil && !results.IsWiki {
+		results.RepoSize = repo.Size
+		results.RepoUnhealthy = repo_module.IsMarkedUnhealthy(repo.RepoPath())
+		if setting.Git.AutoRepackOnAccess {
+			results.LooseObjects = repo_module.EstimateLooseObjects(repo.RepoPath())
+		}
+	}
+
+	// Clones get the LFS pointer files but can't fetch their content if the LFS server is disabled
+	if !setting.LFS.StartServer && !results.IsWiki && requestedMode == perm.AccessModeRead {
+		count, err := git_model.CountLFSMetaObjects(ctx, repo.ID)
+		if err != nil {
+			log.Error("Unable to count the LFS objects of %-v: %v", repo, err)
+		}
+		results.LFSUnavailable = count > 0
+	}
+
+	if repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite && util.SliceContainsString(ctx.FormStrings("verb"), "git-lfs-authenticate") {
+		if quota, has := lfs_module.RepoQuota(results.OwnerName, results.RepoName); has {
+			size, err := git_model.GetRepoLFSSize(ctx, repo.ID)
+			if err != nil {
+				log.Error("Unable to get the size of the LFS objects of %-v: %v", repo, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to get the size of the LFS objects of %s/%s: %v", results.OwnerName, results.RepoName, err),
+				})
+				return
+			}
+			results.LFSQuota = quota
+			results.LFSSize = size
+		}
+	}
+
+	if repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite &&
+		util.SliceContainsString(setting.Repository.PullRequestOnlyRepositories, results.OwnerName+"/"+results.RepoName, true) {
+		results.ProtectedDefaultBranch = repo.DefaultBranch
+	}
+
+	if repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite && setting.Repository.RejectPushesToStatusCheckBranches {
+		rules, err := git_model.FindRepoProtectedBranchRules(ctx, repo.ID)
+		if err != nil {
+			log.Error("Unable to get the protected branch rules of %-v: %v", repo, err)
+			ctx.JSON(http.StatusInternalServerError, private.Response{
+				Err: fmt.Sprintf("Unable to get the protected branch rules of %s/%s: %v", results.OwnerName, results.RepoName, err),
+			})
+			return
+		}
+		for _, rule := range rules {
+			if rule.EnableStatusCheck {
+				results.BranchRules = servBranchRules(rules)
+				break
+			}
+		}
+	}
+
+	if repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite &&
+		util.SliceContainsString(setting.Repository.BranchCreationRestrictedRepositories, results.OwnerName+"/"+results.RepoName, true) {
+		// Only the administrators of the repository may create branches, deploy keys never may
+		results.DenyBranchCreation = true
+		if user != nil {
+			repoPerm, err := access_model.GetUserRepoPermission(ctx, repo, user)
+			if err != nil {
+				log.Error("Unable to get permissions for %-v in %-v Error: %v", user, repo, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to get permissions for user %d:%s in %s/%s Error: %v", user.ID, user.Name, results.OwnerName, results.RepoName, err),
+				})
+				return
+			}
+			results.DenyBranchCreation = !repoPerm.IsAdmin()
+		}
+	}
+
+	// Deploy keys have no emails to match the commits against
+	if user != nil && repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite &&
+		util.SliceContainsString(setting.Repository.VerifiedAuthorEmailRepositories, results.OwnerName+"/"+results.RepoName, true) {
+		results.VerifyAuthorEmails = true
+	}
+
+	if repo != nil && !results.IsWiki && requestedMode == perm.AccessModeWrite &&
+		setting.LFS.StartServer && util.SliceContainsString(setting.Repository.LFSLockEnforcedRepositories, results.OwnerName+"/"+results.RepoName, true) {
+		results.EnforceLFSLocks = true
+	}
+
+	// Deploy keys have no user to accept the CLA
+	if user != nil && repo != nil && requestedMode == perm.AccessModeWrite && util.SliceContainsString(ctx.FormStrings("verb"), "git-receive-pack") {
+		if name, claURL := requiredCLA(results.OwnerName, results.RepoName); claURL != "" {
+			accepted, err := user_model.GetUserSetting(user.ID, user_model.SettingsKeyAcceptedCLAPrefix+name)
+			if err != nil {
+				log.Error("Unable to get the CLA %s accepted by %-v: %v", name, user, err)
+				ctx.JSON(http.StatusInternalServerError, private.Response{
+					Err: fmt.Sprintf("Unable to get the CLA %s accepted by %s: %v", name, user.Name, err),
+				})
+				return
+			}
+			if accepted != claURL {
+				results.UnacceptedCLA = claURL
+			}
+		}
+	}
+
+	if repo != nil && requestedMode == perm.AccessModeRead &&
+		util.SliceContainsString(setting.Repository.CloneApprovalRepositories, results.OwnerName+"/"+results.RepoName, true) {
+		results.CloneApprovalRequired = true
+	}
+
+	// Fetches from a fork may read the objects it still shares with its base repository, if the user can read the base.
+	// git serves any object of the alternates by its ID, so they mustn't expose objects of a base the user can't read.
+	if setting.Repository.ShareForkObjects && repo != nil && repo.IsFork && !results.IsWiki && requestedMode == perm.AccessModeRead {
+		if err := repo.GetBaseRepo(ctx); err != nil {
+			log.Error("Unable to get the base repository of %-v: %v", repo, err)
+		} else if basePerm, err := access_model.GetUserRepoPermission(ctx, repo.BaseRepo, user); err != nil {
+			log.Error("Unable to get the permission of %-v in the base repository %-v: %v", user, repo.BaseRepo, err)
+		} else if basePerm.CanRead(unit.TypeCode) {
+			results.BaseRepoPath = repo.BaseRepo.RepoPath()
+		}
+	}
+
 	log.Debug("Serv Results:\nIsWiki: %t\nDeployKeyID: %d\nKeyID: %d\tKeyName: %s\nUserName: %s\nUserID: %d\nOwnerName: %s\nRepoName: %s\nRepoID: %d",
 		results.IsWiki,
 		results.DeployKeyID,
@@ -392,6 +654,34 @@ func ServCommand(ctx *context.PrivateContext) {
 		results.RepoName,
 		results.RepoID)
 
+	// Only repositories anyone may read are reused, the entry expires rather than being renewed by the reads reusing it
+	if setting.Service.PublicReadFastPath && requestedMode == perm.AccessModeRead && repoExist && !fromCache &&
+		!repo.IsPrivate && !owner.Visibility.IsPrivate() && !setting.Service.RequireSignInView {
+		cachePublicRead(owner, repo)
+	}
+
 	ctx.JSON(http.StatusOK, results)
 	// We will update the keys in a different call.
 }
+
+// ServTouchRepo records that a repository has just been accessed
+func ServTouchRepo(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	if _, err := repo_model.TouchRepository(ctx, repoID, private.RepoTouchInterval); err != nil {
+		log.Error("Unable to update the last access time of repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to update the last access time of repository %d: %v", repoID, err),
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// servBranchRules returns what serv needs to know of the branch protection rules
+func servBranchRules(rules git_model.ProtectedBranchRules) []private.ServBranchRule {
+	servRules := make([]private.ServBranchRule, 0, len(rules))
+	for _, rule := range rules {
+		servRules = append(servRules, private.ServBranchRule{RuleName: rule.RuleName, RequireStatusCheck: rule.EnableStatusCheck})
+	}
+	return servRules
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+)
+
+// maxBackupWindow is how long a backup window lasts at most, so writes resume if it is never ended, e.g. because the backup failed
+const maxBackupWindow = 24 * time.Hour
+
+// backupWindow is the time until which a backup snapshot is in progress
+var backupWindow = struct {
+	sync.Mutex
+	until time.Time
+}{}
+
+// startBackupWindow pauses writes over SSH for the duration, or until the window is ended
+func startBackupWindow(duration time.Duration) time.Time {
+	if duration <= 0 || duration > maxBackupWindow {
+		duration = maxBackupWindow
+	}
+
+	backupWindow.Lock()
+	defer backupWindow.Unlock()
+	backupWindow.until = time.Now().Add(duration)
+	return backupWindow.until
+}
+
+// endBackupWindow resumes writes over SSH
+func endBackupWindow() {
+	backupWindow.Lock()
+	defer backupWindow.Unlock()
+	backupWindow.until = time.Time{}
+}
+
+// isBackupInProgress returns true if a backup window has been started and hasn't ended yet
+func isBackupInProgress() bool {
+	backupWindow.Lock()
+	defer backupWindow.Unlock()
+	return time.Now().Before(backupWindow.until)
+}
+
+// ServBackupInProgress reports whether writes over SSH are paused for a backup snapshot
+func ServBackupInProgress(ctx *context.PrivateContext) {
+	ctx.JSON(http.StatusOK, private.ServBackupInProgressResult{InProgress: isBackupInProgress()})
+}
+
+// BackupStart pauses writes over SSH while a backup snapshot is taken
+func BackupStart(ctx *context.PrivateContext) {
+	until := startBackupWindow(time.Duration(ctx.FormInt64("duration")))
+	log.Info("Backup window started, writes over SSH are paused until %v", until)
+	ctx.JSON(http.StatusOK, private.Response{
+		UserMsg: fmt.Sprintf("Writes over SSH are paused until %s", until.Format(time.RFC3339)),
+	})
+}
+
+// BackupEnd resumes writes over SSH after a backup snapshot
+func BackupEnd(ctx *context.PrivateContext) {
+	endBackupWindow()
+	log.Info("Backup window ended, writes over SSH are resumed")
+	ctx.PlainText(http.StatusOK, "success")
+}
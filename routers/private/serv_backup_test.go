@@ -0,0 +1,30 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupWindow(t *testing.T) {
+	defer endBackupWindow()
+
+	assert.False(t, isBackupInProgress())
+
+	until := startBackupWindow(time.Minute)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), until, time.Second)
+	assert.True(t, isBackupInProgress())
+	endBackupWindow()
+	assert.False(t, isBackupInProgress())
+
+	// a window which is never ended is over after its duration, or the maximum if there is none
+	startBackupWindow(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, isBackupInProgress())
+	assert.WithinDuration(t, time.Now().Add(maxBackupWindow), startBackupWindow(0), time.Second)
+	assert.WithinDuration(t, time.Now().Add(maxBackupWindow), startBackupWindow(48*time.Hour), time.Second)
+}
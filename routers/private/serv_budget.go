@@ -0,0 +1,76 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// cheapOperationCost is the cost of operations which are allowed even if the budget is used up
+const cheapOperationCost = 1
+
+type costBudget struct {
+	spent       int64
+	windowStart time.Time
+}
+
+// costBudgets holds how much of their budget the users have spent in the current window, keyed by user ID
+var costBudgets = struct {
+	sync.Mutex
+	users map[int64]*costBudget
+}{
+	users: map[int64]*costBudget{},
+}
+
+// chargeBudget charges cost to the budget of the user at now. An operation costing more than the whole budget
+// is allowed at the beginning of a window, so it can still be done once per window. It returns the remaining budget, or false and how long to wait for the next window if the budget doesn't cover the cost.
+func chargeBudget(userID, cost int64, now time.Time) (remaining int64, retryAfter time.Duration, ok bool) {
+	costBudgets.Lock()
+	defer costBudgets.Unlock()
+
+	for id, budget := range costBudgets.users {
+		if !now.Before(budget.windowStart.Add(setting.SSH.CostBudgetWindow)) {
+			delete(costBudgets.users, id)
+		}
+	}
+
+	budget, has := costBudgets.users[userID]
+	if !has {
+		budget = &costBudget{windowStart: now}
+		costBudgets.users[userID] = budget
+	}
+
+	if cost > cheapOperationCost && budget.spent > 0 && budget.spent+cost > setting.SSH.CostBudget {
+		return setting.SSH.CostBudget - budget.spent, budget.windowStart.Add(setting.SSH.CostBudgetWindow).Sub(now), false
+	}
+	budget.spent += cost
+	return setting.SSH.CostBudget - budget.spent, 0, true
+}
+
+// ServBudget charges the cost of an SSH operation to the budget of a user
+func ServBudget(ctx *context.PrivateContext) {
+	userID := ctx.ParamsInt64(":userid")
+	cost := ctx.FormInt64("cost")
+
+	remaining, retryAfter, ok := chargeBudget(userID, cost, time.Now())
+	if !ok {
+		retryAfter = retryAfter.Round(time.Second)
+		ctx.Resp.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter/time.Second), 10))
+		ctx.JSON(http.StatusTooManyRequests, private.Response{
+			UserMsg: fmt.Sprintf("This operation would exceed your budget of %d cost units per %v, please retry after %v", setting.SSH.CostBudget, setting.SSH.CostBudgetWindow, retryAfter),
+			Reason:  private.DenialRateLimit,
+			Args:    []string{strconv.FormatInt(setting.SSH.CostBudget, 10), setting.SSH.CostBudgetWindow.String(), retryAfter.String()},
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.ServBudgetResult{Remaining: remaining})
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChargeBudget(t *testing.T) {
+	oldBudget, oldWindow := setting.SSH.CostBudget, setting.SSH.CostBudgetWindow
+	defer func() {
+		setting.SSH.CostBudget, setting.SSH.CostBudgetWindow = oldBudget, oldWindow
+	}()
+	setting.SSH.CostBudget = 100
+	setting.SSH.CostBudgetWindow = time.Hour
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// the costs accrue within the window
+	remaining, _, ok := chargeBudget(1, 60, now)
+	assert.True(t, ok)
+	assert.EqualValues(t, 40, remaining)
+	remaining, _, ok = chargeBudget(1, 40, now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.EqualValues(t, 0, remaining)
+
+	// expensive operations are rejected until the window is over, cheap ones are still allowed
+	remaining, retryAfter, ok := chargeBudget(1, 2, now.Add(20*time.Minute))
+	assert.False(t, ok)
+	assert.EqualValues(t, 0, remaining)
+	assert.Equal(t, 40*time.Minute, retryAfter)
+	_, _, ok = chargeBudget(1, cheapOperationCost, now.Add(20*time.Minute))
+	assert.True(t, ok)
+
+	// other users have their own budget
+	remaining, _, ok = chargeBudget(2, 100, now.Add(20*time.Minute))
+	assert.True(t, ok)
+	assert.EqualValues(t, 0, remaining)
+	_, _, ok = chargeBudget(2, 101, now.Add(30*time.Minute))
+	assert.False(t, ok)
+
+	// an operation costing more than the whole budget is only allowed at the beginning of a window
+	remaining, _, ok = chargeBudget(3, 250, now)
+	assert.True(t, ok)
+	assert.EqualValues(t, -150, remaining)
+	_, _, ok = chargeBudget(3, 250, now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// a new window starts with the full budget
+	remaining, _, ok = chargeBudget(1, 60, now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.EqualValues(t, 40, remaining)
+}
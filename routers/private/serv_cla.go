@@ -0,0 +1,24 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"strings"
+
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// requiredCLA returns the name of the [repository.cla] entry of the repository and the URL of its CLA,
+// the entry of the repository taking precedence over the one of its owner
+func requiredCLA(ownerName, repoName string) (name, url string) {
+	name = strings.ToLower(ownerName + "/" + repoName)
+	if url, has := setting.Repository.CLAs[name]; has {
+		return name, url
+	}
+	name = strings.ToLower(ownerName)
+	if url, has := setting.Repository.CLAs[name]; has {
+		return name, url
+	}
+	return "", ""
+}
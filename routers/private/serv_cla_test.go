@@ -0,0 +1,36 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequiredCLA(t *testing.T) {
+	oldCLAs := setting.Repository.CLAs
+	defer func() {
+		setting.Repository.CLAs = oldCLAs
+	}()
+	setting.Repository.CLAs = map[string]string{
+		"user2":       "https://example.com/cla",
+		"user2/repo1": "https://example.com/repo1-cla",
+	}
+
+	name, url := requiredCLA("User2", "Repo1")
+	assert.Equal(t, "user2/repo1", name)
+	assert.Equal(t, "https://example.com/repo1-cla", url)
+
+	// the other repositories of the owner share its CLA
+	name, url = requiredCLA("user2", "repo2")
+	assert.Equal(t, "user2", name)
+	assert.Equal(t, "https://example.com/cla", url)
+
+	name, url = requiredCLA("user3", "repo3")
+	assert.Empty(t, name)
+	assert.Empty(t, url)
+}
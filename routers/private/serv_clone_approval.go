@@ -0,0 +1,111 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// cloneApprovalLease is how long a clone approval request stays pending, and how long an approval stays usable
+const cloneApprovalLease = time.Hour
+
+type cloneApproval struct {
+	id       string
+	repoID   int64
+	keyID    int64
+	approved bool
+	expires  time.Time
+}
+
+// cloneApprovals holds the clone approval requests, keyed by request ID
+var cloneApprovals = struct {
+	sync.Mutex
+	requests map[string]*cloneApproval
+}{
+	requests: map[string]*cloneApproval{},
+}
+
+// requestCloneApproval returns the approval request of the key to read the repository, creating it with id if there is none.
+// An approved request is used up, so every read needs its own approval.
+func requestCloneApproval(repoID, keyID int64, id string) (request cloneApproval, created bool) {
+	cloneApprovals.Lock()
+	defer cloneApprovals.Unlock()
+
+	now := time.Now()
+	for requestID, pending := range cloneApprovals.requests {
+		if !now.Before(pending.expires) {
+			delete(cloneApprovals.requests, requestID)
+		}
+	}
+
+	for requestID, pending := range cloneApprovals.requests {
+		if pending.repoID == repoID && pending.keyID == keyID {
+			if pending.approved {
+				delete(cloneApprovals.requests, requestID)
+			}
+			return *pending, false
+		}
+	}
+
+	request = cloneApproval{id: id, repoID: repoID, keyID: keyID, expires: now.Add(cloneApprovalLease)}
+	cloneApprovals.requests[id] = &request
+	return request, true
+}
+
+// approveClone approves the pending clone approval request with the id, returning false if there is none
+func approveClone(id string) bool {
+	cloneApprovals.Lock()
+	defer cloneApprovals.Unlock()
+
+	request, has := cloneApprovals.requests[id]
+	if !has || !time.Now().Before(request.expires) {
+		return false
+	}
+	request.approved = true
+	request.expires = time.Now().Add(cloneApprovalLease)
+	return true
+}
+
+// ServCloneApproval requests the approval of a key to read a repository, or reports whether it has been approved
+func ServCloneApproval(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	keyID := ctx.FormInt64("keyid")
+
+	id, err := util.CryptoRandomString(12)
+	if err != nil {
+		log.Error("Unable to generate clone approval request ID: %v", err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	request, created := requestCloneApproval(repoID, keyID, id)
+	if created {
+		log.Warn("Clone approval request %s: %s wants to read %s with key %d, approve it with \"gitea manager approve-clone %s\"",
+			request.id, ctx.FormString("user"), ctx.FormString("repo"), keyID, request.id)
+	}
+	ctx.JSON(http.StatusOK, private.ServCloneApprovalResult{RequestID: request.id, Approved: request.approved})
+}
+
+// ApproveClone approves a pending clone approval request
+func ApproveClone(ctx *context.PrivateContext) {
+	id := ctx.Params(":id")
+	if !approveClone(id) {
+		ctx.JSON(http.StatusNotFound, private.Response{
+			UserMsg: fmt.Sprintf("There is no pending clone approval request %s", id),
+		})
+		return
+	}
+	log.Info("Clone approval request %s has been approved", id)
+	ctx.PlainText(http.StatusOK, "success")
+}
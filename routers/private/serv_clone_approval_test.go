@@ -0,0 +1,52 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloneApproval(t *testing.T) {
+	// the first read creates a pending request, later reads get the same one
+	request, created := requestCloneApproval(1, 10, "request-a")
+	assert.True(t, created)
+	assert.Equal(t, "request-a", request.id)
+	assert.False(t, request.approved)
+
+	request, created = requestCloneApproval(1, 10, "request-b")
+	assert.False(t, created)
+	assert.Equal(t, "request-a", request.id)
+	assert.False(t, request.approved)
+
+	// other keys and repositories need their own approval
+	request, created = requestCloneApproval(2, 10, "request-c")
+	assert.True(t, created)
+	assert.Equal(t, "request-c", request.id)
+	request, created = requestCloneApproval(1, 11, "request-d")
+	assert.True(t, created)
+	assert.Equal(t, "request-d", request.id)
+
+	// an approval is used up by the read it was given for
+	assert.False(t, approveClone("unknown"))
+	assert.True(t, approveClone("request-a"))
+	request, created = requestCloneApproval(1, 10, "request-e")
+	assert.False(t, created)
+	assert.True(t, request.approved)
+	request, created = requestCloneApproval(1, 10, "request-f")
+	assert.True(t, created)
+	assert.Equal(t, "request-f", request.id)
+	assert.False(t, request.approved)
+
+	// expired requests can't be approved any more
+	cloneApprovals.Lock()
+	cloneApprovals.requests["request-c"].expires = time.Now().Add(-time.Second)
+	cloneApprovals.Unlock()
+	assert.False(t, approveClone("request-c"))
+	request, created = requestCloneApproval(2, 10, "request-g")
+	assert.True(t, created)
+	assert.Equal(t, "request-g", request.id)
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/nosql"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/web"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// servEventQueueLength is how many events may wait to be published, further events are dropped
+const servEventQueueLength = 1000
+
+// servEvents holds the events waiting to be published to the [server] SSH_EVENT_STREAM
+var servEvents = struct {
+	once  sync.Once
+	queue chan *private.ServEvent
+}{
+	queue: make(chan *private.ServEvent, servEventQueueLength),
+}
+
+// publishServEvent adds the event to the Redis stream, it is replaced in tests
+var publishServEvent = func(ctx gocontext.Context, event *private.ServEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return nosql.GetManager().GetRedisClient(setting.SSH.EventStream).XAdd(ctx, &redis.XAddArgs{
+		Stream: setting.SSH.EventStreamName,
+		Values: map[string]interface{}{"event": string(data)},
+	}).Err()
+}
+
+// queueServEvent queues the event to be published in the background, returning false if the queue is full
+func queueServEvent(event *private.ServEvent) bool {
+	servEvents.once.Do(func() {
+		go runServEventPublisher(graceful.GetManager().ShutdownContext(), servEvents.queue)
+	})
+	return offerServEvent(servEvents.queue, event)
+}
+
+// offerServEvent adds the event to the queue unless it is full
+func offerServEvent(queue chan<- *private.ServEvent, event *private.ServEvent) bool {
+	select {
+	case queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+// runServEventPublisher publishes the events of the queue until ctx is done
+func runServEventPublisher(ctx gocontext.Context, queue <-chan *private.ServEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-queue:
+			if err := publishServEvent(ctx, event); err != nil {
+				log.Error("Unable to publish the SSH event of %s on %s to %s: %v", event.Verb, event.Repo, setting.SSH.EventStreamName, err)
+			}
+		}
+	}
+}
+
+// ServPublishEvent queues the outcome of an SSH operation to be published to the event stream
+func ServPublishEvent(ctx *context.PrivateContext) {
+	event := web.GetForm(ctx).(*private.ServEvent)
+	if setting.SSH.EventStream != "" && !queueServEvent(event) {
+		log.Warn("Dropped the SSH event of %s on %s, the event stream can't keep up", event.Verb, event.Repo)
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
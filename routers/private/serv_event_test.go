@@ -0,0 +1,55 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	gocontext "context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/private"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServEventPublisher(t *testing.T) {
+	oldPublish := publishServEvent
+	defer func() {
+		publishServEvent = oldPublish
+	}()
+	published := make(chan *private.ServEvent, 2)
+	publishServEvent = func(ctx gocontext.Context, event *private.ServEvent) error {
+		published <- event
+		if event.Outcome == "failure" {
+			return errors.New("stream unavailable")
+		}
+		return nil
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	queue := make(chan *private.ServEvent, 2)
+	go runServEventPublisher(ctx, queue)
+
+	// events of successful and failed operations are published alike, an error of the stream doesn't stop the publisher
+	failure := &private.ServEvent{Repo: "user2/repo1", User: "user2", Verb: "git-receive-pack", Outcome: "failure", ExitCode: 1}
+	success := &private.ServEvent{Repo: "user2/repo1", User: "user2", Verb: "git-upload-pack", Outcome: "success", BytesOut: 4}
+	for _, event := range []*private.ServEvent{failure, success} {
+		assert.True(t, offerServEvent(queue, event))
+		select {
+		case got := <-published:
+			assert.Equal(t, event, got)
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "event not published", event.Verb)
+		}
+	}
+}
+
+func TestOfferServEventFull(t *testing.T) {
+	// events are dropped rather than waiting for the stream
+	queue := make(chan *private.ServEvent, 1)
+	assert.True(t, offerServEvent(queue, &private.ServEvent{Verb: "git-upload-pack"}))
+	assert.False(t, offerServEvent(queue, &private.ServEvent{Verb: "git-upload-pack"}))
+}
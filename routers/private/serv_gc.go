@@ -0,0 +1,86 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	repo_service "code.gitea.io/gitea/services/repository"
+)
+
+// autoRepacks holds when git gc was last started on access and whether it still runs, keyed by repository ID
+var autoRepacks = struct {
+	sync.Mutex
+	started map[int64]time.Time
+	running map[int64]bool
+}{
+	started: map[int64]time.Time{},
+	running: map[int64]bool{},
+}
+
+// startAutoRepack returns true if git gc may be run on the repository now, and records that it runs.
+// It isn't run while it still runs, nor within [git] AUTO_REPACK_INTERVAL of the last run:
+// git gc keeps recent unreachable loose objects, so a repository may stay above the threshold.
+func startAutoRepack(repoID int64) bool {
+	autoRepacks.Lock()
+	defer autoRepacks.Unlock()
+
+	if autoRepacks.running[repoID] {
+		return false
+	}
+	now := time.Now()
+	if started, has := autoRepacks.started[repoID]; has && now.Sub(started) < setting.Git.AutoRepackInterval {
+		return false
+	}
+	autoRepacks.started[repoID] = now
+	autoRepacks.running[repoID] = true
+	return true
+}
+
+// finishAutoRepack records that git gc of the repository has finished
+func finishAutoRepack(repoID int64) {
+	autoRepacks.Lock()
+	defer autoRepacks.Unlock()
+
+	delete(autoRepacks.running, repoID)
+}
+
+// ServScheduleGC runs git gc on a repository with too many loose objects in the background
+func ServScheduleGC(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %d", repoID),
+			})
+			return
+		}
+		log.Error("Unable to get repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get repository %d: %v", repoID, err),
+		})
+		return
+	}
+
+	if startAutoRepack(repoID) {
+		log.Info("Running git gc on %-v, it has too many loose objects", repo)
+		go func() {
+			defer finishAutoRepack(repoID)
+			// the git args are set by config, they can be safe to be trusted
+			_ = repo_service.GitGcRepo(graceful.GetManager().ShutdownContext(), repo, time.Duration(setting.Git.Timeout.GC)*time.Second, git.ToTrustedCmdArgs(setting.Git.GCArgs))
+		}()
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
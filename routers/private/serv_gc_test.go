@@ -0,0 +1,77 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartAutoRepack(t *testing.T) {
+	oldAutoRepackInterval := setting.Git.AutoRepackInterval
+	defer func() {
+		setting.Git.AutoRepackInterval = oldAutoRepackInterval
+	}()
+	setting.Git.AutoRepackInterval = time.Hour
+
+	assert.True(t, startAutoRepack(1))
+	assert.True(t, startAutoRepack(2))
+	finishAutoRepack(2)
+
+	// git gc isn't run again on the same repository until the interval has passed
+	assert.False(t, startAutoRepack(2))
+	autoRepacks.Lock()
+	autoRepacks.started[2] = time.Now().Add(-time.Hour)
+	autoRepacks.Unlock()
+	assert.True(t, startAutoRepack(2))
+	finishAutoRepack(2)
+	assert.False(t, startAutoRepack(2))
+
+	// nor while it still runs, however long ago it was started
+	autoRepacks.Lock()
+	autoRepacks.started[1] = time.Now().Add(-2 * time.Hour)
+	autoRepacks.Unlock()
+	assert.False(t, startAutoRepack(1))
+	finishAutoRepack(1)
+	assert.True(t, startAutoRepack(1))
+	finishAutoRepack(1)
+
+	// without an interval only running ones are skipped
+	setting.Git.AutoRepackInterval = 0
+	assert.True(t, startAutoRepack(1))
+	assert.False(t, startAutoRepack(1))
+	finishAutoRepack(1)
+	assert.True(t, startAutoRepack(1))
+	finishAutoRepack(1)
+}
+
+func TestStartAutoRepackConcurrent(t *testing.T) {
+	oldAutoRepackInterval := setting.Git.AutoRepackInterval
+	defer func() {
+		setting.Git.AutoRepackInterval = oldAutoRepackInterval
+	}()
+	setting.Git.AutoRepackInterval = time.Hour
+
+	// of many simultaneous requests for one repository only one runs git gc
+	var started atomic.Int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if startAutoRepack(3) {
+				started.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, started.Load())
+	finishAutoRepack(3)
+}
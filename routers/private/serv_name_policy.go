@@ -0,0 +1,58 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"code.gitea.io/gitea/modules/process"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// namePolicyTimeout is how long the naming policy command may run
+const namePolicyTimeout = 10 * time.Second
+
+// checkNamePolicy runs the naming policy command on the name of a repository which a push would create, telling it about
+// the name through the environment, and returns the reason to reject the name if the command exits with a non-zero status.
+// The reason is the output of the command, if it printed any.
+func checkNamePolicy(ctx context.Context, command, ownerName, repoName string) (string, error) {
+	args, err := shellquote.Split(command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	ctx, _, finished := process.GetManager().AddContextTimeout(ctx, namePolicyTimeout, fmt.Sprintf("Naming policy check of %s/%s", ownerName, repoName))
+	defer finished()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	process.SetSysProcAttribute(cmd)
+	cmd.Env = append(os.Environ(),
+		"GITEA_REPO_OWNER="+ownerName,
+		"GITEA_REPO_NAME="+repoName,
+	)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "", nil
+	} else if !errors.As(err, &exitErr) || ctx.Err() != nil {
+		return "", fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	if userMsg := strings.TrimSpace(stdout.String()); userMsg != "" {
+		return userMsg, nil
+	}
+	return fmt.Sprintf("The repository name %s/%s doesn't follow the naming policy", ownerName, repoName), nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNamePolicy(t *testing.T) {
+	command := `sh -c 'case "$GITEA_REPO_OWNER/$GITEA_REPO_NAME" in org3/team-*) exit 0;; esac; echo "Repository names must start with team-"; exit 1'`
+
+	userMsg, err := checkNamePolicy(context.Background(), command, "org3", "team-infra")
+	assert.NoError(t, err)
+	assert.Empty(t, userMsg)
+
+	userMsg, err = checkNamePolicy(context.Background(), command, "org3", "infra")
+	assert.NoError(t, err)
+	assert.Equal(t, "Repository names must start with team-", userMsg)
+
+	// a rejection without output gets a generic message
+	userMsg, err = checkNamePolicy(context.Background(), "false", "org3", "infra")
+	assert.NoError(t, err)
+	assert.Equal(t, "The repository name org3/infra doesn't follow the naming policy", userMsg)
+
+	// a command which can't be run is an error rather than a rejection
+	_, err = checkNamePolicy(context.Background(), "/nonexistent/policy", "org3", "infra")
+	assert.Error(t, err)
+	_, err = checkNamePolicy(context.Background(), "", "org3", "infra")
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/private"
+)
+
+// servProtocolStat is the number of SSH operations of one kind by clients using a version of the git transport protocol
+type servProtocolStat struct {
+	Version string
+	Verb    string
+	Count   int64
+}
+
+// servProtocols counts the SSH operations per protocol version and verb since the start
+var servProtocols = struct {
+	sync.Mutex
+	counts map[[2]string]int64
+}{
+	counts: map[[2]string]int64{},
+}
+
+// servProtocolVerbs are the SSH operations whose protocol versions are counted
+var servProtocolVerbs = map[string]bool{
+	"git-upload-pack":    true,
+	"git-upload-archive": true,
+	"git-receive-pack":   true,
+}
+
+// servProtocolVersions are the versions of the git transport protocol which are counted,
+// so that the counts can't grow with whatever clients request
+var servProtocolVersions = map[string]bool{
+	"0": true,
+	"1": true,
+	"2": true,
+}
+
+// recordServProtocol counts an SSH operation of the verb using the protocol version
+func recordServProtocol(verb, version string) {
+	servProtocols.Lock()
+	defer servProtocols.Unlock()
+
+	servProtocols.counts[[2]string{version, verb}]++
+}
+
+// servProtocolStats returns the counts of the SSH operations sorted by protocol version and verb
+func servProtocolStats() []servProtocolStat {
+	servProtocols.Lock()
+	defer servProtocols.Unlock()
+
+	stats := make([]servProtocolStat, 0, len(servProtocols.counts))
+	for key, count := range servProtocols.counts {
+		stats = append(stats, servProtocolStat{Version: key[0], Verb: key[1], Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Version != stats[j].Version {
+			return stats[i].Version < stats[j].Version
+		}
+		return stats[i].Verb < stats[j].Verb
+	})
+	return stats
+}
+
+// ServRecordProtocol counts an SSH operation by a client using a version of the git transport protocol
+func ServRecordProtocol(ctx *context.PrivateContext) {
+	verb, version := ctx.FormString("verb"), ctx.FormString("version")
+	if !servProtocolVerbs[verb] || !servProtocolVersions[version] {
+		ctx.JSON(http.StatusBadRequest, private.Response{
+			UserMsg: fmt.Sprintf("Invalid operation %q or protocol version %q", verb, version),
+		})
+		return
+	}
+	recordServProtocol(verb, version)
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// ServProtocolStats shows the number of SSH operations per git transport protocol version and operation
+func ServProtocolStats(ctx *context.PrivateContext) {
+	stats := servProtocolStats()
+	if ctx.FormBool("json") {
+		ctx.JSON(http.StatusOK, stats)
+		return
+	}
+
+	sb := &strings.Builder{}
+	w := tabwriter.NewWriter(sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Protocol version\tOperation\tCount")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", stat.Version, stat.Verb, stat.Count)
+	}
+	_ = w.Flush()
+	ctx.PlainText(http.StatusOK, sb.String())
+}
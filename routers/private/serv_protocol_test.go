@@ -0,0 +1,30 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordServProtocol(t *testing.T) {
+	recordServProtocol("git-upload-pack", "2")
+	recordServProtocol("git-upload-pack", "2")
+	recordServProtocol("git-upload-pack", "0")
+	recordServProtocol("git-receive-pack", "0")
+
+	assert.Equal(t, []servProtocolStat{
+		{Version: "0", Verb: "git-receive-pack", Count: 1},
+		{Version: "0", Verb: "git-upload-pack", Count: 1},
+		{Version: "2", Verb: "git-upload-pack", Count: 2},
+	}, servProtocolStats())
+}
+
+func TestServProtocolKnownOnly(t *testing.T) {
+	assert.True(t, servProtocolVerbs["git-upload-pack"])
+	assert.False(t, servProtocolVerbs["git-annex-shell"])
+	assert.True(t, servProtocolVersions["2"])
+	assert.False(t, servProtocolVersions["3"])
+}
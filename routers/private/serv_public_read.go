@@ -0,0 +1,81 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// publicRead is a public repository and its owner as they were looked up for a read
+type publicRead struct {
+	owner   user_model.User
+	repo    repo_model.Repository
+	expires time.Time
+}
+
+// publicReads holds the public repositories read recently, keyed by their full name.
+// Only the lookups of the repository are reused, the key and the user reading it are always checked.
+// The entries are checked against the database when they are reused, see getPublicRead.
+var publicReads = struct {
+	sync.Mutex
+	results map[string]publicRead
+}{
+	results: map[string]publicRead{},
+}
+
+func publicReadKey(ownerName, repoName string) string {
+	return strings.ToLower(ownerName) + "/" + strings.ToLower(repoName)
+}
+
+// getPublicRead returns copies of the public repository and its owner as they were looked up for the last read,
+// unless that is more than [service] PUBLIC_READ_FAST_PATH_TTL ago. An entry is dropped as soon as the repository
+// or its owner has changed since, e.g. the repository was made private, scheduled for deletion or its settings were changed.
+func getPublicRead(ctx context.Context, ownerName, repoName string) (*user_model.User, *repo_model.Repository) {
+	key := publicReadKey(ownerName, repoName)
+	publicReads.Lock()
+	read, has := publicReads.results[key]
+	publicReads.Unlock()
+	if !has || !time.Now().Before(read.expires) {
+		return nil, nil
+	}
+
+	unchanged, err := repo_model.IsPublicRepositoryUnchanged(ctx, &read.repo, &read.owner)
+	if err != nil {
+		log.Error("Unable to check whether %s/%s has changed: %v", read.owner.Name, read.repo.Name, err)
+	}
+	if !unchanged {
+		publicReads.Lock()
+		if publicReads.results[key].expires == read.expires {
+			delete(publicReads.results, key)
+		}
+		publicReads.Unlock()
+		return nil, nil
+	}
+
+	owner, repo := read.owner, read.repo
+	repo.Owner = &owner
+	return &owner, &repo
+}
+
+// cachePublicRead records the public repository and its owner looked up for a read
+func cachePublicRead(owner *user_model.User, repo *repo_model.Repository) {
+	publicReads.Lock()
+	defer publicReads.Unlock()
+
+	now := time.Now()
+	for key, read := range publicReads.results {
+		if !now.Before(read.expires) {
+			delete(publicReads.results, key)
+		}
+	}
+	publicReads.results[publicReadKey(owner.Name, repo.Name)] = publicRead{owner: *owner, repo: *repo, expires: now.Add(setting.Service.PublicReadFastPathTTL)}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/models/db"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/structs"
+	"code.gitea.io/gitea/modules/timeutil"
+	repo_service "code.gitea.io/gitea/services/repository"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicReadCache(t *testing.T) {
+	unittest.PrepareTestEnv(t)
+
+	oldTTL := setting.Service.PublicReadFastPathTTL
+	defer func() {
+		setting.Service.PublicReadFastPathTTL = oldTTL
+	}()
+	setting.Service.PublicReadFastPathTTL = time.Minute
+
+	loadRepo := func(id int64) (*user_model.User, *repo_model.Repository) {
+		repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: id})
+		owner := unittest.AssertExistsAndLoadBean(t, &user_model.User{ID: repo.OwnerID})
+		return owner, repo
+	}
+
+	_, repo := getPublicRead(db.DefaultContext, "user2", "repo1")
+	assert.Nil(t, repo)
+
+	cachePublicRead(loadRepo(1))
+	owner, repo := getPublicRead(db.DefaultContext, "User2", "Repo1")
+	if assert.NotNil(t, repo) {
+		assert.EqualValues(t, 1, repo.ID)
+		assert.EqualValues(t, 2, owner.ID)
+		assert.Same(t, owner, repo.Owner)
+	}
+
+	// every read gets its own copy to fill in
+	repo.Description = "changed"
+	_, again := getPublicRead(db.DefaultContext, "user2", "repo1")
+	assert.Empty(t, again.Description)
+
+	// expired entries aren't reused
+	publicReads.Lock()
+	read := publicReads.results[publicReadKey("user2", "repo1")]
+	read.expires = time.Now().Add(-time.Second)
+	publicReads.results[publicReadKey("user2", "repo1")] = read
+	publicReads.Unlock()
+	_, repo = getPublicRead(db.DefaultContext, "user2", "repo1")
+	assert.Nil(t, repo)
+
+	cachePublicRead(loadRepo(4))
+	publicReads.Lock()
+	assert.NotContains(t, publicReads.results, publicReadKey("user2", "repo1"))
+	publicReads.Unlock()
+
+	// the repository is no longer reused once it has been made private within the TTL
+	_, repo = getPublicRead(db.DefaultContext, "user5", "repo4")
+	assert.NotNil(t, repo)
+	repo = unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 4})
+	repo.IsPrivate = true
+	assert.NoError(t, repo_service.UpdateRepository(db.DefaultContext, repo, true))
+	_, cached := getPublicRead(db.DefaultContext, "user5", "repo4")
+	assert.Nil(t, cached)
+	publicReads.Lock()
+	assert.NotContains(t, publicReads.results, publicReadKey("user5", "repo4"))
+	publicReads.Unlock()
+	repo.IsPrivate = false
+	assert.NoError(t, repo_service.UpdateRepository(db.DefaultContext, repo, true))
+
+	// nor once any of its settings have changed
+	cachePublicRead(loadRepo(4))
+	_, err := db.GetEngine(db.DefaultContext).ID(4).Cols("updated_unix").NoAutoTime().
+		Update(&repo_model.Repository{UpdatedUnix: timeutil.TimeStampNow() + 1})
+	assert.NoError(t, err)
+	_, cached = getPublicRead(db.DefaultContext, "user5", "repo4")
+	assert.Nil(t, cached)
+
+	// nor once its owner has been made private
+	cachePublicRead(loadRepo(4))
+	owner = unittest.AssertExistsAndLoadBean(t, &user_model.User{ID: 5})
+	owner.Visibility = structs.VisibleTypePrivate
+	assert.NoError(t, user_model.UpdateUserCols(db.DefaultContext, owner, "visibility"))
+	_, cached = getPublicRead(db.DefaultContext, "user5", "repo4")
+	assert.Nil(t, cached)
+
+	// a TTL of 0 doesn't reuse anything
+	setting.Service.PublicReadFastPathTTL = 0
+	cachePublicRead(loadRepo(1))
+	_, repo = getPublicRead(db.DefaultContext, "user2", "repo1")
+	assert.Nil(t, repo)
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/util"
+)
+
+type pushLock struct {
+	token   string
+	expires time.Time
+}
+
+// pushLocks holds the push locks of the repositories, keyed by repository ID
+var pushLocks = struct {
+	sync.Mutex
+	locks map[int64]pushLock
+}{
+	locks: map[int64]pushLock{},
+}
+
+// tryLockPush takes the push lock of the repository with the token if nobody else holds it
+func tryLockPush(repoID int64, token string) bool {
+	pushLocks.Lock()
+	defer pushLocks.Unlock()
+
+	if lock, has := pushLocks.locks[repoID]; has && time.Now().Before(lock.expires) {
+		return false
+	}
+	pushLocks.locks[repoID] = pushLock{token: token, expires: time.Now().Add(private.LockLease)}
+	return true
+}
+
+// renewPush extends the lease of the push lock of the repository if it is still held with the token
+func renewPush(repoID int64, token string) bool {
+	pushLocks.Lock()
+	defer pushLocks.Unlock()
+
+	lock, has := pushLocks.locks[repoID]
+	if !has || lock.token != token || !time.Now().Before(lock.expires) {
+		return false
+	}
+	lock.expires = time.Now().Add(private.LockLease)
+	pushLocks.locks[repoID] = lock
+	return true
+}
+
+// unlockPush releases the push lock of the repository if it is held with the token
+func unlockPush(repoID int64, token string) {
+	pushLocks.Lock()
+	defer pushLocks.Unlock()
+
+	if lock, has := pushLocks.locks[repoID]; has && lock.token == token {
+		delete(pushLocks.locks, repoID)
+	}
+}
+
+// ServPushLock takes the push lock of a repository
+func ServPushLock(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+
+	token, err := util.CryptoRandomString(32)
+	if err != nil {
+		log.Error("Unable to generate push lock token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	if !tryLockPush(repoID, token) {
+		ctx.JSON(http.StatusLocked, private.Response{
+			UserMsg: "Another push to this repository is in progress, please retry later",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, private.ServPushLockResult{Token: token})
+}
+
+// ServPushLockRenew extends the lease of the push lock of a repository
+func ServPushLockRenew(ctx *context.PrivateContext) {
+	if !renewPush(ctx.ParamsInt64(":repoid"), ctx.FormString("token")) {
+		ctx.JSON(http.StatusNotFound, private.Response{
+			Err: "The push lock is not held with this token",
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// ServPushUnlock releases the push lock of a repository
+func ServPushUnlock(ctx *context.PrivateContext) {
+	unlockPush(ctx.ParamsInt64(":repoid"), ctx.FormString("token"))
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushLock(t *testing.T) {
+	const repoID = 1
+
+	// only one of concurrent pushes to the same repository gets the lock
+	var locked atomic.Int32
+	wg := sync.WaitGroup{}
+	for _, token := range []string{"token-a", "token-b", "token-c"} {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			if tryLockPush(repoID, token) {
+				locked.Add(1)
+			}
+		}(token)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, locked.Load())
+
+	// other repositories are not affected
+	assert.True(t, tryLockPush(repoID+1, "token-other"))
+	unlockPush(repoID+1, "token-other")
+
+	// releasing needs the token the lock was taken with
+	var holder string
+	for _, token := range []string{"token-a", "token-b", "token-c"} {
+		if pushLocks.locks[repoID].token == token {
+			holder = token
+		}
+	}
+	unlockPush(repoID, "wrong-token")
+	assert.False(t, tryLockPush(repoID, "token-d"))
+	unlockPush(repoID, holder)
+	assert.True(t, tryLockPush(repoID, "token-d"))
+
+	// only the holder renews the lease, and only until it has expired
+	assert.False(t, renewPush(repoID, "token-e"))
+	assert.True(t, renewPush(repoID, "token-d"))
+	pushLocks.Lock()
+	pushLocks.locks[repoID] = pushLock{token: "token-d", expires: time.Now().Add(-time.Second)}
+	pushLocks.Unlock()
+	assert.False(t, renewPush(repoID, "token-d"))
+	assert.True(t, tryLockPush(repoID, "token-e"))
+	unlockPush(repoID, "token-e")
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// countedReads holds when a read of a repository by a user was last counted, keyed by repository and user ID
+var countedReads = struct {
+	sync.Mutex
+	counted map[[2]int64]time.Time
+}{
+	counted: map[[2]int64]time.Time{},
+}
+
+// shouldCountRead returns true if the read of the repository by the user is to be counted, and records that it is.
+// The reads of a user are only counted once within [service] TRACK_CLONES_INTERVAL, so hot repositories don't
+// cause a database write for every fetch.
+func shouldCountRead(repoID, userID int64) bool {
+	countedReads.Lock()
+	defer countedReads.Unlock()
+
+	now := time.Now()
+	for key, counted := range countedReads.counted {
+		if now.Sub(counted) >= setting.Service.TrackClonesInterval {
+			delete(countedReads.counted, key)
+		}
+	}
+	key := [2]int64{repoID, userID}
+	if _, has := countedReads.counted[key]; has {
+		return false
+	}
+	if setting.Service.TrackClonesInterval > 0 {
+		countedReads.counted[key] = now
+	}
+	return true
+}
+
+// ServRecordRead counts a clone or fetch of a repository over SSH
+func ServRecordRead(ctx *context.PrivateContext) {
+	repoID := ctx.ParamsInt64(":repoid")
+	if !shouldCountRead(repoID, ctx.FormInt64("user_id")) {
+		ctx.PlainText(http.StatusOK, "success")
+		return
+	}
+	if err := repo_model.IncrementReadCount(ctx, repoID, time.Now()); err != nil {
+		log.Error("Unable to count the read of repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to count the read of repository %d: %v", repoID, err),
+		})
+		return
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldCountRead(t *testing.T) {
+	oldInterval := setting.Service.TrackClonesInterval
+	defer func() {
+		setting.Service.TrackClonesInterval = oldInterval
+	}()
+	setting.Service.TrackClonesInterval = time.Hour
+
+	// the reads of a user are counted once per repository within the interval
+	assert.True(t, shouldCountRead(1, 2))
+	assert.False(t, shouldCountRead(1, 2))
+	assert.True(t, shouldCountRead(1, 3))
+	assert.True(t, shouldCountRead(2, 2))
+	assert.False(t, shouldCountRead(2, 2))
+
+	countedReads.Lock()
+	countedReads.counted[[2]int64{1, 2}] = time.Now().Add(-time.Hour)
+	countedReads.Unlock()
+	assert.True(t, shouldCountRead(1, 2))
+	assert.False(t, shouldCountRead(1, 2))
+
+	// without an interval every read is counted
+	setting.Service.TrackClonesInterval = 0
+	assert.True(t, shouldCountRead(1, 2))
+	assert.True(t, shouldCountRead(1, 2))
+	countedReads.Lock()
+	assert.Empty(t, countedReads.counted)
+	countedReads.Unlock()
+}
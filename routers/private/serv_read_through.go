@@ -0,0 +1,54 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	repo_service "code.gitea.io/gitea/services/repository"
+)
+
+// ServReadThrough fetches a repository which is missing or out of date on a read-through cache node from the origin
+func ServReadThrough(ctx *context.PrivateContext) {
+	if !setting.CacheService.GitReadThrough.Enabled {
+		ctx.JSON(http.StatusForbidden, private.Response{
+			UserMsg: "The read-through cache is disabled",
+		})
+		return
+	}
+
+	repoID := ctx.ParamsInt64(":repoid")
+	repo, err := repo_model.GetRepositoryByID(ctx, repoID)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository %d", repoID),
+			})
+			return
+		}
+		log.Error("Unable to get repository %d: %v", repoID, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: err.Error(),
+		})
+		return
+	}
+
+	hit, err := repo_service.ReadThrough(ctx, repo, ctx.FormBool("wiki"), ctx.FormStrings("key"))
+	if err != nil {
+		log.Error("Unable to fetch %-v from the origin: %v", repo, err)
+		ctx.JSON(http.StatusBadGateway, private.Response{
+			Err:     err.Error(),
+			UserMsg: "Unable to fetch the repository from the origin server, please retry later",
+		})
+		return
+	}
+	log.Trace("Read-through of %-v, hit: %t", repo, hit)
+	ctx.JSON(http.StatusOK, private.ServReadThroughResult{Hit: hit})
+}
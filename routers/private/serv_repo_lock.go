@@ -0,0 +1,98 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	repo_module "code.gitea.io/gitea/modules/repository"
+)
+
+// getRepoToLock returns the repository given as owner/repo in the "repo" form value,
+// if nil is returned the error has been written
+func getRepoToLock(ctx *context.PrivateContext) *repo_model.Repository {
+	repoName := ctx.FormString("repo")
+	ownerName, name, _ := strings.Cut(repoName, "/")
+	if ownerName == "" || name == "" {
+		ctx.JSON(http.StatusBadRequest, private.Response{
+			UserMsg: fmt.Sprintf("Invalid repository %q, it must be given as owner/repo", repoName),
+		})
+		return nil
+	}
+	repo, err := repo_model.GetRepositoryByOwnerAndName(ctx, ownerName, name)
+	if err != nil {
+		if repo_model.IsErrRepoNotExist(err) {
+			ctx.JSON(http.StatusNotFound, private.Response{
+				UserMsg: fmt.Sprintf("Cannot find repository: %s", repoName),
+			})
+			return nil
+		}
+		log.Error("Unable to get repository: %s Error: %v", repoName, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to get repository: %s %v", repoName, err),
+		})
+		return nil
+	}
+	return repo
+}
+
+// LockRepo locks a repository for operations over SSH
+func LockRepo(ctx *context.PrivateContext) {
+	scope := ctx.FormString("scope")
+	if scope != private.RepoLockWrite && scope != private.RepoLockAll {
+		ctx.JSON(http.StatusBadRequest, private.Response{
+			UserMsg: fmt.Sprintf("Invalid lock scope %q, it must be %q or %q", scope, private.RepoLockWrite, private.RepoLockAll),
+		})
+		return
+	}
+	repo := getRepoToLock(ctx)
+	if repo == nil {
+		return
+	}
+
+	until, err := repo_module.LockRepo(ctx, repo.ID, scope, time.Duration(ctx.FormInt64("duration")))
+	if err != nil {
+		log.Error("Unable to lock %-v: %v", repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to lock %s: %v", repo.FullName(), err),
+		})
+		return
+	}
+	log.Info("Repository %s is locked for %s operations over SSH until %v", repo.FullName(), scope, until)
+	ctx.JSON(http.StatusOK, private.Response{
+		UserMsg: fmt.Sprintf("Repository %s is locked for %s operations over SSH until %s", repo.FullName(), scope, until.Format(time.RFC3339)),
+	})
+}
+
+// UnlockRepo unlocks a repository locked with LockRepo
+func UnlockRepo(ctx *context.PrivateContext) {
+	repo := getRepoToLock(ctx)
+	if repo == nil {
+		return
+	}
+
+	unlocked, err := repo_module.UnlockRepo(ctx, repo.ID)
+	if err != nil {
+		log.Error("Unable to unlock %-v: %v", repo, err)
+		ctx.JSON(http.StatusInternalServerError, private.Response{
+			Err: fmt.Sprintf("Unable to unlock %s: %v", repo.FullName(), err),
+		})
+		return
+	}
+	if !unlocked {
+		ctx.JSON(http.StatusNotFound, private.Response{
+			UserMsg: fmt.Sprintf("Repository %s is not locked", repo.FullName()),
+		})
+		return
+	}
+	log.Info("Repository %s is unlocked", repo.FullName())
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,24 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"net/http"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/web"
+	"code.gitea.io/gitea/services/sshstatus"
+)
+
+// ServStreamStatus records the state of an ongoing SSH operation for the administrators to monitor
+func ServStreamStatus(ctx *context.PrivateContext) {
+	status := web.GetForm(ctx).(*private.ServStatus)
+	if setting.SSH.LiveStatus {
+		sshstatus.Update(status, time.Now())
+	}
+	ctx.PlainText(http.StatusOK, "success")
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/web"
+)
+
+type servUsageID struct {
+	repoID int64
+	verb   string
+}
+
+// servUsageStat is the resource usage of the SSH operations of one kind on a repository
+type servUsageStat struct {
+	RepoID     int64
+	Repo       string `json:",omitempty"`
+	Verb       string
+	Count      int64
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64 // the largest of the operations, in bytes
+}
+
+// maxServUsageStats is how many repositories and operations the resource usage is aggregated for at most
+const maxServUsageStats = 10000
+
+// servUsage aggregates the resource usage of the SSH operations since the start
+var servUsage = struct {
+	sync.Mutex
+	stats map[servUsageID]*servUsageStat
+}{
+	stats: map[servUsageID]*servUsageStat{},
+}
+
+// recordServUsage adds the resource usage of an SSH operation on the repository to the aggregates.
+// Once there are maxServUsageStats of them, the one that used the least CPU time makes room for a new one.
+func recordServUsage(repoID int64, usage *private.ServUsage) {
+	servUsage.Lock()
+	defer servUsage.Unlock()
+
+	id := servUsageID{repoID: repoID, verb: usage.Verb}
+	stat, has := servUsage.stats[id]
+	if !has {
+		if len(servUsage.stats) >= maxServUsageStats {
+			evictServUsage()
+		}
+		stat = &servUsageStat{RepoID: repoID, Verb: usage.Verb}
+		servUsage.stats[id] = stat
+	}
+	stat.Count++
+	stat.UserTime += usage.UserTime
+	stat.SystemTime += usage.SystemTime
+	if usage.MaxRSS > stat.MaxRSS {
+		stat.MaxRSS = usage.MaxRSS
+	}
+}
+
+// evictServUsage drops the aggregate that used the least CPU time, servUsage must be locked
+func evictServUsage() {
+	var leastID servUsageID
+	var least time.Duration = -1
+	for id, stat := range servUsage.stats {
+		if total := stat.UserTime + stat.SystemTime; least < 0 || total < least {
+			leastID, least = id, total
+		}
+	}
+	delete(servUsage.stats, leastID)
+}
+
+// servUsageStats returns the aggregated resource usage, the most CPU time consuming first
+func servUsageStats() []servUsageStat {
+	servUsage.Lock()
+	defer servUsage.Unlock()
+
+	stats := make([]servUsageStat, 0, len(servUsage.stats))
+	for _, stat := range servUsage.stats {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		ti, tj := stats[i].UserTime+stats[i].SystemTime, stats[j].UserTime+stats[j].SystemTime
+		if ti != tj {
+			return ti > tj
+		}
+		if stats[i].RepoID != stats[j].RepoID {
+			return stats[i].RepoID < stats[j].RepoID
+		}
+		return stats[i].Verb < stats[j].Verb
+	})
+	return stats
+}
+
+// ServRecordUsage records the resource usage of an SSH operation on a repository
+func ServRecordUsage(ctx *context.PrivateContext) {
+	recordServUsage(ctx.ParamsInt64(":repoid"), web.GetForm(ctx).(*private.ServUsage))
+	ctx.PlainText(http.StatusOK, "success")
+}
+
+// ServUsageStats shows the resource usage of the SSH operations per repository and operation
+func ServUsageStats(ctx *context.PrivateContext) {
+	stats := servUsageStats()
+	for i := range stats {
+		if repo, err := repo_model.GetRepositoryByID(ctx, stats[i].RepoID); err == nil {
+			stats[i].Repo = repo.FullName()
+		}
+	}
+
+	if ctx.FormBool("json") {
+		ctx.JSON(http.StatusOK, stats)
+		return
+	}
+
+	sb := &strings.Builder{}
+	w := tabwriter.NewWriter(sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Repository\tOperation\tCount\tUser CPU\tSystem CPU\tMax RSS")
+	for _, stat := range stats {
+		repo := stat.Repo
+		if repo == "" {
+			repo = fmt.Sprintf("#%d", stat.RepoID)
+		}
+		maxRSS := "-"
+		if stat.MaxRSS > 0 {
+			maxRSS = base.FileSize(stat.MaxRSS)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%v\t%s\n", repo, stat.Verb, stat.Count, stat.UserTime, stat.SystemTime, maxRSS)
+	}
+	_ = w.Flush()
+	ctx.PlainText(http.StatusOK, sb.String())
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package private
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/private"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordServUsage(t *testing.T) {
+	recordServUsage(1, &private.ServUsage{Verb: "git-upload-pack", UserTime: time.Second, SystemTime: time.Second, MaxRSS: 100})
+	recordServUsage(1, &private.ServUsage{Verb: "git-upload-pack", UserTime: 2 * time.Second, MaxRSS: 50})
+	recordServUsage(1, &private.ServUsage{Verb: "git-receive-pack", UserTime: time.Millisecond})
+	recordServUsage(2, &private.ServUsage{Verb: "git-upload-pack", UserTime: time.Second, SystemTime: 3 * time.Second, MaxRSS: 200})
+
+	assert.Equal(t, []servUsageStat{
+		{RepoID: 1, Verb: "git-upload-pack", Count: 2, UserTime: 3 * time.Second, SystemTime: time.Second, MaxRSS: 100},
+		{RepoID: 2, Verb: "git-upload-pack", Count: 1, UserTime: time.Second, SystemTime: 3 * time.Second, MaxRSS: 200},
+		{RepoID: 1, Verb: "git-receive-pack", Count: 1, UserTime: time.Millisecond},
+	}, servUsageStats())
+
+	// the aggregates are capped, the least CPU time consuming makes room
+	servUsage.Lock()
+	for i := int64(0); len(servUsage.stats) < maxServUsageStats; i++ {
+		servUsage.stats[servUsageID{repoID: 100 + i, verb: "git-upload-pack"}] = &servUsageStat{RepoID: 100 + i, Verb: "git-upload-pack", UserTime: time.Second}
+	}
+	servUsage.Unlock()
+	recordServUsage(3, &private.ServUsage{Verb: "git-upload-pack", UserTime: time.Minute})
+	stats := servUsageStats()
+	assert.Len(t, stats, maxServUsageStats)
+	assert.Equal(t, servUsageStat{RepoID: 3, Verb: "git-upload-pack", Count: 1, UserTime: time.Minute}, stats[0])
+	for _, stat := range stats {
+		assert.NotEqual(t, "git-receive-pack", stat.Verb)
+	}
+}
@@ -21,11 +21,12 @@ import (
 )
 
 const (
-	tplDashboard   base.TplName = "admin/dashboard"
-	tplCron        base.TplName = "admin/cron"
-	tplQueue       base.TplName = "admin/queue"
-	tplStacktrace  base.TplName = "admin/stacktrace"
-	tplQueueManage base.TplName = "admin/queue_manage"
+	tplDashboard     base.TplName = "admin/dashboard"
+	tplCron          base.TplName = "admin/cron"
+	tplQueue         base.TplName = "admin/queue"
+	tplStacktrace    base.TplName = "admin/stacktrace"
+	tplQueueManage   base.TplName = "admin/queue_manage"
+	tplSSHOperations base.TplName = "admin/ssh_operations"
 )
 
 var sysStatus struct {
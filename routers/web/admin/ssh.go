@@ -0,0 +1,22 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/services/sshstatus"
+)
+
+// SSHOperations shows the ongoing SSH operations
+func SSHOperations(ctx *context.Context) {
+	ctx.Data["Title"] = ctx.Tr("admin.monitor.ssh")
+	ctx.Data["PageIsAdminMonitorSSH"] = true
+	ctx.Data["LiveStatusEnabled"] = setting.SSH.LiveStatus
+	ctx.Data["Operations"] = sshstatus.Operations(time.Now())
+	ctx.HTML(http.StatusOK, tplSSHOperations)
+}
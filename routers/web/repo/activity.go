@@ -8,9 +8,11 @@ import (
 	"time"
 
 	activities_model "code.gitea.io/gitea/models/activities"
+	repo_model "code.gitea.io/gitea/models/repo"
 	"code.gitea.io/gitea/models/unit"
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/setting"
 )
 
 const (
@@ -65,6 +67,13 @@ func Activity(ctx *context.Context) {
 		return
 	}
 
+	if setting.Service.TrackClones && ctx.Repo.CanRead(unit.TypeCode) {
+		if ctx.Data["ReadCount"], err = repo_model.CountReads(ctx, ctx.Repo.Repository.ID, timeFrom); err != nil {
+			ctx.ServerError("CountReads", err)
+			return
+		}
+	}
+
 	ctx.HTML(http.StatusOK, tplActivity)
 }
 
@@ -9,6 +9,8 @@ import (
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
 	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/models/perm"
+	user_model "code.gitea.io/gitea/models/user"
 	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/setting"
@@ -168,7 +170,11 @@ func KeysPost(ctx *context.Context) {
 			return
 		}
 
-		if _, err = asymkey_model.AddPublicKey(ctx.Doer.ID, form.Title, content, 0); err != nil {
+		mode := perm.AccessModeWrite
+		if form.ReadOnly {
+			mode = perm.AccessModeRead
+		}
+		if _, err = asymkey_model.AddPublicKey(ctx.Doer.ID, form.Title, content, 0, mode); err != nil {
 			ctx.Data["HasSSHError"] = true
 			switch {
 			case asymkey_model.IsErrKeyAlreadyExist(err):
@@ -191,6 +197,23 @@ func KeysPost(ctx *context.Context) {
 		}
 		ctx.Flash.Success(ctx.Tr("settings.add_key_success", form.Title))
 		ctx.Redirect(setting.AppSubURL + "/user/settings/keys")
+	case "ssh_read_only":
+		var err error
+		if form.ReadOnly {
+			err = user_model.SetUserSetting(ctx.Doer.ID, user_model.SettingsKeySSHReadOnly, "true")
+		} else {
+			err = user_model.DeleteUserSetting(ctx.Doer.ID, user_model.SettingsKeySSHReadOnly)
+		}
+		if err != nil {
+			ctx.ServerError("SetUserSetting", err)
+			return
+		}
+		if form.ReadOnly {
+			ctx.Flash.Success(ctx.Tr("settings.ssh_account_read_only_enabled"))
+		} else {
+			ctx.Flash.Success(ctx.Tr("settings.ssh_account_read_only_disabled"))
+		}
+		ctx.Redirect(setting.AppSubURL + "/user/settings/keys")
 	case "verify_ssh":
 		token := asymkey_model.VerificationToken(ctx.Doer, 1)
 		lastToken := asymkey_model.VerificationToken(ctx.Doer, 0)
@@ -261,6 +284,9 @@ func DeleteKey(ctx *context.Context) {
 	})
 }
 
+// keyActivityHistorySize is how many of the latest operations of each SSH key are shown
+const keyActivityHistorySize = 10
+
 func loadKeysData(ctx *context.Context) {
 	keys, err := asymkey_model.ListPublicKeys(ctx.Doer.ID, db.ListOptions{})
 	if err != nil {
@@ -276,6 +302,26 @@ func loadKeysData(ctx *context.Context) {
 	}
 	ctx.Data["ExternalKeys"] = externalKeys
 
+	sshReadOnly, err := user_model.GetUserSetting(ctx.Doer.ID, user_model.SettingsKeySSHReadOnly)
+	if err != nil {
+		ctx.ServerError("GetUserSetting", err)
+		return
+	}
+	ctx.Data["SSHReadOnly"] = sshReadOnly == "true"
+
+	if setting.SSH.KeyActivityHistory {
+		keyIDs := make([]int64, 0, len(keys))
+		for _, key := range keys {
+			keyIDs = append(keyIDs, key.ID)
+		}
+		keyActivities, err := asymkey_model.GetPublicKeyActivities(ctx, keyIDs, keyActivityHistorySize)
+		if err != nil {
+			ctx.ServerError("GetPublicKeyActivities", err)
+			return
+		}
+		ctx.Data["KeyActivities"] = keyActivities
+	}
+
 	gpgkeys, err := asymkey_model.ListGPGKeys(ctx, ctx.Doer.ID, db.ListOptions{})
 	if err != nil {
 		ctx.ServerError("ListGPGKeys", err)
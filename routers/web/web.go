@@ -227,6 +227,13 @@ func registerRoutes(m *web.Route) {
 		}
 	}
 
+	annexEnabled := func(ctx *context.Context) {
+		if !setting.Annex.Enabled {
+			ctx.Error(http.StatusNotFound)
+			return
+		}
+	}
+
 	federationEnabled := func(ctx *context.Context) {
 		if !setting.Federation.Enabled {
 			ctx.Error(http.StatusNotFound)
@@ -557,6 +564,7 @@ func registerRoutes(m *web.Route) {
 				m.Post("/remove-all-items", admin.QueueRemoveAllItems)
 			})
 			m.Get("/diagnosis", admin.MonitorDiagnosis)
+			m.Get("/ssh", admin.SSHOperations)
 		})
 
 		m.Group("/users", func() {
@@ -1367,6 +1375,16 @@ func registerRoutes(m *web.Route) {
 				})
 			}, ignSignInAndCsrf, lfsServerEnabled)
 
+			m.Group("", func() {
+				m.Get("/config", lfs.AnnexConfigHandler)
+				m.Group("/annex/objects/{hash1}/{hash2}/{key}", func() {
+					m.Get("/{filename}", lfs.AnnexDownloadHandler)
+					m.Head("/{filename}", lfs.AnnexDownloadHandler)
+					m.Put("/{filename}", lfs.AnnexUploadHandler)
+				})
+				m.RouteMethods("/annex-p2phttp/git-annex/*", "GET, POST", lfs.AnnexP2PHTTPHandler)
+			}, ignSignInAndCsrf, annexEnabled, repo.HTTPGitEnabledHandler)
+
 			m.Group("", func() {
 				m.PostOptions("/git-upload-pack", repo.ServiceUploadPack)
 				m.PostOptions("/git-receive-pack", repo.ServiceReceivePack)
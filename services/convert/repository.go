@@ -164,6 +164,7 @@ func innerToRepo(ctx context.Context, repo *repo_model.Repository, mode perm.Acc
 		Empty:                         repo.IsEmpty,
 		Archived:                      repo.IsArchived,
 		Size:                          int(repo.Size / 1024),
+		AnnexSize:                     int(repo.AnnexSize / 1024),
 		Fork:                          repo.IsFork,
 		Parent:                        parent,
 		Mirror:                        repo.IsMirror,
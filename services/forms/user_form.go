@@ -356,6 +356,7 @@ type AddKeyForm struct {
 	KeyID       string `binding:"OmitEmpty"`
 	Fingerprint string `binding:"OmitEmpty"`
 	IsWritable  bool
+	ReadOnly    bool
 }
 
 // Validate validates the fields
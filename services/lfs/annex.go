@@ -0,0 +1,355 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package lfs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	access_model "code.gitea.io/gitea/models/perm/access"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/context"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/private"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// The annex handlers serve the git-annex objects of a repository at the paths git-annex uses for remotes with an https URL,
+// so that "git annex get" works with them. Content can be stored with a PUT to the same paths.
+// With [annex] P2PHTTP the repository config points git-annex to the P2P protocol over HTTP instead,
+// which it can also store and drop content with, e.g. "git annex copy --to origin".
+// They authenticate like the LFS handlers and make the same checks as git-annex-shell over SSH.
+
+// getAnnexKey returns the key of the requested object, writing a NotFound status if the path isn't one of a key
+func getAnnexKey(ctx *context.Context) string {
+	key := ctx.Params("key")
+	if !annex.IsValidKey(key) || ctx.Params("filename") != key {
+		writeStatus(ctx, http.StatusNotFound)
+		return ""
+	}
+	return key
+}
+
+// assertAnnexRepoUnlocked returns true if an administrator hasn't locked the repository for the operation,
+// if false is returned the Locked status has been written
+func assertAnnexRepoUnlocked(ctx *context.Context, repository *repo_model.Repository, write bool) bool {
+	lock, err := repo_module.GetRepoLock(ctx, repository.ID)
+	if err != nil {
+		log.Error("Unable to get the lock of %-v: %v", repository, err)
+		writeStatus(ctx, http.StatusInternalServerError)
+		return false
+	}
+	if lock == private.RepoLockAll || (lock == private.RepoLockWrite && write) {
+		writeStatusMessage(ctx, http.StatusLocked, "Repository is temporarily locked by an administrator, please retry later")
+		return false
+	}
+	return true
+}
+
+// annexKeyLockLease is how long the handlers hold the lock of a key at most, they release it themselves when they are done
+const annexKeyLockLease = time.Hour
+
+// lockAnnexKey takes the lock of the key shared with other transfers, so that it isn't dropped meanwhile,
+// or exclusively to drop it. If nil is returned the Locked status has been written.
+func lockAnnexKey(ctx *context.Context, repository *repo_model.Repository, key string, exclusive bool) func() {
+	token, err := util.CryptoRandomString(32)
+	if err != nil {
+		log.Error("Unable to generate git-annex key lock token: %v", err)
+		writeStatus(ctx, http.StatusInternalServerError)
+		return nil
+	}
+	if !annex.TryLockKey(repository.ID, key, token, exclusive, annexKeyLockLease) {
+		if exclusive {
+			writeStatusMessage(ctx, http.StatusLocked, "The git-annex content is being transferred by someone else, please retry later")
+		} else {
+			writeStatusMessage(ctx, http.StatusLocked, "The git-annex content is being dropped by someone else, please retry later")
+		}
+		return nil
+	}
+	return func() {
+		annex.UnlockKey(repository.ID, key, token)
+	}
+}
+
+// assertAnnexUploadAllowed returns true if the content of the key may be stored in the repository within the limits
+// that apply over SSH, if false is returned the status telling why not has been written
+func assertAnnexUploadAllowed(ctx *context.Context, repository *repo_model.Repository, key string) bool {
+	if repository.IsArchived {
+		writeStatusMessage(ctx, http.StatusForbidden, "Repository is archived")
+		return false
+	}
+	size, hasSize := annex.KeySize(key)
+	if !hasSize {
+		size = ctx.Req.ContentLength
+	}
+	if setting.Annex.MaxFileSize > 0 && size > setting.Annex.MaxFileSize {
+		writeStatusMessage(ctx, http.StatusRequestEntityTooLarge, fmt.Sprintf("Content of %d bytes exceeds the limit of %d bytes", size, setting.Annex.MaxFileSize))
+		return false
+	}
+	if !assertDiskBelowHighWatermark(ctx) {
+		return false
+	}
+	if !annex.IsInitialized(ctx, repository.RepoPath()) {
+		writeStatusMessage(ctx, http.StatusConflict, "git-annex isn't initialized in the repository, push the git-annex branch first")
+		return false
+	}
+	if setting.Annex.MaxObjectCount > 0 {
+		count, err := annex.ObjectCount(repository.RepoPath())
+		if err != nil {
+			log.Error("Unable to count the git-annex objects of %-v: %v", repository, err)
+			writeStatus(ctx, http.StatusInternalServerError)
+			return false
+		}
+		if count >= setting.Annex.MaxObjectCount {
+			writeStatusMessage(ctx, http.StatusForbidden, fmt.Sprintf("This repository has reached its limit of %d git-annex objects", setting.Annex.MaxObjectCount))
+			return false
+		}
+	}
+	return true
+}
+
+// AnnexConfigHandler serves the git-annex UUID of the repository in the format of a git config,
+// git-annex reads it from remotes with an https URL to tell them apart
+func AnnexConfigHandler(ctx *context.Context) {
+	repository := getAuthenticatedRepository(ctx, getRequestContext(ctx), false)
+	if repository == nil {
+		return
+	}
+
+	uuid, _, err := git.NewCommand(ctx, "config", "--get", "annex.uuid").RunStdString(&git.RunOpts{Dir: repository.RepoPath()})
+	if err != nil || strings.TrimSpace(uuid) == "" {
+		writeStatus(ctx, http.StatusNotFound)
+		return
+	}
+	config := fmt.Sprintf("[annex]\n\tuuid = %s\n", strings.TrimSpace(uuid))
+	if setting.Annex.P2PHTTP {
+		// git-annex uses the P2P protocol over HTTP at annex.url of a remote with an https URL
+		config += fmt.Sprintf("\turl = annex+%s\n", annexP2PHTTPURL(repository))
+	}
+	ctx.PlainText(http.StatusOK, config)
+}
+
+// AnnexDownloadHandler serves the content of a git-annex key
+func AnnexDownloadHandler(ctx *context.Context) {
+	rc := getRequestContext(ctx)
+	key := getAnnexKey(ctx)
+	if key == "" {
+		return
+	}
+
+	repository := getAuthenticatedRepository(ctx, rc, false)
+	if repository == nil || !assertAnnexRepoUnlocked(ctx, repository, false) {
+		return
+	}
+	unlock := lockAnnexKey(ctx, repository, key, false)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	if !fetchAnnexKey(ctx, repository, key) {
+		return
+	}
+	content, err := os.Open(annex.KeyPath(repository.RepoPath(), key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Unable to open the content of git-annex key %s in %-v: %v", key, repository, err)
+		}
+		writeStatus(ctx, http.StatusNotFound)
+		return
+	}
+	defer content.Close()
+	fi, err := content.Stat()
+	if err != nil {
+		log.Error("Unable to stat the content of git-annex key %s in %-v: %v", key, repository, err)
+		writeStatus(ctx, http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Resp.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(ctx.Resp, ctx.Req, key, fi.ModTime(), content)
+}
+
+// AnnexUploadHandler stores the content of a git-annex key, which has to match the size and checksum the key records
+func AnnexUploadHandler(ctx *context.Context) {
+	rc := getRequestContext(ctx)
+	key := getAnnexKey(ctx)
+	if key == "" {
+		return
+	}
+	defer ctx.Req.Body.Close()
+
+	repository := getAuthenticatedRepository(ctx, rc, true)
+	if repository == nil || !assertAnnexRepoUnlocked(ctx, repository, true) {
+		return
+	}
+	if !assertAnnexUploadAllowed(ctx, repository, key) {
+		return
+	}
+	unlock := lockAnnexKey(ctx, repository, key, false)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+
+	if err := annex.PutContent(ctx, repository.RepoPath(), key, ctx.Req.Body, setting.Annex.MaxFileSize); err != nil {
+		switch {
+		case errors.Is(err, annex.ErrContentMismatch):
+			log.Warn("Upload of git-annex key %s to %-v doesn't match the key: %v", key, repository, err)
+			writeStatusMessage(ctx, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, annex.ErrContentTooLarge):
+			writeStatusMessage(ctx, http.StatusRequestEntityTooLarge, err.Error())
+		default:
+			log.Error("Unable to store the content of git-annex key %s in %-v: %v", key, repository, err)
+			writeStatus(ctx, http.StatusInternalServerError)
+		}
+		return
+	}
+	if setting.Annex.Storage != nil {
+		if err := annex.SaveToStorage(repository.ID, repository.RepoPath(), key); err != nil {
+			log.Error("Unable to save the content of git-annex key %s of %-v to the object storage: %v", key, repository, err)
+			writeStatus(ctx, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := repo_module.UpdateRepoSize(ctx, repository); err != nil {
+		log.Error("Unable to update the size of %-v: %v", repository, err)
+	}
+	if setting.Annex.TrackKeys {
+		trackAnnexKey(ctx, repository, key)
+	}
+
+	writeStatus(ctx, http.StatusOK)
+}
+
+// annexP2PHTTPURL returns the URL of the P2P protocol over HTTP of the repository, git-annex adds "/<uuid>/v<version>/<op>" to it
+func annexP2PHTTPURL(repository *repo_model.Repository) string {
+	return repository.HTMLURL() + ".git/annex-p2phttp/git-annex"
+}
+
+// AnnexP2PHTTPHandler passes requests of the git-annex P2P protocol over HTTP on to "git annex p2phttp" in the repository,
+// after checking them like git-annex-shell over SSH does
+func AnnexP2PHTTPHandler(ctx *context.Context) {
+	if !setting.Annex.P2PHTTP {
+		writeStatus(ctx, http.StatusNotFound)
+		return
+	}
+	rc := getRequestContext(ctx)
+	request, ok := annex.ParseP2PHTTPRequest(ctx.Params("*"), ctx.Req.URL.Query())
+	if !ok {
+		writeStatus(ctx, http.StatusNotFound)
+		return
+	}
+
+	repository := getAuthenticatedRepository(ctx, rc, request.IsWrite())
+	if repository == nil || !assertAnnexRepoUnlocked(ctx, repository, request.IsWrite()) {
+		return
+	}
+	switch {
+	case request.IsRemove():
+		if repository.IsArchived {
+			writeStatusMessage(ctx, http.StatusForbidden, "Repository is archived")
+			return
+		}
+		if setting.Annex.ProtectDropkey {
+			perm, err := access_model.GetUserRepoPermission(ctx, repository, ctx.Doer)
+			if err != nil {
+				log.Error("Unable to GetUserRepoPermission for user %-v in repo %-v Error: %v", ctx.Doer, repository, err)
+				writeStatus(ctx, http.StatusInternalServerError)
+				return
+			}
+			if !perm.IsAdmin() {
+				writeStatusMessage(ctx, http.StatusForbidden, "Only repository administrators may drop git-annex content")
+				return
+			}
+		}
+	case request.IsWrite():
+		if !assertAnnexUploadAllowed(ctx, repository, request.Key) {
+			return
+		}
+	}
+	if request.Key != "" {
+		unlock := lockAnnexKey(ctx, repository, request.Key, request.IsRemove())
+		if unlock == nil {
+			return
+		}
+		defer unlock()
+	}
+	if request.Op == "get" && !fetchAnnexKey(ctx, repository, request.Key) {
+		return
+	}
+
+	req := ctx.Req.Clone(ctx)
+	req.URL.Path = "/git-annex/" + ctx.Params("*")
+	req.URL.RawPath = ""
+	if err := annex.ServeP2PHTTP(ctx.Resp, req, repository.RepoPath(), setting.Annex.P2PHTTPIdleTimeout); err != nil {
+		log.Error("Unable to serve git-annex P2P protocol over HTTP for %-v: %v", repository, err)
+		writeStatus(ctx, http.StatusServiceUnavailable)
+		return
+	}
+	if !request.IsWrite() {
+		return
+	}
+
+	if err := repo_module.UpdateRepoSize(ctx, repository); err != nil {
+		log.Error("Unable to update the size of %-v: %v", repository, err)
+	}
+	if setting.Annex.TrackKeys {
+		trackAnnexKey(ctx, repository, request.Key)
+	}
+	if setting.Annex.Storage != nil {
+		syncAnnexStorageKey(repository, request.Key)
+	}
+}
+
+// fetchAnnexKey copies the content of the key from the [annex] object storage into the repository before it is served,
+// if the repository doesn't have it. If false is returned the error has been written.
+func fetchAnnexKey(ctx *context.Context, repository *repo_model.Repository, key string) bool {
+	if setting.Annex.Storage == nil {
+		return true
+	}
+	if _, err := annex.FetchFromStorage(ctx, repository.ID, repository.RepoPath(), key); err != nil {
+		log.Error("Unable to fetch the content of git-annex key %s of %-v from the object storage: %v", key, repository, err)
+		writeStatus(ctx, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// syncAnnexStorageKey saves the content of the key to the [annex] object storage if the repository has it after a
+// request of the P2P protocol over HTTP, or deletes it from there if it doesn't. The response has been sent already,
+// so failures are only logged.
+func syncAnnexStorageKey(repository *repo_model.Repository, key string) {
+	if err := annex.SaveToStorage(repository.ID, repository.RepoPath(), key); err != nil {
+		log.Error("Unable to save the content of git-annex key %s of %-v to the object storage: %v", key, repository, err)
+	}
+	if err := annex.DeleteFromStorage(repository.ID, repository.RepoPath(), key); err != nil {
+		log.Error("Unable to delete the content of git-annex key %s of %-v from the object storage: %v", key, repository, err)
+	}
+}
+
+// trackAnnexKey records whether the repository stores the content of the key after it may have changed
+func trackAnnexKey(ctx *context.Context, repository *repo_model.Repository, key string) {
+	if _, err := os.Stat(annex.KeyPath(repository.RepoPath(), key)); err == nil {
+		size, has := annex.KeySize(key)
+		if !has {
+			size = -1
+		}
+		if _, err := repo_model.RecordAnnexKey(ctx, repository.ID, key, size); err != nil {
+			log.Error("Unable to record git-annex key %s of %-v: %v", key, repository, err)
+		}
+	} else if os.IsNotExist(err) {
+		if err := repo_model.ForgetAnnexKey(ctx, repository.ID, key); err != nil {
+			log.Error("Unable to forget git-annex key %s of %-v: %v", key, repository, err)
+		}
+	}
+}
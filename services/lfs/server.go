@@ -24,12 +24,14 @@ import (
 	repo_model "code.gitea.io/gitea/models/repo"
 	"code.gitea.io/gitea/models/unit"
 	user_model "code.gitea.io/gitea/models/user"
+	"code.gitea.io/gitea/modules/base"
 	"code.gitea.io/gitea/modules/context"
 	"code.gitea.io/gitea/modules/json"
 	lfs_module "code.gitea.io/gitea/modules/lfs"
 	"code.gitea.io/gitea/modules/log"
 	"code.gitea.io/gitea/modules/setting"
 	"code.gitea.io/gitea/modules/storage"
+	"code.gitea.io/gitea/modules/util"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/minio/sha256-simd"
@@ -42,6 +44,24 @@ type requestContext struct {
 	Authorization string
 }
 
+// The operations of LFS tokens, the Op of their Claims
+const (
+	// TokenOpDownload is the operation of tokens which may only read
+	TokenOpDownload = "download"
+	// TokenOpUpload is the operation of tokens which may upload objects and create and delete locks
+	TokenOpUpload = "upload"
+	// TokenOpLock is the operation of tokens which may create and delete locks but not upload objects
+	TokenOpLock = "lock"
+)
+
+var (
+	// objectWriteOps are the operations of the tokens which may write objects
+	objectWriteOps = []string{TokenOpUpload}
+	// lockWriteOps are the operations of the tokens which may write locks,
+	// git-lfs verifies the locks of a push with the token it got for uploading
+	lockWriteOps = []string{TokenOpUpload, TokenOpLock}
+)
+
 // Claims is a JWT Token Claims
 type Claims struct {
 	RepoID int64
@@ -179,6 +199,18 @@ func BatchHandler(ctx *context.Context) {
 
 	contentStore := lfs_module.NewContentStore()
 
+	// the objects new to the repository count towards its quota
+	quota, hasQuota := lfs_module.RepoQuota(repository.OwnerName, repository.Name)
+	var quotaUsed int64
+	if isUpload && hasQuota {
+		var err error
+		if quotaUsed, err = git_model.GetRepoLFSSize(ctx, repository.ID); err != nil {
+			log.Error("Unable to get the size of the LFS objects of %-v: %v", repository, err)
+			writeStatus(ctx, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	var responseObjects []*lfs_module.ObjectResponse
 
 	for _, p := range br.Objects {
@@ -222,7 +254,18 @@ func BatchHandler(ctx *context.Context) {
 				}
 			}
 
-			if exists && meta == nil {
+			if err == nil && meta == nil && hasQuota {
+				if quotaUsed+p.Size > quota {
+					err = &lfs_module.ObjectError{
+						Code:    http.StatusUnprocessableEntity,
+						Message: lfsQuotaMessage(repository, quotaUsed, quota),
+					}
+				} else {
+					quotaUsed += p.Size
+				}
+			}
+
+			if err == nil && exists && meta == nil {
 				accessible, err := git_model.LFSObjectAccessible(ctx, ctx.Doer, p.Oid)
 				if err != nil {
 					log.Error("Unable to check if LFS MetaObject [%s] is accessible. Error: %v", p.Oid, err)
@@ -266,6 +309,32 @@ func BatchHandler(ctx *context.Context) {
 	}
 }
 
+// assertDiskBelowHighWatermark returns true if the usage of the filesystem of the repositories doesn't exceed
+// [repository] DISK_HIGH_WATERMARK, if false is returned the InsufficientStorage status has been written
+func assertDiskBelowHighWatermark(ctx *context.Context) bool {
+	if setting.Repository.DiskHighWatermark <= 0 {
+		return true
+	}
+	usage, err := util.DiskUsagePercent(setting.RepoRootPath)
+	if err != nil {
+		// the check only protects the server, failing to do it mustn't stop the writes
+		log.Warn("Unable to get the storage usage of %s: %v", setting.RepoRootPath, err)
+		return true
+	}
+	if usage > float64(setting.Repository.DiskHighWatermark) {
+		writeStatusMessage(ctx, http.StatusInsufficientStorage, "Server storage is nearly full, writes temporarily disabled")
+		return false
+	}
+	return true
+}
+
+// lfsQuotaMessage returns the reason to refuse new LFS objects in the repository,
+// whose LFS objects take used bytes of its quota in [repository.lfs_quota]
+func lfsQuotaMessage(repository *repo_model.Repository, used, quota int64) string {
+	return fmt.Sprintf("LFS quota exceeded: the LFS objects of %s take %s of its quota of %s, please remove unused LFS objects before uploading more",
+		repository.FullName(), base.FileSize(used), base.FileSize(quota))
+}
+
 // UploadHandler receives data from the client and puts it into the content store
 func UploadHandler(ctx *context.Context) {
 	rc := getRequestContext(ctx)
@@ -283,10 +352,29 @@ func UploadHandler(ctx *context.Context) {
 	}
 
 	repository := getAuthenticatedRepository(ctx, rc, true)
-	if repository == nil {
+	if repository == nil || !assertDiskBelowHighWatermark(ctx) {
 		return
 	}
 
+	if quota, has := lfs_module.RepoQuota(repository.OwnerName, repository.Name); has {
+		if _, err := git_model.GetLFSMetaObjectByOid(ctx, repository.ID, p.Oid); err == git_model.ErrLFSObjectNotExist {
+			used, err := git_model.GetRepoLFSSize(ctx, repository.ID)
+			if err != nil {
+				log.Error("Unable to get the size of the LFS objects of %-v: %v", repository, err)
+				writeStatus(ctx, http.StatusInternalServerError)
+				return
+			}
+			if used+p.Size > quota {
+				writeStatusMessage(ctx, http.StatusRequestEntityTooLarge, lfsQuotaMessage(repository, used, quota))
+				return
+			}
+		} else if err != nil {
+			log.Error("Unable to get LFS MetaObject [%s] for %-v. Error: %v", p.Oid, repository, err)
+			writeStatus(ctx, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	contentStore := lfs_module.NewContentStore()
 	exists, err := contentStore.Exists(p)
 	if err != nil {
@@ -418,7 +506,7 @@ func getAuthenticatedRepository(ctx *context.Context, rc *requestContext, requir
 		return nil
 	}
 
-	if !authenticate(ctx, repository, rc.Authorization, false, requireWrite) {
+	if !authenticate(ctx, repository, rc.Authorization, false, requireWrite, objectWriteOps) {
 		requireAuth(ctx)
 		return nil
 	}
@@ -496,7 +584,8 @@ func writeStatusMessage(ctx *context.Context, status int, message string) {
 
 // authenticate uses the authorization string to determine whether
 // or not to proceed. This server assumes an HTTP Basic auth format.
-func authenticate(ctx *context.Context, repository *repo_model.Repository, authorization string, requireSigned, requireWrite bool) bool {
+// A write with an LFS token requires the token to have one of writeOps.
+func authenticate(ctx *context.Context, repository *repo_model.Repository, authorization string, requireSigned, requireWrite bool, writeOps []string) bool {
 	accessMode := perm.AccessModeRead
 	if requireWrite {
 		accessMode = perm.AccessModeWrite
@@ -531,7 +620,7 @@ func authenticate(ctx *context.Context, repository *repo_model.Repository, autho
 		return true
 	}
 
-	user, err := parseToken(ctx, authorization, repository, accessMode)
+	user, err := parseToken(ctx, authorization, repository, accessMode, writeOps)
 	if err != nil {
 		// Most of these are Warn level - the true internal server errors are logged in parseToken already
 		log.Warn("Authentication failure for provided token with Error: %v", err)
@@ -541,9 +630,9 @@ func authenticate(ctx *context.Context, repository *repo_model.Repository, autho
 	return true
 }
 
-func handleLFSToken(ctx stdCtx.Context, tokenSHA string, target *repo_model.Repository, mode perm.AccessMode) (*user_model.User, error) {
+func handleLFSToken(ctx stdCtx.Context, tokenSHA string, target *repo_model.Repository, mode perm.AccessMode, writeOps []string) (*user_model.User, error) {
 	if !strings.Contains(tokenSHA, ".") {
-		return nil, nil
+		return nil, fmt.Errorf("invalid token")
 	}
 	token, err := jwt.ParseWithClaims(tokenSHA, &Claims{}, func(t *jwt.Token) (interface{}, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -552,7 +641,7 @@ func handleLFSToken(ctx stdCtx.Context, tokenSHA string, target *repo_model.Repo
 		return setting.LFS.JWTSecretBytes, nil
 	})
 	if err != nil {
-		return nil, nil
+		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
 	claims, claimsOk := token.Claims.(*Claims)
@@ -564,7 +653,7 @@ func handleLFSToken(ctx stdCtx.Context, tokenSHA string, target *repo_model.Repo
 		return nil, fmt.Errorf("invalid token claim")
 	}
 
-	if mode == perm.AccessModeWrite && claims.Op != "upload" {
+	if mode == perm.AccessModeWrite && !util.SliceContainsString(writeOps, claims.Op) {
 		return nil, fmt.Errorf("invalid token claim")
 	}
 
@@ -576,7 +665,7 @@ func handleLFSToken(ctx stdCtx.Context, tokenSHA string, target *repo_model.Repo
 	return u, nil
 }
 
-func parseToken(ctx stdCtx.Context, authorization string, target *repo_model.Repository, mode perm.AccessMode) (*user_model.User, error) {
+func parseToken(ctx stdCtx.Context, authorization string, target *repo_model.Repository, mode perm.AccessMode, writeOps []string) (*user_model.User, error) {
 	if authorization == "" {
 		return nil, fmt.Errorf("no token")
 	}
@@ -590,7 +679,7 @@ func parseToken(ctx stdCtx.Context, authorization string, target *repo_model.Rep
 	case "bearer":
 		fallthrough
 	case "token":
-		return handleLFSToken(ctx, tokenSHA, target, mode)
+		return handleLFSToken(ctx, tokenSHA, target, mode, writeOps)
 	}
 	return nil, fmt.Errorf("token not found")
 }
@@ -55,6 +55,13 @@ func GitFsckRepo(ctx context.Context, repo *repo_model.Repository, timeout time.
 		if err = system_model.CreateRepositoryNotice("Failed to health check repository (%s): %v", repo.FullName(), err); err != nil {
 			log.Error("CreateRepositoryNotice: %v", err)
 		}
+		if err = repo_module.MarkUnhealthy(repoPath, err.Error()); err != nil {
+			log.Error("Unable to mark %-v as unhealthy: %v", repo, err)
+		}
+		return nil
+	}
+	if err := repo_module.MarkHealthy(repoPath); err != nil {
+		log.Error("Unable to mark %-v as healthy: %v", repo, err)
 	}
 	return nil
 }
@@ -0,0 +1,91 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/git"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/sync"
+	"code.gitea.io/gitea/modules/util"
+)
+
+// readThroughPool makes concurrent reads of the same repository wait for a single fetch from the origin
+var readThroughPool = sync.NewExclusivePool()
+
+// readThroughOriginURL returns the URL the repository, or its wiki, is fetched from by a read-through cache node
+func readThroughOriginURL(repo *repo_model.Repository, isWiki bool) string {
+	name := repo.OwnerName + "/" + repo.Name
+	if isWiki {
+		name += ".wiki"
+	}
+	return setting.CacheService.GitReadThrough.OriginURL + name + ".git"
+}
+
+// ReadThrough makes sure that the repository, or its wiki, is present and up to date in the repository storage
+// of a read-through cache node, and that it holds the content of the git-annex keys.
+// Missing repositories are cloned from [cache.git_read_through] ORIGIN_URL, repositories fetched longer than ITEM_TTL ago
+// are fetched again, and missing git-annex content is copied from the origin.
+// It returns true if everything was present already.
+func ReadThrough(ctx context.Context, repo *repo_model.Repository, isWiki bool, keys []string) (bool, error) {
+	repoPath := repo.RepoPath()
+	if isWiki {
+		repoPath = repo.WikiPath()
+	}
+	originURL := readThroughOriginURL(repo, isWiki)
+
+	readThroughPool.CheckIn(repoPath)
+	defer readThroughPool.CheckOut(repoPath)
+
+	hit := true
+	if _, err := os.Stat(repoPath); errors.Is(err, os.ErrNotExist) {
+		hit = false
+		if err := git.Clone(ctx, originURL, repoPath, git.CloneRepoOptions{
+			Mirror:  true,
+			Quiet:   true,
+			Timeout: time.Duration(setting.Git.Timeout.Clone) * time.Second,
+		}); err != nil {
+			return false, fmt.Errorf("clone %s: %w", util.SanitizeCredentialURLs(originURL), err)
+		}
+	} else if err != nil {
+		return false, err
+	} else if repo_module.IsReadThroughMiss(repoPath) {
+		hit = false
+		if _, _, err := git.NewCommand(ctx, "fetch", "--prune", "--quiet", "origin").RunStdString(&git.RunOpts{
+			Dir:     repoPath,
+			Timeout: time.Duration(setting.Git.Timeout.Pull) * time.Second,
+		}); err != nil {
+			return false, fmt.Errorf("fetch %s: %w", util.SanitizeCredentialURLs(originURL), err)
+		}
+	}
+	if !hit {
+		if err := repo_module.MarkReadThroughFetched(repoPath); err != nil {
+			return false, err
+		}
+	}
+
+	for _, key := range keys {
+		if annex.HasContent(ctx, repoPath, key) {
+			continue
+		}
+		hit = false
+		if !annex.IsInitialized(ctx, repoPath) {
+			if err := annex.Init(ctx, repoPath); err != nil {
+				return false, fmt.Errorf("annex init: %w", err)
+			}
+		}
+		if err := annex.Get(ctx, repoPath, key, "origin"); err != nil {
+			return false, fmt.Errorf("annex get %s from %s: %w", key, util.SanitizeCredentialURLs(originURL), err)
+		}
+	}
+	return hit, nil
+}
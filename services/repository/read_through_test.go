@@ -0,0 +1,65 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+	"code.gitea.io/gitea/modules/git"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadThrough(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	// the fixture repositories play the origin, the cache node starts out empty
+	oldRepoRootPath, oldReadThrough := setting.RepoRootPath, setting.CacheService.GitReadThrough
+	defer func() {
+		setting.RepoRootPath, setting.CacheService.GitReadThrough = oldRepoRootPath, oldReadThrough
+	}()
+	setting.CacheService.GitReadThrough.Enabled = true
+	setting.CacheService.GitReadThrough.OriginURL = "file://" + filepath.ToSlash(setting.RepoRootPath) + "/"
+	setting.CacheService.GitReadThrough.TTL = time.Hour
+	setting.RepoRootPath = t.TempDir()
+
+	repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 1})
+	assert.True(t, repo_module.IsReadThroughMiss(repo.RepoPath()))
+
+	// a miss clones the repository from the origin
+	hit, err := ReadThrough(git.DefaultContext, repo, false, nil)
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	assert.False(t, repo_module.IsReadThroughMiss(repo.RepoPath()))
+	gitRepo, err := git.OpenRepository(git.DefaultContext, repo.RepoPath())
+	assert.NoError(t, err)
+	assert.True(t, gitRepo.IsBranchExist("master"))
+	gitRepo.Close()
+
+	// then the local copy is used
+	hit, err = ReadThrough(git.DefaultContext, repo, false, nil)
+	assert.NoError(t, err)
+	assert.True(t, hit)
+
+	// until it is older than the TTL and fetched again
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(repo.RepoPath(), repo_module.ReadThroughMarker), old, old))
+	assert.True(t, repo_module.IsReadThroughMiss(repo.RepoPath()))
+	hit, err = ReadThrough(git.DefaultContext, repo, false, nil)
+	assert.NoError(t, err)
+	assert.False(t, hit)
+	assert.False(t, repo_module.IsReadThroughMiss(repo.RepoPath()))
+
+	// repositories missing on the origin can't be read
+	missing := &repo_model.Repository{ID: 1000, OwnerName: "user2", Name: "missing"}
+	_, err = ReadThrough(git.DefaultContext, missing, false, nil)
+	assert.Error(t, err)
+}
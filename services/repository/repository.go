@@ -52,6 +52,13 @@ func CreateRepository(ctx context.Context, doer, owner *user_model.User, opts re
 
 // DeleteRepository deletes a repository for a user or organization.
 func DeleteRepository(ctx context.Context, doer *user_model.User, repo *repo_model.Repository, notify bool) error {
+	// Refuse any further access over SSH while the pull requests are closed and the webhooks are sent
+	oldStatus := repo.Status
+	repo.Status = repo_model.RepositoryPendingDeletion
+	if err := repo_model.UpdateRepositoryCols(ctx, repo, "status"); err != nil {
+		return err
+	}
+
 	if err := pull_service.CloseRepoBranchesPulls(ctx, doer, repo); err != nil {
 		log.Error("CloseRepoBranchesPulls failed: %v", err)
 	}
@@ -62,24 +69,37 @@ func DeleteRepository(ctx context.Context, doer *user_model.User, repo *repo_mod
 	}
 
 	if err := models.DeleteRepository(doer, repo.OwnerID, repo.ID); err != nil {
+		repo.Status = oldStatus
+		if err := repo_model.UpdateRepositoryCols(ctx, repo, "status"); err != nil {
+			log.Error("Unable to restore the status of %-v after its deletion failed: %v", repo, err)
+		}
 		return err
 	}
 
 	return packages_model.UnlinkRepositoryFromAllPackages(ctx, repo.ID)
 }
 
+// CheckPushCreateRepo returns an error if authUser may not create a repository of owner by pushing to it
+func CheckPushCreateRepo(ctx context.Context, authUser, owner *user_model.User) error {
+	if authUser.IsAdmin {
+		return nil
+	}
+	if owner.IsOrganization() {
+		if ok, err := organization.CanCreateOrgRepo(ctx, owner.ID, authUser.ID); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("cannot push-create repository for org")
+		}
+	} else if authUser.ID != owner.ID {
+		return fmt.Errorf("cannot push-create repository for another user")
+	}
+	return nil
+}
+
 // PushCreateRepo creates a repository when a new repository is pushed to an appropriate namespace
 func PushCreateRepo(ctx context.Context, authUser, owner *user_model.User, repoName string) (*repo_model.Repository, error) {
-	if !authUser.IsAdmin {
-		if owner.IsOrganization() {
-			if ok, err := organization.CanCreateOrgRepo(ctx, owner.ID, authUser.ID); err != nil {
-				return nil, err
-			} else if !ok {
-				return nil, fmt.Errorf("cannot push-create repository for org")
-			}
-		} else if authUser.ID != owner.ID {
-			return nil, fmt.Errorf("cannot push-create repository for another user")
-		}
+	if err := CheckPushCreateRepo(ctx, authUser, owner); err != nil {
+		return nil, err
 	}
 
 	repo, err := CreateRepository(ctx, authUser, owner, repo_module.CreateRepoOptions{
@@ -0,0 +1,70 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package sshstatus keeps the state of the ongoing SSH operations sent by serv when [server] SSH_LIVE_STATUS is enabled
+package sshstatus
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+)
+
+// staleIntervals is after how many intervals without progress an operation is dropped,
+// serv may have been killed before it could send the end of the operation
+const staleIntervals = 3
+
+// Operation is an ongoing SSH operation
+type Operation struct {
+	private.ServStatus
+	Started time.Time
+	Updated time.Time
+}
+
+var operations = struct {
+	sync.Mutex
+	m map[string]*Operation
+}{
+	m: map[string]*Operation{},
+}
+
+// Update records the status of an operation received at now, the operation is forgotten once it is done
+func Update(status *private.ServStatus, now time.Time) {
+	operations.Lock()
+	defer operations.Unlock()
+
+	if status.Event == private.ServStatusDone {
+		delete(operations.m, status.ID)
+		return
+	}
+	op, has := operations.m[status.ID]
+	if !has {
+		// the start may have got lost, so the first event seen starts the operation
+		op = &Operation{Started: now}
+		operations.m[status.ID] = op
+	}
+	op.ServStatus = *status
+	op.Updated = now
+}
+
+// Operations returns the ongoing operations at now, the oldest first
+func Operations(now time.Time) []Operation {
+	operations.Lock()
+	defer operations.Unlock()
+
+	ops := make([]Operation, 0, len(operations.m))
+	for id, op := range operations.m {
+		if now.Sub(op.Updated) > staleIntervals*setting.SSH.LiveStatusInterval {
+			delete(operations.m, id)
+			continue
+		}
+		ops = append(ops, *op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
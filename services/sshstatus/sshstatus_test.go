@@ -0,0 +1,46 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package sshstatus
+
+import (
+	"testing"
+	"time"
+
+	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperations(t *testing.T) {
+	oldInterval := setting.SSH.LiveStatusInterval
+	defer func() {
+		setting.SSH.LiveStatusInterval = oldInterval
+	}()
+	setting.SSH.LiveStatusInterval = 5 * time.Second
+
+	now := time.Now()
+	Update(&private.ServStatus{ID: "clone", Event: private.ServStatusStart, Repo: "user2/repo1", Verb: "git-upload-pack"}, now)
+	Update(&private.ServStatus{ID: "annex", Event: private.ServStatusProgress, Repo: "user2/repo2", Verb: "git-annex-shell recvkey", BytesIn: 1024}, now.Add(time.Second))
+	Update(&private.ServStatus{ID: "clone", Event: private.ServStatusProgress, Repo: "user2/repo1", Verb: "git-upload-pack", BytesOut: 2048}, now.Add(5*time.Second))
+
+	ops := Operations(now.Add(5 * time.Second))
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, "clone", ops[0].ID)
+		assert.EqualValues(t, 2048, ops[0].BytesOut)
+		assert.Equal(t, now, ops[0].Started)
+		assert.Equal(t, "annex", ops[1].ID)
+		assert.EqualValues(t, 1024, ops[1].BytesIn)
+	}
+
+	// done operations are forgotten
+	Update(&private.ServStatus{ID: "clone", Event: private.ServStatusDone}, now.Add(6*time.Second))
+	ops = Operations(now.Add(6 * time.Second))
+	if assert.Len(t, ops, 1) {
+		assert.Equal(t, "annex", ops[0].ID)
+	}
+
+	// so are operations which stopped sending their progress
+	assert.Empty(t, Operations(now.Add(time.Minute)))
+}
@@ -151,6 +151,13 @@ func deleteUser(ctx context.Context, u *user_model.User, purge bool) (err error)
 	// ***** END: Branch Protections *****
 
 	// ***** START: PublicKey *****
+	var keyIDs []int64
+	if err = db.GetEngine(ctx).Table("public_key").Where("owner_id = ?", u.ID).Cols("id").Find(&keyIDs); err != nil {
+		return fmt.Errorf("find public key ids: %w", err)
+	}
+	if err = asymkey_model.DeletePublicKeyActivities(ctx, keyIDs...); err != nil {
+		return fmt.Errorf("deletePublicKeyActivities: %w", err)
+	}
 	if _, err = db.DeleteByBean(ctx, &asymkey_model.PublicKey{OwnerID: u.ID}); err != nil {
 		return fmt.Errorf("deletePublicKeys: %w", err)
 	}
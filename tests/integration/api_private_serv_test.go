@@ -5,12 +5,24 @@ package integration
 
 import (
 	"context"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	asymkey_model "code.gitea.io/gitea/models/asymkey"
+	auth_model "code.gitea.io/gitea/models/auth"
+	"code.gitea.io/gitea/models/db"
+	git_model "code.gitea.io/gitea/models/git"
 	"code.gitea.io/gitea/models/perm"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+	user_model "code.gitea.io/gitea/models/user"
 	"code.gitea.io/gitea/modules/private"
+	"code.gitea.io/gitea/modules/setting"
+	repo_service "code.gitea.io/gitea/services/repository"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,21 +31,31 @@ func TestAPIPrivateNoServ(t *testing.T) {
 	onGiteaRun(t, func(*testing.T, *url.URL) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		key, user, err := private.ServNoCommand(ctx, 1)
+		keyAndOwner, err := private.ServNoCommand(ctx, 1)
 		assert.NoError(t, err)
-		assert.Equal(t, int64(2), user.ID)
-		assert.Equal(t, "user2", user.Name)
-		assert.Equal(t, int64(1), key.ID)
-		assert.Equal(t, "user2@localhost", key.Name)
+		assert.Equal(t, int64(2), keyAndOwner.Owner.ID)
+		assert.Equal(t, "user2", keyAndOwner.Owner.Name)
+		assert.Equal(t, int64(1), keyAndOwner.Key.ID)
+		assert.Equal(t, "user2@localhost", keyAndOwner.Key.Name)
+		assert.Empty(t, keyAndOwner.RepoCloneURL)
 
 		deployKey, err := asymkey_model.AddDeployKey(1, "test-deploy", "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGXEEzWmm1dxb+57RoK5KVCL0w2eNv9cqJX2AGGVlkFsVDhOXHzsadS3LTK4VlEbbrDMJdoti9yM8vclA8IeRacAAAAEc3NoOg== nocomment", false)
 		assert.NoError(t, err)
 
-		key, user, err = private.ServNoCommand(ctx, deployKey.KeyID)
+		keyAndOwner, err = private.ServNoCommand(ctx, deployKey.KeyID)
 		assert.NoError(t, err)
-		assert.Empty(t, user)
-		assert.Equal(t, deployKey.KeyID, key.ID)
-		assert.Equal(t, "test-deploy", key.Name)
+		assert.Empty(t, keyAndOwner.Owner)
+		assert.Equal(t, deployKey.KeyID, keyAndOwner.Key.ID)
+		assert.Equal(t, "test-deploy", keyAndOwner.Key.Name)
+		// the key is only bound to user2/repo1
+		assert.Equal(t, repo_model.ComposeSSHCloneURL("user2", "repo1"), keyAndOwner.RepoCloneURL)
+
+		// a key bound to several repositories could be used for any of them
+		_, err = asymkey_model.AddDeployKey(2, "test-deploy", "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGXEEzWmm1dxb+57RoK5KVCL0w2eNv9cqJX2AGGVlkFsVDhOXHzsadS3LTK4VlEbbrDMJdoti9yM8vclA8IeRacAAAAEc3NoOg== nocomment", false)
+		assert.NoError(t, err)
+		keyAndOwner, err = private.ServNoCommand(ctx, deployKey.KeyID)
+		assert.NoError(t, err)
+		assert.Empty(t, keyAndOwner.RepoCloneURL)
 	})
 }
 
@@ -54,6 +76,10 @@ func TestAPIPrivateServ(t *testing.T) {
 		assert.Equal(t, "user2", results.OwnerName)
 		assert.Equal(t, "repo1", results.RepoName)
 		assert.Equal(t, int64(1), results.RepoID)
+		assert.False(t, results.RepoIsPrivate)
+		assert.True(t, results.UserEmailVerified)
+		assert.False(t, results.IsPrincipal)
+		assert.True(t, results.RepoAdmin)
 
 		// Cannot push to a private repo we're not associated with
 		results, extra = private.ServCommand(ctx, 1, "user15", "big_test_private_1", perm.AccessModeWrite, "git-upload-pack", "")
@@ -99,12 +125,19 @@ func TestAPIPrivateServ(t *testing.T) {
 		assert.Equal(t, "user15", results.OwnerName)
 		assert.Equal(t, "big_test_private_1", results.RepoName)
 		assert.Equal(t, int64(19), results.RepoID)
+		assert.True(t, results.RepoIsPrivate)
 
 		// Cannot push to a private repo with reading key
 		results, extra = private.ServCommand(ctx, deployKey.KeyID, "user15", "big_test_private_1", perm.AccessModeWrite, "git-upload-pack", "")
 		assert.Error(t, extra.Error)
 		assert.Empty(t, results)
 
+		// Nor run git-annex-shell commands needing write access such as p2pstdio with it, the refusal explains why
+		results, extra = private.ServCommand(ctx, deployKey.KeyID, "user15", "big_test_private_1", perm.AccessModeWrite, "git-annex-shell", "")
+		assert.Error(t, extra.Error)
+		assert.Empty(t, results)
+		assert.Contains(t, extra.UserMsg, "is not authorized to write to user15/big_test_private_1")
+
 		// Cannot pull from a private repo we're not associated with
 		results, extra = private.ServCommand(ctx, deployKey.ID, "user15", "big_test_private_2", perm.AccessModeRead, "git-upload-pack", "")
 		assert.Error(t, extra.Error)
@@ -151,3 +184,703 @@ func TestAPIPrivateServ(t *testing.T) {
 		assert.Equal(t, int64(20), results.RepoID)
 	})
 }
+
+func TestAPIPrivateAnnexObjectCount(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// repo1 doesn't use git-annex
+		count, extra := private.AnnexObjectCount(ctx, 1)
+		assert.NoError(t, extra.Error)
+		assert.EqualValues(t, 0, count)
+
+		_, extra = private.AnnexObjectCount(ctx, 1000)
+		assert.Error(t, extra.Error)
+		assert.Equal(t, 404, extra.StatusCode)
+	})
+}
+
+func TestAPIPrivateAnnexDropNotify(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, _ *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := filepath.Join(t.TempDir(), "notified")
+		oldCommand := setting.Annex.DropNotifyCommand
+		setting.Annex.DropNotifyCommand = `sh -c 'echo "$GITEA_REPO_NAME $GITEA_ANNEX_KEY" > "$0"' ` + out
+		defer func() {
+			setting.Annex.DropNotifyCommand = oldCommand
+		}()
+
+		assert.NoError(t, private.AnnexDropNotify(ctx, 1, "SHA256E-s1--abc"))
+
+		// the command runs in the background
+		assert.Eventually(t, func() bool {
+			notified, err := os.ReadFile(out)
+			return err == nil && string(notified) == "user2/repo1 SHA256E-s1--abc\n"
+		}, 10*time.Second, 100*time.Millisecond)
+	})
+}
+
+func TestAPIPrivateAnnexRecordKey(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, _ *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		const key = "SHA256E-s3--2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824.txt"
+		others, err := private.AnnexRecordKey(ctx, 1, key)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 0, others)
+		others, err = private.AnnexRecordKey(ctx, 2, key)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, others)
+		record := unittest.AssertExistsAndLoadBean(t, &repo_model.AnnexKey{RepoID: 2, Key: key})
+		assert.EqualValues(t, 3, record.Size)
+
+		assert.NoError(t, private.AnnexForgetKey(ctx, 2, key))
+		unittest.AssertNotExistsBean(t, &repo_model.AnnexKey{RepoID: 2, Key: key})
+
+		_, err = private.AnnexRecordKey(ctx, 1, "SHA256E-s1--../../config")
+		assert.Error(t, err)
+	})
+}
+
+func TestAPIPrivateServLFSUnavailable(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldStartServer := setting.LFS.StartServer
+		defer func() {
+			setting.LFS.StartServer = oldStartServer
+		}()
+
+		// user2/lfs has LFS objects
+		setting.LFS.StartServer = true
+		results, extra := private.ServCommand(ctx, 1, "user2", "lfs", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.LFSUnavailable)
+
+		setting.LFS.StartServer = false
+		results, extra = private.ServCommand(ctx, 1, "user2", "lfs", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.LFSUnavailable)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.LFSUnavailable)
+
+		// the size is passed on for the large clone warning
+		assert.EqualValues(t, 7320, results.RepoSize)
+	})
+}
+
+func TestAPIPrivateServLFSQuota(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldQuotas := setting.Repository.LFSQuotas
+		defer func() {
+			setting.Repository.LFSQuotas = oldQuotas
+		}()
+		setting.Repository.LFSQuotas = map[string]int64{"user2/lfs": 200}
+
+		// user2/lfs has 266 bytes of LFS objects
+		results, extra := private.ServCommand(ctx, 1, "user2", "lfs", perm.AccessModeWrite, "git-lfs-authenticate", "upload")
+		assert.NoError(t, extra.Error)
+		assert.EqualValues(t, 200, results.LFSQuota)
+		assert.EqualValues(t, 266, results.LFSSize)
+
+		// the size is only needed for uploads
+		results, extra = private.ServCommand(ctx, 1, "user2", "lfs", perm.AccessModeRead, "git-lfs-authenticate", "download")
+		assert.NoError(t, extra.Error)
+		assert.Zero(t, results.LFSQuota)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-lfs-authenticate", "upload")
+		assert.NoError(t, extra.Error)
+		assert.Zero(t, results.LFSQuota)
+	})
+}
+
+func TestAPIPrivateServReadOnlyCredentials(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// key 1 of user2 is made read-only
+		_, err := db.GetEngine(db.DefaultContext).ID(1).Cols("mode").Update(&asymkey_model.PublicKey{Mode: perm.AccessModeRead})
+		assert.NoError(t, err)
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.KeyReadOnly)
+		assert.False(t, results.AccountReadOnly)
+
+		// the flags are only needed for writes
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.KeyReadOnly)
+
+		_, err = db.GetEngine(db.DefaultContext).ID(1).Cols("mode").Update(&asymkey_model.PublicKey{Mode: perm.AccessModeWrite})
+		assert.NoError(t, err)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-annex-shell", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.KeyReadOnly)
+		assert.False(t, results.AccountReadOnly)
+
+		// user2 makes the whole account read-only
+		assert.NoError(t, user_model.SetUserSetting(2, user_model.SettingsKeySSHReadOnly, "true"))
+		defer func() {
+			assert.NoError(t, user_model.DeleteUserSetting(2, user_model.SettingsKeySSHReadOnly))
+		}()
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-annex-shell", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.KeyReadOnly)
+		assert.True(t, results.AccountReadOnly)
+	})
+}
+
+func TestAPIPrivateServCLA(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldCLAs := setting.Repository.CLAs
+		defer func() {
+			setting.Repository.CLAs = oldCLAs
+		}()
+		setting.Repository.CLAs = map[string]string{"user2/repo1": "https://example.com/cla-v1"}
+		defer func() {
+			assert.NoError(t, user_model.DeleteUserSetting(2, user_model.SettingsKeyAcceptedCLAPrefix+"user2/repo1"))
+		}()
+
+		// user2 has not accepted the CLA yet
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, "https://example.com/cla-v1", results.UnacceptedCLA)
+
+		// reads and other repositories aren't affected
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.UnacceptedCLA)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.UnacceptedCLA)
+
+		assert.NoError(t, user_model.SetUserSetting(2, user_model.SettingsKeyAcceptedCLAPrefix+"user2/repo1", "https://example.com/cla-v1"))
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.UnacceptedCLA)
+
+		// a revised CLA has to be accepted again
+		setting.Repository.CLAs = map[string]string{"user2/repo1": "https://example.com/cla-v2"}
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, "https://example.com/cla-v2", results.UnacceptedCLA)
+	})
+}
+
+func TestAPIPrivateServBaseRepoPath(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldShareForkObjects := setting.Repository.ShareForkObjects
+		defer func() {
+			setting.Repository.ShareForkObjects = oldShareForkObjects
+		}()
+
+		// user20/big_test_public_fork_7 is a fork of user19/big_test_public_mirror_6
+		setting.Repository.ShareForkObjects = false
+		results, extra := private.ServCommand(ctx, 1, "user20", "big_test_public_fork_7", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BaseRepoPath)
+
+		setting.Repository.ShareForkObjects = true
+		results, extra = private.ServCommand(ctx, 1, "user20", "big_test_public_fork_7", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, repo_model.RepoPath("user19", "big_test_public_mirror_6"), results.BaseRepoPath)
+
+		// the objects of a base the user can't read aren't shared
+		base, err := repo_model.GetRepositoryByOwnerAndName(ctx, "user19", "big_test_public_mirror_6")
+		assert.NoError(t, err)
+		base.IsPrivate = true
+		assert.NoError(t, repo_model.UpdateRepositoryCols(ctx, base, "is_private"))
+		defer func() {
+			base.IsPrivate = false
+			assert.NoError(t, repo_model.UpdateRepositoryCols(ctx, base, "is_private"))
+		}()
+		results, extra = private.ServCommand(ctx, 1, "user20", "big_test_public_fork_7", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BaseRepoPath)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BaseRepoPath)
+	})
+}
+
+func TestAPIPrivateServRepoLock(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		extra := private.LockRepo(ctx, "user2/repo1", private.RepoLockWrite, time.Hour)
+		assert.NoError(t, extra.Error)
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, private.RepoLockWrite, results.RepoLock)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, private.RepoLockWrite, results.RepoLock)
+
+		// other repositories aren't affected
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.RepoLock)
+
+		extra = private.LockRepo(ctx, "user2/repo1", "everything", time.Hour)
+		assert.Error(t, extra.Error)
+		extra = private.LockRepo(ctx, "user2/missing", private.RepoLockAll, time.Hour)
+		assert.Error(t, extra.Error)
+
+		extra = private.UnlockRepo(ctx, "user2/repo1")
+		assert.NoError(t, extra.Error)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.RepoLock)
+		extra = private.UnlockRepo(ctx, "user2/repo1")
+		assert.Error(t, extra.Error)
+	})
+}
+
+func TestAPIPrivateServBranchCreationRestricted(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRepos := setting.Repository.BranchCreationRestrictedRepositories
+		defer func() {
+			setting.Repository.BranchCreationRestrictedRepositories = oldRepos
+		}()
+
+		setting.Repository.BranchCreationRestrictedRepositories = []string{"User2/Repo1"}
+		// the owner is an administrator of the repository
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.DenyBranchCreation)
+
+		// deploy keys may not create branches
+		deployKey, err := asymkey_model.AddDeployKey(1, "test-branch-creation", "sk-ecdsa-sha2-nistp256@openssh.com AAAAInNrLWVjZHNhLXNoYTItbmlzdHAyNTZAb3BlbnNzaC5jb20AAAAIbmlzdHAyNTYAAABBBGXEEzWmm1dxb+57RoK5KVCL0w2eNv9cqJX2AGGVlkFsVDhOXHzsadS3LTK4VlEbbrDMJdoti9yM8vclA8IeRacAAAAEc3NoOg== nocomment", false)
+		assert.NoError(t, err)
+		results, extra = private.ServCommand(ctx, deployKey.KeyID, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.DenyBranchCreation)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.DenyBranchCreation)
+
+		setting.Repository.BranchCreationRestrictedRepositories = nil
+		results, extra = private.ServCommand(ctx, deployKey.KeyID, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.DenyBranchCreation)
+	})
+}
+
+func TestAPIPrivateServVerifyAuthorEmails(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRepos := setting.Repository.VerifiedAuthorEmailRepositories
+		defer func() {
+			setting.Repository.VerifiedAuthorEmailRepositories = oldRepos
+		}()
+
+		setting.Repository.VerifiedAuthorEmailRepositories = []string{"User2/Repo1"}
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.VerifyAuthorEmails)
+
+		// reads and other repositories aren't affected
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.VerifyAuthorEmails)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.VerifyAuthorEmails)
+	})
+}
+
+func TestAPIPrivateServEnforceLFSLocks(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRepos := setting.Repository.LFSLockEnforcedRepositories
+		defer func() {
+			setting.Repository.LFSLockEnforcedRepositories = oldRepos
+		}()
+
+		setting.Repository.LFSLockEnforcedRepositories = []string{"User2/Repo1"}
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.EnforceLFSLocks)
+
+		// reads, wikis and other repositories aren't affected
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.EnforceLFSLocks)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.EnforceLFSLocks)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.EnforceLFSLocks)
+	})
+}
+
+func TestAPIPrivateServNamePolicy(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldCommand, oldPushCreate := setting.Repository.NamePolicyCommand, setting.Repository.EnablePushCreateUser
+		defer func() {
+			setting.Repository.NamePolicyCommand, setting.Repository.EnablePushCreateUser = oldCommand, oldPushCreate
+		}()
+
+		setting.Repository.NamePolicyCommand = `sh -c 'case "$GITEA_REPO_NAME" in team-*) exit 0;; esac; echo "Repository names must start with team-"; exit 1'`
+
+		// the policy only applies to pushes which may create the repository
+		setting.Repository.EnablePushCreateUser = false
+		_, extra := private.ServCommand(ctx, 1, "user2", "infra", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.Error(t, extra.Error)
+		assert.Equal(t, "Push to create is not enabled for users.", extra.UserMsg)
+
+		setting.Repository.EnablePushCreateUser = true
+		_, extra = private.ServCommand(ctx, 1, "user2", "infra", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.Error(t, extra.Error)
+		assert.Equal(t, http.StatusForbidden, extra.StatusCode)
+		assert.Equal(t, "Repository names must start with team-", extra.UserMsg)
+
+		results, extra := private.ServCommand(ctx, 1, "user2", "team-infra", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.NotZero(t, results.RepoID)
+
+		// users who may not create the repository aren't told about the policy
+		_, extra = private.ServCommand(ctx, 1, "user15", "infra", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.Error(t, extra.Error)
+		assert.Equal(t, "Cannot find repository: user15/infra", extra.UserMsg)
+
+		// existing repositories keep working whatever their name
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+	})
+}
+
+func TestAPIPrivateServProtectedDefaultBranch(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRepos := setting.Repository.PullRequestOnlyRepositories
+		defer func() {
+			setting.Repository.PullRequestOnlyRepositories = oldRepos
+		}()
+
+		setting.Repository.PullRequestOnlyRepositories = []string{"User2/Repo1"}
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, "master", results.ProtectedDefaultBranch)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.ProtectedDefaultBranch)
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.ProtectedDefaultBranch)
+
+		setting.Repository.PullRequestOnlyRepositories = nil
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.ProtectedDefaultBranch)
+	})
+}
+
+func TestAPIPrivateServStatusCheckBranchRules(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldReject := setting.Repository.RejectPushesToStatusCheckBranches
+		defer func() {
+			setting.Repository.RejectPushesToStatusCheckBranches = oldReject
+		}()
+		setting.Repository.RejectPushesToStatusCheckBranches = true
+
+		// without a rule requiring status checks there is nothing to reject
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BranchRules)
+
+		repo, err := repo_model.GetRepositoryByOwnerAndName(db.DefaultContext, "user2", "repo1")
+		assert.NoError(t, err)
+		assert.NoError(t, git_model.UpdateProtectBranch(db.DefaultContext, repo, &git_model.ProtectedBranch{RepoID: repo.ID, RuleName: "release/*"}, git_model.WhitelistOptions{}))
+		assert.NoError(t, git_model.UpdateProtectBranch(db.DefaultContext, repo, &git_model.ProtectedBranch{RepoID: repo.ID, RuleName: "master", EnableStatusCheck: true, StatusCheckContexts: []string{"ci"}}, git_model.WhitelistOptions{}))
+
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, []private.ServBranchRule{
+			{RuleName: "master", RequireStatusCheck: true},
+			{RuleName: "release/*"},
+		}, results.BranchRules)
+
+		// reads and pushes to the wiki aren't checked
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BranchRules)
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BranchRules)
+
+		setting.Repository.RejectPushesToStatusCheckBranches = false
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Empty(t, results.BranchRules)
+	})
+}
+
+func TestAPIPrivateServPendingDeletion(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		repo, err := repo_model.GetRepositoryByOwnerAndName(db.DefaultContext, "user2", "repo1")
+		assert.NoError(t, err)
+		repo.Status = repo_model.RepositoryPendingDeletion
+		assert.NoError(t, repo_model.UpdateRepositoryCols(db.DefaultContext, repo, "status"))
+		defer func() {
+			repo.Status = repo_model.RepositoryReady
+			assert.NoError(t, repo_model.UpdateRepositoryCols(db.DefaultContext, repo, "status"))
+		}()
+
+		for _, tc := range []struct {
+			mode    perm.AccessMode
+			verb    string
+			lfsVerb string
+		}{
+			{perm.AccessModeRead, "git-upload-pack", ""},
+			{perm.AccessModeRead, "git-upload-archive", ""},
+			{perm.AccessModeWrite, "git-receive-pack", ""},
+			{perm.AccessModeRead, "git-lfs-authenticate", "download"},
+			{perm.AccessModeWrite, "git-lfs-authenticate", "upload"},
+			{perm.AccessModeRead, "git-annex-shell", ""},
+			{perm.AccessModeWrite, "git-annex-shell", ""},
+		} {
+			_, extra := private.ServCommand(ctx, 1, "user2", "repo1", tc.mode, tc.verb, tc.lfsVerb)
+			assert.Error(t, extra.Error, tc.verb)
+			assert.Equal(t, http.StatusGone, extra.StatusCode, tc.verb)
+			assert.Equal(t, "Repository is scheduled for deletion", extra.UserMsg, tc.verb)
+		}
+
+		// the wiki goes with the repository
+		_, extra := private.ServCommand(ctx, 1, "user2", "repo1.wiki", perm.AccessModeRead, "git-upload-pack", "")
+		assert.Error(t, extra.Error)
+		assert.Equal(t, http.StatusGone, extra.StatusCode)
+	})
+}
+
+func TestAPIPrivateServPublicReadFastPath(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldPublicReadFastPath := setting.Service.PublicReadFastPath
+		defer func() {
+			setting.Service.PublicReadFastPath = oldPublicReadFastPath
+		}()
+		setting.Service.PublicReadFastPath = true
+
+		markBroken := func(ownerName, repoName string) func() {
+			repo, err := repo_model.GetRepositoryByOwnerAndName(db.DefaultContext, ownerName, repoName)
+			assert.NoError(t, err)
+			repo.Status = repo_model.RepositoryBroken
+			assert.NoError(t, repo_model.UpdateRepositoryCols(db.DefaultContext, repo, "status"))
+			return func() {
+				repo.Status = repo_model.RepositoryReady
+				assert.NoError(t, repo_model.UpdateRepositoryCols(db.DefaultContext, repo, "status"))
+			}
+		}
+
+		// a read of a public repository is reused while the repository is unchanged
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		cached, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, results, cached)
+		restore := markBroken("user2", "repo1")
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.Error(t, extra.Error)
+		restore()
+
+		// making the repository private applies at once, user2 can't read the repository of user5 then
+		_, extra = private.ServCommand(ctx, 1, "user5", "repo4", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 4})
+		repo.IsPrivate = true
+		assert.NoError(t, repo_service.UpdateRepository(db.DefaultContext, repo, true))
+		_, extra = private.ServCommand(ctx, 1, "user5", "repo4", perm.AccessModeRead, "git-upload-pack", "")
+		assert.Error(t, extra.Error)
+		repo.IsPrivate = false
+		assert.NoError(t, repo_service.UpdateRepository(db.DefaultContext, repo, true))
+
+		// the key and the user are checked every time, even while the repository is reused
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		user := unittest.AssertExistsAndLoadBean(t, &user_model.User{ID: 2})
+		user.ProhibitLogin = true
+		assert.NoError(t, user_model.UpdateUserCols(db.DefaultContext, user, "prohibit_login"))
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.Error(t, extra.Error)
+		user.ProhibitLogin = false
+		assert.NoError(t, user_model.UpdateUserCols(db.DefaultContext, user, "prohibit_login"))
+
+		// reads of private repositories are always checked in full
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		restore = markBroken("user2", "repo2")
+		defer restore()
+		_, extra = private.ServCommand(ctx, 1, "user2", "repo2", perm.AccessModeRead, "git-upload-pack", "")
+		assert.Error(t, extra.Error)
+	})
+}
+
+func TestAPIPrivateServRequire2FA(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRequire2FAForGit := setting.Service.Require2FAForGit
+		defer func() {
+			setting.Service.Require2FAForGit = oldRequire2FAForGit
+		}()
+
+		setting.Service.Require2FAForGit = false
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.Require2FA)
+
+		// user2 has not enrolled
+		setting.Service.Require2FAForGit = true
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.Require2FA)
+		assert.False(t, results.UserTwoFactorEnabled)
+
+		twoFactor := &auth_model.TwoFactor{UID: 2}
+		assert.NoError(t, auth_model.NewTwoFactor(twoFactor))
+		defer func() {
+			assert.NoError(t, auth_model.DeleteTwoFactorByID(twoFactor.ID, 2))
+		}()
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.Require2FA)
+		assert.True(t, results.UserTwoFactorEnabled)
+	})
+}
+
+func TestAPIPrivateServCloneApproval(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldRepos := setting.Repository.CloneApprovalRepositories
+		defer func() {
+			setting.Repository.CloneApprovalRepositories = oldRepos
+		}()
+
+		setting.Repository.CloneApprovalRepositories = []string{"user2/repo1"}
+		results, extra := private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeRead, "git-upload-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.True(t, results.CloneApprovalRequired)
+
+		// pushes are not affected
+		results, extra = private.ServCommand(ctx, 1, "user2", "repo1", perm.AccessModeWrite, "git-receive-pack", "")
+		assert.NoError(t, extra.Error)
+		assert.False(t, results.CloneApprovalRequired)
+
+		// the request stays pending until it is approved, and the approval is good for one read
+		approval, extra := private.ServCloneApproval(ctx, 1, 1, "user2", "user2/repo1")
+		assert.NoError(t, extra.Error)
+		assert.False(t, approval.Approved)
+		assert.NotEmpty(t, approval.RequestID)
+
+		again, extra := private.ServCloneApproval(ctx, 1, 1, "user2", "user2/repo1")
+		assert.NoError(t, extra.Error)
+		assert.Equal(t, approval.RequestID, again.RequestID)
+		assert.False(t, again.Approved)
+
+		assert.Error(t, private.ApproveClone(ctx, "unknown").Error)
+		assert.NoError(t, private.ApproveClone(ctx, approval.RequestID).Error)
+
+		approved, extra := private.ServCloneApproval(ctx, 1, 1, "user2", "user2/repo1")
+		assert.NoError(t, extra.Error)
+		assert.True(t, approved.Approved)
+
+		next, extra := private.ServCloneApproval(ctx, 1, 1, "user2", "user2/repo1")
+		assert.NoError(t, extra.Error)
+		assert.False(t, next.Approved)
+		assert.NotEqual(t, approval.RequestID, next.RequestID)
+	})
+}
+
+func TestAPIPrivateServBudget(t *testing.T) {
+	onGiteaRun(t, func(*testing.T, *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		oldBudget, oldWindow := setting.SSH.CostBudget, setting.SSH.CostBudgetWindow
+		defer func() {
+			setting.SSH.CostBudget, setting.SSH.CostBudgetWindow = oldBudget, oldWindow
+		}()
+		setting.SSH.CostBudget = 10
+		setting.SSH.CostBudgetWindow = time.Hour
+
+		result, extra := private.ServBudget(ctx, 5, 8)
+		assert.NoError(t, extra.Error)
+		assert.EqualValues(t, 2, result.Remaining)
+
+		_, extra = private.ServBudget(ctx, 5, 5)
+		assert.Error(t, extra.Error)
+		assert.Equal(t, http.StatusTooManyRequests, extra.StatusCode)
+		assert.Contains(t, extra.UserMsg, "This operation would exceed your budget of 10 cost units per 1h0m0s, please retry after")
+
+		// cheap operations are still allowed
+		_, extra = private.ServBudget(ctx, 5, 1)
+		assert.NoError(t, extra.Error)
+	})
+}
+
+func TestAPIPrivateServRecordKeyActivity(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, _ *url.URL) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		assert.NoError(t, private.ServRecordKeyActivity(ctx, 1, 1, "git-upload-pack"))
+		assert.NoError(t, private.ServRecordKeyActivity(ctx, 1, 1, "git-annex-shell sendkey"))
+		// throttled
+		assert.NoError(t, private.ServRecordKeyActivity(ctx, 1, 1, "git-upload-pack"))
+
+		activities, err := asymkey_model.GetPublicKeyActivities(db.DefaultContext, []int64{1}, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, activities[1], 2) {
+			assert.Equal(t, "git-annex-shell sendkey", activities[1][0].Verb)
+			assert.Equal(t, "git-upload-pack", activities[1][1].Verb)
+			assert.Equal(t, "user2/repo1", activities[1][1].RepoName)
+		}
+	})
+}
@@ -15,8 +15,10 @@ import (
 	"code.gitea.io/gitea/modules/lfs"
 	"code.gitea.io/gitea/modules/setting"
 	api "code.gitea.io/gitea/modules/structs"
+	lfs_service "code.gitea.io/gitea/services/lfs"
 	"code.gitea.io/gitea/tests"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -179,3 +181,50 @@ func TestAPILFSLocksLogged(t *testing.T) {
 		assert.Len(t, lfsLocks.Locks, 0)
 	}
 }
+
+func TestAPILFSLocksLockToken(t *testing.T) {
+	defer tests.PrepareTestEnv(t)()
+	setting.LFS.StartServer = true
+	repo1 := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 1})
+
+	newToken := func(t *testing.T, op string) string {
+		claims := lfs_service.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				NotBefore: jwt.NewNumericDate(time.Now()),
+			},
+			RepoID: repo1.ID,
+			Op:     op,
+			UserID: 2,
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(setting.LFS.JWTSecretBytes)
+		assert.NoError(t, err)
+		return "Bearer " + token
+	}
+	newRequest := func(t *testing.T, url, token string, body any) *http.Request {
+		req := NewRequestWithJSON(t, "POST", url, body)
+		req.Header.Set("Accept", lfs.MediaType)
+		req.Header.Set("Content-Type", lfs.MediaType)
+		req.Header.Set("Authorization", token)
+		return req
+	}
+
+	// git-lfs-authenticate "lock" gives a token which can lock and unlock
+	lockToken := newToken(t, lfs_service.TokenOpLock)
+	resp := MakeRequest(t, newRequest(t, "/user2/repo1.git/info/lfs/locks", lockToken, map[string]string{"path": "lock-token.bin"}), http.StatusCreated)
+	var lfsLock api.LFSLockResponse
+	DecodeJSON(t, resp, &lfsLock)
+	MakeRequest(t, newRequest(t, fmt.Sprintf("/user2/repo1.git/info/lfs/locks/%s/unlock", lfsLock.Lock.ID), lockToken, map[string]string{}), http.StatusOK)
+
+	// but can't upload
+	batch := &lfs.BatchRequest{
+		Operation: "upload",
+		Objects:   []lfs.Pointer{{Oid: "fb8f7d8435968c4f82a726a92395be4d16f2f63116caf36c8ad35c60831ab041", Size: 6}},
+	}
+	MakeRequest(t, newRequest(t, "/user2/repo1.git/info/lfs/objects/batch", lockToken, batch), http.StatusUnauthorized)
+
+	// the token of an upload can do both, git-lfs verifies the locks with it when pushing
+	uploadToken := newToken(t, lfs_service.TokenOpUpload)
+	MakeRequest(t, newRequest(t, "/user2/repo1.git/info/lfs/locks/verify", uploadToken, map[string]string{}), http.StatusOK)
+	MakeRequest(t, newRequest(t, "/user2/repo1.git/info/lfs/objects/batch", uploadToken, batch), http.StatusOK)
+}
@@ -59,6 +59,26 @@ func TestAPILFSMediaType(t *testing.T) {
 	MakeRequest(t, req, http.StatusUnsupportedMediaType)
 }
 
+func TestAPILFSInvalidToken(t *testing.T) {
+	defer tests.PrepareTestEnv(t)()
+
+	setting.LFS.StartServer = true
+
+	repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{ID: 2})
+	assert.True(t, repo.IsPrivate)
+
+	for _, token := range []string{"malformed", "mal.formed.token"} {
+		req := NewRequestWithJSON(t, "POST", "/user2/repo2.git/info/lfs/objects/batch", &lfs.BatchRequest{
+			Operation: "download",
+			Objects:   []lfs.Pointer{{Oid: "fb8f7d8435968c4f82a726a92395be4d16f2f63116caf36c8ad35c60831ab041", Size: 6}},
+		})
+		req.Header.Set("Accept", lfs.MediaType)
+		req.Header.Set("Content-Type", lfs.MediaType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		MakeRequest(t, req, http.StatusUnauthorized)
+	}
+}
+
 func createLFSTestRepository(t *testing.T, name string) *repo_model.Repository {
 	ctx := NewAPITestContext(t, "user2", "lfs-"+name+"-repo", auth_model.AccessTokenScopeRepo)
 	t.Run("CreateRepo", doAPICreateRepository(ctx, false))
@@ -248,6 +268,36 @@ func TestAPILFSBatch(t *testing.T) {
 			setting.LFS.MaxFileSize = oldMaxFileSize
 		})
 
+		t.Run("Quota", func(t *testing.T) {
+			defer tests.PrintCurrentTest(t)()
+
+			oldQuotas := setting.Repository.LFSQuotas
+			defer func() {
+				setting.Repository.LFSQuotas = oldQuotas
+			}()
+			// the repository already has 6 bytes of LFS objects
+			setting.Repository.LFSQuotas = map[string]int64{"user2/lfs-batch-repo": 10}
+
+			req := newRequest(t, &lfs.BatchRequest{
+				Operation: "upload",
+				Objects: []lfs.Pointer{
+					{Oid: oid, Size: 6},
+					{Oid: "fb8f7d8435968c4f82a726a92395be4d16f2f63116caf36c8ad35c60831ab043", Size: 3},
+					{Oid: "fb8f7d8435968c4f82a726a92395be4d16f2f63116caf36c8ad35c60831ab044", Size: 2},
+				},
+			})
+
+			resp := session.MakeRequest(t, req, http.StatusOK)
+			br := decodeResponse(t, resp.Body)
+			assert.Len(t, br.Objects, 3)
+			// objects the repository already has don't count
+			assert.Nil(t, br.Objects[0].Error)
+			assert.Nil(t, br.Objects[1].Error)
+			assert.NotNil(t, br.Objects[2].Error)
+			assert.Equal(t, http.StatusUnprocessableEntity, br.Objects[2].Error.Code)
+			assert.Equal(t, "LFS quota exceeded: the LFS objects of user2/lfs-batch-repo take 9 B of its quota of 10 B, please remove unused LFS objects before uploading more", br.Objects[2].Error.Message)
+		})
+
 		t.Run("AddMeta", func(t *testing.T) {
 			defer tests.PrintCurrentTest(t)()
 
@@ -414,6 +464,24 @@ func TestAPILFSUpload(t *testing.T) {
 		session.MakeRequest(t, req, http.StatusUnprocessableEntity)
 	})
 
+	t.Run("Quota", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		oldQuotas := setting.Repository.LFSQuotas
+		defer func() {
+			setting.Repository.LFSQuotas = oldQuotas
+		}()
+		// the repository already has 12 bytes of LFS objects
+		setting.Repository.LFSQuotas = map[string]int64{"user2": 16}
+
+		req := newRequest(t, lfs.Pointer{Oid: "6ccce4863b70f258d691f59609d31b4502e1ba5199942d3bc5d35d17a4ce771d", Size: 5}, "gitea")
+		resp := session.MakeRequest(t, req, http.StatusRequestEntityTooLarge)
+		assert.Contains(t, resp.Body.String(), "LFS quota exceeded")
+
+		// objects the repository already has can be uploaded again
+		session.MakeRequest(t, newRequest(t, lfs.Pointer{Oid: oid, Size: 6}, ""), http.StatusOK)
+	})
+
 	t.Run("Success", func(t *testing.T) {
 		defer tests.PrintCurrentTest(t)()
 
@@ -0,0 +1,390 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package integration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	auth_model "code.gitea.io/gitea/models/auth"
+	"code.gitea.io/gitea/models/db"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/models/unittest"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/private"
+	repo_module "code.gitea.io/gitea/modules/repository"
+	"code.gitea.io/gitea/modules/setting"
+	"code.gitea.io/gitea/modules/storage"
+	"code.gitea.io/gitea/modules/util"
+	"code.gitea.io/gitea/tests"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitAnnexHTTP(t *testing.T) {
+	defer tests.PrepareTestEnv(t)()
+
+	oldEnabled := setting.Annex.Enabled
+	defer func() {
+		setting.Annex.Enabled = oldEnabled
+	}()
+
+	const content = "dummy\n"
+	const key = "SHA256E-s6--d3eb539a556352f3f47881d71fb0e5777b2f3e9a4251d283c18c67ce996774b7.txt"
+	objectPath := func(repo, key string) string {
+		// git-annex asks for the objects in both the hashdirlower and hashdirmixed layouts, the directories don't matter
+		return path.Join("/user2", repo, "annex/objects/abc/def", key, key)
+	}
+	storeObject := func(t *testing.T, repo string) {
+		keyPath := annex.KeyPath(filepath.Join(setting.RepoRootPath, "user2", repo+".git"), key)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(keyPath), os.ModePerm))
+		// git-annex stores its objects read-only, so an earlier one has to be removed to store it again
+		assert.NoError(t, util.Remove(keyPath))
+		assert.NoError(t, os.WriteFile(keyPath, []byte(content), 0o444))
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		setting.Annex.Enabled = false
+		storeObject(t, "repo1")
+		MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", key)), http.StatusNotFound)
+	})
+
+	setting.Annex.Enabled = true
+
+	t.Run("Download", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		storeObject(t, "repo1")
+		resp := MakeRequest(t, NewRequest(t, "GET", objectPath("repo1.git", key)), http.StatusOK)
+		assert.Equal(t, content, resp.Body.String())
+		MakeRequest(t, NewRequest(t, "HEAD", objectPath("repo1", key)), http.StatusOK)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		storeObject(t, "repo1")
+		req := NewRequest(t, "GET", objectPath("repo1", key))
+		req.Header.Set("Range", "bytes=1-3")
+		resp := MakeRequest(t, req, http.StatusPartialContent)
+		assert.Equal(t, content[1:4], resp.Body.String())
+		assert.Equal(t, "bytes 1-3/6", resp.Header().Get("Content-Range"))
+
+		req = NewRequest(t, "GET", objectPath("repo1", key))
+		req.Header.Set("Range", "bytes=4-")
+		resp = MakeRequest(t, req, http.StatusPartialContent)
+		assert.Equal(t, content[4:], resp.Body.String())
+
+		req = NewRequest(t, "GET", objectPath("repo1", key))
+		req.Header.Set("Range", "bytes=6-")
+		MakeRequest(t, req, http.StatusRequestedRangeNotSatisfiable)
+	})
+
+	t.Run("HTTPGitDisabled", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		setting.Repository.DisableHTTPGit = true
+		defer func() {
+			setting.Repository.DisableHTTPGit = false
+		}()
+
+		storeObject(t, "repo1")
+		MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", key)), http.StatusForbidden)
+		req := NewRequestWithBody(t, "PUT", objectPath("repo1", key), strings.NewReader(content))
+		MakeRequest(t, req, http.StatusForbidden)
+		MakeRequest(t, NewRequest(t, "POST", "/user2/repo1/annex-p2phttp/git-annex/v4/checkpresent?key="+key), http.StatusForbidden)
+	})
+
+	t.Run("AuthFailure", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		// repo2 is private
+		storeObject(t, "repo2")
+		MakeRequest(t, NewRequest(t, "GET", objectPath("repo2", key)), http.StatusUnauthorized)
+		req := NewRequest(t, "GET", objectPath("repo2", key))
+		req.Header.Set("Authorization", "Bearer invalid.jwt.token")
+		MakeRequest(t, req, http.StatusUnauthorized)
+
+		session := loginUser(t, "user2")
+		resp := session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo2", key)), http.StatusOK)
+		assert.Equal(t, content, resp.Body.String())
+	})
+
+	t.Run("MissingKey", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		session := loginUser(t, "user2")
+		missing := "SHA256E-s7--0000000000000000000000000000000000000000000000000000000000000000.txt"
+		session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", missing)), http.StatusNotFound)
+		// the path has to name the key twice, and keys can't be paths
+		session.MakeRequest(t, NewRequest(t, "GET", path.Join("/user2/repo1/annex/objects/abc/def", key, "other")), http.StatusNotFound)
+		session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", "..")), http.StatusNotFound)
+	})
+
+	t.Run("ReadOnlyUserWrite", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		// user4 can only read the public repo1
+		session := loginUser(t, "user4")
+		session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", key)), http.StatusOK)
+		req := NewRequestWithBody(t, "PUT", objectPath("repo1", key), strings.NewReader(content))
+		session.MakeRequest(t, req, http.StatusUnauthorized)
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", key), strings.NewReader(content))
+		MakeRequest(t, req, http.StatusUnauthorized)
+	})
+
+	t.Run("P2PHTTP", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		const uuid = "e1b2f4c6-0d7a-4b7e-9a53-6f0c1b2d3e4f"
+		p2phttpPath := func(repo, op string) string {
+			return path.Join("/user2", repo+".git", "annex-p2phttp/git-annex", uuid, "v4", op) + "?key=" + url.QueryEscape(key)
+		}
+		MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo1", "checkpresent")), http.StatusNotFound)
+
+		oldP2PHTTP := setting.Annex.P2PHTTP
+		defer func() {
+			setting.Annex.P2PHTTP = oldP2PHTTP
+		}()
+		setting.Annex.P2PHTTP = true
+
+		// git-annex finds the P2P protocol over HTTP at annex.url of the config
+		repoPath := filepath.Join(setting.RepoRootPath, "user2", "repo1.git")
+		_, _, err := git.NewCommand(git.DefaultContext, "config", "annex.uuid", uuid).RunStdString(&git.RunOpts{Dir: repoPath})
+		assert.NoError(t, err)
+		defer func() {
+			_, _, _ = git.NewCommand(git.DefaultContext, "config", "--unset", "annex.uuid").RunStdString(&git.RunOpts{Dir: repoPath})
+		}()
+		resp := MakeRequest(t, NewRequest(t, "GET", "/user2/repo1.git/config"), http.StatusOK)
+		assert.Equal(t, "[annex]\n\tuuid = "+uuid+"\n\turl = annex+"+setting.AppURL+"user2/repo1.git/annex-p2phttp/git-annex\n", resp.Body.String())
+
+		// storing and dropping need write access like over SSH, requests which aren't about a valid key are refused
+		MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo1", "put")), http.StatusUnauthorized)
+		MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo1", "remove")), http.StatusUnauthorized)
+		loginUser(t, "user4").MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo1", "put")), http.StatusUnauthorized)
+		MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo2", "checkpresent")), http.StatusUnauthorized)
+		session := loginUser(t, "user2")
+		session.MakeRequest(t, NewRequest(t, "POST", "/user2/repo1.git/annex-p2phttp/git-annex/"+uuid+"/v4/put?key=..%2Fconfig"), http.StatusNotFound)
+
+		// so do the limits
+		oldMaxFileSize := setting.Annex.MaxFileSize
+		defer func() {
+			setting.Annex.MaxFileSize = oldMaxFileSize
+		}()
+		setting.Annex.MaxFileSize = 4
+		session.MakeRequest(t, NewRequest(t, "POST", p2phttpPath("repo1", "put")), http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		repoPath := filepath.Join(setting.RepoRootPath, "user2", "repo1.git")
+		uploaded := "SHA256E-s8--4a8e2bf2b8ac4a1fa3a6b3e3b0dbd9e8b5fa6d05b0a9a8e7b5e8c4b4e7b2d6e1.txt"
+		session := loginUser(t, "user2")
+
+		// nothing can be stored before git-annex has been initialized by pushing the git-annex branch
+		req := NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("uploaded"))
+		session.MakeRequest(t, req, http.StatusConflict)
+
+		_, _, err := git.NewCommand(git.DefaultContext, "config", "annex.uuid", "e1b2f4c6-0d7a-4b7e-9a53-6f0c1b2d3e4f").RunStdString(&git.RunOpts{Dir: repoPath})
+		assert.NoError(t, err)
+		defer func() {
+			_, _, _ = git.NewCommand(git.DefaultContext, "config", "--unset", "annex.uuid").RunStdString(&git.RunOpts{Dir: repoPath})
+		}()
+
+		// content has to match the size and checksum of the key
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("too long content"))
+		session.MakeRequest(t, req, http.StatusUnprocessableEntity)
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("Uploaded"))
+		session.MakeRequest(t, req, http.StatusUnprocessableEntity)
+		assert.NoFileExists(t, annex.KeyPath(repoPath, uploaded))
+
+		// git-annex reads the UUID of https remotes from their config
+		resp := MakeRequest(t, NewRequest(t, "GET", "/user2/repo1.git/config"), http.StatusOK)
+		assert.Equal(t, "[annex]\n\tuuid = e1b2f4c6-0d7a-4b7e-9a53-6f0c1b2d3e4f\n", resp.Body.String())
+
+		// the limits of git-annex-shell over SSH apply, reading stops at them
+		oldMaxFileSize, oldMaxObjectCount := setting.Annex.MaxFileSize, setting.Annex.MaxObjectCount
+		defer func() {
+			setting.Annex.MaxFileSize, setting.Annex.MaxObjectCount = oldMaxFileSize, oldMaxObjectCount
+		}()
+		setting.Annex.MaxFileSize = 4
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("uploaded"))
+		session.MakeRequest(t, req, http.StatusRequestEntityTooLarge)
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", "WORM-m1682000000--file.txt"), strings.NewReader(strings.Repeat("x", 1000)))
+		session.MakeRequest(t, req, http.StatusRequestEntityTooLarge)
+		setting.Annex.MaxFileSize = 0
+		setting.Annex.MaxObjectCount = 1
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("uploaded"))
+		session.MakeRequest(t, req, http.StatusForbidden)
+		setting.Annex.MaxObjectCount = 0
+
+		// so do the locks of administrators
+		_, lockErr := repo_module.LockRepo(db.DefaultContext, 1, private.RepoLockWrite, time.Minute)
+		assert.NoError(t, lockErr)
+		req = NewRequestWithBody(t, "PUT", objectPath("repo1", uploaded), strings.NewReader("uploaded"))
+		session.MakeRequest(t, req, http.StatusLocked)
+		session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo1", key)), http.StatusOK)
+		_, lockErr = repo_module.UnlockRepo(db.DefaultContext, 1)
+		assert.NoError(t, lockErr)
+
+		if _, err := exec.LookPath("git-annex"); err != nil {
+			t.Skip("git-annex is not installed")
+		}
+		_, _, err = git.NewCommand(git.DefaultContext, "annex", "init").RunStdString(&git.RunOpts{Dir: filepath.Join(setting.RepoRootPath, "user2", "repo2.git")})
+		assert.NoError(t, err)
+		sum := sha256.Sum256([]byte("uploaded"))
+		newKey := "SHA256E-s8--" + hex.EncodeToString(sum[:]) + ".txt"
+		req = NewRequestWithBody(t, "PUT", objectPath("repo2", newKey), strings.NewReader("uploaded"))
+		session.MakeRequest(t, req, http.StatusOK)
+		resp = session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo2", newKey)), http.StatusOK)
+		assert.Equal(t, "uploaded", resp.Body.String())
+
+		// the size of the annexed content includes the one stored before
+		repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{OwnerName: "user2", Name: "repo2"})
+		assert.EqualValues(t, len(content)+len("uploaded"), repo.AnnexSize)
+	})
+
+	t.Run("ObjectStorage", func(t *testing.T) {
+		defer tests.PrintCurrentTest(t)()
+
+		if _, err := exec.LookPath("git-annex"); err != nil {
+			t.Skip("git-annex is not installed")
+		}
+		oldStorage, oldAnnexStorage := setting.Annex.Storage, storage.Annex
+		defer func() {
+			setting.Annex.Storage, storage.Annex = oldStorage, oldAnnexStorage
+		}()
+		setting.Annex.Storage = &setting.Storage{Type: string(storage.LocalStorageType), Path: t.TempDir()}
+		var err error
+		storage.Annex, err = storage.NewLocalStorage(db.DefaultContext, storage.LocalStorageConfig{Path: setting.Annex.Storage.Path})
+		assert.NoError(t, err)
+
+		// uploaded content is saved to the object storage, and fetched from there once the repository lost it
+		repo := unittest.AssertExistsAndLoadBean(t, &repo_model.Repository{OwnerName: "user2", Name: "repo2"})
+		sum := sha256.Sum256([]byte("stored"))
+		storedKey := "SHA256E-s6--" + hex.EncodeToString(sum[:]) + ".txt"
+		session := loginUser(t, "user2")
+		req := NewRequestWithBody(t, "PUT", objectPath("repo2", storedKey), strings.NewReader("stored"))
+		session.MakeRequest(t, req, http.StatusOK)
+		_, err = storage.Annex.Stat(annex.StoragePath(repo.ID, storedKey))
+		assert.NoError(t, err)
+
+		keyPath := annex.KeyPath(repo.RepoPath(), storedKey)
+		assert.NoError(t, os.Chmod(filepath.Dir(keyPath), 0o755))
+		assert.NoError(t, util.Remove(keyPath))
+		resp := session.MakeRequest(t, NewRequest(t, "GET", objectPath("repo2", storedKey)), http.StatusOK)
+		assert.Equal(t, "stored", resp.Body.String())
+	})
+}
+
+func TestGitAnnexHTTPGet(t *testing.T) {
+	if _, err := exec.LookPath("git-annex"); err != nil {
+		t.Skip("git-annex is not installed")
+	}
+
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		t.Setenv("GITEA__annex__ENABLED", "true")
+		oldEnabled := setting.Annex.Enabled
+		setting.Annex.Enabled = true
+		defer func() {
+			setting.Annex.Enabled = oldEnabled
+		}()
+
+		ctx := NewAPITestContext(t, "user2", "annex-http-get", auth_model.AccessTokenScopeRepo, auth_model.AccessTokenScopeAdminPublicKey)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		runAnnex := func(t *testing.T, dir string, args ...string) string {
+			stdout, _, err := git.NewCommand(git.DefaultContext, "annex").AddArguments(git.ToTrustedCmdArgs(args)...).RunStdString(&git.RunOpts{Dir: dir})
+			assert.NoError(t, err)
+			return stdout
+		}
+
+		// the content is stored over SSH, then fetched by a clone of the https URL
+		withKeyFile(t, "annex-http-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "annex-http-key", keyFile))
+
+			sshPath := t.TempDir()
+			t.Run("CloneSSH", doGitClone(sshPath, createSSHUrl(ctx.GitPath(), u)))
+			runAnnex(t, sshPath, "init")
+			assert.NoError(t, os.WriteFile(filepath.Join(sshPath, "annexed.bin"), []byte("annexed content"), 0o644))
+			runAnnex(t, sshPath, "add", "annexed.bin")
+			_, _, err := git.NewCommand(git.DefaultContext, "commit", "-m", "Add annexed file").RunStdString(&git.RunOpts{Dir: sshPath})
+			assert.NoError(t, err)
+			runAnnex(t, sshPath, "sync", "--content")
+			runAnnex(t, sshPath, "sync", "--content")
+		})
+
+		httpURL := *u
+		httpURL.Path = ctx.GitPath()
+		httpPath := t.TempDir()
+		t.Run("CloneHTTP", doGitClone(httpPath, &httpURL))
+		runAnnex(t, httpPath, "init")
+		runAnnex(t, httpPath, "get", "annexed.bin")
+		content, err := os.ReadFile(filepath.Join(httpPath, "annexed.bin"))
+		assert.NoError(t, err)
+		assert.Equal(t, "annexed content", string(content))
+	})
+}
+
+func TestGitAnnexHTTPCopyTo(t *testing.T) {
+	if _, err := exec.LookPath("git-annex"); err != nil {
+		t.Skip("git-annex is not installed")
+	}
+	if err := exec.Command("git-annex", "p2phttp", "--help").Run(); err != nil {
+		t.Skip("git-annex doesn't support p2phttp")
+	}
+
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		oldEnabled, oldP2PHTTP := setting.Annex.Enabled, setting.Annex.P2PHTTP
+		setting.Annex.Enabled, setting.Annex.P2PHTTP = true, true
+		defer func() {
+			setting.Annex.Enabled, setting.Annex.P2PHTTP = oldEnabled, oldP2PHTTP
+		}()
+
+		ctx := NewAPITestContext(t, "user2", "annex-http-copy", auth_model.AccessTokenScopeRepo)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		runAnnex := func(t *testing.T, dir string, args ...string) string {
+			stdout, stderr, err := git.NewCommand(git.DefaultContext, "annex").AddArguments(git.ToTrustedCmdArgs(args)...).RunStdString(&git.RunOpts{Dir: dir})
+			assert.NoError(t, err, stderr)
+			return stdout
+		}
+
+		httpURL := *u
+		httpURL.Path = ctx.GitPath()
+		httpURL.User = url.UserPassword("user2", userPassword)
+		dstPath := t.TempDir()
+		t.Run("Clone", doGitClone(dstPath, &httpURL))
+
+		runAnnex(t, dstPath, "init")
+		assert.NoError(t, os.WriteFile(filepath.Join(dstPath, "annexed.bin"), []byte("annexed content"), 0o644))
+		runAnnex(t, dstPath, "add", "annexed.bin")
+		_, _, err := git.NewCommand(git.DefaultContext, "commit", "-m", "Add annexed file").RunStdString(&git.RunOpts{Dir: dstPath})
+		assert.NoError(t, err)
+		// pushing the git-annex branch initializes annex on the server, which the clone only notices on its next try
+		t.Run("Push", doGitPushTestRepository(dstPath, "origin", "master", "git-annex"))
+		_, _, _ = git.NewCommand(git.DefaultContext, "config", "--unset", "remote.origin.annex-ignore").RunStdString(&git.RunOpts{Dir: dstPath})
+
+		runAnnex(t, dstPath, "copy", "--to", "origin", "annexed.bin")
+
+		key := strings.TrimSpace(runAnnex(t, dstPath, "lookupkey", "annexed.bin"))
+		content, readErr := os.ReadFile(annex.KeyPath(repo_model.RepoPath("user2", "annex-http-copy"), key))
+		assert.NoError(t, readErr)
+		assert.Equal(t, "annexed content", string(content))
+		assert.Contains(t, runAnnex(t, dstPath, "find", "--in", "origin"), "annexed.bin")
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package integration
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	auth_model "code.gitea.io/gitea/models/auth"
+	repo_model "code.gitea.io/gitea/models/repo"
+	"code.gitea.io/gitea/modules/annex"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitAnnexInitAndSync(t *testing.T) {
+	if _, err := exec.LookPath("git-annex"); err != nil {
+		t.Skip("git-annex is not installed")
+	}
+
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		// serv runs as a subprocess of the builtin SSH server and picks this up from the environment
+		t.Setenv("GITEA__annex__ENABLED", "true")
+		oldEnabled := setting.Annex.Enabled
+		setting.Annex.Enabled = true
+		defer func() {
+			setting.Annex.Enabled = oldEnabled
+		}()
+
+		ctx := NewAPITestContext(t, "user2", "annex-sync", auth_model.AccessTokenScopeRepo, auth_model.AccessTokenScopeAdminPublicKey)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		withKeyFile(t, "annex-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "annex-key", keyFile))
+
+			dstPath := t.TempDir()
+			t.Run("Clone", doGitClone(dstPath, createSSHUrl(ctx.GitPath(), u)))
+
+			runAnnex := func(t *testing.T, args ...string) string {
+				stdout, _, err := git.NewCommand(git.DefaultContext, "annex").AddArguments(git.ToTrustedCmdArgs(args)...).RunStdString(&git.RunOpts{Dir: dstPath})
+				assert.NoError(t, err)
+				return stdout
+			}
+
+			runAnnex(t, "init")
+			assert.NoError(t, os.WriteFile(filepath.Join(dstPath, "annexed.bin"), []byte("annexed content"), 0o644))
+			runAnnex(t, "add", "annexed.bin")
+			_, _, err := git.NewCommand(git.DefaultContext, "commit", "-m", "Add annexed file").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.NoError(t, err)
+
+			// the first sync pushes the git-annex branch, which initializes annex on the server
+			runAnnex(t, "sync", "--content")
+			assert.True(t, annex.IsInitialized(git.DefaultContext, repo_model.RepoPath("user2", "annex-sync")))
+
+			// the second sync can then send the content over git-annex-shell
+			runAnnex(t, "sync", "--content")
+			assert.Contains(t, runAnnex(t, "find", "--in", "origin"), "annexed.bin")
+		})
+	})
+}
+
+func TestGitAnnexConfiglistProbe(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		t.Setenv("GITEA__annex__ENABLED", "true")
+
+		ctx := NewAPITestContext(t, "user2", "repo1", auth_model.AccessTokenScopeAdminPublicKey)
+		withKeyFile(t, "annex-probe-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "annex-probe-key", keyFile))
+
+			configlist := func(repoPath string) (string, string, error) {
+				cmd := exec.Command("ssh", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-o", "IdentitiesOnly=yes", "-i", keyFile,
+					"-p", strconv.Itoa(setting.SSH.ListenPort), "git@"+setting.SSH.ListenHost, "git-annex-shell 'configlist' '/~/"+repoPath+"'")
+				stdout, stderr := &strings.Builder{}, &strings.Builder{}
+				cmd.Stdout, cmd.Stderr = stdout, stderr
+				err := cmd.Run()
+				return stdout.String(), stderr.String(), err
+			}
+
+			t.Run("Unauthorized", func(t *testing.T) {
+				_, stderr, err := configlist("user15/big_test_private_1.git")
+				assert.Error(t, err)
+				assert.Contains(t, stderr, "Access denied: user15/big_test_private_1 does not exist or your SSH key has no read access to it")
+			})
+
+			t.Run("Authorized", func(t *testing.T) {
+				if _, err := exec.LookPath("git-annex-shell"); err != nil {
+					t.Skip("git-annex is not installed")
+				}
+				stdout, stderr, err := configlist("user2/repo1.git")
+				assert.NoError(t, err, stderr)
+				assert.Contains(t, stdout, "annex.uuid=")
+			})
+		})
+	})
+}
+
+func TestGitAnnexMalformedKey(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		t.Setenv("GITEA__annex__ENABLED", "true")
+
+		ctx := NewAPITestContext(t, "user2", "repo1", auth_model.AccessTokenScopeAdminPublicKey)
+		withKeyFile(t, "annex-key-check-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "annex-key-check-key", keyFile))
+
+			cmd := exec.Command("ssh", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-o", "IdentitiesOnly=yes", "-i", keyFile,
+				"-p", strconv.Itoa(setting.SSH.ListenPort), "git@"+setting.SSH.ListenHost, "git-annex-shell 'sendkey' '/~/user2/repo1.git' 'SHA256E-s1--../../config'")
+			stderr := &strings.Builder{}
+			cmd.Stderr = stderr
+			assert.Error(t, cmd.Run())
+			assert.Contains(t, stderr.String(), "Malformed git-annex key")
+		})
+	})
+}
+
+func TestGitAnnexProtectedMetadataBranch(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		// serv picks the settings up from the environment, the pre-receive checks run in this process
+		t.Setenv("GITEA__annex__ENABLED", "true")
+		t.Setenv("GITEA__annex__PROTECT_METADATA_BRANCH", "true")
+		oldEnabled, oldProtect := setting.Annex.Enabled, setting.Annex.ProtectMetadataBranch
+		setting.Annex.Enabled, setting.Annex.ProtectMetadataBranch = true, true
+		defer func() {
+			setting.Annex.Enabled, setting.Annex.ProtectMetadataBranch = oldEnabled, oldProtect
+		}()
+
+		ctx := NewAPITestContext(t, "user2", "annex-protected", auth_model.AccessTokenScopeRepo, auth_model.AccessTokenScopeAdminPublicKey)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		withKeyFile(t, "annex-protected-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "annex-protected-key", keyFile))
+
+			dstPath := t.TempDir()
+			t.Run("Clone", doGitClone(dstPath, createSSHUrl(ctx.GitPath(), u)))
+
+			runGit := func(args ...string) (string, error) {
+				_, stderr, err := git.NewCommand(git.DefaultContext).AddArguments(git.ToTrustedCmdArgs(args)...).RunStdString(&git.RunOpts{Dir: dstPath})
+				return stderr, err
+			}
+			commitMetadata := func(content string) {
+				assert.NoError(t, os.WriteFile(filepath.Join(dstPath, "uuid.log"), []byte(content), 0o644))
+				_, err := runGit("add", "uuid.log")
+				assert.NoError(t, err)
+				_, err = runGit("commit", "-m", "update")
+				assert.NoError(t, err)
+			}
+
+			// creating and adding to the git-annex branch is what git-annex does
+			_, err := runGit("checkout", "--orphan", "git-annex")
+			assert.NoError(t, err)
+			_, err = runGit("rm", "-rf", "--cached", ".")
+			assert.NoError(t, err)
+			commitMetadata("first\n")
+			stderr, err := runGit("push", "origin", "git-annex")
+			assert.NoError(t, err, stderr)
+			commitMetadata("second\n")
+			stderr, err = runGit("push", "origin", "git-annex")
+			assert.NoError(t, err, stderr)
+
+			// rewriting it is rejected by the pre-receive hook
+			_, err = runGit("reset", "--hard", "HEAD~1")
+			assert.NoError(t, err)
+			commitMetadata("rewritten\n")
+			stderr, err = runGit("push", "--force", "origin", "git-annex")
+			assert.Error(t, err)
+			assert.Contains(t, stderr, "the git-annex branch holds the git-annex metadata and cannot be force pushed")
+
+			// deleting it is rejected by serv before git sees the push
+			stderr, err = runGit("push", "origin", ":git-annex")
+			assert.Error(t, err)
+			assert.Contains(t, stderr, "Deleting the git-annex branch is not allowed")
+		})
+	})
+}
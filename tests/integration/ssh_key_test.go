@@ -14,6 +14,7 @@ import (
 
 	auth_model "code.gitea.io/gitea/models/auth"
 	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/setting"
 	api "code.gitea.io/gitea/modules/structs"
 
 	"github.com/stretchr/testify/assert"
@@ -204,3 +205,64 @@ func testKeyOnlyOneType(t *testing.T, u *url.URL) {
 		})
 	})
 }
+
+func TestPushToPullRequestOnlyDefaultBranch(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		oldRepos := setting.Repository.PullRequestOnlyRepositories
+		setting.Repository.PullRequestOnlyRepositories = []string{"user2/pr-only"}
+		defer func() {
+			setting.Repository.PullRequestOnlyRepositories = oldRepos
+		}()
+
+		ctx := NewAPITestContext(t, "user2", "pr-only", auth_model.AccessTokenScopeRepo, auth_model.AccessTokenScopeAdminPublicKey)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		withKeyFile(t, "pr-only-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "pr-only-key", keyFile))
+
+			dstPath := t.TempDir()
+			t.Run("Clone", doGitClone(dstPath, createSSHUrl(ctx.GitPath(), u)))
+			t.Run("AddChanges", doAddChangesToCheckout(dstPath, "README.md"))
+
+			_, stderr, err := git.NewCommand(git.DefaultContext, "push", "origin", "HEAD").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.Error(t, err)
+			assert.Contains(t, stderr, fmt.Sprintf("Pushing to the default branch %q is not allowed, please open a pull request instead", setting.Repository.DefaultBranch))
+
+			t.Run("PushBranch", doGitPushTestRepository(dstPath, "origin", "HEAD:refs/heads/feature"))
+		})
+	})
+}
+
+func TestDryRunPush(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		ctx := NewAPITestContext(t, "user2", "dry-run-push", auth_model.AccessTokenScopeRepo, auth_model.AccessTokenScopeAdminPublicKey)
+		t.Run("CreateRepository", doAPICreateRepository(ctx, false))
+
+		withKeyFile(t, "dry-run-push-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "dry-run-push-key", keyFile))
+
+			dstPath := t.TempDir()
+			t.Run("Clone", doGitClone(dstPath, createSSHUrl(ctx.GitPath(), u)))
+			before, _, err := git.NewCommand(git.DefaultContext, "ls-remote", "origin").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.NoError(t, err)
+			t.Run("AddChanges", doAddChangesToCheckout(dstPath, "README.md"))
+
+			// the hooks read the setting from the environment
+			_, stderr, err := git.NewCommand(git.DefaultContext, "push", "-o", "dry-run", "origin", "HEAD").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.Error(t, err)
+			assert.Contains(t, stderr, "Dry-run pushes are not allowed on this server, nothing has been pushed")
+
+			t.Setenv("GITEA__repository__ALLOW_DRY_RUN_PUSH", "true")
+			_, stderr, err = git.NewCommand(git.DefaultContext, "push", "-o", "dry-run", "origin", "HEAD").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.Error(t, err)
+			assert.Contains(t, stderr, "Dry run: the push would have been accepted, no references have been changed:")
+			assert.Contains(t, stderr, "refs/heads/"+setting.Repository.DefaultBranch+" would be updated from")
+
+			after, _, err := git.NewCommand(git.DefaultContext, "ls-remote", "origin").RunStdString(&git.RunOpts{Dir: dstPath})
+			assert.NoError(t, err)
+			assert.Equal(t, before, after)
+
+			t.Run("Push", doGitPushTestRepository(dstPath, "origin", "HEAD"))
+		})
+	})
+}
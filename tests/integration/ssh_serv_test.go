@@ -0,0 +1,36 @@
+// Copyright 2023 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package integration
+
+import (
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	auth_model "code.gitea.io/gitea/models/auth"
+	"code.gitea.io/gitea/modules/setting"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHRepoPathWhitespace(t *testing.T) {
+	onGiteaRun(t, func(t *testing.T, u *url.URL) {
+		ctx := NewAPITestContext(t, "user2", "repo1", auth_model.AccessTokenScopeAdminPublicKey)
+		withKeyFile(t, "repo-path-whitespace-key", func(keyFile string) {
+			t.Run("CreateUserKey", doAPICreateUserKey(ctx, "repo-path-whitespace-key", keyFile))
+
+			// the whitespace around the segments of the path is ignored, for the checks as well as for git
+			cmd := exec.Command("ssh", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no", "-o", "IdentitiesOnly=yes", "-i", keyFile,
+				"-p", strconv.Itoa(setting.SSH.ListenPort), "git@"+setting.SSH.ListenHost, "git-upload-pack ' user2 /repo1.git'")
+			stdout, stderr := &strings.Builder{}, &strings.Builder{}
+			cmd.Stdout, cmd.Stderr = stdout, stderr
+			// a flush ends the session after the ref advertisement, like a client which doesn't want anything
+			cmd.Stdin = strings.NewReader("0000")
+			assert.NoError(t, cmd.Run(), stderr.String())
+			assert.Contains(t, stdout.String(), "refs/heads/master")
+		})
+	})
+}